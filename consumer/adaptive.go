@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// AdaptiveConfig tunes GetRecords per shard instead of one static max_records and
+// idle_time_between_reads_in_millis: a shard that is behind reads large batches back
+// to back, a caught-up shard reads small batches and idles longer between empty reads.
+type AdaptiveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Batch size bounds (defaults 100 and 10000, the GetRecords maximum)
+	MinRecords int `yaml:"min_records"`
+	MaxRecords int `yaml:"max_records"`
+	// Idle bounds after an empty read (defaults idle_time_between_reads_in_millis or
+	// 200, and 2000)
+	MinIdleMillis int `yaml:"min_idle_millis"`
+	MaxIdleMillis int `yaml:"max_idle_millis"`
+	// A shard more than TargetLagMillis behind (default 1000) counts as behind
+	TargetLagMillis int64 `yaml:"target_lag_millis"`
+	// Batches that take longer than MaxBatchMillis to process (default 5000) are
+	// halved, so one slow batch cannot delay lease renewal and checkpoints
+	MaxBatchMillis int `yaml:"max_batch_millis"`
+}
+
+// adaptiveController holds the per-shard read settings; nil when disabled
+type adaptiveController struct {
+	cfg     AdaptiveConfig
+	initial int
+
+	mu     sync.Mutex
+	shards map[string]*adaptiveShard
+}
+
+type adaptiveShard struct {
+	limit     int
+	idle      time.Duration
+	lastEmpty bool
+}
+
+// adaptive is shared by every record processor of this worker; nil when disabled
+var adaptive *adaptiveController
+
+func newAdaptiveController(cfg AdaptiveConfig, maxRecords, idleMillis int) *adaptiveController {
+	if cfg.MinRecords <= 0 {
+		cfg.MinRecords = 100
+	}
+	if cfg.MaxRecords <= 0 || cfg.MaxRecords > 10000 {
+		cfg.MaxRecords = 10000
+	}
+	if cfg.MinIdleMillis <= 0 {
+		cfg.MinIdleMillis = idleMillis
+	}
+	if cfg.MinIdleMillis <= 0 {
+		cfg.MinIdleMillis = 200
+	}
+	if cfg.MaxIdleMillis < cfg.MinIdleMillis {
+		cfg.MaxIdleMillis = max(2000, cfg.MinIdleMillis)
+	}
+	if cfg.TargetLagMillis <= 0 {
+		cfg.TargetLagMillis = 1000
+	}
+	if cfg.MaxBatchMillis <= 0 {
+		cfg.MaxBatchMillis = 5000
+	}
+	cfg.MaxRecords = max(cfg.MaxRecords, cfg.MinRecords)
+	// Shards start at the static setting, clamped to the bounds
+	if maxRecords <= 0 {
+		maxRecords = cfg.MaxRecords
+	}
+	return &adaptiveController{
+		cfg:     cfg,
+		initial: min(max(maxRecords, cfg.MinRecords), cfg.MaxRecords),
+		shards:  make(map[string]*adaptiveShard),
+	}
+}
+
+// shard returns the state of shardID, creating it from the initial settings.
+// Callers hold mu.
+func (a *adaptiveController) shard(shardID string) *adaptiveShard {
+	s := a.shards[shardID]
+	if s == nil {
+		s = &adaptiveShard{
+			limit: a.initial,
+			idle:  time.Duration(a.cfg.MinIdleMillis) * time.Millisecond,
+		}
+		a.shards[shardID] = s
+	}
+	return s
+}
+
+// beforeRead returns the batch size to request and how long to idle first, on top
+// of the idle KCL already applied after an empty read
+func (a *adaptiveController) beforeRead(shardID string) (int, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.shard(shardID)
+	var extra time.Duration
+	if s.lastEmpty {
+		extra = s.idle - time.Duration(a.cfg.MinIdleMillis)*time.Millisecond
+	}
+	return s.limit, extra
+}
+
+// observeRead adapts the shard to a GetRecords response
+func (a *adaptiveController) observeRead(shardID string, out *kinesis.GetRecordsOutput) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.shard(shardID)
+	minIdle := time.Duration(a.cfg.MinIdleMillis) * time.Millisecond
+	maxIdle := time.Duration(a.cfg.MaxIdleMillis) * time.Millisecond
+
+	if aws.Int64Value(out.MillisBehindLatest) > a.cfg.TargetLagMillis {
+		// Behind: larger batches, no idling
+		s.limit = min(2*s.limit, a.cfg.MaxRecords)
+		s.idle = minIdle
+		s.lastEmpty = false
+	} else {
+		// Caught up: small batches for low latency, and back off while empty
+		s.limit = max(s.limit/2, a.cfg.MinRecords)
+		s.lastEmpty = len(out.Records) == 0
+		if s.lastEmpty {
+			s.idle = min(2*s.idle, maxIdle)
+		} else {
+			s.idle = minIdle
+		}
+	}
+}
+
+// observeProcessing halves the batch size of a shard whose batch was slow to process
+func (a *adaptiveController) observeProcessing(shardID string, took time.Duration) {
+	if a == nil || took <= time.Duration(a.cfg.MaxBatchMillis)*time.Millisecond {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.shard(shardID)
+	s.limit = max(s.limit/2, a.cfg.MinRecords)
+}
+
+// forget drops a shard this worker no longer processes
+func (a *adaptiveController) forget(shardID string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.shards, shardID)
+}
+
+// writeMetrics writes the per-shard settings in Prometheus text format
+func (a *adaptiveController) writeMetrics(w io.Writer) {
+	a.mu.Lock()
+	limits := make(map[string]float64, len(a.shards))
+	idles := make(map[string]float64, len(a.shards))
+	for shardID, s := range a.shards {
+		limits[shardID] = float64(s.limit)
+		idles[shardID] = float64(s.idle.Milliseconds())
+	}
+	a.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_adaptive_max_records GetRecords limit currently used per shard (the lowest, aggregated to the worker)")
+	fmt.Fprintln(w, "# TYPE kcl_adaptive_max_records gauge")
+	writeShardSeries(w, "adaptive", "kcl_adaptive_max_records", limits, aggregateMin)
+	fmt.Fprintln(w, "# HELP kcl_adaptive_idle_millis Idle time after an empty read currently used per shard (the longest, aggregated to the worker)")
+	fmt.Fprintln(w, "# TYPE kcl_adaptive_idle_millis gauge")
+	writeShardSeries(w, "adaptive", "kcl_adaptive_idle_millis", idles, aggregateMax)
+}
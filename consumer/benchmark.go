@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxLatencySamples bounds the latencies kept for percentiles; beyond it they are a
+// uniform sample of everything observed
+const maxLatencySamples = 100000
+
+// BenchmarkConfig runs the consumer for a fixed time and reports its throughput, to
+// compare configuration changes across runs
+type BenchmarkConfig struct {
+	// DurationMillis is how long the consumer runs before it stops and writes the
+	// report; 0 disables benchmarking
+	DurationMillis int `yaml:"duration_millis"`
+	// WarmupMillis at the start are left out of the report, so the initial lease
+	// assignment is not counted as rebalancing (default 30000)
+	WarmupMillis *int `yaml:"warmup_millis"`
+	// Label names the run in the report, e.g. the setting being compared
+	Label string `yaml:"label"`
+	// Output is a file the report is written to as indented JSON, besides stdout
+	Output string `yaml:"output"`
+}
+
+func (c BenchmarkConfig) enabled() bool {
+	return c.DurationMillis > 0
+}
+
+func (c BenchmarkConfig) warmup() time.Duration {
+	if c.WarmupMillis == nil {
+		return 30 * time.Second
+	}
+	return time.Duration(*c.WarmupMillis) * time.Millisecond
+}
+
+func (c BenchmarkConfig) validate() error {
+	if c.DurationMillis < 0 {
+		return fmt.Errorf("benchmark.duration_millis must not be negative, got %d", c.DurationMillis)
+	}
+	if w := c.warmup(); w < 0 || c.enabled() && w >= time.Duration(c.DurationMillis)*time.Millisecond {
+		return fmt.Errorf("benchmark.warmup_millis must be at least 0 and below duration_millis, got %d", w.Milliseconds())
+	}
+	return nil
+}
+
+// latencySummary are the percentiles of a latency distribution, in milliseconds
+type latencySummary struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean_millis"`
+	P50   float64 `json:"p50_millis"`
+	P90   float64 `json:"p90_millis"`
+	P99   float64 `json:"p99_millis"`
+	Max   float64 `json:"max_millis"`
+}
+
+// latencySample keeps a bounded uniform sample of latencies (reservoir sampling) with
+// the exact count, sum and maximum
+type latencySample struct {
+	samples []time.Duration
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (s *latencySample) observe(d time.Duration, rng *rand.Rand) {
+	s.count++
+	s.sum += d
+	s.max = max(s.max, d)
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, d)
+	} else if i := rng.Int63n(s.count); i < maxLatencySamples {
+		s.samples[i] = d
+	}
+}
+
+func (s *latencySample) summary() latencySummary {
+	if s.count == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration(nil), s.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	millis := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	percentile := func(p float64) float64 {
+		return millis(sorted[min(int(p*float64(len(sorted))), len(sorted)-1)])
+	}
+	return latencySummary{
+		Count: s.count,
+		Mean:  millis(s.sum / time.Duration(s.count)),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P99:   percentile(0.99),
+		Max:   millis(s.max),
+	}
+}
+
+// benchmarkShard is one shard in the benchmark report
+type benchmarkShard struct {
+	Records       int64   `json:"records"`
+	HeldSeconds   float64 `json:"held_seconds"`
+	RecordsPerSec float64 `json:"records_per_sec"` // over the time the shard was held
+	Checkpoints   int64   `json:"checkpoints"`
+	Taken         int     `json:"leases_taken"`
+	Lost          int     `json:"leases_lost"`
+
+	heldSince time.Time // zero while not held
+	held      time.Duration
+}
+
+// benchmarkReport is written when the benchmark ends. Everything is counted after the
+// warmup only.
+type benchmarkReport struct {
+	Label            string                     `json:"label,omitempty"`
+	Application      string                     `json:"application"`
+	Worker           string                     `json:"worker"`
+	Stream           string                     `json:"stream"`
+	StartedAt        time.Time                  `json:"started_at"`
+	MeasuredFrom     time.Time                  `json:"measured_from"`
+	StoppedAt        time.Time                  `json:"stopped_at"`
+	Completed        bool                       `json:"completed"` // false when stopped before the duration
+	StopReason       string                     `json:"stop_reason"`
+	MeasuredSeconds  float64                    `json:"measured_seconds"`
+	Records          int64                      `json:"records"`
+	RecordsPerSec    float64                    `json:"records_per_sec"`
+	Batches          int64                      `json:"batches"`
+	DecodeFailures   int64                      `json:"decode_failures"`
+	Processing       latencySummary             `json:"processing_latency"` // per batch, ProcessRecords start to checkpoint
+	EndToEnd         latencySummary             `json:"end_to_end_latency"` // per record, event time (or arrival) to processing
+	Checkpoints      int64                      `json:"checkpoints"`
+	CheckpointErrors int64                      `json:"checkpoint_errors"`
+	LeasesTaken      int                        `json:"leases_taken"`
+	LeasesLost       int                        `json:"leases_lost"`  // to another worker (ZOMBIE)
+	ShardsEnded      int                        `json:"shards_ended"` // TERMINATE after a reshard
+	Rebalances       int                        `json:"rebalances"`   // leases taken or lost
+	Shards           map[string]*benchmarkShard `json:"shards"`
+	// Settings is the consumer block of the configuration, so runs can be compared
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// benchmarkRecorder collects the benchmark report while the consumer runs
+type benchmarkRecorder struct {
+	cfg          BenchmarkConfig
+	startedAt    time.Time
+	measuredFrom time.Time
+
+	mu               sync.Mutex
+	rng              *rand.Rand
+	records          int64
+	batches          int64
+	decodeFailures   int64
+	processing       latencySample
+	endToEnd         latencySample
+	checkpoints      int64
+	checkpointErrors int64
+	shardsEnded      int
+	shards           map[string]*benchmarkShard
+}
+
+// bench is nil unless consumer.benchmark.duration_millis is set
+var bench *benchmarkRecorder
+
+func newBenchmarkRecorder(cfg BenchmarkConfig) *benchmarkRecorder {
+	now := time.Now().UTC()
+	return &benchmarkRecorder{
+		cfg:          cfg,
+		startedAt:    now,
+		measuredFrom: now.Add(cfg.warmup()),
+		rng:          rand.New(rand.NewSource(now.UnixNano())),
+		shards:       make(map[string]*benchmarkShard),
+	}
+}
+
+// measuring reports whether the warmup is over at now
+func (b *benchmarkRecorder) measuring(now time.Time) bool {
+	return !now.Before(b.measuredFrom)
+}
+
+func (b *benchmarkRecorder) shard(shardID string) *benchmarkShard {
+	s := b.shards[shardID]
+	if s == nil {
+		s = &benchmarkShard{}
+		b.shards[shardID] = s
+	}
+	return s
+}
+
+// taken records this worker starting on a shard
+func (b *benchmarkRecorder) taken(shardID string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	s := b.shard(shardID)
+	s.heldSince = now
+	if b.measuring(now) {
+		s.Taken++
+	}
+}
+
+// released records the end of a shard's processor: lost is a lease taken by another
+// worker, ended a closed shard
+func (b *benchmarkRecorder) released(shardID string, lost, ended bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	s := b.shard(shardID)
+	b.stopHolding(s, now)
+	if !b.measuring(now) {
+		return
+	}
+	if lost {
+		s.Lost++
+	}
+	if ended {
+		b.shardsEnded++
+	}
+}
+
+// stopHolding adds the measured part of the shard's current holding to its held time
+func (b *benchmarkRecorder) stopHolding(s *benchmarkShard, now time.Time) {
+	if s.heldSince.IsZero() {
+		return
+	}
+	if from := maxTime(s.heldSince, b.measuredFrom); now.After(from) {
+		s.held += now.Sub(from)
+	}
+	s.heldSince = time.Time{}
+}
+
+// batch records one processed batch: the records decoded and failed, the time it took
+// and the end-to-end latency of each decoded record
+func (b *benchmarkRecorder) batch(shardID string, records, failures int, took time.Duration, endToEnd []time.Duration) {
+	if b == nil || records+failures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.measuring(time.Now()) {
+		return
+	}
+	b.batches++
+	b.records += int64(records)
+	b.decodeFailures += int64(failures)
+	b.shard(shardID).Records += int64(records)
+	b.processing.observe(took, b.rng)
+	for _, d := range endToEnd {
+		b.endToEnd.observe(d, b.rng)
+	}
+}
+
+// checkpointed records a checkpoint attempt
+func (b *benchmarkRecorder) checkpointed(shardID string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.measuring(time.Now()) {
+		return
+	}
+	if err != nil {
+		b.checkpointErrors++
+		return
+	}
+	b.checkpoints++
+	b.shard(shardID).Checkpoints++
+}
+
+func (b *benchmarkRecorder) report(cfg *Config, stream StreamTarget, completed bool, reason string) benchmarkReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().UTC()
+	report := benchmarkReport{
+		Label:            b.cfg.Label,
+		Application:      stream.ApplicationName,
+		Worker:           cfg.Consumer.WorkerID,
+		Stream:           stream.StreamName,
+		StartedAt:        b.startedAt,
+		MeasuredFrom:     b.measuredFrom,
+		StoppedAt:        now,
+		Completed:        completed,
+		StopReason:       reason,
+		MeasuredSeconds:  max(now.Sub(b.measuredFrom).Seconds(), 0),
+		Records:          b.records,
+		Batches:          b.batches,
+		DecodeFailures:   b.decodeFailures,
+		Processing:       b.processing.summary(),
+		EndToEnd:         b.endToEnd.summary(),
+		Checkpoints:      b.checkpoints,
+		CheckpointErrors: b.checkpointErrors,
+		ShardsEnded:      b.shardsEnded,
+		Shards:           make(map[string]*benchmarkShard, len(b.shards)),
+		Settings:         consumerSettings(cfg),
+	}
+	if report.MeasuredSeconds > 0 {
+		report.RecordsPerSec = float64(report.Records) / report.MeasuredSeconds
+	}
+	for shardID, s := range b.shards {
+		copied := *s
+		// A shard still held counts until now
+		if !copied.heldSince.IsZero() {
+			b.stopHolding(&copied, now)
+		}
+		copied.HeldSeconds = copied.held.Seconds()
+		if copied.HeldSeconds > 0 {
+			copied.RecordsPerSec = float64(copied.Records) / copied.HeldSeconds
+		}
+		report.Shards[shardID] = &copied
+		report.LeasesTaken += copied.Taken
+		report.LeasesLost += copied.Lost
+	}
+	report.Rebalances = report.LeasesTaken + report.LeasesLost
+	return report
+}
+
+// consumerSettings returns the consumer block of cfg under its YAML names
+func consumerSettings(cfg *Config) map[string]interface{} {
+	var settings map[string]interface{}
+	data, err := yaml.Marshal(&cfg.Consumer)
+	if err == nil {
+		err = yaml.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to record benchmark settings: %v", err)
+	}
+	return settings
+}
+
+// writeBenchmarkReport prints the report to stdout as one JSON line prefixed with
+// "BENCHMARK_REPORT " and writes it to benchmark.output when configured
+func writeBenchmarkReport(cfg *Config, stream StreamTarget, completed bool, reason string) {
+	if bench == nil {
+		return
+	}
+	report := bench.report(cfg, stream, completed, reason)
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("⚠️  Failed to encode benchmark report: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "BENCHMARK_REPORT %s\n", body)
+	log.Printf("⏱️  Benchmark %s: %d records in %.1fs (%.1f rec/s), processing p50=%.1fms p99=%.1fms, %d checkpoints, %d rebalances",
+		reason, report.Records, report.MeasuredSeconds, report.RecordsPerSec,
+		report.Processing.P50, report.Processing.P99, report.Checkpoints, report.Rebalances)
+
+	if path := bench.cfg.Output; path != "" {
+		indented, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(path, append(indented, '\n'), 0o644)
+		}
+		if err != nil {
+			log.Printf("⚠️  Failed to write benchmark report to %s: %v", path, err)
+			return
+		}
+		log.Printf("📝 Benchmark report written to %s", path)
+	}
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// CaptureConfig stores a sample of raw records for debugging, so production decode
+// failures can be reproduced without logging payloads. Every capture is redacted
+// before it leaves the process, by the redaction section and then RedactFields and
+// RedactPatterns.
+type CaptureConfig struct {
+	// DecodeFailures captures every record that is not a valid event
+	DecodeFailures bool `yaml:"decode_failures"`
+	// SampleEvery captures 1 in N decoded records, 0 for none
+	SampleEvery int `yaml:"sample_every"`
+	// Match captures decoded records whose top-level fields all equal these values
+	Match map[string]string `yaml:"match"`
+
+	// RedactFields are dotted JSON paths whose values are replaced, e.g. user_id or metadata.email
+	RedactFields []string `yaml:"redact_fields"`
+	// RedactPatterns are regular expressions replaced in the raw payload, which also
+	// covers records that are not valid JSON
+	RedactPatterns []string `yaml:"redact_patterns"`
+
+	// Dir and S3URI (s3://bucket/prefix) are where captures go; at least one is needed
+	Dir   string `yaml:"dir"`
+	S3URI string `yaml:"s3_uri"`
+	// MaxPerMinute bounds captures across all shards (default 60); more are dropped
+	MaxPerMinute int `yaml:"max_per_minute"`
+}
+
+func (c CaptureConfig) enabled() bool {
+	return c.DecodeFailures || c.SampleEvery > 0 || len(c.Match) > 0
+}
+
+// capturedRecord is the JSON document written per capture. Data holds the redacted
+// payload when it is valid UTF-8, DataBase64 otherwise.
+type capturedRecord struct {
+	ShardID        string    `json:"shard_id"`
+	SequenceNumber string    `json:"sequence_number"`
+	PartitionKey   string    `json:"partition_key"`
+	ArrivalTime    time.Time `json:"arrival_time"`
+	CapturedAt     time.Time `json:"captured_at"`
+	Reason         string    `json:"reason"` // decode_error, sample or match
+	Error          string    `json:"error,omitempty"`
+	Data           string    `json:"data,omitempty"`
+	DataBase64     []byte    `json:"data_base64,omitempty"`
+
+	key string
+}
+
+// payloadCapture writes captures in the background; nil when capture is off
+type payloadCapture struct {
+	cfg      CaptureConfig
+	redactor Redactor
+	bucket   string
+	prefix   string
+	uploader *s3manager.Uploader
+
+	sampled atomic.Int64 // decoded records offered, for SampleEvery
+
+	mu          sync.Mutex
+	windowStart time.Time
+	inWindow    int
+	captured    map[string]int64 // per reason
+	dropped     int64
+	closed      bool
+
+	queue chan capturedRecord
+	done  chan struct{}
+}
+
+// capture is nil unless the capture section enables it
+var capture *payloadCapture
+
+func newPayloadCapture(cfg *Config, region string) (*payloadCapture, error) {
+	c := cfg.Capture
+	if !c.enabled() {
+		return nil, nil
+	}
+	if c.Dir == "" && c.S3URI == "" {
+		return nil, fmt.Errorf("capture needs dir or s3_uri")
+	}
+	if c.MaxPerMinute <= 0 {
+		c.MaxPerMinute = 60
+	}
+	p := &payloadCapture{
+		cfg:      c,
+		captured: make(map[string]int64),
+		queue:    make(chan capturedRecord, 100),
+		done:     make(chan struct{}),
+	}
+	// Captures are redacted like everything else, then by their own fields and patterns
+	own, err := newFieldRedactor(RedactionConfig{Fields: c.RedactFields, Patterns: c.RedactPatterns})
+	if err != nil {
+		return nil, err
+	}
+	p.redactor = redactor
+	if own != nil {
+		p.redactor = redactors{redactor, own}
+	}
+	if c.Dir != "" {
+		if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create capture dir: %w", err)
+		}
+	}
+	if c.S3URI != "" {
+		bucket, prefix, err := parseS3URI(c.S3URI)
+		if err != nil {
+			return nil, err
+		}
+		// LocalStack serves S3 on path-style URLs only
+		sess, err := session.NewSession(awsConfig(cfg, region).WithS3ForcePathStyle(cfg.AWS.Endpoint != ""))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 session: %w", err)
+		}
+		p.bucket, p.prefix, p.uploader = bucket, prefix, s3manager.NewUploader(sess)
+	}
+	go p.run()
+	return p, nil
+}
+
+// parseS3URI splits s3://bucket[/prefix]
+func parseS3URI(uri string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", fmt.Errorf("%q must be s3://bucket[/prefix]", uri)
+	}
+	bucket, prefix, _ = strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q must be s3://bucket[/prefix]", uri)
+	}
+	return bucket, prefix, nil
+}
+
+// decodeFailure captures a record that failed to decode, if configured
+func (p *payloadCapture) decodeFailure(shardID string, record *kinesis.Record, err error) {
+	if p == nil || !p.cfg.DecodeFailures {
+		return
+	}
+	p.offer(shardID, record, "decode_error", err.Error())
+}
+
+// decoded captures a decoded record when it is sampled or matches
+func (p *payloadCapture) decoded(shardID string, record *kinesis.Record) {
+	if p == nil {
+		return
+	}
+	if n := p.cfg.SampleEvery; n > 0 && p.sampled.Add(1)%int64(n) == 0 {
+		p.offer(shardID, record, "sample", "")
+	} else if p.matches(record.Data) {
+		p.offer(shardID, record, "match", "")
+	}
+}
+
+func (p *payloadCapture) matches(data []byte) bool {
+	if len(p.cfg.Match) == 0 {
+		return false
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	for field, want := range p.cfg.Match {
+		value, ok := fields[field]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// offer redacts and queues a capture unless the per-minute budget is spent or the
+// writer is behind; capturing never blocks processing
+func (p *payloadCapture) offer(shardID string, record *kinesis.Record, reason, errMsg string) {
+	now := time.Now().UTC()
+	p.mu.Lock()
+	if now.Sub(p.windowStart) >= time.Minute {
+		p.windowStart, p.inWindow = now, 0
+	}
+	if p.inWindow >= p.cfg.MaxPerMinute {
+		p.dropped++
+		p.mu.Unlock()
+		return
+	}
+	p.inWindow++
+	p.mu.Unlock()
+
+	sequence := aws.StringValue(record.SequenceNumber)
+	c := capturedRecord{
+		ShardID:        shardID,
+		SequenceNumber: sequence,
+		PartitionKey:   aws.StringValue(record.PartitionKey),
+		ArrivalTime:    aws.TimeValue(record.ApproximateArrivalTimestamp),
+		CapturedAt:     now,
+		Reason:         reason,
+		Error:          errMsg,
+		// KPL user records share their aggregate's sequence number
+		key: path.Join(shardID, fmt.Sprintf("%s-%s-%d.json", now.Format("20060102T150405Z"), sequence, now.UnixNano())),
+	}
+	data := p.redactor.Redact(record.Data)
+	if utf8.Valid(data) {
+		c.Data = string(data)
+	} else {
+		c.DataBase64 = data
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- c:
+		p.captured[reason]++
+	default:
+		p.dropped++
+	}
+}
+
+func (p *payloadCapture) run() {
+	defer close(p.done)
+	for c := range p.queue {
+		body, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			log.Printf("⚠️  Failed to encode capture: %v", err)
+			continue
+		}
+		if p.cfg.Dir != "" {
+			file := filepath.Join(p.cfg.Dir, filepath.FromSlash(c.key))
+			err := os.MkdirAll(filepath.Dir(file), 0o755)
+			if err == nil {
+				err = os.WriteFile(file, body, 0o644)
+			}
+			if err != nil {
+				log.Printf("⚠️  Failed to write capture %s: %v", file, err)
+			}
+		}
+		if p.uploader != nil {
+			key := path.Join(p.prefix, c.key)
+			if _, err := p.uploader.Upload(&s3manager.UploadInput{
+				Bucket:      aws.String(p.bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader(body),
+				ContentType: aws.String("application/json"),
+			}); err != nil {
+				log.Printf("⚠️  Failed to upload capture to s3://%s/%s: %v", p.bucket, key, err)
+			}
+		}
+	}
+}
+
+// close writes the queued captures and stops the writer
+func (p *payloadCapture) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	<-p.done
+}
+
+func (p *payloadCapture) writeMetrics(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_captured_records_total Raw records captured for debugging, by reason")
+	fmt.Fprintln(w, "# TYPE kcl_captured_records_total counter")
+	for _, reason := range []string{"decode_error", "sample", "match"} {
+		fmt.Fprintf(w, "kcl_captured_records_total{reason=%q} %d\n", reason, p.captured[reason])
+	}
+	fmt.Fprintln(w, "# HELP kcl_capture_dropped_total Captures dropped over max_per_minute or a full queue")
+	fmt.Fprintln(w, "# TYPE kcl_capture_dropped_total counter")
+	fmt.Fprintf(w, "kcl_capture_dropped_total %d\n", p.dropped)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// duplicateTracker estimates the duplicate-delivery rate from a bounded LRU of recent
+// event IDs. It only sees redeliveries to this worker: a record first processed by
+// another pod before its lease moved here is not counted.
+type duplicateTracker struct {
+	size int
+
+	mu         sync.Mutex
+	recent     *list.List               // event IDs, most recent first
+	index      map[string]*list.Element // event ID -> element of recent
+	seen       map[string]int64         // records with an event ID, per shard
+	duplicates map[string]int64         // of which already in recent, per shard
+}
+
+// duplicates is nil unless consumer.duplicate_window is set
+var duplicates *duplicateTracker
+
+func newDuplicateTracker(size int) *duplicateTracker {
+	return &duplicateTracker{
+		size:       size,
+		recent:     list.New(),
+		index:      make(map[string]*list.Element, size),
+		seen:       make(map[string]int64),
+		duplicates: make(map[string]int64),
+	}
+}
+
+// observe records one delivery of eventID; events without an ID are not tracked
+func (d *duplicateTracker) observe(shardID, eventID string) {
+	if d == nil || eventID == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen[shardID]++
+	if e, ok := d.index[eventID]; ok {
+		d.duplicates[shardID]++
+		d.recent.MoveToFront(e)
+		return
+	}
+	d.index[eventID] = d.recent.PushFront(eventID)
+	if d.recent.Len() > d.size {
+		oldest := d.recent.Back()
+		d.recent.Remove(oldest)
+		delete(d.index, oldest.Value.(string))
+	}
+}
+
+// writeMetrics writes per-shard counters and the overall duplicate rate
+func (d *duplicateTracker) writeMetrics(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	checked := make(map[string]float64, len(d.seen))
+	duplicated := make(map[string]float64, len(d.seen))
+	var seen, dups int64
+	for shardID, n := range d.seen {
+		checked[shardID] = float64(n)
+		duplicated[shardID] = float64(d.duplicates[shardID])
+		seen += n
+		dups += d.duplicates[shardID]
+	}
+
+	fmt.Fprintln(w, "# HELP kcl_records_deduplicated_total Records with an event ID checked against the recent-ID window")
+	fmt.Fprintln(w, "# TYPE kcl_records_deduplicated_total counter")
+	writeShardSeries(w, "duplicates", "kcl_records_deduplicated_total", checked, aggregateSum)
+	fmt.Fprintln(w, "# HELP kcl_duplicate_records_total Records whose event ID was already in the recent-ID window")
+	fmt.Fprintln(w, "# TYPE kcl_duplicate_records_total counter")
+	writeShardSeries(w, "duplicates", "kcl_duplicate_records_total", duplicated, aggregateSum)
+	rate := 0.0
+	if seen > 0 {
+		rate = float64(dups) / float64(seen)
+	}
+	fmt.Fprintln(w, "# HELP kcl_duplicate_rate Duplicate records over checked records since start")
+	fmt.Fprintln(w, "# TYPE kcl_duplicate_rate gauge")
+	fmt.Fprintf(w, "kcl_duplicate_rate %g\n", rate)
+	fmt.Fprintln(w, "# HELP kcl_duplicate_window_ids Event IDs currently held in the recent-ID window")
+	fmt.Fprintln(w, "# TYPE kcl_duplicate_window_ids gauge")
+	fmt.Fprintf(w, "kcl_duplicate_window_ids %d\n", d.recent.Len())
+}
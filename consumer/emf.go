@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// EMFConfig writes the registered metrics to stdout in CloudWatch Embedded Metric
+// Format, for deployments that ship logs to CloudWatch but run no Prometheus
+type EMFConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespace defaults to "KDS/Consumer"
+	Namespace string `yaml:"namespace"`
+	// FlushIntervalMillis defaults to 60000
+	FlushIntervalMillis int `yaml:"flush_interval_millis"`
+}
+
+// emfMaxMetrics is the most metrics CloudWatch accepts in one EMF document
+const emfMaxMetrics = 100
+
+// emfWriter renders the Prometheus text of every registered metrics writer and
+// re-emits it as EMF: one JSON line per label set, with the labels plus the
+// application as dimensions. Counters, and the _sum/_count series of histograms,
+// become the increase since the previous flush; histogram buckets are dropped.
+type emfWriter struct {
+	out       io.Writer
+	namespace string
+	app       string
+	worker    string
+	last      counterBaseline
+}
+
+func newEMFWriter(cfg EMFConfig, app, worker string) *emfWriter {
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = "KDS/Consumer"
+	}
+	return &emfWriter{out: os.Stdout, namespace: namespace, app: app, worker: worker, last: counterBaseline{}}
+}
+
+// run flushes every interval until stop is closed, then once more
+func (e *emfWriter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush(time.Now())
+		case <-stop:
+			e.flush(time.Now())
+			return
+		}
+	}
+}
+
+func (e *emfWriter) flush(now time.Time) {
+	type document struct {
+		labels [][2]string
+		names  []string
+		units  []string
+		values []float64
+	}
+	docs := map[string]*document{}
+	var order []string
+	for _, sample := range collectMetricSamples() {
+		unit := "None"
+		key := labelKey(sample.labels)
+		if sample.kind == "counter" {
+			sample.value, _ = e.last.delta(sample.name+key, sample.value)
+			unit = "Count"
+		}
+		switch {
+		case strings.HasSuffix(sample.name, "_seconds"), strings.HasSuffix(sample.name, "_seconds_sum"):
+			unit = "Seconds"
+		case strings.HasSuffix(sample.name, "_bytes"):
+			unit = "Bytes"
+		}
+		doc := docs[key]
+		if doc == nil {
+			doc = &document{labels: sample.labels}
+			docs[key] = doc
+			order = append(order, key)
+		}
+		doc.names = append(doc.names, sample.name)
+		doc.units = append(doc.units, unit)
+		doc.values = append(doc.values, sample.value)
+	}
+
+	for _, key := range order {
+		doc := docs[key]
+		for start := 0; start < len(doc.names); start += emfMaxMetrics {
+			end := min(start+emfMaxMetrics, len(doc.names))
+			root := map[string]any{"app": e.app}
+			dimensions := []string{"app"}
+			for _, l := range doc.labels {
+				if _, dup := root[l[0]]; !dup {
+					dimensions = append(dimensions, l[0])
+				}
+				root[l[0]] = l[1]
+			}
+			if _, ok := root["worker"]; !ok {
+				root["worker"] = e.worker
+			}
+			definitions := make([]map[string]string, 0, end-start)
+			for i := start; i < end; i++ {
+				definitions = append(definitions, map[string]string{"Name": doc.names[i], "Unit": doc.units[i]})
+				root[doc.names[i]] = doc.values[i]
+			}
+			root["_aws"] = map[string]any{
+				"Timestamp": now.UnixMilli(),
+				"CloudWatchMetrics": []map[string]any{{
+					"Namespace":  e.namespace,
+					"Dimensions": [][]string{dimensions},
+					"Metrics":    definitions,
+				}},
+			}
+			line, err := json.Marshal(root)
+			if err != nil {
+				log.Printf("⚠️  Failed to encode EMF document: %v", err)
+				continue
+			}
+			e.out.Write(append(line, '\n'))
+		}
+	}
+}
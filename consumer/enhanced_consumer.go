@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,11 +10,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/sirupsen/logrus"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/config"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
 	"github.com/vmware/vmware-go-kcl/clientlibrary/worker"
+	"github.com/vmware/vmware-go-kcl/logger"
 	"gopkg.in/yaml.v3"
 )
 
@@ -27,10 +29,17 @@ type Config struct {
 	} `yaml:"aws"`
 	Kinesis struct {
 		StreamName string `yaml:"stream_name"`
+
+		// Multi-region failover: streams consumed, in order, when the primary
+		// stream above is unavailable
+		Failover                    []StreamTarget `yaml:"failover"`
+		FailoverCheckIntervalMillis int            `yaml:"failover_check_interval_millis"`
+		FailoverAfterChecks         int            `yaml:"failover_after_checks"`
 	} `yaml:"kinesis"`
 	Consumer struct {
 		ApplicationName                          string `yaml:"application_name"`
 		WorkerID                                 string `yaml:"worker_id"`
+		LogLevel                                 string `yaml:"log_level"`
 		MaxRecords                               int    `yaml:"max_records"`
 		CallProcessRecordsEvenForEmptyRecordList bool   `yaml:"call_process_records_even_for_empty_list"`
 
@@ -53,7 +62,78 @@ type Config struct {
 
 		// Number of pods for calculating max leases
 		TotalNumPods int `yaml:"total_num_pods"`
+
+		// Max leases per worker from the lease manager's coordinator row, see maxleases.go
+		DynamicMaxLeases DynamicMaxLeasesConfig `yaml:"dynamic_max_leases"`
+
+		// Batches processed at once across all shards of this worker, 0 for no limit
+		// (derived from the CPU limit unless resources.disable_autotune is set)
+		MaxConcurrentBatches int `yaml:"max_concurrent_batches"`
+
+		// Defaults derived from the container's CPU and memory limits, see resources.go
+		Resources ResourcesConfig `yaml:"resources"`
+
+		// Recent event IDs remembered to estimate the duplicate-delivery rate, 0 to disable
+		DuplicateWindow int `yaml:"duplicate_window"`
+
+		// Memory-aware backpressure
+		Memory MemoryConfig `yaml:"memory"`
+
+		// Per-shard tuning of max_records and idle_time_between_reads_in_millis
+		Adaptive AdaptiveConfig `yaml:"adaptive"`
+
+		// Client-side per-shard GetRecords limits
+		ReadLimit ReadLimitConfig `yaml:"read_limit"`
+
+		// Pause and resume intake through metrics_addr
+		Pause PauseConfig `yaml:"pause"`
+
+		// Lag-based readiness served on metrics_addr
+		Readiness ReadinessConfig `yaml:"readiness"`
+
+		// Where the shutdown report goes besides stdout
+		ShutdownReport ShutdownReportConfig `yaml:"shutdown_report"`
+
+		// Fixed-duration runs with a throughput report, see benchmark.go
+		Benchmark BenchmarkConfig `yaml:"benchmark"`
+
+		// Lease table bootstrap and teardown
+		LeaseTable LeaseTableConfig `yaml:"lease_table"`
+
+		// Event-time watermark publication
+		Watermark WatermarkConfig `yaml:"watermark"`
+
+		// Per-shard key/value state for stateful handlers, see state.go
+		State StateConfig `yaml:"state"`
 	} `yaml:"consumer"`
+
+	// Validation rejects records that do not match a schema to the DLQ, see validate.go
+	Validation ValidationConfig `yaml:"validation"`
+	DLQ        SinkConfig       `yaml:"dlq"`
+
+	// Transforms rewrite records before they reach the sinks, see transform.go
+	Transforms []TransformConfig `yaml:"transforms"`
+
+	// Sinks receive every batch before it is checkpointed, see sink.go
+	Sinks []SinkConfig `yaml:"sinks"`
+
+	// Redaction masks record content in logs, the DLQ and captures, see redact.go
+	Redaction RedactionConfig `yaml:"redaction"`
+
+	// Capture stores a redacted sample of raw records for debugging, see capture.go
+	Capture CaptureConfig `yaml:"capture"`
+
+	// MetricsAddr serves Prometheus metrics, e.g. ":9102"
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// MetricsEMF also writes the metrics to stdout for CloudWatch, see emf.go
+	MetricsEMF EMFConfig `yaml:"metrics_emf"`
+
+	// MetricsStatsD also pushes the metrics to the Datadog agent, see statsd.go
+	MetricsStatsD StatsDConfig `yaml:"metrics_statsd"`
+
+	// MetricsShardLabels aggregates per-shard metric groups to the worker, see metrics.go
+	MetricsShardLabels ShardLabelConfig `yaml:"metrics_shard_labels"`
 }
 
 // Event represents a sample data event
@@ -74,6 +154,18 @@ type EnhancedRecordProcessor struct {
 	isParentShard  bool
 	childShardIDs  []string
 	processingRate float64
+	sink           Sink
+	transforms     pipeline
+	validator      *recordValidator
+	dlq            Sink
+
+	// Last record handed to a buffering sink but not yet checkpointed
+	pendingSequence *string
+	pendingEvent    time.Time
+
+	// Shard state and the windows kept in it; nil unless consumer.state is configured
+	state   *ShardState
+	windows *shardWindows
 }
 
 // Initialize is called once when the processor starts processing a shard
@@ -81,6 +173,12 @@ func (rp *EnhancedRecordProcessor) Initialize(input *interfaces.InitializationIn
 	rp.shardID = input.ShardId
 	rp.recordCount = 0
 	rp.startTime = time.Now()
+	watermarks.start(rp.shardID)
+	lags.start(rp.shardID)
+	activity.start(rp.shardID)
+	bench.taken(rp.shardID)
+	rp.state = states.acquire(rp.shardID, input.ExtendedSequenceNumber)
+	rp.windows = newShardWindows(rp.shardID, rp.state)
 
 	log.Printf("[%s] 🚀 Initializing record processor", rp.shardID)
 	log.Printf("[%s] ExtendedSequenceNumber: %v", rp.shardID, input.ExtendedSequenceNumber)
@@ -88,17 +186,56 @@ func (rp *EnhancedRecordProcessor) Initialize(input *interfaces.InitializationIn
 
 // ProcessRecords is called to process a batch of records from the shard
 func (rp *EnhancedRecordProcessor) ProcessRecords(input *interfaces.ProcessRecordsInput) {
+	// Pause intake while too many record bytes are held, see memory.go
+	size := recordBytes(input.Records)
+	memory.admit(rp.shardID, size, func() {
+		// Flushing our own buffer is the one release that does not depend on other shards
+		if buffered, ok := rp.sink.(bufferedSink); ok && rp.pendingSequence != nil {
+			flush(buffered, rp.shardID)
+			rp.checkpointFlushed(input.Checkpointer, time.Now())
+		}
+	})
+	defer memory.release(size)
+
+	// Wait for a slot of the worker-wide budget, see scheduler.go
+	defer slots.acquire()()
+
 	batchStart := time.Now()
+	lags.observe(rp.shardID, input.MillisBehindLatest)
+	activity.processed(rp.shardID, len(input.Records), input.MillisBehindLatest)
+	var decoded, failed int
+	var endToEnd []time.Duration
+	defer func() {
+		took := time.Since(batchStart)
+		adaptive.observeProcessing(rp.shardID, took)
+		bench.batch(rp.shardID, decoded, failed, took, endToEnd)
+	}()
+	var latestEvent time.Time
 
 	// Process each record
 	for _, record := range input.Records {
 		var event Event
 		if err := json.Unmarshal(record.Data, &event); err != nil {
 			log.Printf("[%s] ❌ Failed to unmarshal record: %v", rp.shardID, err)
+			capture.decodeFailure(rp.shardID, record, err)
+			failed++
 			continue
 		}
 
 		rp.recordCount++
+		decoded++
+		latencies.observe(rp.shardID, event.Action, event.Timestamp, aws.TimeValue(record.ApproximateArrivalTimestamp))
+		if bench != nil {
+			if latency, ok := endToEndLatency(event.Timestamp, aws.TimeValue(record.ApproximateArrivalTimestamp)); ok {
+				endToEnd = append(endToEnd, latency)
+			}
+		}
+		duplicates.observe(rp.shardID, event.EventID)
+		rp.windows.observe(event, aws.StringValue(record.SequenceNumber))
+		capture.decoded(rp.shardID, record)
+		if event.Timestamp.After(latestEvent) {
+			latestEvent = event.Timestamp
+		}
 
 		// Log every 10th record to reduce noise
 		if rp.recordCount%10 == 0 {
@@ -106,30 +243,106 @@ func (rp *EnhancedRecordProcessor) ProcessRecords(input *interfaces.ProcessRecor
 			rate := float64(rp.recordCount) / elapsed
 			rp.processingRate = rate
 
-			log.Printf("[%s] 📊 Record #%d | Rate: %.2f rec/s | EventID: %s | UserID: %s | Action: %s",
-				rp.shardID, rp.recordCount, rate, event.EventID, event.UserID, event.Action)
+			log.Printf("[%s] 📊 Record #%d | Rate: %.2f rec/s | Latency: %s | Key: %s | EventID: %s | UserID: %s | Action: %s",
+				rp.shardID, rp.recordCount, rate,
+				time.Since(aws.TimeValue(record.ApproximateArrivalTimestamp)).Round(time.Millisecond),
+				redactor.RedactField("partition_key", aws.StringValue(record.PartitionKey)),
+				redactor.RedactField("event_id", event.EventID),
+				redactor.RedactField("user_id", event.UserID),
+				redactor.RedactField("action", event.Action))
 		}
 	}
 
+	// Deliver to the configured sinks before checkpointing, so nothing is lost;
+	// records failing validation go to the DLQ instead
+	if len(input.Records) > 0 && (rp.sink != nil || rp.validator != nil) {
+		records, rejected := rp.validator.split(sinkRecords(rp.shardID, input.Records))
+		if len(rejected) > 0 {
+			log.Printf("[%s] 🚫 %d records failed validation, first: %s",
+				rp.shardID, len(rejected), redactor.RedactField("error", rejected[0].Error))
+			deliver(rp.dlq, rp.shardID, redactRecords(redactor, rejected))
+		}
+		if rp.sink != nil && len(records) > 0 {
+			deliver(rp.sink, rp.shardID, rp.transforms.apply(records))
+		}
+	}
+
+	// A buffering sink holds the checkpoint back until its buffer is flushed
+	if buffered, ok := rp.sink.(bufferedSink); ok {
+		if len(input.Records) > 0 {
+			rp.pendingSequence = input.Records[len(input.Records)-1].SequenceNumber
+			if latestEvent.After(rp.pendingEvent) {
+				rp.pendingEvent = latestEvent
+			}
+		}
+		if buffered.Due(rp.shardID) {
+			flush(buffered, rp.shardID)
+			rp.checkpointFlushed(input.Checkpointer, batchStart)
+		} else if len(input.Records) == 0 && input.MillisBehindLatest == 0 && rp.pendingSequence == nil {
+			watermarks.advance(rp.shardID, batchStart)
+		}
+		return
+	}
+
 	// Checkpoint after processing records
 	if len(input.Records) > 0 {
 		lastRecord := input.Records[len(input.Records)-1]
-		if err := input.Checkpointer.Checkpoint(lastRecord.SequenceNumber); err != nil {
+		rp.saveState(lastRecord.SequenceNumber)
+		err := input.Checkpointer.Checkpoint(lastRecord.SequenceNumber)
+		bench.checkpointed(rp.shardID, err)
+		if err != nil {
 			log.Printf("[%s] ❌ Failed to checkpoint: %v", rp.shardID, err)
 		} else {
 			batchDuration := time.Since(batchStart).Milliseconds()
 			log.Printf("[%s] ✅ Checkpointed batch of %d records (took %dms)",
 				rp.shardID, len(input.Records), batchDuration)
+			activity.checkpointed(rp.shardID, lastRecord.SequenceNumber)
+			watermarks.advance(rp.shardID, latestEvent)
 		}
+	} else if input.MillisBehindLatest == 0 {
+		// A caught-up idle shard must not hold the application watermark back
+		watermarks.advance(rp.shardID, batchStart)
 	}
 }
 
+// checkpointFlushed checkpoints the last record a buffering sink has flushed
+func (rp *EnhancedRecordProcessor) checkpointFlushed(checkpointer interfaces.IRecordProcessorCheckpointer, flushStart time.Time) {
+	if rp.pendingSequence == nil {
+		return
+	}
+	rp.saveState(rp.pendingSequence)
+	err := checkpointer.Checkpoint(rp.pendingSequence)
+	bench.checkpointed(rp.shardID, err)
+	if err != nil {
+		log.Printf("[%s] ❌ Failed to checkpoint after flush: %v", rp.shardID, err)
+		return
+	}
+	log.Printf("[%s] ✅ Checkpointed flushed records up to %s (took %dms)",
+		rp.shardID, *rp.pendingSequence, time.Since(flushStart).Milliseconds())
+	activity.checkpointed(rp.shardID, rp.pendingSequence)
+	watermarks.advance(rp.shardID, rp.pendingEvent)
+	rp.pendingSequence = nil
+	rp.pendingEvent = time.Time{}
+}
+
+// saveState saves the shard state as covering the records up to sequence, before
+// they are checkpointed
+func (rp *EnhancedRecordProcessor) saveState(sequence *string) {
+	rp.windows.sync()
+	states.save(rp.state, sequence)
+}
+
 // Shutdown is called when the processor is shutting down
 func (rp *EnhancedRecordProcessor) Shutdown(input *interfaces.ShutdownInput) {
 	elapsed := time.Since(rp.startTime).Seconds()
 	avgRate := float64(rp.recordCount) / elapsed
 
 	log.Printf("[%s] 🛑 Shutting down. Reason: %v", rp.shardID, input.ShutdownReason)
+	adaptive.forget(rp.shardID)
+	readers.forget(rp.shardID)
+	lags.forget(rp.shardID)
+	defer activity.release(rp.shardID, aws.StringValue(interfaces.ShutdownReasonMessage(input.ShutdownReason)))
+	defer bench.released(rp.shardID, input.ShutdownReason == interfaces.ZOMBIE, input.ShutdownReason == interfaces.TERMINATE)
 	log.Printf("[%s] 📈 Statistics: %d records, %.2f seconds, %.2f rec/s",
 		rp.shardID, rp.recordCount, elapsed, avgRate)
 
@@ -138,13 +351,29 @@ func (rp *EnhancedRecordProcessor) Shutdown(input *interfaces.ShutdownInput) {
 	case interfaces.TERMINATE:
 		// Shard has been closed (split or merged)
 		log.Printf("[%s] 🔄 Shard TERMINATED (likely split/merged). Child shards can now be processed.", rp.shardID)
-		if err := input.Checkpointer.Checkpoint(nil); err != nil {
+		if buffered, ok := rp.sink.(bufferedSink); ok {
+			flush(buffered, rp.shardID)
+		}
+		// The children restore the final state, without the windows closed here
+		rp.windows.close()
+		states.release(rp.state, rp.pendingSequence, true)
+		err := input.Checkpointer.Checkpoint(nil)
+		bench.checkpointed(rp.shardID, err)
+		if err != nil {
 			log.Printf("[%s] ❌ Failed to checkpoint on TERMINATE: %v", rp.shardID, err)
+		} else {
+			activity.checkpointed(rp.shardID, nil)
 		}
+		watermarks.stop(rp.shardID, true)
 	case interfaces.ZOMBIE:
 		// This worker lost the lease to another worker
 		log.Printf("[%s] 👻 Shard became ZOMBIE (lease stolen by another worker)", rp.shardID)
 		// Don't checkpoint on ZOMBIE - let the new owner continue from last checkpoint
+		if buffered, ok := rp.sink.(bufferedSink); ok {
+			buffered.Discard(rp.shardID)
+		}
+		states.forget(rp.shardID)
+		watermarks.stop(rp.shardID, false)
 	case interfaces.REQUESTED:
 		// Explicit shutdown requested (e.g., application termination)
 		log.Printf("[%s] 🔌 Shutdown REQUESTED (application terminating)", rp.shardID)
@@ -152,15 +381,33 @@ func (rp *EnhancedRecordProcessor) Shutdown(input *interfaces.ShutdownInput) {
 		// Checkpointing with nil marks the shard as SHARD_END, preventing restart.
 		// The shard is still OPEN in Kinesis, so we should let it resume from the last checkpoint.
 		log.Printf("[%s] ℹ️  Not checkpointing - shard will resume from last position on restart", rp.shardID)
+		// Buffered records are flushed and checkpointed, which only moves the position forward
+		if buffered, ok := rp.sink.(bufferedSink); ok {
+			flush(buffered, rp.shardID)
+			rp.checkpointFlushed(input.Checkpointer, time.Now())
+		}
+		// Hand the state saved with the last checkpoint to the next owner
+		states.release(rp.state, nil, false)
+		watermarks.stop(rp.shardID, false)
 	}
 }
 
 // EnhancedRecordProcessorFactory creates new EnhancedRecordProcessor instances
-type EnhancedRecordProcessorFactory struct{}
+type EnhancedRecordProcessorFactory struct {
+	sink       Sink
+	transforms pipeline
+	validator  *recordValidator
+	dlq        Sink
+}
 
 // CreateProcessor creates a new EnhancedRecordProcessor for a shard
 func (f *EnhancedRecordProcessorFactory) CreateProcessor() interfaces.IRecordProcessor {
-	return &EnhancedRecordProcessor{}
+	return &EnhancedRecordProcessor{
+		sink:       f.sink,
+		transforms: f.transforms,
+		validator:  f.validator,
+		dlq:        f.dlq,
+	}
 }
 
 func loadConfig() (*Config, error) {
@@ -213,28 +460,65 @@ func main() {
 		log.Fatalf("❌ Failed to load config: %v", err)
 	}
 
+	tagAWSRequests(cfg)
+
+	// Size batches and the worker pool for the container's CPU and memory limits
+	resources := detectResources()
+	tuned, err := autotune(cfg, &resources)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
 	log.Printf("📝 Worker ID: %s", cfg.Consumer.WorkerID)
 	log.Printf("📝 Application: %s", cfg.Consumer.ApplicationName)
-	log.Printf("📝 Stream: %s", cfg.Kinesis.StreamName)
+	log.Printf("📝 Stream: %s (%d failover streams)", cfg.Kinesis.StreamName, len(cfg.Kinesis.Failover))
 	log.Printf("📝 Lease Stealing: %v", cfg.Consumer.EnableLeaseStealing)
-	log.Printf("📝 Max Leases For Worker: %d", cfg.Consumer.MaxLeasesForWorker)
+	log.Printf("📝 Max Leases For Worker: %d (dynamic: %v)", cfg.Consumer.MaxLeasesForWorker, cfg.Consumer.DynamicMaxLeases.Enabled)
 	log.Printf("📝 Process Parent Before Children: %v", cfg.Consumer.ProcessParentShardBeforeChildren)
+	log.Printf("📝 Resources: %s", resources)
+	log.Printf("📝 Max Records: %d", cfg.Consumer.MaxRecords)
+	log.Printf("📝 Max Concurrent Batches: %d", cfg.Consumer.MaxConcurrentBatches)
+	for _, choice := range tuned {
+		log.Printf("🎛️  Autotuned %s", choice)
+	}
 
-	// Enable detailed logging for KCL library
-	logrus.SetLevel(logrus.InfoLevel)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-		ForceColors:   true,
-	})
+	// Pick the first available stream when failover streams are configured
+	targets := streamTargets(cfg)
+	active := 0
+	if len(targets) > 1 {
+		active, err = selectStream(cfg, targets)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if active > 0 {
+			log.Printf("🔀 Failing over to stream %s (priority %d, application %s)",
+				targets[active], active, targets[active].ApplicationName)
+		}
+	}
+	stream := targets[active]
+
+	// Create the lease table with our settings before KCL creates it with its defaults
+	if cfg.Consumer.LeaseTable.Bootstrap {
+		if err := ensureLeaseTable(cfg, stream); err != nil {
+			log.Fatalf("❌ Failed to bootstrap lease table: %v", err)
+		}
+	}
 
 	// Configure KCL
 	kclConfig := config.NewKinesisClientLibConfig(
-		cfg.Consumer.ApplicationName,
-		cfg.Kinesis.StreamName,
-		cfg.AWS.Region,
+		stream.ApplicationName,
+		stream.StreamName,
+		stream.Region,
 		cfg.Consumer.WorkerID,
 	)
 
+	// Route KCL-internal logs (lease stealing, shard sync) through our logger
+	kclLogger := newStructuredLogger(cfg.Consumer.LogLevel, logger.Fields{
+		"app":    cfg.Consumer.ApplicationName,
+		"worker": cfg.Consumer.WorkerID,
+	})
+	kclConfig.WithLogger(kclLogger)
+
 	// Set LocalStack endpoints
 	kclConfig.KinesisEndpoint = cfg.AWS.Endpoint
 	kclConfig.DynamoDBEndpoint = cfg.AWS.Endpoint
@@ -258,6 +542,29 @@ func main() {
 		log.Printf("🎯 MaxLeasesForWorker set to: %d", cfg.Consumer.MaxLeasesForWorker)
 	}
 
+	// Follow the fleet's max leases per worker in the lease manager's coordinator
+	// row; the static value is used when the counts cannot be taken
+	stopLeases := make(chan struct{})
+	defer close(stopLeases)
+	var maxLeasesChanges <-chan int
+	if dm := cfg.Consumer.DynamicMaxLeases; dm.Enabled {
+		coordinator, err := newCoordinator(cfg, stream)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up coordinator: %v", err)
+		}
+		maxLeases, err := coordinator.maxLeases(context.Background())
+		switch {
+		case err == nil:
+			kclConfig.MaxLeasesForWorker = maxLeases
+			log.Printf("🎯 MaxLeasesForWorker set from %s to: %d (refreshed every %s)", coordinator, maxLeases, dm.refreshInterval())
+		case cfg.Consumer.MaxLeasesForWorker > 0:
+			log.Printf("⚠️  %v, starting with max_leases_for_worker=%d", err, cfg.Consumer.MaxLeasesForWorker)
+		default:
+			log.Fatalf("❌ %v and max_leases_for_worker is not set", err)
+		}
+		maxLeasesChanges = coordinator.watch(kclConfig.MaxLeasesForWorker, dm.refreshInterval(), stopLeases)
+	}
+
 	// Set max leases to steal at one time (conservative approach)
 	if cfg.Consumer.MaxLeasesToStealAtOneTime > 0 {
 		kclConfig.MaxLeasesToStealAtOneTime = cfg.Consumer.MaxLeasesToStealAtOneTime
@@ -291,9 +598,222 @@ func main() {
 		log.Println("⚠️  Child shards will start processing immediately (if supported by library)")
 	}
 
+	// Publish event-time watermarks for downstream batch jobs
+	stopWatermarks := make(chan struct{})
+	defer close(stopWatermarks)
+	if wm := cfg.Consumer.Watermark; wm.Enabled {
+		table := wm.Table
+		if table == "" {
+			table = stream.ApplicationName + "_watermarks"
+		}
+		svc, err := leaseTableClient(cfg, stream.Region)
+		if err == nil {
+			err = ensureWatermarkTable(svc, table)
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to set up watermark table %s: %v", table, err)
+		}
+		interval := time.Duration(wm.PublishIntervalMillis) * time.Millisecond
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		watermarks = newWatermarkTracker()
+		go watermarks.run(svc, table, cfg.Consumer.WorkerID, interval, stopWatermarks)
+		registerMetrics(watermarks.writeMetrics)
+		log.Printf("💧 Publishing event-time watermarks to %s every %s", table, interval)
+	}
+
+	// Keep per-shard state for stateful handlers across lease moves and resharding
+	if err := cfg.Consumer.State.validate(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if cfg.Consumer.State.enabled() {
+		manager, err := newStateManager(cfg, stream)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up shard state: %v", err)
+		}
+		states = manager
+		registerMetrics(states.writeMetrics)
+		log.Printf("🗃️  Keeping shard state in %s", states.store)
+		if states.window > 0 {
+			log.Printf("🪟 Aggregating events per action in %s tumbling windows", states.window)
+		}
+	}
+
+	// Bound the batches processed at once across all shards
+	if n := cfg.Consumer.MaxConcurrentBatches; n > 0 {
+		slots = newBatchSlots(n)
+		registerMetrics(slots.writeMetrics)
+		log.Printf("🚦 Processing at most %d batches at once", n)
+	}
+
+	// Estimate redelivery caused by lease moves and failovers
+	if n := cfg.Consumer.DuplicateWindow; n > 0 {
+		duplicates = newDuplicateTracker(n)
+		registerMetrics(duplicates.writeMetrics)
+		log.Printf("🔁 Tracking duplicates across the last %d event IDs", n)
+	}
+
+	// Let operators pause intake per shard while keeping the leases
+	pauses, err := newPauseController(cfg.Consumer.Pause)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up pause: %v", err)
+	}
+	if pauses != nil {
+		registerMetrics(pauses.writeMetrics)
+	}
+
+	// Pause intake before held records approach the memory limit
+	gate, err := newMemoryGate(cfg.Consumer.Memory)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up memory backpressure: %v", err)
+	}
+	if gate != nil {
+		memory = gate
+		registerMetrics(memory.writeMetrics)
+		log.Printf("🧠 Pausing intake above %d in-flight record bytes (limit %d)", memory.budget, memory.limit)
+	}
+
+	// Mask sensitive content everywhere records leave the processor other than the sinks
+	fields, err := newFieldRedactor(cfg.Redaction)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up redaction: %v", err)
+	}
+	if fields != nil {
+		redactor = fields
+		log.Printf("🙈 Redacting %d fields and %d patterns in logs, DLQ and captures",
+			len(cfg.Redaction.Fields), len(cfg.Redaction.Patterns))
+	}
+
+	// Deliver records to the configured sinks, through the transform pipeline
+	transforms, err := newPipeline(cfg.Transforms)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up transforms: %v", err)
+	}
+	sink, err := newSinks(cfg, stream.Region)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up sinks: %v", err)
+	}
+	if sink != nil {
+		defer sink.Close()
+	}
+	validator, err := newRecordValidator(cfg.Validation)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up validation: %v", err)
+	}
+	dlq, err := newDLQ(cfg, stream.Region)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up DLQ: %v", err)
+	}
+	if validator != nil {
+		if dlq == nil {
+			log.Fatalf("❌ validation needs a dlq for rejected records")
+		}
+		registerMetrics(validator.writeMetrics)
+	}
+	if dlq != nil {
+		defer dlq.Close()
+	}
+
+	// Keep a redacted sample of raw records for debugging
+	capture, err = newPayloadCapture(cfg, stream.Region)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up capture: %v", err)
+	}
+	if capture != nil {
+		defer capture.close()
+		registerMetrics(capture.writeMetrics)
+	}
+
+	// Serve the metrics registered above
+	registerMetrics(latencies.writeMetrics)
+	if err := cfg.MetricsShardLabels.validate(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	shardLabels = cfg.MetricsShardLabels
+	metricsAddr := cfg.MetricsAddr
+	if metricsAddr == "" {
+		metricsAddr = cfg.Consumer.Watermark.MetricsAddr
+	}
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr, cfg.Consumer.Readiness)
+	} else if pauses != nil {
+		log.Fatalf("❌ consumer.pause needs metrics_addr to serve /pause and /resume")
+	}
+	if cfg.MetricsEMF.Enabled {
+		interval := time.Duration(cfg.MetricsEMF.FlushIntervalMillis) * time.Millisecond
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		emf := newEMFWriter(cfg.MetricsEMF, stream.ApplicationName, cfg.Consumer.WorkerID)
+		stopEMF := make(chan struct{})
+		defer close(stopEMF)
+		go emf.run(interval, stopEMF)
+		log.Printf("📈 Writing metrics to stdout in CloudWatch EMF every %s (namespace %s)", interval, emf.namespace)
+	}
+	if cfg.MetricsStatsD.Addr != "" {
+		interval := time.Duration(cfg.MetricsStatsD.FlushIntervalMillis) * time.Millisecond
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		statsd, err := newStatsDWriter(cfg.MetricsStatsD, stream.ApplicationName, cfg.Consumer.WorkerID)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		stopStatsD := make(chan struct{})
+		defer close(stopStatsD)
+		go statsd.run(interval, stopStatsD)
+		log.Printf("📈 Sending metrics to StatsD at %s every %s (tags: %t)", cfg.MetricsStatsD.Addr, interval, statsd.tagged)
+	}
+
+	// Stop after a fixed duration and report throughput, for comparing configurations
+	if err := cfg.Consumer.Benchmark.validate(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	var benchmarkDone <-chan time.Time
+	if b := cfg.Consumer.Benchmark; b.enabled() {
+		bench = newBenchmarkRecorder(b)
+		duration := time.Duration(b.DurationMillis) * time.Millisecond
+		benchmarkDone = time.After(duration)
+		log.Printf("⏱️  Benchmarking for %s after a %s warmup", duration, b.warmup())
+	}
+
 	// Create worker with enhanced record processor
-	recordProcessorFactory := &EnhancedRecordProcessorFactory{}
-	kclWorker := worker.NewWorker(recordProcessorFactory, kclConfig)
+	recordProcessorFactory := &EnhancedRecordProcessorFactory{
+		sink:       sink,
+		transforms: transforms,
+		validator:  validator,
+		dlq:        dlq,
+	}
+
+	// Tune batch size and idle time, limit reads and pause intake, per shard through
+	// the Kinesis client KCL uses
+	if cfg.Consumer.Adaptive.Enabled {
+		adaptive = newAdaptiveController(cfg.Consumer.Adaptive, kclConfig.MaxRecords, kclConfig.IdleTimeBetweenReadsInMillis)
+		kclConfig.IdleTimeBetweenReadsInMillis = adaptive.cfg.MinIdleMillis
+		registerMetrics(adaptive.writeMetrics)
+		log.Printf("🎚️  Adapting max records (%d-%d) and idle time (%d-%dms) per shard",
+			adaptive.cfg.MinRecords, adaptive.cfg.MaxRecords, adaptive.cfg.MinIdleMillis, adaptive.cfg.MaxIdleMillis)
+	}
+	limiter := newReadLimiter(cfg.Consumer.ReadLimit)
+	if limiter != nil {
+		registerMetrics(limiter.writeMetrics)
+		log.Printf("🚧 Limiting reads to %.1f/s and %.0f bytes/s per shard", limiter.reads, limiter.bytes)
+	}
+	if adaptive != nil || limiter != nil || pauses != nil {
+		readers, err = newKCLKinesis(cfg, stream.Region, adaptive, limiter, pauses)
+		if err != nil {
+			log.Fatalf("❌ Failed to create Kinesis client: %v", err)
+		}
+	}
+	newKCLWorker := func() *worker.Worker {
+		w := worker.NewWorker(recordProcessorFactory, kclConfig)
+		if readers != nil {
+			w.WithKinesis(readers)
+		}
+		return w
+	}
+	kclWorker := newKCLWorker()
 
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -305,19 +825,106 @@ func main() {
 	log.Println("=" + "=")
 
 	errChan := make(chan error, 1)
-	go func() {
-		if err := kclWorker.Start(); err != nil {
-			errChan <- err
+	// startWorker starts w in the background; the returned channel is closed once
+	// Start returned, after which Shutdown stops it
+	startWorker := func(w *worker.Worker) <-chan struct{} {
+		started := make(chan struct{})
+		go func() {
+			defer close(started)
+			if err := w.Start(); err != nil {
+				errChan <- err
+				return
+			}
+			lags.started.Store(true)
+		}()
+		return started
+	}
+	workerStarted := startWorker(kclWorker)
+
+	// Exit when the active stream stays unavailable, so the restarted consumer
+	// selects the next stream in the failover list
+	failoverChan := make(chan error, 1)
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	if len(targets) > 1 {
+		interval := time.Duration(cfg.Kinesis.FailoverCheckIntervalMillis) * time.Millisecond
+		if interval <= 0 {
+			interval = 30 * time.Second
 		}
-	}()
+		threshold := cfg.Kinesis.FailoverAfterChecks
+		if threshold <= 0 {
+			threshold = 3
+		}
+		go func() {
+			if err := watchStream(cfg, stream, interval, threshold, stopWatch); err != nil {
+				failoverChan <- err
+			}
+		}()
+	}
 
-	// Wait for either shutdown signal or error
-	select {
-	case <-sigChan:
-		log.Println("🛑 Received shutdown signal...")
-		kclWorker.Shutdown()
-	case err := <-errChan:
-		log.Fatalf("❌ Worker failed: %v", err)
+	// Wait for either shutdown signal or error. KCL reads max leases per worker
+	// unsynchronized and never sheds leases above it, so a new value restarts the
+	// worker: the old one releases its leases and the new one takes up to the new value.
+	restartCooldown := cfg.Consumer.DynamicMaxLeases.restartCooldown()
+	lastRestart := time.Now()
+	var restartWorker <-chan time.Time
+	pendingMaxLeases := 0
+	for {
+		select {
+		case maxLeases := <-maxLeasesChanges:
+			pendingMaxLeases = maxLeases
+			if restartWorker == nil {
+				restartWorker = time.After(time.Until(lastRestart.Add(restartCooldown)))
+			}
+			continue
+		case <-restartWorker:
+			restartWorker = nil
+			if pendingMaxLeases == kclConfig.MaxLeasesForWorker {
+				continue
+			}
+			log.Printf("🔁 Restarting the KCL worker for MaxLeasesForWorker %d -> %d",
+				kclConfig.MaxLeasesForWorker, pendingMaxLeases)
+			<-workerStarted
+			lags.started.Store(false)
+			kclWorker.Shutdown()
+			kclConfig.MaxLeasesForWorker = pendingMaxLeases
+			kclWorker = newKCLWorker()
+			workerStarted = startWorker(kclWorker)
+			lastRestart = time.Now()
+			continue
+		case <-sigChan:
+			log.Println("🛑 Received shutdown signal...")
+			lags.started.Store(false)
+			kclWorker.Shutdown()
+			writeShutdownReport(cfg, stream, "signal")
+			writeBenchmarkReport(cfg, stream, false, "interrupted")
+			if cfg.Consumer.LeaseTable.DeleteOnShutdown {
+				if err := deleteLeaseTable(cfg, stream); err != nil {
+					log.Printf("⚠️  %v", err)
+				}
+			}
+		case <-benchmarkDone:
+			log.Println("⏱️  Benchmark duration reached...")
+			lags.started.Store(false)
+			kclWorker.Shutdown()
+			writeShutdownReport(cfg, stream, "benchmark finished")
+			writeBenchmarkReport(cfg, stream, true, "finished")
+			if cfg.Consumer.LeaseTable.DeleteOnShutdown {
+				if err := deleteLeaseTable(cfg, stream); err != nil {
+					log.Printf("⚠️  %v", err)
+				}
+			}
+		case err := <-errChan:
+			writeShutdownReport(cfg, stream, "worker failed: "+err.Error())
+			writeBenchmarkReport(cfg, stream, false, "worker failed: "+err.Error())
+			log.Fatalf("❌ Worker failed: %v", err)
+		case err := <-failoverChan:
+			kclWorker.Shutdown()
+			writeShutdownReport(cfg, stream, "failover: "+err.Error())
+			writeBenchmarkReport(cfg, stream, false, "failover: "+err.Error())
+			log.Fatalf("🔀 %v, exiting so the restarted consumer fails over", err)
+		}
+		break
 	}
 
 	log.Println("=" + "=")
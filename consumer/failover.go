@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// StreamTarget is one stream of a multi-region setup
+type StreamTarget struct {
+	Region     string `yaml:"region"`
+	StreamName string `yaml:"stream_name"`
+	// ApplicationName is the KCL application (and lease table) used for this stream.
+	// Shard IDs repeat across streams, so every stream needs its own lease table;
+	// defaults to "<application_name>-<region>".
+	ApplicationName string `yaml:"application_name"`
+}
+
+func (t StreamTarget) String() string {
+	return t.Region + ":" + t.StreamName
+}
+
+// streamTargets returns the configured primary stream followed by the failover
+// streams, in priority order
+func streamTargets(cfg *Config) []StreamTarget {
+	targets := []StreamTarget{{
+		Region:          cfg.AWS.Region,
+		StreamName:      cfg.Kinesis.StreamName,
+		ApplicationName: cfg.Consumer.ApplicationName,
+	}}
+	for _, target := range cfg.Kinesis.Failover {
+		if target.ApplicationName == "" {
+			target.ApplicationName = cfg.Consumer.ApplicationName + "-" + target.Region
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// selectStream returns the index of the first available stream in targets
+func selectStream(cfg *Config, targets []StreamTarget) (int, error) {
+	var problems []string
+	for i, target := range targets {
+		if err := streamAvailable(cfg, target); err != nil {
+			log.Printf("⚠️  Stream %s unavailable: %v", target, err)
+			problems = append(problems, fmt.Sprintf("%s: %v", target, err))
+			continue
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("no stream available: %s", strings.Join(problems, "; "))
+}
+
+// streamAvailable checks that the stream exists and is ACTIVE or UPDATING
+func streamAvailable(cfg *Config, target StreamTarget) error {
+	sess, err := session.NewSession(awsConfig(cfg, target.Region).WithMaxRetries(1))
+	if err != nil {
+		return err
+	}
+
+	summary, err := kinesis.New(sess).DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(target.StreamName),
+	})
+	if err != nil {
+		return err
+	}
+	status := aws.StringValue(summary.StreamDescriptionSummary.StreamStatus)
+	if status != kinesis.StreamStatusActive && status != kinesis.StreamStatusUpdating {
+		return fmt.Errorf("stream status %s", status)
+	}
+	return nil
+}
+
+// awsConfig returns the SDK config for region with the configured endpoint and
+// credentials
+func awsConfig(cfg *Config, region string) *aws.Config {
+	awsCfg := aws.NewConfig().WithRegion(region)
+	if cfg.AWS.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.AWS.Endpoint)
+	}
+	if cfg.AWS.AccessKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(cfg.AWS.AccessKey, cfg.AWS.SecretKey, ""))
+	}
+	return awsCfg
+}
+
+// watchStream checks the active stream every interval and returns once it has been
+// unavailable for threshold consecutive checks, or stop is closed
+func watchStream(cfg *Config, target StreamTarget, interval time.Duration, threshold int, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+
+		err := streamAvailable(cfg, target)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		log.Printf("⚠️  Active stream %s unavailable (%d/%d): %v", target, failures, threshold, err)
+		if failures >= threshold {
+			return fmt.Errorf("stream %s unavailable for %d checks: %w", target, failures, err)
+		}
+	}
+}
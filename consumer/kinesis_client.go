@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// KinesisAPIForRecords defines the Kinesis operations a polling shard consumer reads with
+type KinesisAPIForRecords interface {
+	GetShardIterator(*kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
+	GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+}
+
+// KinesisAPIForFanOut defines the Kinesis operation an enhanced fan-out shard consumer
+// reads with
+type KinesisAPIForFanOut interface {
+	SubscribeToShard(*kinesis.SubscribeToShardInput) (*kinesis.SubscribeToShardOutput, error)
+}
+
+// kclKinesis is the Kinesis client handed to KCL when a feature acts on each shard's
+// GetRecords calls. Shard iterators are opaque, so it follows each shard from
+// GetShardIterator through every NextShardIterator to know which shard a read is for.
+//
+// Reads go through records and fanOut, so the data path can run against fakes or
+// another transport; the embedded client serves the rest of what KCL calls (listing
+// shards, registering fan-out consumers).
+type kclKinesis struct {
+	kinesisiface.KinesisAPI
+	records  KinesisAPIForRecords
+	fanOut   KinesisAPIForFanOut
+	adaptive *adaptiveController
+	limiter  *readLimiter
+	pauses   *pauseController
+
+	mu        sync.Mutex
+	iterators map[string]string // shard iterator -> shard ID
+
+	// Where each shard's reads are, to replace an iterator that expired while paused
+	origins map[string]kinesis.GetShardIteratorInput
+	lastSeq map[string]string
+	lastLag map[string]int64
+	resumed map[string]bool // paused since the current iterator was issued
+}
+
+// readers is the Kinesis client KCL reads through; nil unless adaptive reads, read
+// limits or pauses are enabled
+var readers *kclKinesis
+
+func newKCLKinesis(cfg *Config, region string, adaptive *adaptiveController, limiter *readLimiter, pauses *pauseController) (*kclKinesis, error) {
+	sess, err := session.NewSession(awsConfig(cfg, region))
+	if err != nil {
+		return nil, err
+	}
+	client := kinesis.New(sess)
+	return wrapKinesis(client, client, client, adaptive, limiter, pauses), nil
+}
+
+// wrapKinesis builds a kclKinesis reading through records and fanOut; api may be nil
+// when only the data path is exercised
+func wrapKinesis(api kinesisiface.KinesisAPI, records KinesisAPIForRecords, fanOut KinesisAPIForFanOut,
+	adaptive *adaptiveController, limiter *readLimiter, pauses *pauseController) *kclKinesis {
+	return &kclKinesis{
+		KinesisAPI: api,
+		records:    records,
+		fanOut:     fanOut,
+		adaptive:   adaptive,
+		limiter:    limiter,
+		pauses:     pauses,
+		iterators:  make(map[string]string),
+		origins:    make(map[string]kinesis.GetShardIteratorInput),
+		lastSeq:    make(map[string]string),
+		lastLag:    make(map[string]int64),
+		resumed:    make(map[string]bool),
+	}
+}
+
+func (k *kclKinesis) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	out, err := k.records.GetShardIterator(in)
+	if err == nil && out.ShardIterator != nil {
+		shardID := aws.StringValue(in.ShardId)
+		k.mu.Lock()
+		k.iterators[*out.ShardIterator] = shardID
+		// A new shard consumer starts from its checkpoint
+		k.origins[shardID] = *in
+		delete(k.lastSeq, shardID)
+		delete(k.resumed, shardID)
+		k.mu.Unlock()
+	}
+	return out, err
+}
+
+func (k *kclKinesis) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	iterator := aws.StringValue(in.ShardIterator)
+	k.mu.Lock()
+	shardID, ok := k.iterators[iterator]
+	k.mu.Unlock()
+	if !ok {
+		return k.records.GetRecords(in)
+	}
+
+	// A paused shard gets an empty read every pausePoll with the same iterator, so KCL
+	// keeps renewing its lease. The reported lag grows with the pause, so the shard
+	// counts as behind and its watermark stays put.
+	if since := k.pauses.pausedSince(shardID); !since.IsZero() {
+		time.Sleep(pausePoll)
+		k.mu.Lock()
+		k.resumed[shardID] = true
+		lag := k.lastLag[shardID] + time.Since(since).Milliseconds()
+		k.mu.Unlock()
+		return &kinesis.GetRecordsOutput{
+			Records:            []*kinesis.Record{},
+			NextShardIterator:  in.ShardIterator,
+			MillisBehindLatest: aws.Int64(lag),
+		}, nil
+	}
+
+	req := *in
+	k.mu.Lock()
+	resumed := k.resumed[shardID]
+	delete(k.resumed, shardID)
+	k.mu.Unlock()
+	if resumed {
+		// Iterators expire after 5 minutes
+		fresh, err := k.reposition(shardID)
+		if err != nil {
+			k.failed(iterator, err)
+			return nil, err
+		}
+		req.ShardIterator = fresh
+	}
+
+	if k.adaptive != nil {
+		limit, idle := k.adaptive.beforeRead(shardID)
+		if idle > 0 {
+			time.Sleep(idle)
+		}
+		req.Limit = aws.Int64(int64(limit))
+	}
+	k.limiter.wait(shardID)
+
+	out, err := k.records.GetRecords(&req)
+	if err != nil {
+		k.failed(iterator, err)
+		return out, err
+	}
+	k.limiter.observe(shardID, out.Records)
+	if k.adaptive != nil {
+		k.adaptive.observeRead(shardID, out)
+	}
+
+	k.mu.Lock()
+	delete(k.iterators, iterator)
+	if next := aws.StringValue(out.NextShardIterator); next != "" {
+		k.iterators[next] = shardID
+	}
+	if n := len(out.Records); n > 0 {
+		k.lastSeq[shardID] = aws.StringValue(out.Records[n-1].SequenceNumber)
+	}
+	k.lastLag[shardID] = aws.Int64Value(out.MillisBehindLatest)
+	k.mu.Unlock()
+	return out, err
+}
+
+// reposition returns a new iterator right after the last record read from the shard,
+// or where its shard consumer started when nothing was read yet
+func (k *kclKinesis) reposition(shardID string) (*string, error) {
+	k.mu.Lock()
+	in, seq := k.origins[shardID], k.lastSeq[shardID]
+	k.mu.Unlock()
+	if seq != "" {
+		in.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		in.StartingSequenceNumber = aws.String(seq)
+		in.Timestamp = nil
+	}
+	out, err := k.records.GetShardIterator(&in)
+	if err != nil {
+		return nil, err
+	}
+	return out.ShardIterator, nil
+}
+
+// forget drops what is tracked for a shard this worker no longer processes
+func (k *kclKinesis) forget(shardID string) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for iterator, id := range k.iterators {
+		if id == shardID {
+			delete(k.iterators, iterator)
+		}
+	}
+	delete(k.origins, shardID)
+	delete(k.lastSeq, shardID)
+	delete(k.lastLag, shardID)
+	delete(k.resumed, shardID)
+}
+
+// failed drops an iterator whose read failed with err. KCL retries a throttled read
+// with the same iterator; after any other error the shard consumer stops and the
+// iterator is never used again.
+func (k *kclKinesis) failed(iterator string, err error) {
+	if retriedRead(err) {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.iterators, iterator)
+}
+
+// retriedRead reports whether KCL retries a GetRecords call that failed with err
+func retriedRead(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException ||
+		aerr.Code() == kinesis.ErrCodeKMSThrottlingException
+}
+
+// SubscribeToShard passes enhanced fan-out reads through. Pauses, read limits and
+// adaptive reads act on polling only; pushed events are not throttled here.
+func (k *kclKinesis) SubscribeToShard(in *kinesis.SubscribeToShardInput) (*kinesis.SubscribeToShardOutput, error) {
+	return k.fanOut.SubscribeToShard(in)
+}
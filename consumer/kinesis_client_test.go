@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// fakeRecords serves GetShardIterator and GetRecords from memory. Every iterator it
+// hands out is new; a read returns one record and fails with the next queued error.
+type fakeRecords struct {
+	issued    int
+	seq       int
+	errs      []error
+	positions []kinesis.GetShardIteratorInput
+	reads     []string // iterators read with
+}
+
+func (f *fakeRecords) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	f.issued++
+	f.positions = append(f.positions, *in)
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("iterator-%d", f.issued))}, nil
+}
+
+func (f *fakeRecords) GetRecords(in *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	f.reads = append(f.reads, aws.StringValue(in.ShardIterator))
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	f.issued++
+	f.seq++
+	return &kinesis.GetRecordsOutput{
+		Records:            []*kinesis.Record{{SequenceNumber: aws.String(fmt.Sprint(f.seq))}},
+		NextShardIterator:  aws.String(fmt.Sprintf("iterator-%d", f.issued)),
+		MillisBehindLatest: aws.Int64(int64(1000 * f.seq)),
+	}, nil
+}
+
+func startShard(t *testing.T, k *kclKinesis, shardID string) string {
+	t.Helper()
+	out, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String("stream"),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(out.ShardIterator)
+}
+
+func read(t *testing.T, k *kclKinesis, iterator string) string {
+	t.Helper()
+	out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String(iterator)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(out.NextShardIterator)
+}
+
+func TestKCLKinesisFollowsIterators(t *testing.T) {
+	fake := &fakeRecords{}
+	k := wrapKinesis(nil, fake, nil, nil, nil, nil)
+
+	next := read(t, k, startShard(t, k, "shard-0"))
+	next = read(t, k, next)
+	if len(k.iterators) != 1 || k.iterators[next] != "shard-0" {
+		t.Fatalf("iterators %v, want only %s for shard-0", k.iterators, next)
+	}
+	if k.lastSeq["shard-0"] != "2" || k.lastLag["shard-0"] != 2000 {
+		t.Fatalf("last sequence %q and lag %d, want 2 and 2000", k.lastSeq["shard-0"], k.lastLag["shard-0"])
+	}
+
+	// An iterator handed out before the client was wrapped is read as is
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String("unknown")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.iterators["unknown"]; ok {
+		t.Fatal("unknown iterator tracked")
+	}
+}
+
+func TestKCLKinesisDropsFailedIterators(t *testing.T) {
+	throttled := awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	expired := awserr.New(kinesis.ErrCodeExpiredIteratorException, "expired", nil)
+	fake := &fakeRecords{errs: []error{throttled, expired, errors.New("connection reset")}}
+	k := wrapKinesis(nil, fake, nil, nil, nil, nil)
+
+	// KCL retries a throttled read with the same iterator, which must stay tracked
+	iterator := startShard(t, k, "shard-0")
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String(iterator)}); err != throttled {
+		t.Fatalf("got %v, want %v", err, throttled)
+	}
+	if k.iterators[iterator] != "shard-0" {
+		t.Fatal("throttled iterator dropped")
+	}
+
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String(iterator)}); err != expired {
+		t.Fatalf("got %v, want %v", err, expired)
+	}
+	if len(k.iterators) != 0 {
+		t.Fatalf("iterators %v kept after a failed read", k.iterators)
+	}
+
+	iterator = startShard(t, k, "shard-1")
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String(iterator)}); err == nil {
+		t.Fatal("read did not fail")
+	}
+	if len(k.iterators) != 0 {
+		t.Fatalf("iterators %v kept after a failed read", k.iterators)
+	}
+}
+
+func TestKCLKinesisForgetsReleasedShards(t *testing.T) {
+	fake := &fakeRecords{}
+	k := wrapKinesis(nil, fake, nil, nil, nil, nil)
+
+	read(t, k, startShard(t, k, "shard-0"))
+	kept := read(t, k, startShard(t, k, "shard-1"))
+	k.mu.Lock()
+	k.resumed["shard-0"] = true
+	k.mu.Unlock()
+
+	k.forget("shard-0")
+	if len(k.iterators) != 1 || len(k.origins) != 1 || len(k.lastSeq) != 1 || len(k.lastLag) != 1 || len(k.resumed) != 0 {
+		t.Fatalf("shard-0 still tracked: iterators %v, origins %v, last sequences %v, lags %v, resumed %v",
+			k.iterators, k.origins, k.lastSeq, k.lastLag, k.resumed)
+	}
+	if k.iterators[kept] != "shard-1" || k.lastSeq["shard-1"] == "" {
+		t.Fatal("shard-1 forgotten with shard-0")
+	}
+
+	// Without a client there is nothing to forget
+	var none *kclKinesis
+	none.forget("shard-0")
+}
+
+func TestKCLKinesisRepositionsAfterPause(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for a pause poll")
+	}
+	fake := &fakeRecords{}
+	pauses := &pauseController{shards: make(map[string]time.Time)}
+	k := wrapKinesis(nil, fake, nil, nil, nil, pauses)
+
+	next := read(t, k, startShard(t, k, "shard-0"))
+	pauses.pause([]string{"shard-0"})
+	if again := read(t, k, next); again != next {
+		t.Fatalf("paused read moved the iterator to %s", again)
+	}
+	pauses.resume([]string{"shard-0"})
+
+	// The first read after the pause starts right after the last record, with a new
+	// iterator in case the paused one expired
+	read(t, k, next)
+	last := fake.positions[len(fake.positions)-1]
+	if len(fake.positions) != 2 || aws.StringValue(last.ShardIteratorType) != kinesis.ShardIteratorTypeAfterSequenceNumber ||
+		aws.StringValue(last.StartingSequenceNumber) != "1" {
+		t.Fatalf("repositioned at %+v", last)
+	}
+	if fake.reads[len(fake.reads)-1] == next {
+		t.Fatal("read with the iterator held through the pause")
+	}
+}
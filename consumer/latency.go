@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the end-to-end latency histograms
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+
+// maxLatencyActions caps the action label values; later actions are counted as "other"
+const maxLatencyActions = 50
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last entry is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, label, value string) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", name, label, value, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, value, h.count)
+	fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, value, h.sum)
+	fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, value, h.count)
+}
+
+// latencyTracker measures producer-to-processing latency: from the event's timestamp
+// field, or the record's approximate arrival time when the event has none
+type latencyTracker struct {
+	mu       sync.Mutex
+	byShard  map[string]*histogram
+	byAction map[string]*histogram
+}
+
+var latencies = &latencyTracker{byShard: make(map[string]*histogram), byAction: make(map[string]*histogram)}
+
+func (l *latencyTracker) observe(shardID, action string, eventTime, arrival time.Time) {
+	latency, ok := endToEndLatency(eventTime, arrival)
+	if !ok {
+		return
+	}
+	seconds := latency.Seconds()
+	if action == "" {
+		action = "unknown"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	shard := l.byShard[shardID]
+	if shard == nil {
+		shard = &histogram{}
+		l.byShard[shardID] = shard
+	}
+	shard.observe(seconds)
+	if _, ok := l.byAction[action]; !ok && len(l.byAction) >= maxLatencyActions {
+		action = "other"
+	}
+	byAction := l.byAction[action]
+	if byAction == nil {
+		byAction = &histogram{}
+		l.byAction[action] = byAction
+	}
+	byAction.observe(seconds)
+}
+
+// endToEndLatency is the time since the event's timestamp, or the record's arrival
+// when the event has none; false when neither is known
+func endToEndLatency(eventTime, arrival time.Time) (time.Duration, bool) {
+	from := eventTime
+	if from.IsZero() {
+		from = arrival
+	}
+	if from.IsZero() {
+		return 0, false
+	}
+	// Producer clocks ahead of ours would make latency negative
+	return max(time.Since(from), 0), true
+}
+
+// writeMetrics writes both histograms in Prometheus text format
+func (l *latencyTracker) writeMetrics(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_end_to_end_latency_seconds Event timestamp (or arrival time) to processing, per shard")
+	fmt.Fprintln(w, "# TYPE kcl_end_to_end_latency_seconds histogram")
+	for _, shardID := range sortedKeys(l.byShard) {
+		l.byShard[shardID].write(w, "kcl_end_to_end_latency_seconds", "shard", shardID)
+	}
+	fmt.Fprintln(w, "# HELP kcl_action_end_to_end_latency_seconds Event timestamp (or arrival time) to processing, per action")
+	fmt.Fprintln(w, "# TYPE kcl_action_end_to_end_latency_seconds histogram")
+	for _, action := range sortedKeys(l.byAction) {
+		l.byAction[action].write(w, "kcl_action_end_to_end_latency_seconds", "action", action)
+	}
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// leaseKeyKey is the hash key of KCL lease tables
+const leaseKeyKey = "ShardID"
+
+// LeaseTableConfig describes the KCL lease (checkpoint) table. With bootstrap set the
+// consumer creates the table itself before the worker starts, instead of relying on
+// the library's defaults (provisioned 10/10, no tags, no TTL).
+type LeaseTableConfig struct {
+	Bootstrap bool `yaml:"bootstrap"`
+	// BillingMode is PAY_PER_REQUEST (default) or PROVISIONED
+	BillingMode   string            `yaml:"billing_mode"`
+	ReadCapacity  int64             `yaml:"read_capacity"`
+	WriteCapacity int64             `yaml:"write_capacity"`
+	Tags          map[string]string `yaml:"tags"`
+	// TTLAttribute enables DynamoDB TTL on this attribute
+	TTLAttribute string `yaml:"ttl_attribute"`
+	// DeleteOnShutdown drops the table after a graceful shutdown, for test teardown
+	DeleteOnShutdown bool `yaml:"delete_on_shutdown"`
+}
+
+func (c LeaseTableConfig) billingMode() string {
+	if c.BillingMode == "" {
+		return dynamodb.BillingModePayPerRequest
+	}
+	return c.BillingMode
+}
+
+func (c LeaseTableConfig) validate() error {
+	switch c.billingMode() {
+	case dynamodb.BillingModePayPerRequest:
+	case dynamodb.BillingModeProvisioned:
+		if c.ReadCapacity <= 0 || c.WriteCapacity <= 0 {
+			return fmt.Errorf("lease_table: PROVISIONED needs read_capacity and write_capacity")
+		}
+	default:
+		return fmt.Errorf("lease_table: billing_mode %q must be PAY_PER_REQUEST or PROVISIONED", c.BillingMode)
+	}
+	return nil
+}
+
+func leaseTableClient(cfg *Config, region string) (*dynamodb.DynamoDB, error) {
+	sess, err := session.NewSession(awsConfig(cfg, region))
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.New(sess), nil
+}
+
+// ensureLeaseTable creates the lease table of target when it does not exist and
+// waits until it is ACTIVE. An existing table gets missing tags and TTL added; its
+// billing mode is left alone, since switching is rate limited by DynamoDB.
+func ensureLeaseTable(cfg *Config, target StreamTarget) error {
+	tableCfg := cfg.Consumer.LeaseTable
+	if err := tableCfg.validate(); err != nil {
+		return err
+	}
+	svc, err := leaseTableClient(cfg, target.Region)
+	if err != nil {
+		return err
+	}
+	table := target.ApplicationName
+
+	desc, err := svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+			return fmt.Errorf("failed to describe lease table %s: %w", table, err)
+		}
+		if err := createLeaseTable(svc, table, tableCfg); err != nil {
+			return err
+		}
+		log.Printf("🗄️  Created lease table %s (%s)", table, tableCfg.billingMode())
+	} else {
+		actual := dynamodb.BillingModeProvisioned
+		if desc.Table.BillingModeSummary != nil {
+			actual = aws.StringValue(desc.Table.BillingModeSummary.BillingMode)
+		}
+		if actual != tableCfg.billingMode() {
+			log.Printf("⚠️  Lease table %s uses billing mode %s, configured %s; not changing it",
+				table, actual, tableCfg.billingMode())
+		}
+		if err := tagLeaseTable(svc, aws.StringValue(desc.Table.TableArn), tableCfg.Tags); err != nil {
+			return err
+		}
+	}
+
+	return enableLeaseTableTTL(svc, table, tableCfg.TTLAttribute)
+}
+
+func createLeaseTable(svc *dynamodb.DynamoDB, table string, tableCfg LeaseTableConfig) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(leaseKeyKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(leaseKeyKey), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(tableCfg.billingMode()),
+		Tags:        dynamoTags(tableCfg.Tags),
+	}
+	if tableCfg.billingMode() == dynamodb.BillingModeProvisioned {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(tableCfg.ReadCapacity),
+			WriteCapacityUnits: aws.Int64(tableCfg.WriteCapacity),
+		}
+	}
+
+	if _, err := svc.CreateTable(input); err != nil {
+		// Another pod created it first
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceInUseException {
+			return fmt.Errorf("failed to create lease table %s: %w", table, err)
+		}
+	}
+	if err := svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+		return fmt.Errorf("lease table %s did not become active: %w", table, err)
+	}
+	return nil
+}
+
+// tagLeaseTable adds the configured tags to an existing table
+func tagLeaseTable(svc *dynamodb.DynamoDB, tableARN string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := svc.TagResource(&dynamodb.TagResourceInput{
+		ResourceArn: aws.String(tableARN),
+		Tags:        dynamoTags(tags),
+	}); err != nil {
+		return fmt.Errorf("failed to tag lease table %s: %w", tableARN, err)
+	}
+	return nil
+}
+
+// enableLeaseTableTTL turns on TTL for attribute unless it already is
+func enableLeaseTableTTL(svc *dynamodb.DynamoDB, table, attribute string) error {
+	if attribute == "" {
+		return nil
+	}
+	ttl, err := svc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		return fmt.Errorf("failed to describe TTL of lease table %s: %w", table, err)
+	}
+	if desc := ttl.TimeToLiveDescription; desc != nil &&
+		aws.StringValue(desc.AttributeName) == attribute &&
+		aws.StringValue(desc.TimeToLiveStatus) != dynamodb.TimeToLiveStatusDisabled &&
+		aws.StringValue(desc.TimeToLiveStatus) != dynamodb.TimeToLiveStatusDisabling {
+		return nil
+	}
+
+	if _, err := svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attribute),
+			Enabled:       aws.Bool(true),
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to enable TTL on lease table %s: %w", table, err)
+	}
+	log.Printf("🗄️  Enabled TTL on lease table %s (attribute %s)", table, attribute)
+	return nil
+}
+
+// deleteLeaseTable drops the lease table of target and waits until it is gone
+func deleteLeaseTable(cfg *Config, target StreamTarget) error {
+	svc, err := leaseTableClient(cfg, target.Region)
+	if err != nil {
+		return err
+	}
+	table := target.ApplicationName
+	if _, err := svc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)}); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+			return nil
+		}
+		return fmt.Errorf("failed to delete lease table %s: %w", table, err)
+	}
+	if err := svc.WaitUntilTableNotExists(&dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+		return fmt.Errorf("lease table %s was not deleted: %w", table, err)
+	}
+	log.Printf("🗑️  Deleted lease table %s", table)
+	return nil
+}
+
+// dynamoTags converts tags to the SDK form, in a stable order
+func dynamoTags(tags map[string]string) []*dynamodb.Tag {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out []*dynamodb.Tag
+	for _, key := range keys {
+		out = append(out, &dynamodb.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return out
+}
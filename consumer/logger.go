@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/vmware/vmware-go-kcl/logger"
+)
+
+// logLevels orders the level names understood by the KCL logger configuration
+var logLevels = map[string]int{
+	logger.Debug: 0,
+	logger.Info:  1,
+	logger.Warn:  2,
+	logger.Error: 3,
+	logger.Fatal: 4,
+}
+
+// structuredLogger writes through the standard log package so KCL-internal messages
+// (lease stealing, shard sync, checkpointing) share the consumer's output stream and
+// carry the same worker/app fields. It implements vmware-go-kcl's logger.Logger.
+type structuredLogger struct {
+	level  int
+	fields logger.Fields
+}
+
+// newStructuredLogger creates a logger that drops messages below the given level
+// ("debug", "info", "warn", "error"). Unknown levels fall back to "info".
+func newStructuredLogger(level string, fields logger.Fields) *structuredLogger {
+	lvl, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		lvl = logLevels[logger.Info]
+	}
+
+	copied := make(logger.Fields, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+
+	return &structuredLogger{level: lvl, fields: copied}
+}
+
+// Debugf logs a message at debug level
+func (l *structuredLogger) Debugf(format string, args ...interface{}) {
+	l.output(logger.Debug, format, args...)
+}
+
+// Infof logs a message at info level
+func (l *structuredLogger) Infof(format string, args ...interface{}) {
+	l.output(logger.Info, format, args...)
+}
+
+// Warnf logs a message at warn level
+func (l *structuredLogger) Warnf(format string, args ...interface{}) {
+	l.output(logger.Warn, format, args...)
+}
+
+// Errorf logs a message at error level
+func (l *structuredLogger) Errorf(format string, args ...interface{}) {
+	l.output(logger.Error, format, args...)
+}
+
+// Fatalf logs a message and exits the process
+func (l *structuredLogger) Fatalf(format string, args ...interface{}) {
+	log.Fatal(l.format(logger.Fatal, format, args...))
+}
+
+// Panicf logs a message and panics
+func (l *structuredLogger) Panicf(format string, args ...interface{}) {
+	log.Panic(l.format("panic", format, args...))
+}
+
+// WithFields returns a child logger carrying the parent's fields plus keyValues
+func (l *structuredLogger) WithFields(keyValues logger.Fields) logger.Logger {
+	merged := make(logger.Fields, len(l.fields)+len(keyValues))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range keyValues {
+		merged[k] = v
+	}
+
+	return &structuredLogger{level: l.level, fields: merged}
+}
+
+func (l *structuredLogger) output(level, format string, args ...interface{}) {
+	if logLevels[level] < l.level {
+		return
+	}
+	log.Print(l.format(level, format, args...))
+}
+
+// format renders "[LEVEL] message key=value ..." with fields in a stable order
+func (l *structuredLogger) format(level, format string, args ...interface{}) string {
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(strings.ToUpper(level))
+	b.WriteString("] ")
+	b.WriteString(fmt.Sprintf(format, args...))
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, l.fields[k])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	awsv1 "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	dynamodbv1 "github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"expr_mohan/leasemanager"
+)
+
+// DynamicMaxLeasesConfig follows the fleet's max leases per worker instead of the
+// static max_leases_for_worker. The value lives in the coordinator row of
+// <application_name>_meta, shared with the lease manager of the k8s test consumer
+// (k8s/test/test-consumer): both compute it from the open shards and the live workers
+// with the leasemanager package and write it with the same conditional puts, so a
+// fleet of either or both settles on one value.
+type DynamicMaxLeasesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ConsumerGroup is the lease manager's KDS_CONSUMER_GROUP (default "default")
+	ConsumerGroup string `yaml:"consumer_group"`
+	// RefreshIntervalMillis is how often the counts are taken and the coordinator row
+	// reconciled (default 60s)
+	RefreshIntervalMillis int `yaml:"refresh_interval_millis"`
+	// RestartCooldownMillis is the least time between two worker restarts for a new
+	// value (default 5 minutes)
+	RestartCooldownMillis int `yaml:"restart_cooldown_millis"`
+}
+
+func (c DynamicMaxLeasesConfig) refreshInterval() time.Duration {
+	if c.RefreshIntervalMillis <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.RefreshIntervalMillis) * time.Millisecond
+}
+
+func (c DynamicMaxLeasesConfig) restartCooldown() time.Duration {
+	if c.RestartCooldownMillis <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.RestartCooldownMillis) * time.Millisecond
+}
+
+// workerTimeout is how long a worker row counts as live after its last update. Rows
+// are written every refresh interval, so a worker missing three is gone.
+func (c DynamicMaxLeasesConfig) workerTimeout() time.Duration {
+	return 3 * c.refreshInterval()
+}
+
+// coordinator keeps this worker's row in the lease manager's metadata table and
+// reconciles the coordinator row from the stream's open shards and the live workers
+type coordinator struct {
+	table         leasemanager.Table
+	kinesis       leasemanager.ListShardsAPI
+	workerID      string
+	workerTimeout time.Duration
+}
+
+func newCoordinator(cfg *Config, stream StreamTarget) (*coordinator, error) {
+	if group := cfg.Consumer.DynamicMaxLeases.ConsumerGroup; group != "" && !leasemanager.ValidConsumerGroup(group) {
+		return nil, fmt.Errorf("invalid dynamic_max_leases.consumer_group %q", group)
+	}
+	keys := leasemanager.Keys{
+		App:    stream.ApplicationName,
+		Stream: stream.StreamName,
+		Region: stream.Region,
+		Group:  cfg.Consumer.DynamicMaxLeases.ConsumerGroup,
+	}
+
+	// Only enhanced consumers may be deployed, so nothing else creates the table
+	svc, err := leaseTableClient(cfg, stream.Region)
+	if err == nil {
+		err = ensureMetadataTable(svc, keys.Table())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up metadata table %s: %w", keys.Table(), err)
+	}
+
+	awsCfg, err := awsConfigV2(cfg, stream.Region)
+	if err != nil {
+		return nil, err
+	}
+	var endpoint *string
+	if cfg.AWS.Endpoint != "" {
+		endpoint = aws.String(cfg.AWS.Endpoint)
+	}
+	return &coordinator{
+		table: leasemanager.Table{
+			DB:   dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) { o.BaseEndpoint = endpoint }),
+			Name: keys.Table(),
+			Keys: keys,
+		},
+		kinesis:       kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) { o.BaseEndpoint = endpoint }),
+		workerID:      cfg.Consumer.WorkerID,
+		workerTimeout: cfg.Consumer.DynamicMaxLeases.workerTimeout(),
+	}, nil
+}
+
+// awsConfigV2 is awsConfig for the leasemanager package, which uses the v2 SDK
+func awsConfigV2(cfg *Config, region string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if cfg.AWS.AccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AWS.AccessKey, cfg.AWS.SecretKey, "")))
+	}
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+// ensureMetadataTable creates the lease manager's metadata table on demand
+func ensureMetadataTable(svc *dynamodbv1.DynamoDB, table string) error {
+	_, err := svc.DescribeTable(&dynamodbv1.DescribeTableInput{TableName: awsv1.String(table)})
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != dynamodbv1.ErrCodeResourceNotFoundException {
+		return err
+	}
+	if _, err := svc.CreateTable(&dynamodbv1.CreateTableInput{
+		TableName: awsv1.String(table),
+		AttributeDefinitions: []*dynamodbv1.AttributeDefinition{
+			{AttributeName: awsv1.String("worker_id"), AttributeType: awsv1.String(dynamodbv1.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodbv1.KeySchemaElement{
+			{AttributeName: awsv1.String("worker_id"), KeyType: awsv1.String(dynamodbv1.KeyTypeHash)},
+		},
+		BillingMode: awsv1.String(dynamodbv1.BillingModePayPerRequest),
+	}); err != nil {
+		// Another worker created it first
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodbv1.ErrCodeResourceInUseException {
+			return err
+		}
+	}
+	return svc.WaitUntilTableExists(&dynamodbv1.DescribeTableInput{TableName: awsv1.String(table)})
+}
+
+func (c *coordinator) String() string {
+	return c.table.Name + " " + c.table.Keys.Coordinator()
+}
+
+// maxLeases counts the open shards and the live workers, this one included, and
+// returns the coordinator value for them, creating or updating the row when its
+// counts are out of date. This worker's row is then refreshed, so the other workers
+// count it.
+func (c *coordinator) maxLeases(ctx context.Context) (int, error) {
+	shards, err := leasemanager.OpenShardCount(ctx, c.kinesis, c.table.Keys.Stream)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := c.table.Workers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	others := rows[:0]
+	for _, row := range rows {
+		if row.WorkerID != c.workerID {
+			others = append(others, row)
+		}
+	}
+	workers := leasemanager.LiveWorkers(others, time.Now(), c.workerTimeout) + 1
+
+	metadata, err := c.table.Reconcile(ctx, shards, workers, leasemanager.BuiltinMaxLeases)
+	if err != nil {
+		return 0, err
+	}
+	if metadata == nil {
+		return 0, fmt.Errorf("coordinator metadata in %s was deleted while it was written", c)
+	}
+	if !leasemanager.ValidMaxLeases(metadata.MaxLeasesPerWorker) {
+		return 0, fmt.Errorf("coordinator metadata has invalid max leases %d (allowed 1-%d)",
+			metadata.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
+	}
+
+	if err := c.table.PutWorker(ctx, leasemanager.Item(c.table.Keys.Worker(c.workerID), &leasemanager.Metadata{
+		MaxLeasesPerWorker: metadata.MaxLeasesPerWorker,
+		StreamName:         c.table.Keys.Stream,
+		AppName:            c.table.Keys.App,
+		ShardCount:         metadata.ShardCount,
+		WorkerCount:        metadata.WorkerCount,
+		LastUpdateTime:     time.Now(),
+	})); err != nil {
+		log.Printf("⚠️  Failed to save worker metadata, other workers may not count this one: %v", err)
+	}
+	return metadata.MaxLeasesPerWorker, nil
+}
+
+// watch reconciles the value every interval and sends it when it differs from the
+// last one sent, starting from current. A value the receiver has not taken yet is
+// replaced by the next.
+func (c *coordinator) watch(current int, interval time.Duration, stop <-chan struct{}) <-chan int {
+	changes := make(chan int, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			maxLeases, err := c.maxLeases(context.Background())
+			if err != nil {
+				log.Printf("⚠️  Failed to refresh max leases per worker: %v", err)
+				continue
+			}
+			if maxLeases == current {
+				continue
+			}
+			log.Printf("👑 Coordinator max leases per worker changed: %d -> %d", current, maxLeases)
+			current = maxLeases
+			select {
+			case <-changes:
+			default:
+			}
+			changes <- maxLeases
+		}
+	}()
+	return changes
+}
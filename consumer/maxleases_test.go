@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// fakeMetadata is the lease manager's metadata table in memory, evaluating the two
+// coordinator write conditions
+type fakeMetadata struct {
+	rows map[string]map[string]types.AttributeValue
+}
+
+func rowKey(item map[string]types.AttributeValue) string {
+	return item["worker_id"].(*types.AttributeValueMemberS).Value
+}
+
+func (f *fakeMetadata) GetItem(_ context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.rows[rowKey(in.Key)]}, nil
+}
+
+func (f *fakeMetadata) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	existing, exists := f.rows[rowKey(in.Item)]
+	failed := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	switch condition := aws.ToString(in.ConditionExpression); {
+	case condition == "attribute_not_exists(worker_id)" && exists:
+		return nil, failed
+	case strings.HasPrefix(condition, "shard_count"):
+		for attr, value := range map[string]string{"shard_count": ":expected_shard_count", "worker_count": ":expected_worker_count"} {
+			if !exists || existing[attr].(*types.AttributeValueMemberN).Value != in.ExpressionAttributeValues[value].(*types.AttributeValueMemberN).Value {
+				return nil, failed
+			}
+		}
+	}
+	f.rows[rowKey(in.Item)] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeMetadata) Scan(_ context.Context, in *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	prefix := in.ExpressionAttributeValues[":prefix"].(*types.AttributeValueMemberS).Value
+	out := &dynamodb.ScanOutput{}
+	for key, item := range f.rows {
+		if strings.HasPrefix(key, prefix) {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return out, nil
+}
+
+type fakeShardList int
+
+func (n fakeShardList) ListShards(context.Context, *kinesis.ListShardsInput, ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	shards := make([]kinesistypes.Shard, n)
+	for i := range shards {
+		shards[i].SequenceNumberRange = &kinesistypes.SequenceNumberRange{}
+	}
+	return &kinesis.ListShardsOutput{Shards: shards}, nil
+}
+
+// TestCoordinatorWithoutLeaseManager runs a fleet of enhanced consumers only: the
+// first one creates the coordinator row, and each counts the workers whose rows are
+// fresh
+func TestCoordinatorWithoutLeaseManager(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeMetadata{rows: make(map[string]map[string]types.AttributeValue)}
+	keys := leasemanager.Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	worker := func(id string) *coordinator {
+		return &coordinator{
+			table:         leasemanager.Table{DB: db, Name: keys.Table(), Keys: keys},
+			kinesis:       fakeShardList(20),
+			workerID:      id,
+			workerTimeout: 3 * time.Minute,
+		}
+	}
+
+	if got, err := worker("pod-0").maxLeases(ctx); err != nil || got != 20 {
+		t.Fatalf("first worker: got %d, %v, want 20", got, err)
+	}
+	if got, err := worker("pod-1").maxLeases(ctx); err != nil || got != 10 {
+		t.Fatalf("second worker: got %d, %v, want 10", got, err)
+	}
+
+	// A worker that stopped without deleting its row stops counting once stale
+	stale := leasemanager.Item(keys.Worker("pod-9"), &leasemanager.Metadata{LastUpdateTime: time.Now().Add(-time.Hour)})
+	db.rows[keys.Worker("pod-9")] = stale
+	if got, err := worker("pod-0").maxLeases(ctx); err != nil || got != 10 {
+		t.Fatalf("refresh with a stale row: got %d, %v, want 10", got, err)
+	}
+
+	coord, err := leasemanager.Table{DB: db, Name: keys.Table(), Keys: keys}.Coordinator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coord.MaxLeasesPerWorker != 10 || coord.ShardCount != 20 || coord.WorkerCount != 2 {
+		t.Fatalf("coordinator row is %+v", coord)
+	}
+}
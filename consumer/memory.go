@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// MemoryConfig pauses intake while the record bytes held by this worker exceed a
+// fraction of the memory limit, so a slow sink cannot grow the heap into an OOMKill
+type MemoryConfig struct {
+	// PauseFraction of the limit that in-flight record bytes may use, e.g. 0.6;
+	// 0 disables backpressure
+	PauseFraction float64 `yaml:"pause_fraction"`
+	// LimitBytes defaults to GOMEMLIMIT, then the cgroup memory limit
+	LimitBytes int64 `yaml:"limit_bytes"`
+}
+
+// memoryGate counts the record bytes held by processors and sink buffers. A batch is
+// admitted while the total stays under the budget; the first batch is always admitted
+// so a single oversized batch cannot stall the worker.
+type memoryGate struct {
+	mu       sync.Mutex
+	budget   int64
+	limit    int64
+	inflight int64
+	paused   int
+	released chan struct{}
+}
+
+// memory is shared by every record processor of this worker; nil means no backpressure
+var memory *memoryGate
+
+func newMemoryGate(cfg MemoryConfig) (*memoryGate, error) {
+	if cfg.PauseFraction <= 0 {
+		return nil, nil
+	}
+	if cfg.PauseFraction >= 1 {
+		return nil, fmt.Errorf("pause_fraction must be below 1, got %v", cfg.PauseFraction)
+	}
+	limit := cfg.LimitBytes
+	if limit <= 0 {
+		limit = memoryLimit()
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("no memory limit found, set GOMEMLIMIT or memory.limit_bytes")
+	}
+	return &memoryGate{
+		budget:   int64(cfg.PauseFraction * float64(limit)),
+		limit:    limit,
+		released: make(chan struct{}),
+	}, nil
+}
+
+// memoryLimit is GOMEMLIMIT when set, else the container's cgroup limit, else 0
+func memoryLimit() int64 {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return limit
+	}
+	return cgroupMemoryLimit()
+}
+
+// cgroupMemoryLimit is the container's cgroup memory limit, 0 when unlimited or unknown
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// "max" on v2 and a page-rounded MaxInt64 on v1 both mean unlimited
+		if err == nil && limit > 0 && limit < 1<<60 {
+			return limit
+		}
+	}
+	return 0
+}
+
+// tryAdmit holds n bytes if they fit in the budget
+func (g *memoryGate) tryAdmit(n int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inflight > 0 && g.inflight+n > g.budget {
+		return false
+	}
+	g.inflight += n
+	return true
+}
+
+// admit holds n bytes, waiting for other holders to release while over budget.
+// relieve is called before each wait to let the caller release what it holds itself.
+func (g *memoryGate) admit(shardID string, n int64, relieve func()) {
+	if g == nil || g.tryAdmit(n) {
+		return
+	}
+	start := time.Now()
+	log.Printf("[%s] ⏸️  Pausing intake: %d bytes in flight, budget %d", shardID, g.held(), g.budget)
+	g.mu.Lock()
+	g.paused++
+	g.mu.Unlock()
+	for {
+		relieve()
+		if g.tryAdmit(n) {
+			break
+		}
+		g.mu.Lock()
+		released := g.released
+		g.mu.Unlock()
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+		}
+	}
+	g.mu.Lock()
+	g.paused--
+	g.mu.Unlock()
+	log.Printf("[%s] ▶️  Resuming intake after %s", shardID, time.Since(start).Round(time.Millisecond))
+}
+
+// hold counts n bytes without waiting, for records moving into a sink buffer
+func (g *memoryGate) hold(n int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight += n
+}
+
+// release gives back n bytes and wakes the paused shards
+func (g *memoryGate) release(n int64) {
+	if g == nil || n == 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight -= n
+	close(g.released)
+	g.released = make(chan struct{})
+}
+
+func (g *memoryGate) held() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inflight
+}
+
+// writeMetrics writes the gate's state in Prometheus text format
+func (g *memoryGate) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	inflight, paused := g.inflight, g.paused
+	g.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_memory_inflight_bytes Record bytes held by processors and sink buffers")
+	fmt.Fprintln(w, "# TYPE kcl_memory_inflight_bytes gauge")
+	fmt.Fprintf(w, "kcl_memory_inflight_bytes %d\n", inflight)
+	fmt.Fprintln(w, "# HELP kcl_memory_budget_bytes In-flight bytes at which intake pauses")
+	fmt.Fprintln(w, "# TYPE kcl_memory_budget_bytes gauge")
+	fmt.Fprintf(w, "kcl_memory_budget_bytes %d\n", g.budget)
+	fmt.Fprintln(w, "# HELP kcl_memory_saturation In-flight bytes as a fraction of the budget")
+	fmt.Fprintln(w, "# TYPE kcl_memory_saturation gauge")
+	fmt.Fprintf(w, "kcl_memory_saturation %.3f\n", float64(inflight)/float64(g.budget))
+	fmt.Fprintln(w, "# HELP kcl_memory_paused_shards Shards waiting for in-flight bytes to drop")
+	fmt.Fprintln(w, "# TYPE kcl_memory_paused_shards gauge")
+	fmt.Fprintf(w, "kcl_memory_paused_shards %d\n", paused)
+}
+
+// recordBytes is the payload size of a KCL batch
+func recordBytes(records []*kinesis.Record) int64 {
+	var n int64
+	for _, record := range records {
+		n += int64(len(record.Data))
+	}
+	return n
+}
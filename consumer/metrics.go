@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Features that export metrics register a writer; serveMetrics concatenates them
+var (
+	metricsMu      sync.Mutex
+	metricsWriters []func(io.Writer)
+)
+
+func registerMetrics(write func(io.Writer)) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsWriters = append(metricsWriters, write)
+}
+
+// serveMetrics exposes every registered metric on addr in Prometheus text format,
+// next to the readiness endpoints and, when enabled, the pause endpoints
+func serveMetrics(addr string, readiness ReadinessConfig) {
+	mux := http.NewServeMux()
+	registerReadiness(mux, readiness)
+	if pauses != nil {
+		registerPause(mux)
+	}
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metricsMu.Lock()
+		writers := append([]func(io.Writer){}, metricsWriters...)
+		metricsMu.Unlock()
+		for _, write := range writers {
+			write(rw)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("⚠️  Metrics server stopped: %v", err)
+		}
+	}()
+	log.Printf("📈 Serving /metrics, /ready and /caught-up on %s (pause endpoints: %t)", addr, pauses != nil)
+}
+
+// metricSample is one series of the rendered metrics, for the push sinks (EMF, StatsD)
+type metricSample struct {
+	name   string
+	kind   string // "counter" or "gauge"
+	labels [][2]string
+	value  float64
+}
+
+// collectMetricSamples renders every registered writer and parses the result back
+// into samples. Histogram buckets are dropped and their _sum and _count become
+// counters; untyped series are gauges.
+func collectMetricSamples() []metricSample {
+	var text bytes.Buffer
+	metricsMu.Lock()
+	writers := append([]func(io.Writer){}, metricsWriters...)
+	metricsMu.Unlock()
+	for _, write := range writers {
+		write(&text)
+	}
+
+	var samples []metricSample
+	kinds := map[string]string{}
+	scanner := bufio.NewScanner(&text)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			kinds[fields[2]] = fields[3]
+			continue
+		}
+		sample, ok := parsePrometheusSample(line)
+		if !ok {
+			continue
+		}
+		sample.kind = kinds[sample.name]
+		if base, ok := histogramBase(sample.name); ok && kinds[base] == "histogram" {
+			if strings.HasSuffix(sample.name, "_bucket") {
+				continue
+			}
+			sample.kind = "counter"
+		}
+		if sample.kind != "counter" {
+			sample.kind = "gauge"
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// counterBaseline remembers the last value pushed per counter series, so push sinks
+// can send increases
+type counterBaseline map[string]float64
+
+// delta returns the increase of the series since the previous call, or the value
+// itself on the first call and after a reset; seen reports a previous call
+func (b counterBaseline) delta(series string, value float64) (increase float64, seen bool) {
+	prev, seen := b[series]
+	b[series] = value
+	if seen && value >= prev {
+		return value - prev, true
+	}
+	return value, seen
+}
+
+// parsePrometheusSample parses `name{a="x",b="y"} value`; comments and malformed lines
+// return false
+func parsePrometheusSample(line string) (metricSample, bool) {
+	if line == "" || line[0] == '#' {
+		return metricSample{}, false
+	}
+	var series metricSample
+	rest := line
+	if i := strings.IndexAny(line, "{ "); i > 0 && line[i] == '{' {
+		series.name = line[:i]
+		rest = line[i+1:]
+		for {
+			rest = strings.TrimLeft(rest, ", ")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, "=")
+			if eq <= 0 || len(rest) < eq+2 || rest[eq+1] != '"' {
+				return metricSample{}, false
+			}
+			name := rest[:eq]
+			// The quoted value ends at the first unescaped quote
+			end := eq + 2
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return metricSample{}, false
+			}
+			value, err := strconv.Unquote(rest[eq+1 : end+1])
+			if err != nil {
+				return metricSample{}, false
+			}
+			series.labels = append(series.labels, [2]string{name, value})
+			rest = rest[end+1:]
+		}
+	} else if i > 0 {
+		series.name, rest = line[:i], line[i:]
+	} else {
+		return metricSample{}, false
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+	if err != nil {
+		return metricSample{}, false
+	}
+	series.value = value
+	return series, true
+}
+
+// histogramBase strips the _bucket, _sum or _count suffix of a histogram series
+func histogramBase(name string) (string, bool) {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if base, ok := strings.CutSuffix(name, suffix); ok {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+func labelKey(labels [][2]string) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l[0] + "=" + strconv.Quote(l[1]) + ",")
+	}
+	return b.String()
+}
+
+// Metric groups whose series are labelled by shard
+var shardMetricGroups = []string{"adaptive", "duplicates", "pause", "watermark"}
+
+// ShardLabelConfig chooses the detail of the per-shard metric groups. "shard" (the
+// default) writes one series per shard; "worker" aggregates them to one series per
+// worker, for streams with enough shards that per-shard series explode cardinality.
+type ShardLabelConfig struct {
+	// Default applies to every group not listed in Groups
+	Default string `yaml:"default"`
+	// Groups maps adaptive, duplicates, pause or watermark to its detail
+	Groups map[string]string `yaml:"groups"`
+}
+
+// shardLabels is the detail every shard-labelled writer follows, set at startup
+var shardLabels ShardLabelConfig
+
+func (c ShardLabelConfig) validate() error {
+	if c.Default != "" && c.Default != "shard" && c.Default != "worker" {
+		return fmt.Errorf("metrics_shard_labels.default must be shard or worker, got %q", c.Default)
+	}
+	for group, detail := range c.Groups {
+		if !slices.Contains(shardMetricGroups, group) {
+			return fmt.Errorf("metrics_shard_labels.groups: unknown group %q (want one of %s)", group, strings.Join(shardMetricGroups, ", "))
+		}
+		if detail != "shard" && detail != "worker" {
+			return fmt.Errorf("metrics_shard_labels.groups.%s must be shard or worker, got %q", group, detail)
+		}
+	}
+	return nil
+}
+
+// perShard reports whether the group writes a series per shard
+func (c ShardLabelConfig) perShard(group string) bool {
+	if detail, ok := c.Groups[group]; ok {
+		return detail == "shard"
+	}
+	return c.Default != "worker"
+}
+
+// shardAggregation combines the per-shard values of one metric into the worker's value
+type shardAggregation int
+
+const (
+	aggregateSum shardAggregation = iota // counters and counts; 0 without shards
+	aggregateMin                         // left out without shards
+	aggregateMax                         // left out without shards
+)
+
+// writeShardSeries writes name for every shard in values or, when the group is
+// aggregated to the worker, one unlabelled series combining them
+func writeShardSeries(w io.Writer, group, name string, values map[string]float64, aggregate shardAggregation) {
+	ids := make([]string, 0, len(values))
+	for shardID := range values {
+		ids = append(ids, shardID)
+	}
+	sort.Strings(ids)
+	if shardLabels.perShard(group) {
+		for _, shardID := range ids {
+			fmt.Fprintf(w, "%s{shard=%q} %s\n", name, shardID, strconv.FormatFloat(values[shardID], 'f', -1, 64))
+		}
+		return
+	}
+	if len(ids) == 0 && aggregate != aggregateSum {
+		return
+	}
+	var total float64
+	for i, shardID := range ids {
+		v := values[shardID]
+		switch {
+		case i == 0:
+			total = v
+		case aggregate == aggregateSum:
+			total += v
+		case aggregate == aggregateMin:
+			total = min(total, v)
+		default:
+			total = max(total, v)
+		}
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(total, 'f', -1, 64))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PauseConfig serves /pause and /resume on metrics_addr, for downstream maintenance:
+// paused shards stop calling GetRecords but keep their leases
+type PauseConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TokenFile holds a bearer token required on /pause, /resume and /paused
+	TokenFile string `yaml:"token_file"`
+}
+
+// pausePoll is how often a paused shard's read loop comes around, renewing its lease
+// and noticing shutdown
+const pausePoll = time.Second
+
+// pauseController tracks which shards, or the whole worker, have intake paused
+type pauseController struct {
+	token []byte
+
+	mu     sync.Mutex
+	worker *time.Time           // whole worker paused since
+	shards map[string]time.Time // shard -> paused since
+}
+
+// pauses is nil unless consumer.pause.enabled
+var pauses *pauseController
+
+func newPauseController(cfg PauseConfig) (*pauseController, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	p := &pauseController{shards: make(map[string]time.Time)}
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pause token: %w", err)
+		}
+		p.token = []byte(strings.TrimSpace(string(data)))
+	}
+	return p, nil
+}
+
+// pausedSince returns when intake on the shard was paused, zero when it is not
+func (p *pauseController) pausedSince(shardID string) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.worker != nil {
+		return *p.worker
+	}
+	return p.shards[shardID]
+}
+
+// pause stops intake on shards, or on the whole worker when none are given
+func (p *pauseController) pause(shardIDs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if len(shardIDs) == 0 {
+		if p.worker == nil {
+			p.worker = &now
+		}
+		log.Printf("⏸️  Paused intake on all shards")
+		return
+	}
+	for _, shardID := range shardIDs {
+		if _, ok := p.shards[shardID]; !ok {
+			p.shards[shardID] = now
+		}
+	}
+	log.Printf("⏸️  Paused intake on %s", strings.Join(shardIDs, ", "))
+}
+
+// resume restarts intake on shards, or on every shard when none are given
+func (p *pauseController) resume(shardIDs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(shardIDs) == 0 {
+		p.worker = nil
+		p.shards = make(map[string]time.Time)
+		log.Printf("▶️  Resumed intake on all shards")
+		return
+	}
+	for _, shardID := range shardIDs {
+		delete(p.shards, shardID)
+	}
+	log.Printf("▶️  Resumed intake on %s", strings.Join(shardIDs, ", "))
+}
+
+// pauseStatus is the response body of the pause endpoints
+type pauseStatus struct {
+	Worker *time.Time           `json:"worker_paused_since,omitempty"`
+	Shards map[string]time.Time `json:"shards_paused_since"`
+}
+
+func (p *pauseController) status() pauseStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := pauseStatus{Worker: p.worker, Shards: make(map[string]time.Time, len(p.shards))}
+	for shardID, since := range p.shards {
+		status.Shards[shardID] = since
+	}
+	return status
+}
+
+// registerPause adds POST /pause and /resume, taking shard query parameters (none for
+// the whole worker), and GET /paused to mux
+func registerPause(mux *http.ServeMux) {
+	respond := func(rw http.ResponseWriter) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(pauses.status())
+	}
+	change := func(apply func([]string)) http.HandlerFunc {
+		return pauses.authorized(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				rw.Header().Set("Allow", http.MethodPost)
+				http.Error(rw, "POST only", http.StatusMethodNotAllowed)
+				return
+			}
+			apply(r.URL.Query()["shard"])
+			respond(rw)
+		})
+	}
+	mux.HandleFunc("/pause", change(pauses.pause))
+	mux.HandleFunc("/resume", change(pauses.resume))
+	mux.HandleFunc("/paused", pauses.authorized(func(rw http.ResponseWriter, _ *http.Request) { respond(rw) }))
+}
+
+func (p *pauseController) authorized(next http.HandlerFunc) http.HandlerFunc {
+	if p.token == nil {
+		return next
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), p.token) != 1 {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+func (p *pauseController) writeMetrics(w io.Writer) {
+	status := p.status()
+	fmt.Fprintln(w, "# HELP kcl_worker_paused 1 while intake is paused on every shard")
+	fmt.Fprintln(w, "# TYPE kcl_worker_paused gauge")
+	paused := 0
+	if status.Worker != nil {
+		paused = 1
+	}
+	fmt.Fprintf(w, "kcl_worker_paused %d\n", paused)
+	fmt.Fprintln(w, "# HELP kcl_shard_paused 1 while intake on the shard is paused (paused shards, aggregated to the worker)")
+	fmt.Fprintln(w, "# TYPE kcl_shard_paused gauge")
+	shards := make(map[string]float64, len(status.Shards))
+	for shardID := range status.Shards {
+		shards[shardID] = 1
+	}
+	writeShardSeries(w, "pause", "kcl_shard_paused", shards, aggregateSum)
+}
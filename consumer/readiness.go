@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ReadinessConfig lets deployment automation wait for new pods to catch up before
+// terminating old ones: /caught-up answers 200 once every shard this worker holds
+// is at most MaxLagMillis behind, and with GateReady /ready does too
+type ReadinessConfig struct {
+	// MaxLagMillis is the per-shard MillisBehindLatest that counts as caught up
+	// (default 10000)
+	MaxLagMillis int64 `yaml:"max_lag_millis"`
+	GateReady    bool  `yaml:"gate_ready"`
+}
+
+// lagTracker holds the latest MillisBehindLatest of every shard this worker processes;
+// -1 until the shard's first batch
+type lagTracker struct {
+	started atomic.Bool
+
+	mu     sync.Mutex
+	shards map[string]int64
+}
+
+var lags = &lagTracker{shards: make(map[string]int64)}
+
+func (l *lagTracker) start(shardID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shards[shardID] = -1
+}
+
+func (l *lagTracker) observe(shardID string, millisBehind int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shards[shardID] = millisBehind
+}
+
+func (l *lagTracker) forget(shardID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.shards, shardID)
+}
+
+// lagStatus is the /caught-up response body
+type lagStatus struct {
+	CaughtUp     bool             `json:"caught_up"`
+	MaxLagMillis int64            `json:"max_lag_millis"`
+	Shards       map[string]int64 `json:"shards"`
+	Behind       []string         `json:"behind,omitempty"`
+}
+
+// status reports whether every shard is within maxLag. A worker holding no shards
+// is caught up, so a new pod that has not taken leases yet does not hold a rollout
+// back; shards without a batch yet are behind.
+func (l *lagTracker) status(maxLag int64) lagStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := lagStatus{MaxLagMillis: maxLag, Shards: make(map[string]int64, len(l.shards))}
+	for shardID, lag := range l.shards {
+		status.Shards[shardID] = lag
+		if lag < 0 || lag > maxLag {
+			status.Behind = append(status.Behind, shardID)
+		}
+	}
+	sort.Strings(status.Behind)
+	status.CaughtUp = len(status.Behind) == 0
+	return status
+}
+
+// registerReadiness adds /ready and /caught-up to mux
+func registerReadiness(mux *http.ServeMux, cfg ReadinessConfig) {
+	maxLag := cfg.MaxLagMillis
+	if maxLag <= 0 {
+		maxLag = 10000
+	}
+	mux.HandleFunc("/caught-up", func(rw http.ResponseWriter, _ *http.Request) {
+		status := lags.status(maxLag)
+		rw.Header().Set("Content-Type", "application/json")
+		if !status.CaughtUp {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(status)
+	})
+	mux.HandleFunc("/ready", func(rw http.ResponseWriter, _ *http.Request) {
+		switch {
+		case !lags.started.Load():
+			http.Error(rw, "worker not started", http.StatusServiceUnavailable)
+		case cfg.GateReady && !lags.status(maxLag).CaughtUp:
+			http.Error(rw, "shards behind", http.StatusServiceUnavailable)
+		default:
+			rw.Write([]byte("Ready"))
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ReadLimitConfig keeps each shard's GetRecords calls under the Kinesis per-shard read
+// limits on the client side. The limits are shared by every application polling the
+// stream, so with several non-EFO consumers give each its share, e.g. half each for two.
+type ReadLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ReadsPerSecond per shard (default 5, the Kinesis limit)
+	ReadsPerSecond float64 `yaml:"reads_per_second"`
+	// BytesPerSecond per shard (default 2 MiB, the Kinesis limit)
+	BytesPerSecond float64 `yaml:"bytes_per_second"`
+}
+
+// readLimiter is a pair of token buckets per shard, one for calls and one for bytes.
+// Bytes are only known after the read, so the byte bucket goes into debt and the
+// next read of that shard waits for it to be paid off.
+type readLimiter struct {
+	reads float64
+	bytes float64
+
+	mu     sync.Mutex
+	shards map[string]*readBuckets
+	waited time.Duration
+}
+
+type readBuckets struct {
+	reads  float64
+	bytes  float64
+	filled time.Time
+}
+
+func newReadLimiter(cfg ReadLimitConfig) *readLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.ReadsPerSecond <= 0 {
+		cfg.ReadsPerSecond = 5
+	}
+	if cfg.BytesPerSecond <= 0 {
+		cfg.BytesPerSecond = 2 << 20
+	}
+	return &readLimiter{
+		reads:  cfg.ReadsPerSecond,
+		bytes:  cfg.BytesPerSecond,
+		shards: make(map[string]*readBuckets),
+	}
+}
+
+// wait blocks until the shard may read again and takes a read token
+func (l *readLimiter) wait(shardID string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	b := l.shards[shardID]
+	if b == nil {
+		// Start full: a second's worth of reads and bytes
+		b = &readBuckets{reads: l.reads, bytes: l.bytes, filled: time.Now()}
+		l.shards[shardID] = b
+	}
+	l.refill(b)
+	var delay time.Duration
+	if b.reads < 1 {
+		delay = secondsDuration((1 - b.reads) / l.reads)
+	}
+	if b.bytes < 0 {
+		delay = max(delay, secondsDuration(-b.bytes/l.bytes))
+	}
+	// Take the token now; the refill after the sleep covers it
+	b.reads--
+	l.waited += delay
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// observe charges the bytes a read returned, counted as Kinesis does: data plus
+// partition key
+func (l *readLimiter) observe(shardID string, records []*kinesis.Record) {
+	if l == nil {
+		return
+	}
+	var n int
+	for _, record := range records {
+		n += len(record.Data) + len(aws.StringValue(record.PartitionKey))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.shards[shardID]; b != nil {
+		b.bytes -= float64(n)
+	}
+}
+
+// refill adds the tokens earned since the last refill, up to one second's worth.
+// Callers hold mu.
+func (l *readLimiter) refill(b *readBuckets) {
+	now := time.Now()
+	elapsed := now.Sub(b.filled).Seconds()
+	b.filled = now
+	b.reads = min(b.reads+elapsed*l.reads, l.reads)
+	b.bytes = min(b.bytes+elapsed*l.bytes, l.bytes)
+}
+
+// writeMetrics writes the time spent waiting in Prometheus text format
+func (l *readLimiter) writeMetrics(w io.Writer) {
+	l.mu.Lock()
+	waited := l.waited
+	l.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_read_limit_wait_seconds_total Time GetRecords calls waited for the per-shard read limits")
+	fmt.Fprintln(w, "# TYPE kcl_read_limit_wait_seconds_total counter")
+	fmt.Fprintf(w, "kcl_read_limit_wait_seconds_total %.3f\n", waited.Seconds())
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
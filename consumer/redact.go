@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RedactionConfig masks sensitive record content before it is logged, sent to the
+// DLQ or captured
+type RedactionConfig struct {
+	// Fields are dotted JSON paths whose values are masked, e.g. user_id or metadata.email;
+	// partition_key masks the partition key in logs
+	Fields []string `yaml:"fields"`
+	// Patterns are regular expressions masked anywhere in the payload, which also
+	// covers records that are not valid JSON
+	Patterns []string `yaml:"patterns"`
+}
+
+// Redactor masks record content before it leaves the processor other than through
+// the sinks
+type Redactor interface {
+	// Redact returns the raw record with sensitive content masked
+	Redact(data []byte) []byte
+	// RedactField masks a single value, named by its dotted JSON path
+	RedactField(path, value string) string
+}
+
+const redacted = "[REDACTED]"
+
+// redactor applies the redaction section; it passes content through when unset
+var redactor Redactor = noRedaction{}
+
+type noRedaction struct{}
+
+func (noRedaction) Redact(data []byte) []byte          { return data }
+func (noRedaction) RedactField(_, value string) string { return value }
+
+// fieldRedactor is the default Redactor: it masks configured JSON fields, then patterns
+type fieldRedactor struct {
+	fields   map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// newFieldRedactor returns nil when cfg masks nothing
+func newFieldRedactor(cfg RedactionConfig) (*fieldRedactor, error) {
+	if len(cfg.Fields) == 0 && len(cfg.Patterns) == 0 {
+		return nil, nil
+	}
+	r := &fieldRedactor{fields: make(map[string]bool, len(cfg.Fields))}
+	for _, field := range cfg.Fields {
+		r.fields[field] = true
+	}
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func (r *fieldRedactor) Redact(data []byte) []byte {
+	if len(r.fields) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc map[string]any
+		if decoder.Decode(&doc) == nil {
+			for field := range r.fields {
+				redactPath(doc, strings.Split(field, "."))
+			}
+			if out, err := json.Marshal(doc); err == nil {
+				data = out
+			}
+		}
+	}
+	for _, re := range r.patterns {
+		data = re.ReplaceAll(data, []byte(redacted))
+	}
+	return data
+}
+
+func (r *fieldRedactor) RedactField(path, value string) string {
+	if r.fields[path] {
+		return redacted
+	}
+	for _, re := range r.patterns {
+		value = re.ReplaceAllString(value, redacted)
+	}
+	return value
+}
+
+func redactPath(doc map[string]any, keys []string) {
+	value, ok := doc[keys[0]]
+	if !ok {
+		return
+	}
+	if len(keys) == 1 {
+		doc[keys[0]] = redacted
+		return
+	}
+	if nested, ok := value.(map[string]any); ok {
+		redactPath(nested, keys[1:])
+	}
+}
+
+// redactors applies several Redactors in order
+type redactors []Redactor
+
+func (rs redactors) Redact(data []byte) []byte {
+	for _, r := range rs {
+		data = r.Redact(data)
+	}
+	return data
+}
+
+func (rs redactors) RedactField(path, value string) string {
+	for _, r := range rs {
+		value = r.RedactField(path, value)
+	}
+	return value
+}
+
+// redactRecords returns copies of records with their data redacted
+func redactRecords(r Redactor, records []SinkRecord) []SinkRecord {
+	out := make([]SinkRecord, len(records))
+	for i, record := range records {
+		record.Data = r.Redact(record.Data)
+		out[i] = record
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ShutdownReportConfig uploads the shutdown report next to printing it
+type ShutdownReportConfig struct {
+	// S3URI is a prefix such as s3://bucket/kcl-reports; reports are written to
+	// <prefix>/<application>/<worker>/<stopped at>.json
+	S3URI string `yaml:"s3_uri"`
+}
+
+// shardActivity is what this worker did with one shard
+type shardActivity struct {
+	Held               bool       `json:"held"`
+	Released           string     `json:"released,omitempty"` // shutdown reason once no longer held
+	RecordsProcessed   int64      `json:"records_processed"`
+	LastCheckpoint     string     `json:"last_checkpoint,omitempty"`
+	LastCheckpointAt   *time.Time `json:"last_checkpoint_at,omitempty"`
+	MillisBehindLatest int64      `json:"millis_behind_latest"`
+}
+
+// shutdownReport is printed as one JSON line on termination, for post-incident
+// analysis of what the pod was doing when it went away
+type shutdownReport struct {
+	Application      string                    `json:"application"`
+	Worker           string                    `json:"worker"`
+	Stream           string                    `json:"stream"`
+	Region           string                    `json:"region"`
+	Reason           string                    `json:"reason"`
+	StartedAt        time.Time                 `json:"started_at"`
+	StoppedAt        time.Time                 `json:"stopped_at"`
+	RecordsProcessed int64                     `json:"records_processed"`
+	ShardsHeld       []string                  `json:"shards_held"`
+	Shards           map[string]*shardActivity `json:"shards"`
+}
+
+// activityTracker collects shardActivity for every shard this worker processed
+type activityTracker struct {
+	startedAt time.Time
+
+	mu     sync.Mutex
+	shards map[string]*shardActivity
+}
+
+var activity = &activityTracker{startedAt: time.Now().UTC(), shards: make(map[string]*shardActivity)}
+
+func (a *activityTracker) start(shardID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.shards[shardID]
+	if s == nil {
+		s = &shardActivity{MillisBehindLatest: -1}
+		a.shards[shardID] = s
+	}
+	s.Held = true
+	s.Released = ""
+}
+
+func (a *activityTracker) processed(shardID string, records int, millisBehind int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.shards[shardID]; s != nil {
+		s.RecordsProcessed += int64(records)
+		s.MillisBehindLatest = millisBehind
+	}
+}
+
+// checkpointed records a successful checkpoint; nil is the end of a closed shard
+func (a *activityTracker) checkpointed(shardID string, sequence *string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.shards[shardID]; s != nil {
+		s.LastCheckpoint = "SHARD_END"
+		if sequence != nil {
+			s.LastCheckpoint = *sequence
+		}
+		now := time.Now().UTC()
+		s.LastCheckpointAt = &now
+	}
+}
+
+func (a *activityTracker) release(shardID, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.shards[shardID]; s != nil {
+		s.Held = false
+		s.Released = reason
+	}
+}
+
+func (a *activityTracker) report(cfg *Config, stream StreamTarget, reason string) shutdownReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := shutdownReport{
+		Application: stream.ApplicationName,
+		Worker:      cfg.Consumer.WorkerID,
+		Stream:      stream.StreamName,
+		Region:      stream.Region,
+		Reason:      reason,
+		StartedAt:   a.startedAt,
+		StoppedAt:   time.Now().UTC(),
+		ShardsHeld:  []string{},
+		Shards:      make(map[string]*shardActivity, len(a.shards)),
+	}
+	for shardID, s := range a.shards {
+		copied := *s
+		report.Shards[shardID] = &copied
+		report.RecordsProcessed += s.RecordsProcessed
+		if s.Held {
+			report.ShardsHeld = append(report.ShardsHeld, shardID)
+		}
+	}
+	sort.Strings(report.ShardsHeld)
+	return report
+}
+
+// writeShutdownReport prints the report to stdout as one JSON line prefixed with
+// "SHUTDOWN_REPORT " and uploads it when configured. Failures are only logged: the
+// process is exiting either way.
+func writeShutdownReport(cfg *Config, stream StreamTarget, reason string) {
+	report := activity.report(cfg, stream, reason)
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("⚠️  Failed to encode shutdown report: %v", err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "SHUTDOWN_REPORT %s\n", body)
+
+	uri := cfg.Consumer.ShutdownReport.S3URI
+	if uri == "" {
+		return
+	}
+	bucket, prefix, err := parseS3URI(uri)
+	if err != nil {
+		log.Printf("⚠️  shutdown_report.s3_uri: %v", err)
+		return
+	}
+	key := path.Join(prefix, report.Application, report.Worker, report.StoppedAt.Format("20060102T150405Z")+".json")
+
+	// LocalStack serves S3 on path-style URLs only
+	sess, err := session.NewSession(awsConfig(cfg, stream.Region).WithS3ForcePathStyle(cfg.AWS.Endpoint != ""))
+	if err == nil {
+		_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to upload shutdown report to s3://%s/%s: %v", bucket, key, err)
+		return
+	}
+	log.Printf("📝 Shutdown report uploaded to s3://%s/%s", bucket, key)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ResourcesConfig derives defaults from the container's CPU and memory limits, so one
+// image behaves sensibly across pod sizes. Only settings left at 0 are derived.
+type ResourcesConfig struct {
+	// DisableAutotune keeps the static defaults: KCL's max_records, no limit on
+	// concurrent batches and no GOMEMLIMIT
+	DisableAutotune bool `yaml:"disable_autotune"`
+	// MemoryLimitFraction of the container memory limit GOMEMLIMIT is set to when the
+	// environment does not set it (default 0.9)
+	MemoryLimitFraction float64 `yaml:"memory_limit_fraction"`
+	// RecordBytes is the expected record size batch sizes are derived with (default 1024)
+	RecordBytes int `yaml:"record_bytes"`
+}
+
+const (
+	// kclMaxRecords is the most records one GetRecords call returns
+	kclMaxRecords = 10000
+	// minAutotunedRecords keeps small pods from fetching in tiny batches
+	minAutotunedRecords = 100
+	// batchesPerProc is how many batches run at once per GOMAXPROCS: processing mostly
+	// waits on sinks and checkpoints, so more than one per CPU keeps the CPUs busy
+	batchesPerProc = 2
+	// batchMemoryShare is the part of the memory limit the batches in flight are sized to
+	batchMemoryShare = 0.25
+)
+
+// containerResources is what the process may use
+type containerResources struct {
+	CPUs        int     // logical CPUs of the node
+	CPULimit    float64 // cgroup CPU quota in cores, 0 when unlimited
+	GOMAXPROCS  int     // container-aware since Go 1.25, unless GOMAXPROCS is set
+	MemoryLimit int64   // cgroup memory limit, 0 when unlimited
+	GOMEMLIMIT  int64   // soft memory limit of the runtime, 0 when unset
+}
+
+func detectResources() containerResources {
+	res := containerResources{
+		CPUs:        runtime.NumCPU(),
+		CPULimit:    cgroupCPULimit(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		MemoryLimit: cgroupMemoryLimit(),
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		res.GOMEMLIMIT = limit
+	}
+	return res
+}
+
+// cgroupCPULimit is the container's cgroup CPU quota in cores, 0 when unlimited or unknown
+func cgroupCPULimit() float64 {
+	// cgroup v2: "<quota> <period>", quota "max" when unlimited
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return cpuQuota(fields[0], fields[1])
+		}
+		return 0
+	}
+	// cgroup v1: quota -1 when unlimited
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuota(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// autotune fills the settings of cfg left at 0 from res and sets GOMEMLIMIT when the
+// environment does not. It returns what it chose, for the startup dump.
+func autotune(cfg *Config, res *containerResources) ([]string, error) {
+	rc := cfg.Consumer.Resources
+	if rc.DisableAutotune {
+		return nil, nil
+	}
+	if rc.MemoryLimitFraction < 0 || rc.MemoryLimitFraction > 1 {
+		return nil, fmt.Errorf("resources.memory_limit_fraction must be between 0 and 1, got %v", rc.MemoryLimitFraction)
+	}
+	fraction := rc.MemoryLimitFraction
+	if fraction == 0 {
+		fraction = 0.9
+	}
+	recordBytes := rc.RecordBytes
+	if recordBytes <= 0 {
+		recordBytes = 1024
+	}
+	var tuned []string
+
+	// Leave headroom under the container limit so the GC works harder before an OOMKill
+	if os.Getenv("GOMEMLIMIT") == "" && res.MemoryLimit > 0 {
+		res.GOMEMLIMIT = int64(fraction * float64(res.MemoryLimit))
+		debug.SetMemoryLimit(res.GOMEMLIMIT)
+		tuned = append(tuned, fmt.Sprintf("GOMEMLIMIT=%s (%.0f%% of the memory limit)", formatBytes(res.GOMEMLIMIT), fraction*100))
+	}
+
+	if cfg.Consumer.MaxConcurrentBatches == 0 {
+		cfg.Consumer.MaxConcurrentBatches = batchesPerProc * res.GOMAXPROCS
+		tuned = append(tuned, fmt.Sprintf("max_concurrent_batches=%d (%d per GOMAXPROCS)", cfg.Consumer.MaxConcurrentBatches, batchesPerProc))
+	}
+
+	// The batches in flight fit in a share of the memory limit
+	switch {
+	case cfg.Consumer.MaxRecords != 0:
+	case res.MemoryLimit > 0 && cfg.Consumer.MaxConcurrentBatches > 0:
+		perBatch := int64(batchMemoryShare*float64(res.MemoryLimit)) / int64(cfg.Consumer.MaxConcurrentBatches)
+		cfg.Consumer.MaxRecords = int(min(max(perBatch/int64(recordBytes), minAutotunedRecords), kclMaxRecords))
+		tuned = append(tuned, fmt.Sprintf("max_records=%d (%s per batch of %d-byte records)",
+			cfg.Consumer.MaxRecords, formatBytes(perBatch), recordBytes))
+	default:
+		cfg.Consumer.MaxRecords = kclMaxRecords
+		tuned = append(tuned, fmt.Sprintf("max_records=%d (no memory limit)", kclMaxRecords))
+	}
+	return tuned, nil
+}
+
+// String renders the resources for the startup dump
+func (r containerResources) String() string {
+	cpu := "unlimited"
+	if r.CPULimit > 0 {
+		cpu = strconv.FormatFloat(r.CPULimit, 'f', -1, 64)
+	}
+	memory, soft := "unlimited", "unset"
+	if r.MemoryLimit > 0 {
+		memory = formatBytes(r.MemoryLimit)
+	}
+	if r.GOMEMLIMIT > 0 {
+		soft = formatBytes(r.GOMEMLIMIT)
+	}
+	return fmt.Sprintf("CPU limit %s of %d CPUs, GOMAXPROCS %d, memory limit %s, GOMEMLIMIT %s",
+		cpu, r.CPUs, r.GOMAXPROCS, memory, soft)
+}
+
+// formatBytes renders n in MiB, or KiB below one MiB
+func formatBytes(n int64) string {
+	if n < 1<<20 {
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
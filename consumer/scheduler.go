@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// batchSlots bounds how many shards of this worker process a batch at once. KCL runs
+// one goroutine per leased shard and each holds only the batch it fetched, so while a
+// shard waits for a slot it neither fetches nor decodes more: a worker with 80 leases
+// holds at most max_concurrent_batches batches in flight, plus one fetched batch per
+// waiting shard.
+//
+// Waiters are served first come, first served. A shard that finishes a batch must
+// queue again behind every shard already waiting, so a hot shard cannot starve the
+// rest.
+type batchSlots struct {
+	mu       sync.Mutex
+	free     int
+	capacity int
+	waiters  []chan struct{}
+	waited   time.Duration
+}
+
+// slots is shared by every record processor of this worker; nil means unlimited
+var slots *batchSlots
+
+func newBatchSlots(capacity int) *batchSlots {
+	return &batchSlots{free: capacity, capacity: capacity}
+}
+
+// acquire blocks until a slot is free and returns the function that releases it
+func (s *batchSlots) acquire() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return s.release
+	}
+	ready := make(chan struct{})
+	s.waiters = append(s.waiters, ready)
+	s.mu.Unlock()
+
+	start := time.Now()
+	<-ready
+	s.mu.Lock()
+	s.waited += time.Since(start)
+	s.mu.Unlock()
+	return s.release
+}
+
+// release hands the slot straight to the longest waiting shard, if any
+func (s *batchSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) > 0 {
+		next := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		close(next)
+		return
+	}
+	s.free++
+}
+
+// writeMetrics writes the slot usage in Prometheus text format
+func (s *batchSlots) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	inFlight, waiting, waited := s.capacity-s.free, len(s.waiters), s.waited
+	s.mu.Unlock()
+	fmt.Fprintln(w, "# HELP kcl_batches_in_flight Batches being processed by this worker")
+	fmt.Fprintln(w, "# TYPE kcl_batches_in_flight gauge")
+	fmt.Fprintf(w, "kcl_batches_in_flight %d\n", inFlight)
+	fmt.Fprintln(w, "# HELP kcl_batches_waiting Shards waiting for a processing slot")
+	fmt.Fprintln(w, "# TYPE kcl_batches_waiting gauge")
+	fmt.Fprintf(w, "kcl_batches_waiting %d\n", waiting)
+	fmt.Fprintln(w, "# HELP kcl_batch_slot_wait_seconds_total Time shards spent waiting for a processing slot")
+	fmt.Fprintln(w, "# TYPE kcl_batch_slot_wait_seconds_total counter")
+	fmt.Fprintf(w, "kcl_batch_slot_wait_seconds_total %.3f\n", waited.Seconds())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// SinkRecord is one Kinesis record handed to a sink, with the metadata needed for
+// latency measurement and key-based routing
+type SinkRecord struct {
+	ShardID        string `json:"shard_id"`
+	SequenceNumber string `json:"sequence_number"`
+	// SubSequenceNumber numbers the user records KCL unpacked from one KPL aggregate,
+	// which share its sequence number; 0 for records that were not aggregated
+	SubSequenceNumber int       `json:"sub_sequence_number"`
+	PartitionKey      string    `json:"partition_key"`
+	ArrivalTime       time.Time `json:"arrival_time"`
+	Data              []byte    `json:"-"`
+	// Error is why the record was sent to the DLQ
+	Error string `json:"error,omitempty"`
+}
+
+// Sink delivers batches of records. Write is called before the batch is checkpointed
+// and is retried until it succeeds, so delivery is at-least-once: sinks should be
+// idempotent for a repeated batch (same shard and sequence numbers).
+type Sink interface {
+	Write(ctx context.Context, records []SinkRecord) error
+	Close() error
+}
+
+// bufferedSink holds records back in Write and writes them out in Flush. While one is
+// configured the processor checkpoints only after a successful Flush, so a restart
+// replays exactly the records that never left the buffer.
+type bufferedSink interface {
+	Sink
+	// Due reports whether the shard's buffer has reached a rotation limit
+	Due(shardID string) bool
+	// Flush writes out everything buffered for the shard
+	Flush(ctx context.Context, shardID string) error
+	// Discard drops the shard's buffer after its lease is lost
+	Discard(shardID string)
+}
+
+// SinkConfig selects and configures one sink
+type SinkConfig struct {
+	// Type is s3, postgres, webhook or kafka
+	Type     string             `yaml:"type"`
+	S3       S3SinkConfig       `yaml:"s3"`
+	Postgres PostgresSinkConfig `yaml:"postgres"`
+	Webhook  WebhookSinkConfig  `yaml:"webhook"`
+	Kafka    KafkaSinkConfig    `yaml:"kafka"`
+	// Batch buffers records per shard before they reach the sink, see sink_batch.go
+	Batch BatchConfig `yaml:"batch"`
+}
+
+// newSinks builds the configured sinks; nil when none are configured
+func newSinks(cfg *Config, region string) (Sink, error) {
+	var sinks multiSink
+	for i, sinkCfg := range cfg.Sinks {
+		sink, err := newSink(cfg, region, sinkCfg)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("sinks[%d]: %w", i, err)
+		}
+		if sinkCfg.Batch.enabled() {
+			sink = newBatchingSink(sink, sinkCfg.Batch)
+			log.Printf("📤 Delivering records to %s sink in batches of up to %d records, %d bytes or %dms",
+				sinkCfg.Type, sinkCfg.Batch.MaxRecords, sinkCfg.Batch.MaxBytes, sinkCfg.Batch.MaxAgeMillis)
+		} else {
+			log.Printf("📤 Delivering records to %s sink", sinkCfg.Type)
+		}
+		sinks = append(sinks, namedSink{name: sinkCfg.Type, Sink: sink})
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	for _, sink := range sinks {
+		if _, ok := sink.Sink.(bufferedSink); ok {
+			return bufferedMultiSink{sinks}, nil
+		}
+	}
+	return sinks, nil
+}
+
+func newSink(cfg *Config, region string, sinkCfg SinkConfig) (Sink, error) {
+	switch sinkCfg.Type {
+	case "s3":
+		return newS3Sink(cfg, region, sinkCfg.S3)
+	case "postgres":
+		return newPostgresSink(sinkCfg.Postgres)
+	case "webhook":
+		return newWebhookSink(sinkCfg.Webhook)
+	case "kafka":
+		return newKafkaSink(sinkCfg.Kafka)
+	}
+	return nil, fmt.Errorf("unknown type %q, use s3, postgres, webhook or kafka", sinkCfg.Type)
+}
+
+type namedSink struct {
+	name string
+	Sink
+}
+
+// multiSink writes every batch to all sinks in order
+type multiSink []namedSink
+
+func (m multiSink) Write(ctx context.Context, records []SinkRecord) error {
+	for _, sink := range m {
+		if err := sink.Write(ctx, records); err != nil {
+			return fmt.Errorf("%s sink: %w", sink.name, err)
+		}
+	}
+	return nil
+}
+
+func (m multiSink) Close() error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s sink: %w", sink.name, err)
+		}
+	}
+	return firstErr
+}
+
+// bufferedMultiSink is a multiSink with at least one buffered sink. All buffered sinks
+// flush together, so after Flush every record written so far is durable everywhere.
+type bufferedMultiSink struct {
+	multiSink
+}
+
+func (m bufferedMultiSink) Due(shardID string) bool {
+	for _, sink := range m.multiSink {
+		if b, ok := sink.Sink.(bufferedSink); ok && b.Due(shardID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m bufferedMultiSink) Flush(ctx context.Context, shardID string) error {
+	for _, sink := range m.multiSink {
+		if b, ok := sink.Sink.(bufferedSink); ok {
+			if err := b.Flush(ctx, shardID); err != nil {
+				return fmt.Errorf("%s sink: %w", sink.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m bufferedMultiSink) Discard(shardID string) {
+	for _, sink := range m.multiSink {
+		if b, ok := sink.Sink.(bufferedSink); ok {
+			b.Discard(shardID)
+		}
+	}
+}
+
+// sinkRecords converts a KCL batch. KCL hands over the user records of a KPL
+// aggregate one after another under the aggregate's sequence number, so their
+// sub-sequence number is their position in that run.
+func sinkRecords(shardID string, records []*kinesis.Record) []SinkRecord {
+	out := make([]SinkRecord, 0, len(records))
+	for i, record := range records {
+		sinkRecord := SinkRecord{
+			ShardID:        shardID,
+			SequenceNumber: aws.StringValue(record.SequenceNumber),
+			PartitionKey:   aws.StringValue(record.PartitionKey),
+			ArrivalTime:    aws.TimeValue(record.ApproximateArrivalTimestamp).UTC(),
+			Data:           record.Data,
+		}
+		if i > 0 && out[i-1].SequenceNumber == sinkRecord.SequenceNumber {
+			sinkRecord.SubSequenceNumber = out[i-1].SubSequenceNumber + 1
+		}
+		out = append(out, sinkRecord)
+	}
+	return out
+}
+
+// deliver writes the batch, retrying with backoff until it succeeds. Blocking the
+// shard is deliberate: checkpointing past an undelivered batch would lose it.
+func deliver(sink Sink, shardID string, records []SinkRecord) {
+	retrySink(shardID, fmt.Sprintf("Delivery of %d records", len(records)), func() error {
+		return sink.Write(context.Background(), records)
+	})
+}
+
+// flush writes out the shard's buffer, retrying with backoff until it succeeds
+func flush(sink bufferedSink, shardID string) {
+	retrySink(shardID, "Flush", func() error {
+		return sink.Flush(context.Background(), shardID)
+	})
+}
+
+func retrySink(shardID, what string, fn func() error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return
+		}
+		log.Printf("[%s] ❌ %s failed (attempt %d), retrying in %s: %v",
+			shardID, what, attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// batchID names a batch by its shard and first sequence number, which stays the same
+// when the batch is redelivered
+func batchID(records []SinkRecord) string {
+	return records[0].ShardID + "-" + records[0].SequenceNumber
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchConfig micro-batches a sink, Firehose style: records are buffered per shard
+// and handed to the sink as one Write once any limit is reached
+type BatchConfig struct {
+	MaxRecords   int `yaml:"max_records"`
+	MaxBytes     int `yaml:"max_bytes"`
+	MaxAgeMillis int `yaml:"max_age_millis"`
+}
+
+func (b BatchConfig) enabled() bool {
+	return b.MaxRecords > 0 || b.MaxBytes > 0 || b.MaxAgeMillis > 0
+}
+
+// batchingSink buffers records in front of any sink. It is a bufferedSink, so the
+// processor flushes it before checkpointing and on shutdown.
+type batchingSink struct {
+	Sink
+	cfg BatchConfig
+
+	mu      sync.Mutex
+	buffers map[string]*sinkBuffer
+}
+
+// sinkBuffer holds a shard's records until the next flush
+type sinkBuffer struct {
+	records []SinkRecord
+	bytes   int
+	opened  time.Time
+}
+
+func newBatchingSink(sink Sink, cfg BatchConfig) *batchingSink {
+	return &batchingSink{Sink: sink, cfg: cfg, buffers: make(map[string]*sinkBuffer)}
+}
+
+// Write appends the records to the shard's buffer; nothing reaches the sink until Flush
+func (b *batchingSink) Write(ctx context.Context, records []SinkRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := b.buffers[records[0].ShardID]
+	if buf == nil {
+		buf = &sinkBuffer{opened: time.Now()}
+		b.buffers[records[0].ShardID] = buf
+	}
+	held := 0
+	for _, record := range records {
+		buf.records = append(buf.records, record)
+		held += len(record.Data)
+	}
+	buf.bytes += held
+	// Buffered records stay in memory after the batch that brought them returns
+	memory.hold(int64(held))
+	return nil
+}
+
+func (b *batchingSink) Due(shardID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := b.buffers[shardID]
+	if buf == nil || len(buf.records) == 0 {
+		return false
+	}
+	switch {
+	case b.cfg.MaxRecords > 0 && len(buf.records) >= b.cfg.MaxRecords:
+		return true
+	case b.cfg.MaxBytes > 0 && buf.bytes >= b.cfg.MaxBytes:
+		return true
+	case b.cfg.MaxAgeMillis > 0 && time.Since(buf.opened) >= time.Duration(b.cfg.MaxAgeMillis)*time.Millisecond:
+		return true
+	}
+	return false
+}
+
+// Flush writes the shard's buffer to the sink as one batch. The buffer is kept when
+// the write fails, so the retry sends the same batch again.
+func (b *batchingSink) Flush(ctx context.Context, shardID string) error {
+	b.mu.Lock()
+	buf := b.buffers[shardID]
+	b.mu.Unlock()
+	if buf == nil || len(buf.records) == 0 {
+		return nil
+	}
+	if err := b.Sink.Write(ctx, buf.records); err != nil {
+		return err
+	}
+	b.Discard(shardID)
+	return nil
+}
+
+func (b *batchingSink) Discard(shardID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if buf := b.buffers[shardID]; buf != nil {
+		memory.release(int64(buf.bytes))
+		delete(b.buffers, shardID)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaSinkConfig forwards every record to a Kafka topic
+type KafkaSinkConfig struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+}
+
+type kafkaSink struct {
+	client *kgo.Client
+}
+
+func newKafkaSink(sinkCfg KafkaSinkConfig) (*kafkaSink, error) {
+	if len(sinkCfg.Brokers) == 0 || sinkCfg.Topic == "" {
+		return nil, fmt.Errorf("kafka.brokers and kafka.topic are required")
+	}
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(sinkCfg.Brokers...),
+		kgo.DefaultProduceTopic(sinkCfg.Topic),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{client: client}, nil
+}
+
+// Write produces the batch and waits for every record to be acknowledged. The Kinesis
+// partition key becomes the Kafka key, so per-key ordering carries over; the shard and
+// sequence number travel as headers for deduplication downstream.
+func (k *kafkaSink) Write(ctx context.Context, records []SinkRecord) error {
+	batch := make([]*kgo.Record, 0, len(records))
+	for _, record := range records {
+		headers := []kgo.RecordHeader{
+			{Key: "kinesis-shard-id", Value: []byte(record.ShardID)},
+			{Key: "kinesis-sequence-number", Value: []byte(record.SequenceNumber)},
+			{Key: "kinesis-sub-sequence-number", Value: []byte(strconv.Itoa(record.SubSequenceNumber))},
+		}
+		if record.Error != "" {
+			headers = append(headers, kgo.RecordHeader{Key: "dlq-error", Value: []byte(record.Error)})
+		}
+		batch = append(batch, &kgo.Record{
+			Key:       []byte(record.PartitionKey),
+			Value:     record.Data,
+			Headers:   headers,
+			Timestamp: record.ArrivalTime,
+		})
+	}
+	return k.client.ProduceSync(ctx, batch...).FirstErr()
+}
+
+func (k *kafkaSink) Close() error {
+	k.client.Close()
+	return nil
+}
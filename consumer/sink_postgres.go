@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresSinkConfig inserts records into a table, one multi-row INSERT per batch
+type PostgresSinkConfig struct {
+	// DSN is a lib/pq connection string; ${VAR} references are expanded from the
+	// environment so passwords stay out of the file
+	DSN   string `yaml:"dsn"`
+	Table string `yaml:"table"`
+	// CreateTable creates the table when it does not exist
+	CreateTable bool `yaml:"create_table"`
+	// BatchSize caps the rows per INSERT (default 500)
+	BatchSize int `yaml:"batch_size"`
+	// TransactionalCheckpoint stores each shard's last written sequence number in
+	// CheckpointTable (default "<table>_checkpoints") in the same transaction as the
+	// rows, and skips records at or before it, so every record is written exactly once
+	TransactionalCheckpoint bool   `yaml:"transactional_checkpoint"`
+	CheckpointTable         string `yaml:"checkpoint_table"`
+}
+
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+type postgresSink struct {
+	db        *sql.DB
+	table     string
+	batchSize int
+	// checkpoints is the checkpoint table in transactional mode, "" otherwise
+	checkpoints string
+}
+
+func newPostgresSink(sinkCfg PostgresSinkConfig) (*postgresSink, error) {
+	if sinkCfg.DSN == "" || sinkCfg.Table == "" {
+		return nil, fmt.Errorf("postgres.dsn and postgres.table are required")
+	}
+	// The table name is interpolated into SQL, so only plain identifiers are allowed
+	if !sqlIdentifierPattern.MatchString(sinkCfg.Table) {
+		return nil, fmt.Errorf("postgres.table %q must be [schema.]name", sinkCfg.Table)
+	}
+	if sinkCfg.BatchSize <= 0 {
+		sinkCfg.BatchSize = 500
+	}
+	checkpoints := ""
+	if sinkCfg.TransactionalCheckpoint {
+		checkpoints = sinkCfg.CheckpointTable
+		if checkpoints == "" {
+			checkpoints = sinkCfg.Table + "_checkpoints"
+		}
+		if !sqlIdentifierPattern.MatchString(checkpoints) {
+			return nil, fmt.Errorf("postgres.checkpoint_table %q must be [schema.]name", checkpoints)
+		}
+	}
+
+	db, err := sql.Open("postgres", os.ExpandEnv(sinkCfg.DSN))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot reach PostgreSQL: %w", err)
+	}
+	if sinkCfg.CreateTable {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + sinkCfg.Table + ` (
+			shard_id            TEXT        NOT NULL,
+			sequence_number     TEXT        NOT NULL,
+			sub_sequence_number INTEGER     NOT NULL DEFAULT 0,
+			partition_key       TEXT        NOT NULL,
+			arrival_time        TIMESTAMPTZ NOT NULL,
+			data                JSONB,
+			raw_data            BYTEA,
+			PRIMARY KEY (shard_id, sequence_number, sub_sequence_number)
+		)`)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create table %s: %w", sinkCfg.Table, err)
+		}
+	}
+	if checkpoints != "" {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + checkpoints + ` (
+			shard_id        TEXT        PRIMARY KEY,
+			sequence_number TEXT        NOT NULL,
+			updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create table %s: %w", checkpoints, err)
+		}
+		log.Printf("🔒 PostgreSQL sink checkpoints transactionally in %s", checkpoints)
+	}
+	return &postgresSink{db: db, table: sinkCfg.Table, batchSize: sinkCfg.BatchSize, checkpoints: checkpoints}, nil
+}
+
+// Write inserts the batch in one transaction. Rows already present (a redelivered
+// batch) are skipped, so the table needs a unique key on (shard_id, sequence_number,
+// sub_sequence_number);
+// in transactional mode the checkpoint table does that instead and no key is needed.
+// JSON payloads go to data, anything else to raw_data.
+func (p *postgresSink) Write(ctx context.Context, records []SinkRecord) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if p.checkpoints != "" {
+		if records, err = p.skipWritten(ctx, tx, records); err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+	}
+
+	for start := 0; start < len(records); start += p.batchSize {
+		chunk := records[start:min(start+p.batchSize, len(records))]
+		var placeholders []string
+		args := make([]any, 0, 7*len(chunk))
+		for i, record := range chunk {
+			n := 7 * i
+			placeholders = append(placeholders, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+			var data, raw any
+			if json.Valid(record.Data) {
+				data = string(record.Data)
+			} else {
+				raw = record.Data
+			}
+			args = append(args, record.ShardID, record.SequenceNumber, record.SubSequenceNumber, record.PartitionKey, record.ArrivalTime, data, raw)
+		}
+
+		query := `INSERT INTO ` + p.table + ` (shard_id, sequence_number, sub_sequence_number, partition_key, arrival_time, data, raw_data) VALUES ` +
+			strings.Join(placeholders, ", ")
+		if p.checkpoints == "" {
+			query += ` ON CONFLICT (shard_id, sequence_number, sub_sequence_number) DO NOTHING`
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to insert into %s: %w", p.table, err)
+		}
+	}
+
+	if p.checkpoints != "" {
+		last := records[len(records)-1]
+		_, err := tx.ExecContext(ctx, `UPDATE `+p.checkpoints+` SET sequence_number = $2, updated_at = now() WHERE shard_id = $1`,
+			last.ShardID, last.SequenceNumber)
+		if err != nil {
+			return fmt.Errorf("failed to checkpoint %s in %s: %w", last.ShardID, p.checkpoints, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// skipWritten locks the shard's checkpoint row for the transaction and drops the
+// records at or before it. The lock also serialises a worker that still holds a
+// stale lease with the new owner: whichever commits second skips what the first wrote.
+func (p *postgresSink) skipWritten(ctx context.Context, tx *sql.Tx, records []SinkRecord) ([]SinkRecord, error) {
+	shardID := records[0].ShardID
+	_, err := tx.ExecContext(ctx, `INSERT INTO `+p.checkpoints+` (shard_id, sequence_number) VALUES ($1, '') ON CONFLICT (shard_id) DO NOTHING`, shardID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint of %s: %w", shardID, err)
+	}
+	var written string
+	err = tx.QueryRowContext(ctx, `SELECT sequence_number FROM `+p.checkpoints+` WHERE shard_id = $1 FOR UPDATE`, shardID).Scan(&written)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint of %s: %w", shardID, err)
+	}
+
+	rest := unwritten(records, written)
+	if skipped := len(records) - len(rest); skipped > 0 {
+		log.Printf("[%s] ⏭️  Skipping %d records already written up to %s", shardID, skipped, written)
+	}
+	return rest, nil
+}
+
+// unwritten drops the records of a batch, in sequence order, at or before the
+// checkpoint written; all of them are kept when it is empty
+func unwritten(records []SinkRecord, written string) []SinkRecord {
+	skipped := 0
+	for skipped < len(records) && compareSequence(records[skipped].SequenceNumber, written) <= 0 {
+		skipped++
+	}
+	return records[skipped:]
+}
+
+func (p *postgresSink) Close() error {
+	return p.db.Close()
+}
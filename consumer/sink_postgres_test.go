@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestCompareSequence(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"49590338271490256608559692538361571095921575989136588802", "49590338271490256608559692538361571095921575989136588802", 0},
+		{"49590338271490256608559692538361571095921575989136588803", "49590338271490256608559692538361571095921575989136588802", 1},
+		{"49590338271490256608559692538361571095921575989136588801", "49590338271490256608559692538361571095921575989136588802", -1},
+		// A longer sequence number is later even though it sorts first as a string
+		{"100", "99", 1},
+		{"99", "100", -1},
+		// Every sequence number is after the empty checkpoint
+		{"1", "", 1},
+		{"", "1", -1},
+		{"", "", 0},
+	} {
+		if got := compareSequence(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareSequence(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUnwritten(t *testing.T) {
+	batch := func(sequences ...string) []SinkRecord {
+		records := make([]SinkRecord, len(sequences))
+		for i, sequence := range sequences {
+			records[i] = SinkRecord{ShardID: "shardId-000000000000", SequenceNumber: sequence}
+		}
+		return records
+	}
+	for _, tt := range []struct {
+		name    string
+		records []SinkRecord
+		written string
+		want    int // records kept, from the end
+	}{
+		{"first batch of the shard", batch("98", "99", "100"), "", 3},
+		{"batch after the checkpoint", batch("101", "102"), "100", 2},
+		{"redelivered batch", batch("98", "99", "100"), "100", 0},
+		{"redelivered partly written", batch("98", "99", "100", "101"), "99", 2},
+		{"checkpoint shorter than the batch", batch("99", "100"), "99", 1},
+		{"aggregated records share a sequence number", batch("99", "99", "100"), "99", 1},
+	} {
+		got := unwritten(tt.records, tt.written)
+		if len(got) != tt.want {
+			t.Errorf("%s: kept %d records, want %d", tt.name, len(got), tt.want)
+			continue
+		}
+		if tt.want > 0 && got[0].SequenceNumber != tt.records[len(tt.records)-tt.want].SequenceNumber {
+			t.Errorf("%s: kept from %s", tt.name, got[0].SequenceNumber)
+		}
+	}
+}
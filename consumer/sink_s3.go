@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// S3SinkConfig writes one object per partition and batch under a time-partitioned
+// prefix; give the sink a batch config to roll larger files
+type S3SinkConfig struct {
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	// Format is ndjson (default) or parquet
+	Format string `yaml:"format"`
+	// Compression is none (default) or gzip for ndjson, snappy (default) or gzip for parquet
+	Compression string `yaml:"compression"`
+	// Partition is a Go time layout applied to each record's time,
+	// default "dt=2006-01-02/hour=15"
+	Partition string `yaml:"partition"`
+	// PartitionBy picks the time: arrival (default) or event, the payload's
+	// "timestamp" field, falling back to arrival for records without one
+	PartitionBy string `yaml:"partition_by"`
+	// Region defaults to the stream's region
+	Region string `yaml:"region"`
+}
+
+type s3Sink struct {
+	cfg      S3SinkConfig
+	uploader *s3manager.Uploader
+}
+
+func newS3Sink(cfg *Config, region string, sinkCfg S3SinkConfig) (*s3Sink, error) {
+	if sinkCfg.Bucket == "" {
+		return nil, fmt.Errorf("s3.bucket is required")
+	}
+	switch sinkCfg.Format {
+	case "", "ndjson":
+		sinkCfg.Format = "ndjson"
+		if sinkCfg.Compression == "" {
+			sinkCfg.Compression = "none"
+		}
+		if sinkCfg.Compression != "none" && sinkCfg.Compression != "gzip" {
+			return nil, fmt.Errorf("s3.compression %q must be none or gzip for ndjson", sinkCfg.Compression)
+		}
+	case "parquet":
+		if sinkCfg.Compression == "" {
+			sinkCfg.Compression = "snappy"
+		}
+		if sinkCfg.Compression != "snappy" && sinkCfg.Compression != "gzip" {
+			return nil, fmt.Errorf("s3.compression %q must be snappy or gzip for parquet", sinkCfg.Compression)
+		}
+	default:
+		return nil, fmt.Errorf("s3.format %q must be ndjson or parquet", sinkCfg.Format)
+	}
+	if sinkCfg.Partition == "" {
+		sinkCfg.Partition = "dt=2006-01-02/hour=15"
+	}
+	switch sinkCfg.PartitionBy {
+	case "":
+		sinkCfg.PartitionBy = "arrival"
+	case "arrival", "event":
+	default:
+		return nil, fmt.Errorf("s3.partition_by %q must be arrival or event", sinkCfg.PartitionBy)
+	}
+	if sinkCfg.Region != "" {
+		region = sinkCfg.Region
+	}
+
+	// LocalStack serves S3 on path-style URLs only
+	awsCfg := awsConfig(cfg, region).WithS3ForcePathStyle(cfg.AWS.Endpoint != "")
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Sink{cfg: sinkCfg, uploader: s3manager.NewUploader(sess)}, nil
+}
+
+// Write uploads the records as one object per partition, named
+// <prefix>/<partition>/<shard>-<first sequence>.<format>[.gz]; a redelivered batch
+// overwrites the objects already written
+func (s *s3Sink) Write(ctx context.Context, records []SinkRecord) error {
+	// Group by partition, keeping sequence order within each object
+	var partitions []string
+	groups := make(map[string][]SinkRecord)
+	for _, record := range records {
+		partition := s.recordTime(record).Format(s.cfg.Partition)
+		if _, ok := groups[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		groups[partition] = append(groups[partition], record)
+	}
+	for _, partition := range partitions {
+		if err := s.upload(ctx, partition, groups[partition]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Sink) Close() error {
+	return nil
+}
+
+// recordTime is the time a record is partitioned by
+func (s *s3Sink) recordTime(record SinkRecord) time.Time {
+	if s.cfg.PartitionBy == "event" {
+		var event struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		if json.Unmarshal(record.Data, &event) == nil && !event.Timestamp.IsZero() {
+			return event.Timestamp.UTC()
+		}
+	}
+	return record.ArrivalTime
+}
+
+func (s *s3Sink) upload(ctx context.Context, partition string, records []SinkRecord) error {
+	var body []byte
+	var err error
+	name := batchID(records) + "." + s.cfg.Format
+	contentType := "application/x-ndjson"
+	if s.cfg.Format == "parquet" {
+		codec := parquet.CompressionCodec_SNAPPY
+		if s.cfg.Compression == "gzip" {
+			codec = parquet.CompressionCodec_GZIP
+		}
+		body, err = encodeParquet(records, codec)
+		contentType = "application/vnd.apache.parquet"
+	} else {
+		body, err = encodeNDJSON(records)
+		if err == nil && s.cfg.Compression == "gzip" {
+			body, err = gzipBytes(body)
+			name += ".gz"
+			contentType = "application/gzip"
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(s.cfg.Prefix, partition, name)
+	_, err = s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %w", s.cfg.Bucket, key, err)
+	}
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ndjsonRecord is a record with its payload inlined: as JSON when it is JSON,
+// otherwise as a base64 string
+type ndjsonRecord struct {
+	SinkRecord
+	Data any `json:"data"`
+}
+
+func encodeNDJSON(records []SinkRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		line := ndjsonRecord{SinkRecord: record, Data: record.Data}
+		if json.Valid(record.Data) {
+			line.Data = json.RawMessage(record.Data)
+		}
+		if err := enc.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// parquetRow is the Parquet schema of a record
+type parquetRow struct {
+	ShardID           string `parquet:"name=shard_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SequenceNumber    string `parquet:"name=sequence_number, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SubSequenceNumber int32  `parquet:"name=sub_sequence_number, type=INT32"`
+	PartitionKey      string `parquet:"name=partition_key, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ArrivalTime       int64  `parquet:"name=arrival_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Data              string `parquet:"name=data, type=BYTE_ARRAY"`
+}
+
+func encodeParquet(records []SinkRecord, codec parquet.CompressionCodec) ([]byte, error) {
+	var buf bytes.Buffer
+	pw, err := writer.NewParquetWriterFromWriter(&buf, new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = codec
+	for _, record := range records {
+		if err := pw.Write(parquetRow{
+			ShardID:           record.ShardID,
+			SequenceNumber:    record.SequenceNumber,
+			SubSequenceNumber: int32(record.SubSequenceNumber),
+			PartitionKey:      record.PartitionKey,
+			ArrivalTime:       record.ArrivalTime.UnixMilli(),
+			Data:              string(record.Data),
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// WebhookSinkConfig POSTs every batch as NDJSON to an HTTP endpoint
+type WebhookSinkConfig struct {
+	URL string `yaml:"url"`
+	// Headers are sent with every request; ${VAR} references are expanded from the
+	// environment, e.g. "Authorization: Bearer ${WEBHOOK_TOKEN}"
+	Headers       map[string]string `yaml:"headers"`
+	TimeoutMillis int               `yaml:"timeout_millis"`
+}
+
+type webhookSink struct {
+	cfg    WebhookSinkConfig
+	client *http.Client
+}
+
+func newWebhookSink(sinkCfg WebhookSinkConfig) (*webhookSink, error) {
+	if sinkCfg.URL == "" {
+		return nil, fmt.Errorf("webhook.url is required")
+	}
+	timeout := time.Duration(sinkCfg.TimeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &webhookSink{cfg: sinkCfg, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Write sends the batch with an Idempotency-Key of shard and first sequence number,
+// which repeats when the batch is redelivered. Any non-2xx response is a failure.
+func (w *webhookSink) Write(ctx context.Context, records []SinkRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	body, err := encodeNDJSON(records)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Idempotency-Key", batchID(records))
+	for name, value := range w.cfg.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (w *webhookSink) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
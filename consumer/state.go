@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/vmware/vmware-go-kcl/clientlibrary/interfaces"
+)
+
+// StateConfig gives handlers a key/value store per shard that follows the lease: it
+// is restored when this worker takes the lease and saved before every checkpoint, so
+// the next owner continues from the state matching the checkpoint. A shard without
+// state of its own starts from the state of its parents.
+type StateConfig struct {
+	// Backend is dynamodb or disk; empty disables shard state
+	Backend string `yaml:"backend"`
+	// dynamodb: Table defaults to "<application_name>_shard_state", keyed by ShardID.
+	// A shard's state is one item, so it must stay under DynamoDB's 400KB.
+	Table string `yaml:"table"`
+	// disk: Dir holds one file per shard (default "/tmp/kcl-state")
+	Dir string `yaml:"dir"`
+	// disk: S3URI receives the snapshot uploaded before every checkpoint, which other
+	// workers restore from, s3://bucket[/prefix]
+	S3URI string `yaml:"s3_uri"`
+	// FinishedRetentionHours keeps the DynamoDB state of finished shards for their
+	// children (default 24); S3 snapshots need a lifecycle rule
+	FinishedRetentionHours int `yaml:"finished_retention_hours"`
+	// WindowMillis enables the built-in tumbling-window aggregation, see window.go
+	WindowMillis int `yaml:"window_millis"`
+}
+
+func (c StateConfig) enabled() bool {
+	return c.Backend != ""
+}
+
+func (c StateConfig) validate() error {
+	switch c.Backend {
+	case "":
+		if c.WindowMillis != 0 {
+			return fmt.Errorf("state.window_millis needs a state.backend")
+		}
+		return nil
+	case "dynamodb":
+	case "disk":
+		if c.S3URI == "" {
+			return fmt.Errorf("state.s3_uri is required for the disk backend")
+		}
+		if _, _, err := parseS3URI(c.S3URI); err != nil {
+			return fmt.Errorf("state.s3_uri: %w", err)
+		}
+	default:
+		return fmt.Errorf("state.backend %q must be dynamodb or disk", c.Backend)
+	}
+	if c.WindowMillis < 0 || c.FinishedRetentionHours < 0 {
+		return fmt.Errorf("state: window_millis and finished_retention_hours must not be negative")
+	}
+	return nil
+}
+
+// ShardState is the key/value state of one shard. It belongs to the shard's record
+// processor and is not safe for concurrent use. A nil ShardState, while shard state
+// is disabled, reads as empty and drops writes.
+type ShardState struct {
+	shardID string
+	values  map[string][]byte
+	// sequence is the last record the saved state covers
+	sequence string
+	parents  []string
+}
+
+// Get returns the value of key
+func (s *ShardState) Get(key string) ([]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Put sets key; the value is kept, not copied
+func (s *ShardState) Put(key string, value []byte) {
+	if s == nil {
+		return
+	}
+	s.values[key] = value
+}
+
+// Delete removes key
+func (s *ShardState) Delete(key string) {
+	if s == nil {
+		return
+	}
+	delete(s.values, key)
+}
+
+// Keys returns the keys in order
+func (s *ShardState) Keys() []string {
+	if s == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Covers reports whether the saved state already includes the record with sequence.
+// The state is saved before the checkpoint, so a restart redelivers the records
+// between the two; handlers skip them to apply every record once.
+func (s *ShardState) Covers(sequence string) bool {
+	return s != nil && s.sequence != "" && compareSequence(sequence, s.sequence) <= 0
+}
+
+// Parents returns the shards the state was restored from when the shard had none of
+// its own, e.g. both parents of a merged shard
+func (s *ShardState) Parents() []string {
+	if s == nil {
+		return nil
+	}
+	return s.parents
+}
+
+// stateSnapshot is a shard's state as stored
+type stateSnapshot struct {
+	ShardID string `json:"shard_id"`
+	// SequenceNumber is the last record the state covers, empty before the first save
+	SequenceNumber string `json:"sequence_number,omitempty"`
+	// Finished is set once the shard reached SHARD_END
+	Finished  bool              `json:"finished,omitempty"`
+	Parents   []string          `json:"parents,omitempty"`
+	WorkerID  string            `json:"worker_id"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Values    map[string][]byte `json:"values"`
+}
+
+// newerSnapshot returns the snapshot covering more of the shard
+func newerSnapshot(a, b *stateSnapshot) *stateSnapshot {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	if c := compareSequence(a.SequenceNumber, b.SequenceNumber); c != 0 {
+		if c > 0 {
+			return a
+		}
+		return b
+	}
+	if b.UpdatedAt.After(a.UpdatedAt) {
+		return b
+	}
+	return a
+}
+
+// compareSequence orders Kinesis sequence numbers, which are decimal strings of
+// varying length; an empty sequence comes first
+func compareSequence(a, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// stateStore keeps the shard snapshots
+type stateStore interface {
+	// load returns nil when the shard has no state
+	load(shardID string) (*stateSnapshot, error)
+	// save stores snap where any worker can load it, or returns errStateSuperseded
+	// when the stored snapshot covers more of the shard
+	save(snap *stateSnapshot) error
+	String() string
+}
+
+// errStateSuperseded is returned by a save older than the stored snapshot, written by
+// the worker that took over the shard
+var errStateSuperseded = errors.New("another worker saved newer state")
+
+// states is nil unless consumer.state.backend is set
+var states *stateManager
+
+type stateManager struct {
+	store      stateStore
+	kinesis    *kinesis.Kinesis
+	streamName string
+	workerID   string
+	window     time.Duration
+
+	mu sync.Mutex
+	// lineage maps every shard of the stream to its parents, reloaded on a miss
+	lineage  map[string][]string
+	keys     map[string]int   // keys per shard held, as of the last save
+	restores map[string]int64 // by source: own, parents or none
+	saves    int64
+}
+
+func newStateManager(cfg *Config, stream StreamTarget) (*stateManager, error) {
+	sc := cfg.Consumer.State
+	sess, err := session.NewSession(awsConfig(cfg, stream.Region))
+	if err != nil {
+		return nil, err
+	}
+	m := &stateManager{
+		kinesis:    kinesis.New(sess),
+		streamName: stream.StreamName,
+		workerID:   cfg.Consumer.WorkerID,
+		window:     time.Duration(sc.WindowMillis) * time.Millisecond,
+		keys:       make(map[string]int),
+		restores:   make(map[string]int64),
+	}
+
+	switch sc.Backend {
+	case "dynamodb":
+		table := sc.Table
+		if table == "" {
+			table = stream.ApplicationName + "_shard_state"
+		}
+		svc := dynamodb.New(sess)
+		if err := ensureStateTable(svc, table); err != nil {
+			return nil, fmt.Errorf("failed to set up state table %s: %w", table, err)
+		}
+		retention := time.Duration(sc.FinishedRetentionHours) * time.Hour
+		if retention == 0 {
+			retention = 24 * time.Hour
+		}
+		m.store = &dynamoStateStore{svc: svc, table: table, retention: retention}
+	case "disk":
+		dir := sc.Dir
+		if dir == "" {
+			dir = "/tmp/kcl-state"
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		bucket, prefix, _ := parseS3URI(sc.S3URI)
+		// LocalStack serves S3 on path-style URLs only
+		s3Sess, err := session.NewSession(awsConfig(cfg, stream.Region).WithS3ForcePathStyle(cfg.AWS.Endpoint != ""))
+		if err != nil {
+			return nil, err
+		}
+		m.store = &diskStateStore{
+			dir:      dir,
+			bucket:   bucket,
+			prefix:   path.Join(prefix, stream.ApplicationName),
+			s3:       s3.New(s3Sess),
+			uploader: s3manager.NewUploader(s3Sess),
+		}
+	}
+	return m, nil
+}
+
+// stateRestoreAttempts bounds the reads of a restore, about half a minute with backoff
+const stateRestoreAttempts = 5
+
+// acquire restores the state of a shard this worker took the lease of, from the
+// shard's own snapshot or else its parents'. Reads are retried a bounded number of
+// times; then the worker exits so the lease moves on, since starting empty would
+// overwrite the saved state with the next save.
+func (m *stateManager) acquire(shardID string, checkpoint *interfaces.ExtendedSequenceNumber) *ShardState {
+	if m == nil {
+		return nil
+	}
+	s := &ShardState{shardID: shardID, values: make(map[string][]byte)}
+	var own *stateSnapshot
+	if err := retryState(shardID, "State restore", func() (err error) {
+		own, err = m.store.load(shardID)
+		return err
+	}); err != nil {
+		log.Fatalf("[%s] ❌ Cannot restore shard state: %v", shardID, err)
+	}
+
+	source := "own"
+	switch {
+	case own != nil:
+		s.values, s.sequence, s.parents = own.Values, own.SequenceNumber, own.Parents
+		if s.values == nil {
+			s.values = make(map[string][]byte)
+		}
+		if checkpoint != nil && isSequenceNumber(aws.StringValue(checkpoint.SequenceNumber)) &&
+			compareSequence(s.sequence, aws.StringValue(checkpoint.SequenceNumber)) < 0 {
+			log.Printf("[%s] ⚠️  Shard state covers up to %s, behind the checkpoint %s: records in between are missing from it",
+				shardID, s.sequence, aws.StringValue(checkpoint.SequenceNumber))
+		}
+	default:
+		var err error
+		if source, err = m.inherit(s); err != nil {
+			log.Fatalf("[%s] ❌ Cannot restore shard state from its parents: %v", shardID, err)
+		}
+	}
+	log.Printf("[%s] 🗃️  Restored %d state keys (%s)", shardID, len(s.values), source)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[shardID] = len(s.values)
+	m.restores[source]++
+	return s
+}
+
+// inherit merges the state of the shard's parents into s, the adjacent parent's keys
+// winning, and returns the restore source
+func (m *stateManager) inherit(s *ShardState) (string, error) {
+	var parents []string
+	if err := retryState(s.shardID, "Shard lineage lookup", func() (err error) {
+		parents, err = m.parents(s.shardID)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	for _, parentID := range parents {
+		var parent *stateSnapshot
+		if err := retryState(s.shardID, "Parent state restore", func() (err error) {
+			parent, err = m.store.load(parentID)
+			return err
+		}); err != nil {
+			return "", err
+		}
+		if parent == nil {
+			continue
+		}
+		if !parent.Finished {
+			log.Printf("[%s] ⚠️  Parent shard %s has not finished, its state may be incomplete (see process_parent_shard_before_children)",
+				s.shardID, parentID)
+		}
+		for key, value := range parent.Values {
+			s.values[key] = value
+		}
+		s.parents = append(s.parents, parentID)
+	}
+	if len(s.parents) == 0 {
+		return "none", nil
+	}
+	return "parents", nil
+}
+
+// retryState runs fn with backoff, at most stateRestoreAttempts times
+func retryState(shardID, what string, fn func() error) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == stateRestoreAttempts {
+			return err
+		}
+		log.Printf("[%s] ❌ %s failed (attempt %d/%d), retrying in %s: %v",
+			shardID, what, attempt, stateRestoreAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// parents returns the parent shards of shardID, none for an original shard
+func (m *stateManager) parents(shardID string) ([]string, error) {
+	m.mu.Lock()
+	parents, ok := m.lineage[shardID]
+	m.mu.Unlock()
+	if ok {
+		return parents, nil
+	}
+
+	lineage := make(map[string][]string)
+	input := &kinesis.ListShardsInput{StreamName: aws.String(m.streamName)}
+	for {
+		out, err := m.kinesis.ListShards(input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards of %s: %w", m.streamName, err)
+		}
+		for _, shard := range out.Shards {
+			var ids []string
+			for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+				if aws.StringValue(parent) != "" {
+					ids = append(ids, aws.StringValue(parent))
+				}
+			}
+			lineage[aws.StringValue(shard.ShardId)] = ids
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			break
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lineage = lineage
+	return lineage[shardID], nil
+}
+
+// save stores the state as covering the records up to sequence, retrying until it
+// succeeds. Call it before checkpointing sequence, so the checkpoint never gets
+// ahead of the state.
+func (m *stateManager) save(s *ShardState, sequence *string) {
+	if m == nil || s == nil {
+		return
+	}
+	m.persist(s, sequence, false)
+}
+
+// release hands the state of a shard this worker let go of to the next owner, or to
+// the children of a finished shard
+func (m *stateManager) release(s *ShardState, sequence *string, finished bool) {
+	if m == nil || s == nil {
+		return
+	}
+	m.persist(s, sequence, finished)
+	m.forget(s.shardID)
+}
+
+// forget drops a shard whose lease was lost: the new owner restores the state saved
+// with the last checkpoint
+func (m *stateManager) forget(shardID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, shardID)
+}
+
+func (m *stateManager) persist(s *ShardState, sequence *string, finished bool) {
+	if sequence != nil {
+		s.sequence = aws.StringValue(sequence)
+	}
+	snap := &stateSnapshot{
+		ShardID:        s.shardID,
+		SequenceNumber: s.sequence,
+		Finished:       finished,
+		Parents:        s.parents,
+		WorkerID:       m.workerID,
+		UpdatedAt:      time.Now().UTC(),
+		Values:         s.values,
+	}
+	retrySink(s.shardID, "State save", func() error {
+		err := m.store.save(snap)
+		if errors.Is(err, errStateSuperseded) {
+			// The lease moved on; its checkpoint will fail the same way
+			log.Printf("[%s] ⚠️  Not saving state up to %s: %v", s.shardID, snap.SequenceNumber, err)
+			return nil
+		}
+		return err
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[s.shardID] = len(s.values)
+	m.saves++
+}
+
+// isSequenceNumber tells a record's sequence number from the special checkpoint
+// values such as TRIM_HORIZON and SHARD_END
+func isSequenceNumber(sequence string) bool {
+	for _, c := range sequence {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return sequence != ""
+}
+
+// writeMetrics writes the state held and the restores and saves since start
+func (m *stateManager) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make(map[string]float64, len(m.keys))
+	for shardID, n := range m.keys {
+		keys[shardID] = float64(n)
+	}
+	fmt.Fprintln(w, "# HELP kcl_shard_state_keys Keys in the state of each shard this worker holds, as of the last save")
+	fmt.Fprintln(w, "# TYPE kcl_shard_state_keys gauge")
+	writeShardSeries(w, "state", "kcl_shard_state_keys", keys, aggregateSum)
+	fmt.Fprintln(w, "# HELP kcl_shard_state_restores_total Shard states restored on lease acquisition, by source")
+	fmt.Fprintln(w, "# TYPE kcl_shard_state_restores_total counter")
+	for _, source := range []string{"own", "parents", "none"} {
+		fmt.Fprintf(w, "kcl_shard_state_restores_total{source=%q} %d\n", source, m.restores[source])
+	}
+	fmt.Fprintln(w, "# HELP kcl_shard_state_saves_total Shard states saved, at checkpoints and lease releases")
+	fmt.Fprintln(w, "# TYPE kcl_shard_state_saves_total counter")
+	fmt.Fprintf(w, "kcl_shard_state_saves_total %d\n", m.saves)
+}
+
+// dynamoStateStore keeps one item per shard
+type dynamoStateStore struct {
+	svc       *dynamodb.DynamoDB
+	table     string
+	retention time.Duration
+}
+
+// stateExpiresAttribute is the TTL attribute set on the items of finished shards
+const stateExpiresAttribute = "ExpiresAt"
+
+// stateOrderAttribute holds the sequence number as sequenceOrder renders it, which
+// saves are conditional on
+const stateOrderAttribute = "SequenceOrder"
+
+func (d *dynamoStateStore) String() string {
+	return "DynamoDB table " + d.table
+}
+
+func (d *dynamoStateStore) load(shardID string) (*stateSnapshot, error) {
+	out, err := d.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]*dynamodb.AttributeValue{leaseKeyKey: {S: aws.String(shardID)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state of shard %s: %w", shardID, err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	item := out.Item
+	snap := &stateSnapshot{
+		ShardID:  shardID,
+		Values:   make(map[string][]byte),
+		WorkerID: aws.StringValue(attributeS(item, "WorkerID")),
+	}
+	snap.SequenceNumber = aws.StringValue(attributeS(item, "SequenceNumber"))
+	if v := item["Finished"]; v != nil {
+		snap.Finished = aws.BoolValue(v.BOOL)
+	}
+	if v := item["Parents"]; v != nil {
+		snap.Parents = aws.StringValueSlice(v.SS)
+	}
+	snap.UpdatedAt, _ = time.Parse(time.RFC3339Nano, aws.StringValue(attributeS(item, "UpdatedAt")))
+	if v := item["State"]; v != nil {
+		for key, value := range v.M {
+			snap.Values[key] = value.B
+		}
+	}
+	return snap, nil
+}
+
+func attributeS(item map[string]*dynamodb.AttributeValue, name string) *string {
+	if v := item[name]; v != nil {
+		return v.S
+	}
+	return nil
+}
+
+func (d *dynamoStateStore) save(snap *stateSnapshot) error {
+	values := make(map[string]*dynamodb.AttributeValue, len(snap.Values))
+	for key, value := range snap.Values {
+		values[key] = &dynamodb.AttributeValue{B: value}
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		leaseKeyKey:         {S: aws.String(snap.ShardID)},
+		"State":             {M: values},
+		"Finished":          {BOOL: aws.Bool(snap.Finished)},
+		"WorkerID":          {S: aws.String(snap.WorkerID)},
+		"UpdatedAt":         {S: aws.String(snap.UpdatedAt.Format(time.RFC3339Nano))},
+		stateOrderAttribute: {S: aws.String(sequenceOrder(snap.SequenceNumber))},
+	}
+	if snap.SequenceNumber != "" {
+		item["SequenceNumber"] = &dynamodb.AttributeValue{S: aws.String(snap.SequenceNumber)}
+	}
+	if len(snap.Parents) > 0 {
+		item["Parents"] = &dynamodb.AttributeValue{SS: aws.StringSlice(snap.Parents)}
+	}
+	if snap.Finished {
+		expires := snap.UpdatedAt.Add(d.retention).Unix()
+		item[stateExpiresAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expires, 10))}
+	}
+	// A worker still holding a lost lease must not overwrite the new owner's newer
+	// snapshot. Rows written before the order attribute existed are overwritten.
+	_, err := d.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(d.table),
+		Item:                      item,
+		ConditionExpression:       aws.String("attribute_not_exists(#order) OR #order <= :order"),
+		ExpressionAttributeNames:  map[string]*string{"#order": aws.String(stateOrderAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":order": item[stateOrderAttribute]},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errStateSuperseded
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save state of shard %s: %w", snap.ShardID, err)
+	}
+	return nil
+}
+
+// sequenceOrder renders a sequence number so that string order is compareSequence
+// order, for conditions evaluated by DynamoDB: the length first, zero padded
+func sequenceOrder(sequence string) string {
+	return fmt.Sprintf("%04d:%s", len(sequence), sequence)
+}
+
+// ensureStateTable creates the state table on demand, with TTL for finished shards
+func ensureStateTable(svc *dynamodb.DynamoDB, table string) error {
+	_, err := svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		err = createLeaseTable(svc, table, LeaseTableConfig{})
+	}
+	if err != nil {
+		return err
+	}
+	return enableLeaseTableTTL(svc, table, stateExpiresAttribute)
+}
+
+// diskStateStore writes every save to a local file and uploads it to S3 before the
+// save returns, so the checkpoint that follows never gets ahead of the snapshot other
+// workers restore. A worker restarting on the same disk resumes from its file; other
+// workers restore from S3, whichever covers more of the shard.
+type diskStateStore struct {
+	dir      string
+	bucket   string
+	prefix   string
+	s3       *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func (d *diskStateStore) String() string {
+	return fmt.Sprintf("%s with snapshots in s3://%s/%s", d.dir, d.bucket, d.prefix)
+}
+
+func (d *diskStateStore) file(shardID string) string {
+	return filepath.Join(d.dir, shardID+".json")
+}
+
+func (d *diskStateStore) key(shardID string) string {
+	return path.Join(d.prefix, shardID+".json")
+}
+
+func (d *diskStateStore) load(shardID string) (*stateSnapshot, error) {
+	var local *stateSnapshot
+	data, err := os.ReadFile(d.file(shardID))
+	switch {
+	case err == nil:
+		local = new(stateSnapshot)
+		if err := json.Unmarshal(data, local); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", d.file(shardID), err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	remote, err := d.remote(shardID)
+	if err != nil {
+		return nil, err
+	}
+	return newerSnapshot(local, remote), nil
+}
+
+// remote downloads the shard's snapshot from S3, nil when there is none
+func (d *diskStateStore) remote(shardID string) (*stateSnapshot, error) {
+	out, err := d.s3.GetObject(&s3.GetObjectInput{Bucket: aws.String(d.bucket), Key: aws.String(d.key(shardID))})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download s3://%s/%s: %w", d.bucket, d.key(shardID), err)
+	}
+	defer out.Body.Close()
+	remote := new(stateSnapshot)
+	if err := json.NewDecoder(out.Body).Decode(remote); err != nil {
+		return nil, fmt.Errorf("failed to decode s3://%s/%s: %w", d.bucket, d.key(shardID), err)
+	}
+	return remote, nil
+}
+
+func (d *diskStateStore) save(snap *stateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// A worker still holding a lost lease must not overwrite the new owner's newer
+	// snapshot. S3 cannot make the upload conditional on it, so this narrows the race
+	// to the time between the download and the upload rather than closing it.
+	remote, err := d.remote(snap.ShardID)
+	if err != nil {
+		return err
+	}
+	if remote != nil && compareSequence(remote.SequenceNumber, snap.SequenceNumber) > 0 {
+		return errStateSuperseded
+	}
+
+	// Written aside and renamed, so a crash never leaves a torn file
+	tmp := d.file(snap.ShardID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.file(snap.ShardID)); err != nil {
+		return err
+	}
+
+	if _, err := d.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(d.key(snap.ShardID)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %w", d.bucket, d.key(snap.ShardID), err)
+	}
+	return nil
+}
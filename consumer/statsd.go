@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDConfig pushes the registered metrics over UDP to a StatsD server or the
+// Datadog agent, for deployments that observe through the agent rather than scraping
+type StatsDConfig struct {
+	// Addr is host:port, e.g. "${DD_AGENT_HOST}:8125"; empty disables the sink
+	Addr string `yaml:"addr"`
+	// Format is "dogstatsd" (default), sending labels as tags, or "statsd", which has
+	// no tags and appends the label values to the metric name
+	Format string `yaml:"format"`
+	// Prefix is prepended to every metric name, e.g. "kds."
+	Prefix string `yaml:"prefix"`
+	// FlushIntervalMillis defaults to 10000
+	FlushIntervalMillis int `yaml:"flush_interval_millis"`
+}
+
+// statsdMaxPacket keeps a datagram under the 1500 byte Ethernet MTU
+const statsdMaxPacket = 1432
+
+// statsdWriter sends gauges as gauges and counters, including the _sum and _count of
+// histograms, as their increase since the previous flush
+type statsdWriter struct {
+	addr   string
+	prefix string
+	tagged bool
+	tags   [][2]string // added to every metric with the dogstatsd format
+	last   counterBaseline
+}
+
+func newStatsDWriter(cfg StatsDConfig, app, worker string) (*statsdWriter, error) {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return nil, fmt.Errorf("metrics_statsd.addr must be host:port: %w", err)
+	}
+	switch cfg.Format {
+	case "", "dogstatsd", "statsd":
+	default:
+		return nil, fmt.Errorf("metrics_statsd.format must be dogstatsd or statsd, got %q", cfg.Format)
+	}
+	return &statsdWriter{
+		addr:   cfg.Addr,
+		prefix: cfg.Prefix,
+		tagged: cfg.Format != "statsd",
+		tags:   [][2]string{{"app", app}, {"worker", worker}},
+		last:   counterBaseline{},
+	}, nil
+}
+
+// run flushes every interval until stop is closed, then once more
+func (s *statsdWriter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends every sample, packing lines into datagrams. The address is resolved on
+// every flush, so an agent pod replaced on the node is picked up.
+func (s *statsdWriter) flush() {
+	var lines []string
+	for _, sample := range collectMetricSamples() {
+		kind := "g"
+		if sample.kind == "counter" {
+			increase, seen := s.last.delta(sample.name+labelKey(sample.labels), sample.value)
+			if seen && increase == 0 {
+				continue
+			}
+			sample.value, kind = increase, "c"
+		}
+		lines = append(lines, s.line(sample, kind))
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		log.Printf("⚠️  Failed to reach StatsD at %s: %v", s.addr, err)
+		return
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			conn.Write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		log.Printf("⚠️  Failed to send metrics to StatsD at %s: %v", s.addr, err)
+	}
+}
+
+// line renders one sample as name:value|type, with |#tags for dogstatsd
+func (s *statsdWriter) line(sample metricSample, kind string) string {
+	var b strings.Builder
+	b.WriteString(s.prefix + sample.name)
+	if !s.tagged {
+		for _, l := range sample.labels {
+			b.WriteString("." + statsdSanitize(l[1]))
+		}
+	}
+	b.WriteString(":" + strconv.FormatFloat(sample.value, 'g', -1, 64) + "|" + kind)
+	if s.tagged {
+		sep := "|#"
+		for _, tags := range [][][2]string{s.tags, sample.labels} {
+			for _, t := range tags {
+				b.WriteString(sep + statsdSanitize(t[0]) + ":" + statsdSanitize(t[1]))
+				sep = ","
+			}
+		}
+	}
+	return b.String()
+}
+
+// statsdSanitize replaces the characters the line protocol reserves
+func statsdSanitize(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_", "\n", "_", " ", "_").Replace(s)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransformConfig is one stage of the record transformation pipeline. Stages run in
+// order on every JSON record before it reaches the sinks; records that are not JSON
+// objects pass through unchanged.
+type TransformConfig struct {
+	// Type is rename, add, lookup or metadata
+	Type string `yaml:"type"`
+
+	// metadata: field the Kinesis metadata is stored under (default "_kinesis")
+	Field string `yaml:"field"`
+
+	// rename: old field -> new field
+	Fields map[string]string `yaml:"fields"`
+
+	// add: field -> value; ${VAR} is expanded from the environment once at startup.
+	// Existing fields are kept unless Overwrite is set.
+	Values    map[string]string `yaml:"values"`
+	Overwrite bool              `yaml:"overwrite"`
+
+	// lookup: GET URL with {key} replaced by the record's KeyField, and store the JSON
+	// response under TargetField. Responses are cached per key.
+	KeyField       string `yaml:"key_field"`
+	TargetField    string `yaml:"target_field"`
+	URL            string `yaml:"url"`
+	CacheTTLMillis int    `yaml:"cache_ttl_millis"`
+	CacheSize      int    `yaml:"cache_size"`
+	TimeoutMillis  int    `yaml:"timeout_millis"`
+}
+
+// transformStage rewrites one decoded record in place; meta carries the record's
+// Kinesis metadata
+type transformStage func(ctx context.Context, meta SinkRecord, record map[string]any)
+
+// pipeline is the ordered list of configured stages; nil when none are configured
+type pipeline []transformStage
+
+func newPipeline(cfgs []TransformConfig) (pipeline, error) {
+	var p pipeline
+	for i, cfg := range cfgs {
+		var stage transformStage
+		var err error
+		switch cfg.Type {
+		case "rename":
+			stage, err = renameStage(cfg)
+		case "add":
+			stage, err = addStage(cfg)
+		case "lookup":
+			stage, err = lookupStage(cfg)
+		case "metadata":
+			stage = metadataStage(cfg)
+		default:
+			err = fmt.Errorf("unknown type %q, use rename, add, lookup or metadata", cfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("transforms[%d]: %w", i, err)
+		}
+		log.Printf("🔧 Transform stage %d: %s", i+1, cfg.Type)
+		p = append(p, stage)
+	}
+	return p, nil
+}
+
+// apply runs every stage over the records and re-encodes their payloads
+func (p pipeline) apply(records []SinkRecord) []SinkRecord {
+	if len(p) == 0 {
+		return records
+	}
+	ctx := context.Background()
+	for i := range records {
+		// UseNumber keeps large integers exact through the round trip
+		var decoded map[string]any
+		dec := json.NewDecoder(bytes.NewReader(records[i].Data))
+		dec.UseNumber()
+		if err := dec.Decode(&decoded); err != nil || decoded == nil {
+			continue
+		}
+		for _, stage := range p {
+			stage(ctx, records[i], decoded)
+		}
+		data, err := json.Marshal(decoded)
+		if err != nil {
+			log.Printf("[%s] ❌ Failed to encode transformed record %s: %v",
+				records[i].ShardID, records[i].SequenceNumber, err)
+			continue
+		}
+		records[i].Data = data
+	}
+	return records
+}
+
+func renameStage(cfg TransformConfig) (transformStage, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, fmt.Errorf("rename needs fields")
+	}
+	return func(_ context.Context, _ SinkRecord, record map[string]any) {
+		for from, to := range cfg.Fields {
+			if value, ok := record[from]; ok {
+				delete(record, from)
+				record[to] = value
+			}
+		}
+	}, nil
+}
+
+func addStage(cfg TransformConfig) (transformStage, error) {
+	if len(cfg.Values) == 0 {
+		return nil, fmt.Errorf("add needs values")
+	}
+	values := make(map[string]string, len(cfg.Values))
+	for field, value := range cfg.Values {
+		values[field] = os.ExpandEnv(value)
+	}
+	return func(_ context.Context, _ SinkRecord, record map[string]any) {
+		for field, value := range values {
+			if _, exists := record[field]; !exists || cfg.Overwrite {
+				record[field] = value
+			}
+		}
+	}, nil
+}
+
+// lookupStage enriches records from an HTTP service. A failed callout leaves the
+// record without TargetField rather than holding up the shard; failures are not cached.
+func lookupStage(cfg TransformConfig) (transformStage, error) {
+	if cfg.KeyField == "" || cfg.TargetField == "" || !strings.Contains(cfg.URL, "{key}") {
+		return nil, fmt.Errorf("lookup needs key_field, target_field and a url containing {key}")
+	}
+	ttl := time.Duration(cfg.CacheTTLMillis) * time.Millisecond
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 10000
+	}
+	timeout := time.Duration(cfg.TimeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	cache := newLookupCache(cfg.CacheSize, ttl)
+	client := &http.Client{Timeout: timeout}
+
+	return func(ctx context.Context, _ SinkRecord, record map[string]any) {
+		raw, ok := record[cfg.KeyField]
+		if !ok || raw == nil {
+			return
+		}
+		key := fmt.Sprint(raw)
+		if value, ok := cache.get(key); ok {
+			record[cfg.TargetField] = value
+			return
+		}
+		value, err := lookup(ctx, client, strings.ReplaceAll(cfg.URL, "{key}", url.PathEscape(key)))
+		if err != nil {
+			log.Printf("⚠️  Lookup of %s=%s failed: %v", cfg.KeyField, redactor.RedactField(cfg.KeyField, key), err)
+			return
+		}
+		cache.put(key, value)
+		record[cfg.TargetField] = value
+	}, nil
+}
+
+// metadataStage stores the record's Kinesis metadata in the payload, for consumers
+// downstream of the sinks that route by key or measure end-to-end latency
+func metadataStage(cfg TransformConfig) transformStage {
+	field := cfg.Field
+	if field == "" {
+		field = "_kinesis"
+	}
+	return func(_ context.Context, meta SinkRecord, record map[string]any) {
+		record[field] = map[string]any{
+			"shard_id":            meta.ShardID,
+			"sequence_number":     meta.SequenceNumber,
+			"sub_sequence_number": meta.SubSequenceNumber,
+			"partition_key":       meta.PartitionKey,
+			"arrival_time":        meta.ArrivalTime,
+		}
+	}
+}
+
+func lookup(ctx context.Context, client *http.Client, target string) (any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// A missing key is an answer too, cached as null
+		return nil, nil
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, fmt.Errorf("response is not JSON: %w", err)
+	}
+	return value, nil
+}
+
+// lookupCache is a size-bounded cache with per-entry expiry, shared by all shards
+type lookupCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]lookupEntry
+}
+
+type lookupEntry struct {
+	value   any
+	expires time.Time
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	return &lookupCache{size: size, ttl: ttl, entries: make(map[string]lookupEntry)}
+}
+
+func (c *lookupCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *lookupCache) put(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		// Drop expired entries first, then arbitrary ones until there is room
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = lookupEntry{value: value, expires: now.Add(c.ttl)}
+}
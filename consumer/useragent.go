@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// version is the build version, set with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// tagAWSRequests makes every AWS request of this process, including the clients KCL
+// creates internally, carry "exec-env/kds-consumer_<version>_app_<app>_worker_<id>"
+// in its user agent, so CloudTrail entries and support cases can be attributed to a
+// fleet and pod. aws-sdk-go appends AWS_EXECUTION_ENV to the user agent of each
+// request; an explicitly set value is left alone.
+func tagAWSRequests(cfg *Config) {
+	if os.Getenv("AWS_EXECUTION_ENV") != "" {
+		return
+	}
+	tag := strings.Join([]string{
+		"kds-consumer", userAgentToken(version),
+		"app", userAgentToken(cfg.Consumer.ApplicationName),
+		"worker", userAgentToken(cfg.Consumer.WorkerID),
+	}, "_")
+	os.Setenv("AWS_EXECUTION_ENV", tag)
+}
+
+// userAgentToken replaces characters that are not allowed in a user agent token
+func userAgentToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("!#$%&'*+-.^`|~", r):
+			return r
+		}
+		return '-'
+	}, s)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ValidationConfig checks every record against a JSON Schema before transforms and
+// sinks. Records that fail go to the DLQ with the validation error attached.
+type ValidationConfig struct {
+	// SchemaFile is the path or URL of the schema (draft 4 to 2020-12)
+	SchemaFile string `yaml:"schema_file"`
+}
+
+// recordValidator splits batches into valid and rejected records; nil when
+// validation is not configured
+type recordValidator struct {
+	schema   *jsonschema.Schema
+	valid    atomic.Int64
+	rejected atomic.Int64
+}
+
+func newRecordValidator(cfg ValidationConfig) (*recordValidator, error) {
+	if cfg.SchemaFile == "" {
+		return nil, nil
+	}
+	schema, err := jsonschema.Compile(cfg.SchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile schema %s: %w", cfg.SchemaFile, err)
+	}
+	log.Printf("📐 Validating records against %s", cfg.SchemaFile)
+	return &recordValidator{schema: schema}, nil
+}
+
+// split returns the records that pass and, with Error set, those that do not
+func (v *recordValidator) split(records []SinkRecord) (valid, rejected []SinkRecord) {
+	if v == nil {
+		return records, nil
+	}
+	for _, record := range records {
+		if err := v.validate(record.Data); err != nil {
+			record.Error = err.Error()
+			rejected = append(rejected, record)
+			continue
+		}
+		valid = append(valid, record)
+	}
+	v.valid.Add(int64(len(valid)))
+	v.rejected.Add(int64(len(rejected)))
+	return valid, rejected
+}
+
+func (v *recordValidator) validate(data []byte) error {
+	// UseNumber so integer and multipleOf keywords see exact values
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("not JSON: %w", err)
+	}
+	return v.schema.Validate(doc)
+}
+
+// writeMetrics writes the validation counters in Prometheus text format
+func (v *recordValidator) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP kcl_records_validated_total Records that passed schema validation")
+	fmt.Fprintln(w, "# TYPE kcl_records_validated_total counter")
+	fmt.Fprintf(w, "kcl_records_validated_total %d\n", v.valid.Load())
+	fmt.Fprintln(w, "# HELP kcl_records_rejected_total Records that failed schema validation and went to the DLQ")
+	fmt.Fprintln(w, "# TYPE kcl_records_rejected_total counter")
+	fmt.Fprintf(w, "kcl_records_rejected_total %d\n", v.rejected.Load())
+}
+
+// newDLQ builds the sink for rejected records. It writes immediately, so rejects are
+// durable before the batch is checkpointed, and must be able to carry the error.
+func newDLQ(cfg *Config, region string) (Sink, error) {
+	dlqCfg := cfg.DLQ
+	if dlqCfg.Type == "" {
+		return nil, nil
+	}
+	switch {
+	case dlqCfg.Batch.enabled():
+		return nil, fmt.Errorf("dlq cannot be batched")
+	case dlqCfg.Type == "postgres":
+		return nil, fmt.Errorf("dlq cannot be postgres, the table has no error column")
+	case dlqCfg.Type == "s3" && dlqCfg.S3.Format == "parquet":
+		return nil, fmt.Errorf("dlq cannot write parquet, use ndjson")
+	}
+	sink, err := newSink(cfg, region, dlqCfg)
+	if err != nil {
+		return nil, fmt.Errorf("dlq: %w", err)
+	}
+	log.Printf("📤 Sending rejected records to %s DLQ", dlqCfg.Type)
+	return sink, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// applicationWatermarkKey is the watermark row holding the minimum across all shards
+const applicationWatermarkKey = "application"
+
+// WatermarkConfig enables event-time watermarks: per shard, the latest event
+// timestamp checkpointed; per application, the minimum across shards. Downstream
+// batch jobs read the application row to know up to when the data is complete.
+type WatermarkConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Table defaults to "<application_name>_watermarks", keyed by ShardID
+	Table                 string `yaml:"table"`
+	PublishIntervalMillis int    `yaml:"publish_interval_millis"`
+	// MetricsAddr serves the metrics in Prometheus text format, e.g. ":9102";
+	// kept for older configs, the top-level metrics_addr takes precedence
+	MetricsAddr string `yaml:"metrics_addr"`
+}
+
+// watermarks tracks the shards of this worker; nil when watermarks are disabled
+var watermarks *watermarkTracker
+
+type watermarkTracker struct {
+	mu sync.Mutex
+	// shards holds the watermark of every shard this worker processes; zero until
+	// the first checkpoint, which holds the application watermark back
+	shards map[string]time.Time
+	// finished shards reached SHARD_END and no longer count
+	finished    []string
+	application time.Time
+}
+
+func newWatermarkTracker() *watermarkTracker {
+	return &watermarkTracker{shards: map[string]time.Time{}}
+}
+
+// start registers a shard the worker began processing
+func (w *watermarkTracker) start(shardID string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.shards[shardID]; !ok {
+		w.shards[shardID] = time.Time{}
+	}
+}
+
+// advance moves the shard watermark to eventTime once records up to it are checkpointed
+func (w *watermarkTracker) advance(shardID string, eventTime time.Time) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if eventTime.After(w.shards[shardID]) {
+		w.shards[shardID] = eventTime
+	}
+}
+
+// stop forgets a shard. A shard handed to another worker keeps its row for the new
+// owner to update; a finished shard's row is deleted.
+func (w *watermarkTracker) stop(shardID string, finished bool) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.shards, shardID)
+	if finished {
+		w.finished = append(w.finished, shardID)
+	}
+}
+
+// shardWatermarks returns a copy of the shard watermarks
+func (w *watermarkTracker) shardWatermarks() map[string]time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	shards := make(map[string]time.Time, len(w.shards))
+	for shardID, t := range w.shards {
+		shards[shardID] = t
+	}
+	return shards
+}
+
+// takeFinished returns the shards finished since the last call
+func (w *watermarkTracker) takeFinished() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	finished := w.finished
+	w.finished = nil
+	return finished
+}
+
+// run publishes the watermarks every interval until stop is closed
+func (w *watermarkTracker) run(svc *dynamodb.DynamoDB, table, workerID string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := w.publish(svc, table, workerID); err != nil {
+			log.Printf("⚠️  Failed to publish watermarks: %v", err)
+		}
+	}
+}
+
+// publish writes the shard rows of this worker, then recomputes the application row
+// from all shard rows. The application watermark only moves forward.
+func (w *watermarkTracker) publish(svc *dynamodb.DynamoDB, table, workerID string) error {
+	shards, finished := w.shardWatermarks(), w.takeFinished()
+	now := time.Now().UTC()
+
+	for shardID, t := range shards {
+		if _, err := svc.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(table),
+			Item:      watermarkItem(shardID, t, now, map[string]*dynamodb.AttributeValue{"WorkerID": {S: aws.String(workerID)}}),
+		}); err != nil {
+			return fmt.Errorf("failed to publish watermark of shard %s: %w", shardID, err)
+		}
+	}
+	for i, shardID := range finished {
+		if _, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(table),
+			Key:       map[string]*dynamodb.AttributeValue{leaseKeyKey: {S: aws.String(shardID)}},
+		}); err != nil {
+			for _, retry := range finished[i:] {
+				w.stop(retry, true)
+			}
+			return fmt.Errorf("failed to delete watermark of finished shard %s: %w", shardID, err)
+		}
+	}
+
+	var low time.Time
+	count := 0
+	err := svc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(table), ConsistentRead: aws.Bool(true)},
+		func(page *dynamodb.ScanOutput, _ bool) bool {
+			for _, item := range page.Items {
+				if aws.StringValue(item[leaseKeyKey].S) == applicationWatermarkKey {
+					continue
+				}
+				var millis int64
+				if value := item["WatermarkMillis"]; value != nil {
+					millis, _ = strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+				}
+				t := time.UnixMilli(millis).UTC()
+				if count == 0 || t.Before(low) {
+					low = t
+				}
+				count++
+			}
+			return true
+		})
+	if err != nil {
+		return fmt.Errorf("failed to read shard watermarks: %w", err)
+	}
+	// Some shard has not checkpointed yet: the application watermark is unknown
+	if count == 0 || low.UnixMilli() <= 0 {
+		return nil
+	}
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item: watermarkItem(applicationWatermarkKey, low, now, map[string]*dynamodb.AttributeValue{
+			"ShardCount": {N: aws.String(strconv.Itoa(count))},
+		}),
+		ConditionExpression:       aws.String("attribute_not_exists(WatermarkMillis) OR WatermarkMillis < :new"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":new": {N: aws.String(strconv.FormatInt(low.UnixMilli(), 10))}},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish application watermark: %w", err)
+	}
+
+	w.mu.Lock()
+	if low.After(w.application) {
+		w.application = low
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+func watermarkItem(key string, t, now time.Time, extra map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	millis := int64(0)
+	if !t.IsZero() {
+		millis = t.UnixMilli()
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		leaseKeyKey:       {S: aws.String(key)},
+		"WatermarkMillis": {N: aws.String(strconv.FormatInt(millis, 10))},
+		"Watermark":       {S: aws.String(t.UTC().Format(time.RFC3339Nano))},
+		"UpdatedAt":       {S: aws.String(now.Format(time.RFC3339))},
+	}
+	for name, value := range extra {
+		item[name] = value
+	}
+	return item
+}
+
+// ensureWatermarkTable creates the watermark table on demand
+func ensureWatermarkTable(svc *dynamodb.DynamoDB, table string) error {
+	_, err := svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return createLeaseTable(svc, table, LeaseTableConfig{})
+	}
+	return err
+}
+
+// writeMetrics writes the watermarks in Prometheus text format
+func (w *watermarkTracker) writeMetrics(rw io.Writer) {
+	shards := w.shardWatermarks()
+	fmt.Fprintln(rw, "# HELP kcl_shard_event_watermark_seconds Latest event time checkpointed per shard of this worker (the lowest, aggregated to the worker)")
+	fmt.Fprintln(rw, "# TYPE kcl_shard_event_watermark_seconds gauge")
+	values := make(map[string]float64, len(shards))
+	for shardID, t := range shards {
+		values[shardID] = float64(unixOrZero(t))
+	}
+	writeShardSeries(rw, "watermark", "kcl_shard_event_watermark_seconds", values, aggregateMin)
+
+	w.mu.Lock()
+	application := w.application
+	w.mu.Unlock()
+	fmt.Fprintln(rw, "# HELP kcl_application_event_watermark_seconds Minimum event-time watermark across all shards")
+	fmt.Fprintln(rw, "# TYPE kcl_application_event_watermark_seconds gauge")
+	fmt.Fprintf(rw, "kcl_application_event_watermark_seconds %d\n", unixOrZero(application))
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// windowStateKey holds the open window in the shard state
+const windowStateKey = "window"
+
+// shardWindows aggregates the events of one shard per action into tumbling
+// event-time windows. The open window lives in the shard state, so a window still
+// open when the lease moves is completed by the next owner. A window is emitted as
+// one "WINDOW_AGGREGATE {json}" line on stdout when an event of a later window
+// arrives, or when the shard ends.
+type shardWindows struct {
+	shardID string
+	size    time.Duration
+	state   *ShardState
+	open    *windowAggregate
+	changed bool
+}
+
+type windowAggregate struct {
+	ShardID string                      `json:"shard_id"`
+	Start   time.Time                   `json:"start"`
+	End     time.Time                   `json:"end"`
+	Actions map[string]*actionAggregate `json:"actions"`
+	// Late counts events of windows already emitted, which are dropped
+	Late int64 `json:"late"`
+}
+
+type actionAggregate struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// newShardWindows restores the open window of the shard; nil unless shard state and
+// window_millis are configured
+func newShardWindows(shardID string, state *ShardState) *shardWindows {
+	if state == nil || states.window <= 0 {
+		return nil
+	}
+	w := &shardWindows{shardID: shardID, size: states.window, state: state}
+	if data, ok := state.Get(windowStateKey); ok {
+		open := new(windowAggregate)
+		if err := json.Unmarshal(data, open); err != nil {
+			log.Printf("[%s] ⚠️  Dropping undecodable window state: %v", shardID, err)
+		} else {
+			// An inherited window belongs to the parent: emit it under this shard
+			open.ShardID = shardID
+			w.open = open
+		}
+	}
+	return w
+}
+
+// observe adds one event; sequence is the record's, so records the restored state
+// already covers are not counted twice
+func (w *shardWindows) observe(event Event, sequence string) {
+	if w == nil || event.Timestamp.IsZero() || w.state.Covers(sequence) {
+		return
+	}
+	start := event.Timestamp.UTC().Truncate(w.size)
+	switch {
+	case w.open == nil:
+	case start.After(w.open.Start):
+		w.emit()
+	case start.Before(w.open.Start):
+		w.open.Late++
+		w.changed = true
+		return
+	}
+	if w.open == nil {
+		w.open = &windowAggregate{ShardID: w.shardID, Start: start, End: start.Add(w.size), Actions: make(map[string]*actionAggregate)}
+	}
+	agg := w.open.Actions[event.Action]
+	if agg == nil {
+		agg = new(actionAggregate)
+		w.open.Actions[event.Action] = agg
+	}
+	agg.Count++
+	agg.Sum += event.Value
+	w.changed = true
+}
+
+// sync writes the open window to the shard state; call it before the state is saved
+func (w *shardWindows) sync() {
+	if w == nil || !w.changed {
+		return
+	}
+	w.changed = false
+	if w.open == nil {
+		w.state.Delete(windowStateKey)
+		return
+	}
+	data, err := json.Marshal(w.open)
+	if err != nil {
+		log.Printf("[%s] ⚠️  Failed to encode window state: %v", w.shardID, err)
+		return
+	}
+	w.state.Put(windowStateKey, data)
+}
+
+// close emits the open window of a finished shard, so its children start afresh
+func (w *shardWindows) close() {
+	if w == nil || w.open == nil {
+		return
+	}
+	w.emit()
+	w.sync()
+}
+
+func (w *shardWindows) emit() {
+	data, err := json.Marshal(w.open)
+	if err != nil {
+		log.Printf("[%s] ⚠️  Failed to encode window: %v", w.shardID, err)
+	} else {
+		fmt.Fprintf(os.Stdout, "WINDOW_AGGREGATE %s\n", data)
+	}
+	w.open = nil
+	w.changed = true
+}
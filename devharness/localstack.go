@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"gopkg.in/yaml.v3"
+)
+
+// leaseKeyKey and leaseOwnerKey are the KCL lease table attributes
+const (
+	leaseKeyKey   = "ShardID"
+	leaseOwnerKey = "AssignedTo"
+)
+
+// consumerTemplate is the consumer config every worker starts from. The raw document
+// is kept so the settings the harness does not touch reach the workers unchanged.
+type consumerTemplate struct {
+	doc        map[string]any
+	region     string
+	endpoint   string
+	accessKey  string
+	secretKey  string
+	streamName string
+	appName    string
+}
+
+func loadConsumerTemplate(path string) (*consumerTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumer config %s: %w", path, err)
+	}
+	t := &consumerTemplate{}
+	if err := yaml.Unmarshal(data, &t.doc); err != nil {
+		return nil, fmt.Errorf("failed to parse consumer config %s: %w", path, err)
+	}
+	var fields struct {
+		AWS struct {
+			Region    string `yaml:"region"`
+			Endpoint  string `yaml:"endpoint"`
+			AccessKey string `yaml:"access_key"`
+			SecretKey string `yaml:"secret_key"`
+		} `yaml:"aws"`
+		Kinesis struct {
+			StreamName string `yaml:"stream_name"`
+		} `yaml:"kinesis"`
+		Consumer struct {
+			ApplicationName string `yaml:"application_name"`
+		} `yaml:"consumer"`
+	}
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse consumer config %s: %w", path, err)
+	}
+	if fields.AWS.Endpoint == "" || fields.Kinesis.StreamName == "" || fields.Consumer.ApplicationName == "" {
+		return nil, fmt.Errorf("consumer config %s needs aws.endpoint, kinesis.stream_name and consumer.application_name", path)
+	}
+	t.region, t.endpoint = fields.AWS.Region, fields.AWS.Endpoint
+	t.accessKey, t.secretKey = fields.AWS.AccessKey, fields.AWS.SecretKey
+	t.streamName, t.appName = fields.Kinesis.StreamName, fields.Consumer.ApplicationName
+	return t, nil
+}
+
+// writeWorkerConfig writes the template with the worker's ID, the pod count and,
+// when set, its own metrics address, and returns the file's path
+func (t *consumerTemplate) writeWorkerConfig(dir, workerID string, workers int, metricsAddr string) (string, error) {
+	doc := make(map[string]any, len(t.doc))
+	for k, v := range t.doc {
+		doc[k] = v
+	}
+	consumer := map[string]any{}
+	if c, ok := t.doc["consumer"].(map[string]any); ok {
+		for k, v := range c {
+			consumer[k] = v
+		}
+	}
+	consumer["worker_id"] = workerID
+	consumer["total_num_pods"] = workers
+	doc["consumer"] = consumer
+	if metricsAddr != "" {
+		doc["metrics_addr"] = metricsAddr
+	}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, workerID+".yaml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write config of %s: %w", workerID, err)
+	}
+	return path, nil
+}
+
+// composeUp starts the compose project; LocalStack's init script creates the stream
+func composeUp(ctx context.Context, root, file string) error {
+	log.Printf("🚀 Starting LocalStack (%s)...", file)
+	cmd := exec.CommandContext(ctx, "docker-compose", "-f", file, "up", "-d")
+	cmd.Dir, cmd.Stdout, cmd.Stderr = root, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker-compose up failed: %w", err)
+	}
+	return nil
+}
+
+func composeDown(root, file string) {
+	log.Println("🛑 Stopping LocalStack...")
+	cmd := exec.Command("docker-compose", "-f", file, "down")
+	cmd.Dir, cmd.Stdout, cmd.Stderr = root, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("⚠️  docker-compose down failed: %v", err)
+	}
+}
+
+// localEnvironment holds the clients of the LocalStack the workers use
+type localEnvironment struct {
+	kinesis    *kinesis.Client
+	dynamodb   *dynamodb.Client
+	streamName string
+	leaseTable string
+}
+
+func newLocalEnvironment(ctx context.Context, t *consumerTemplate) (*localEnvironment, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(t.region),
+		config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{URL: t.endpoint, HostnameImmutable: true}, nil
+			})),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(t.accessKey, t.secretKey, "")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return &localEnvironment{
+		kinesis:    kinesis.NewFromConfig(awsCfg),
+		dynamodb:   dynamodb.NewFromConfig(awsCfg),
+		streamName: t.streamName,
+		leaseTable: t.appName,
+	}, nil
+}
+
+// waitReady retries until Kinesis and DynamoDB answer, for up to two minutes
+func (e *localEnvironment) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	for {
+		_, err := e.kinesis.ListStreams(ctx, &kinesis.ListStreamsInput{Limit: aws.Int32(1)})
+		if err == nil {
+			_, err = e.dynamodb.ListTables(ctx, &dynamodb.ListTablesInput{Limit: aws.Int32(1)})
+		}
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// ensureStream creates the stream with shards shards unless it exists, then waits
+// until it is active. An existing stream keeps its shard count.
+func (e *localEnvironment) ensureStream(ctx context.Context, shards int) error {
+	_, err := e.kinesis.CreateStream(ctx, &kinesis.CreateStreamInput{
+		StreamName: aws.String(e.streamName),
+		ShardCount: aws.Int32(int32(shards)),
+	})
+	var inUse *kinesistypes.ResourceInUseException
+	switch {
+	case err == nil:
+		log.Printf("📝 Created stream %s with %d shards", e.streamName, shards)
+	case errors.As(err, &inUse):
+	default:
+		return fmt.Errorf("failed to create stream %s: %w", e.streamName, err)
+	}
+
+	waiter := kinesis.NewStreamExistsWaiter(e.kinesis)
+	if err := waiter.Wait(ctx, &kinesis.DescribeStreamInput{StreamName: aws.String(e.streamName)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("stream %s did not become active: %w", e.streamName, err)
+	}
+	summary, err := e.kinesis.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(e.streamName)})
+	if err != nil {
+		return fmt.Errorf("failed to describe stream %s: %w", e.streamName, err)
+	}
+	log.Printf("✅ Stream %s is active with %d open shards", e.streamName, aws.ToInt32(summary.StreamDescriptionSummary.OpenShardCount))
+	return nil
+}
+
+// ensureLeaseTable creates the KCL lease table unless it exists, so the workers do
+// not race to create it and the status view can read it from the start
+func (e *localEnvironment) ensureLeaseTable(ctx context.Context) error {
+	_, err := e.dynamodb.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(e.leaseTable),
+		AttributeDefinitions: []dbtypes.AttributeDefinition{
+			{AttributeName: aws.String(leaseKeyKey), AttributeType: dbtypes.ScalarAttributeTypeS},
+		},
+		KeySchema: []dbtypes.KeySchemaElement{
+			{AttributeName: aws.String(leaseKeyKey), KeyType: dbtypes.KeyTypeHash},
+		},
+		BillingMode: dbtypes.BillingModePayPerRequest,
+	})
+	var inUse *dbtypes.ResourceInUseException
+	switch {
+	case err == nil:
+		log.Printf("📝 Created lease table %s", e.leaseTable)
+	case errors.As(err, &inUse):
+	default:
+		return fmt.Errorf("failed to create lease table %s: %w", e.leaseTable, err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(e.dynamodb)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(e.leaseTable)}, time.Minute); err != nil {
+		return fmt.Errorf("lease table %s did not become active: %w", e.leaseTable, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Local development harness: starts LocalStack, creates the stream and the KCL lease
+// table, builds and launches N consumers and the producer with distinct worker IDs,
+// and prints their logs with a periodic lease status view in one terminal.
+//
+//	cd devharness && go run . -workers 3
+func main() {
+	var opts harnessOptions
+	flag.StringVar(&opts.root, "root", "..", "Repository root")
+	flag.StringVar(&opts.compose, "compose", "docker-compose-20.yml", "Compose file starting LocalStack, relative to -root; empty uses a LocalStack already running")
+	flag.StringVar(&opts.template, "config", "config/config-pod1.yaml", "Consumer config used as the template of every worker, relative to -root")
+	flag.IntVar(&opts.workers, "workers", 3, "Consumer processes to launch")
+	flag.IntVar(&opts.shards, "shards", 20, "Shards of the stream when the harness creates it")
+	flag.BoolVar(&opts.producer, "producer", true, "Also run the producer")
+	flag.IntVar(&opts.metricsPort, "metrics-port", 9102, "Metrics port of the first worker, the next workers count up; 0 keeps the template's metrics_addr")
+	flag.DurationVar(&opts.statusInterval, "status-interval", 15*time.Second, "How often to print the lease status view")
+	flag.BoolVar(&opts.down, "down", false, "Stop LocalStack on exit")
+	flag.Parse()
+
+	if opts.workers < 1 {
+		log.Fatalf("❌ -workers must be at least 1, got %d", opts.workers)
+	}
+	root, err := filepath.Abs(opts.root)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	opts.root = root
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, opts))
+}
+
+// harnessOptions are the command line flags
+type harnessOptions struct {
+	root           string
+	compose        string
+	template       string
+	workers        int
+	shards         int
+	producer       bool
+	metricsPort    int
+	statusInterval time.Duration
+	down           bool
+}
+
+func run(ctx context.Context, opts harnessOptions) int {
+	template, err := loadConsumerTemplate(filepath.Join(opts.root, opts.template))
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+
+	if opts.compose != "" {
+		if err := composeUp(ctx, opts.root, opts.compose); err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+		if opts.down {
+			defer composeDown(opts.root, opts.compose)
+		}
+	}
+
+	env, err := newLocalEnvironment(ctx, template)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	if err := env.waitReady(ctx); err != nil {
+		log.Printf("❌ LocalStack not reachable at %s: %v", template.endpoint, err)
+		return 1
+	}
+	if err := env.ensureStream(ctx, opts.shards); err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	if err := env.ensureLeaseTable(ctx); err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+
+	binDir := filepath.Join(opts.root, "bin")
+	if err := buildBinaries(ctx, opts.root, binDir, opts.producer); err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	configDir, err := os.MkdirTemp("", "kds-devharness-")
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return 1
+	}
+	defer os.RemoveAll(configDir)
+
+	procs := newProcessGroup()
+	defer procs.stop(15 * time.Second)
+	for i := 1; i <= opts.workers; i++ {
+		workerID := fmt.Sprintf("consumer-pod-%d", i)
+		metricsAddr := ""
+		if opts.metricsPort > 0 {
+			metricsAddr = fmt.Sprintf(":%d", opts.metricsPort+i-1)
+		}
+		configFile, err := template.writeWorkerConfig(configDir, workerID, opts.workers, metricsAddr)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+		// The consumer resolves its relative paths from its own directory, like make consumer-podN
+		if err := procs.start(workerID, filepath.Join(opts.root, "consumer"), filepath.Join(binDir, "enhanced-consumer"), "CONFIG_FILE="+configFile); err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+	}
+	if opts.producer {
+		// The producer reads ../config/config-20-shards.yaml
+		if err := procs.start("producer", filepath.Join(opts.root, "producer"), filepath.Join(binDir, "producer")); err != nil {
+			log.Printf("❌ %v", err)
+			return 1
+		}
+	}
+
+	log.Printf("✅ %d consumers running against %s; Ctrl-C stops them", opts.workers, template.streamName)
+	ticker := time.NewTicker(opts.statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			env.printStatus(ctx, procs)
+		case name := <-procs.exited:
+			// Killing a worker is part of the experiments; stop once nothing runs
+			log.Printf("⚠️  %s exited", name)
+			if procs.running() == 0 {
+				log.Println("❌ Every process exited")
+				return 1
+			}
+		case <-ctx.Done():
+			log.Println("🛑 Stopping...")
+			return 0
+		}
+	}
+}
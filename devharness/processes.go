@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// buildBinaries builds the consumer and, when needed, the producer into binDir, as
+// make build does, so the workers start without compiling N times
+func buildBinaries(ctx context.Context, root, binDir string, producer bool) error {
+	builds := [][2]string{{"consumer", "enhanced-consumer"}}
+	if producer {
+		builds = append(builds, [2]string{"producer", "producer"})
+	}
+	for _, b := range builds {
+		log.Printf("🔨 Building %s...", b[0])
+		cmd := exec.CommandContext(ctx, "go", "build", "-o", filepath.Join(binDir, b[1]), ".")
+		cmd.Dir, cmd.Stdout, cmd.Stderr = filepath.Join(root, b[0]), os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to build %s: %w", b[0], err)
+		}
+	}
+	return nil
+}
+
+// processGroup runs the workers and the producer, interleaving their output line by
+// line behind the name of the process
+type processGroup struct {
+	mu    sync.Mutex
+	out   sync.Mutex
+	procs []*process
+	// exited receives the name of every process that ends
+	exited chan string
+}
+
+func newProcessGroup() *processGroup {
+	return &processGroup{exited: make(chan string)}
+}
+
+type process struct {
+	name    string
+	cmd     *exec.Cmd
+	started time.Time
+	done    chan struct{}
+	err     error
+}
+
+// start launches bin in dir with the harness environment plus env
+func (g *processGroup) start(name, dir, bin string, env ...string) error {
+	cmd := exec.Command(bin)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	// Signals reach the children through stop only, not from the terminal directly
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	log.Printf("▶️  Started %s (pid %d)", name, cmd.Process.Pid)
+
+	p := &process{name: name, cmd: cmd, started: time.Now(), done: make(chan struct{})}
+	g.mu.Lock()
+	g.procs = append(g.procs, p)
+	g.mu.Unlock()
+
+	go func() {
+		g.copyLines(name, stdout)
+		p.err = cmd.Wait()
+		close(p.done)
+		g.exited <- name
+	}()
+	return nil
+}
+
+func (g *processGroup) copyLines(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		g.out.Lock()
+		fmt.Printf("%-16s | %s\n", name, scanner.Text())
+		g.out.Unlock()
+	}
+}
+
+// running returns the processes still alive
+func (g *processGroup) running() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, p := range g.procs {
+		select {
+		case <-p.done:
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// snapshot returns name, state and uptime of every process
+func (g *processGroup) snapshot() [][3]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rows := make([][3]string, 0, len(g.procs))
+	for _, p := range g.procs {
+		select {
+		case <-p.done:
+			state := "exited"
+			if p.err != nil {
+				state = "exited: " + p.err.Error()
+			}
+			rows = append(rows, [3]string{p.name, state, ""})
+		default:
+			rows = append(rows, [3]string{p.name, "running", time.Since(p.started).Round(time.Second).String()})
+		}
+	}
+	return rows
+}
+
+// stop sends SIGTERM to every process so the consumers shut down gracefully and
+// hand over their leases, and kills whatever is left after timeout
+func (g *processGroup) stop(timeout time.Duration) {
+	g.mu.Lock()
+	procs := append([]*process(nil), g.procs...)
+	g.mu.Unlock()
+
+	for _, p := range procs {
+		p.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	for _, p := range procs {
+		if !expired {
+			select {
+			case <-p.done:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-p.done:
+		default:
+			log.Printf("⚠️  %s did not stop within %s, killing it", p.name, timeout)
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+	}
+}
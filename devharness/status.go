@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// leaseStatus summarizes the KCL lease table like scripts/view-distribution.sh
+type leaseStatus struct {
+	total      int
+	closed     int // checkpointed at SHARD_END
+	unassigned int // open and owned by nobody
+	byOwner    map[string]int
+}
+
+func (e *localEnvironment) leaseStatus(ctx context.Context) (leaseStatus, error) {
+	status := leaseStatus{byOwner: map[string]int{}}
+	paginator := dynamodb.NewScanPaginator(e.dynamodb, &dynamodb.ScanInput{TableName: aws.String(e.leaseTable)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return status, fmt.Errorf("failed to scan lease table %s: %w", e.leaseTable, err)
+		}
+		for _, item := range page.Items {
+			status.total++
+			owner := attrString(item, leaseOwnerKey)
+			switch {
+			case attrString(item, "Checkpoint") == "SHARD_END":
+				status.closed++
+			case owner == "":
+				status.unassigned++
+			default:
+				status.byOwner[owner]++
+			}
+		}
+	}
+	return status, nil
+}
+
+func attrString(item map[string]dbtypes.AttributeValue, key string) string {
+	if v, ok := item[key].(*dbtypes.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+// printStatus prints the processes and the lease distribution as one block, so it
+// stands out between the interleaved logs
+func (e *localEnvironment) printStatus(ctx context.Context, procs *processGroup) {
+	var b strings.Builder
+	b.WriteString("==================== status ====================\n")
+	status, err := e.leaseStatus(ctx)
+	if err != nil {
+		fmt.Fprintf(&b, "⚠️  %v\n", err)
+	}
+	for _, p := range procs.snapshot() {
+		line := fmt.Sprintf("%-16s %-10s %s", p[0], p[1], p[2])
+		if n, ok := status.byOwner[p[0]]; ok {
+			line += fmt.Sprintf("  %d leases", n)
+			delete(status.byOwner, p[0])
+		}
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	// Owners without a process here, e.g. workers of an earlier run whose leases
+	// have not expired yet
+	owners := make([]string, 0, len(status.byOwner))
+	for owner := range status.byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		fmt.Fprintf(&b, "%-16s %-10s   %d leases\n", owner, "unknown", status.byOwner[owner])
+	}
+	if err == nil {
+		fmt.Fprintf(&b, "leases: %d total, %d closed (SHARD_END), %d unassigned\n", status.total, status.closed, status.unassigned)
+	}
+	b.WriteString("================================================")
+
+	procs.out.Lock()
+	fmt.Println(b.String())
+	procs.out.Unlock()
+}
@@ -0,0 +1,41 @@
+#!/bin/bash
+
+# Game-day drill: reshard the stream via UpdateShardCount, roll the workers and
+# verify the lease manager converges. Non-prod only: the test-consumer refuses to
+# run unless it talks to LocalStack or the account is in KDS_GAMEDAY_ALLOWED_ACCOUNTS.
+
+set -e
+
+NAMESPACE="${NAMESPACE:-kds-test}"
+
+if [ -z "$1" ]; then
+    echo "Usage: $0 <target_shard_count>"
+    echo "Example: $0 60"
+    exit 1
+fi
+
+TARGET_SHARDS=$1
+
+echo "=========================================="
+echo "Game Day: Reshard and Verify Convergence"
+echo "=========================================="
+echo "Namespace: $NAMESPACE"
+echo "Target shards: $TARGET_SHARDS"
+echo ""
+
+echo "Step 1: Resharding stream (waits until ACTIVE)..."
+kubectl exec -n $NAMESPACE kds-consumer-0 -- ./test-consumer gameday reshard $TARGET_SHARDS
+
+echo ""
+echo "Step 2: Rolling restart so every worker recalculates..."
+kubectl rollout restart statefulset/kds-consumer -n $NAMESPACE
+kubectl rollout status statefulset/kds-consumer -n $NAMESPACE --timeout=300s
+
+echo ""
+echo "Step 3: Verifying convergence..."
+kubectl exec -n $NAMESPACE kds-consumer-0 -- ./test-consumer gameday verify
+
+echo ""
+echo "=========================================="
+echo "Game Day Complete!"
+echo "=========================================="
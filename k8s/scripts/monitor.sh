@@ -30,7 +30,7 @@ while true; do
     echo "-------------------------------------------"
     kubectl exec -n $NAMESPACE deployment/localstack -- awslocal dynamodb get-item \
         --table-name kds-consumer-app_meta \
-        --key '{"worker_id":{"S":"kds-consumer-app_coordinator"}}' 2>/dev/null || echo "No coordinator metadata found"
+        --key '{"worker_id":{"S":"kds-consumer-app#test-stream#us-east-1#coordinator"}}' 2>/dev/null || echo "No coordinator metadata found"
     
     echo ""
     echo "Pod Status:"
@@ -54,10 +54,9 @@ echo ""
 
 # Build the test consumer image
 echo "Building test consumer Docker image..."
-cd test/test-consumer
-docker build -t kds-consumer-test:latest .
+# The image builds from the repository root, which holds the shared leasemanager module
+docker build -t kds-consumer-test:latest -f test/test-consumer/Dockerfile ..
 echo "✅ Docker image built: kds-consumer-test:latest"
-cd ../../
 echo ""
 
 # Deploy using Helm
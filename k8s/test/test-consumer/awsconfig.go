@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// loadAWSConfig is the shared AWS config loader for every client in the process: the
+// default credential chain, an optional endpoint override (LocalStack), the HTTP
+// client settings, the fleet user agent, Kinesis call counting, clock offset sampling and, when
+// configured, an explicit web identity role
+func loadAWSConfig(ctx context.Context, region, endpoint string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+
+	if endpoint != "" {
+		opts = append(opts, config.WithEndpointResolverWithOptions(
+			aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               endpoint,
+					HostnameImmutable: true,
+					SigningRegion:     region,
+				}, nil
+			}),
+		))
+	}
+
+	httpOpts, err := httpClientOptionsFromEnv()
+	if err != nil {
+		return aws.Config{}, err
+	}
+	opts = append(opts, httpOpts...)
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	awsCfg.APIOptions = append(awsCfg.APIOptions, userAgentOptions()...)
+	awsCfg.APIOptions = append(awsCfg.APIOptions, kinesisCallCounting, clockOffsetObserving)
+	if err := applyWebIdentityRole(&awsCfg); err != nil {
+		return aws.Config{}, err
+	}
+	return awsCfg, nil
+}
+
+// applyWebIdentityRole replaces the credentials of awsCfg with
+// AssumeRoleWithWebIdentity when KDS_WEB_IDENTITY_ROLE_ARN and
+// KDS_WEB_IDENTITY_TOKEN_FILE are set. This serves clusters federated through their
+// own OIDC issuer (not EKS IRSA), where the projected token lives at a custom path
+// or the AWS_ROLE_ARN/AWS_WEB_IDENTITY_TOKEN_FILE variables are taken by something
+// else. KDS_ROLE_SESSION_NAME (default: the pod name) and KDS_ROLE_SESSION_DURATION
+// are optional.
+func applyWebIdentityRole(awsCfg *aws.Config) error {
+	roleARN := os.Getenv("KDS_WEB_IDENTITY_ROLE_ARN")
+	tokenFile := os.Getenv("KDS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" && tokenFile == "" {
+		return nil
+	}
+	if roleARN == "" || tokenFile == "" {
+		return fmt.Errorf("KDS_WEB_IDENTITY_ROLE_ARN and KDS_WEB_IDENTITY_TOKEN_FILE must be set together")
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return fmt.Errorf("web identity token file: %w", err)
+	}
+
+	sessionName := getEnv("KDS_ROLE_SESSION_NAME", getEnv("HOSTNAME", "kds-consumer"))
+	duration := getEnvDuration("KDS_ROLE_SESSION_DURATION", time.Hour)
+
+	// AssumeRoleWithWebIdentity is unsigned; the STS client uses the base config
+	// only for region and endpoint
+	provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(*awsCfg), roleARN,
+		stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = sessionName
+			o.Duration = duration
+		})
+	awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	return nil
+}
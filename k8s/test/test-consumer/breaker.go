@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrCircuitOpen is returned without calling DynamoDB while the metadata store
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("metadata store circuit breaker is open")
+
+// Circuit breaker states, also the value of kds_metadata_breaker_state
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+var breakerStateNames = map[int]string{breakerClosed: "closed", breakerOpen: "open", breakerHalfOpen: "half_open"}
+
+var (
+	breakerStateGauge       = metrics.gauge("kds_metadata_breaker_state", "Metadata store circuit breaker state (0 closed, 1 open, 2 half-open)")
+	breakerTransitions      = metrics.counter("kds_metadata_breaker_transitions_total", "Metadata store circuit breaker state transitions")
+	breakerRejectedRequests = metrics.counter("kds_metadata_breaker_rejected_total", "Metadata calls rejected while the circuit breaker was open")
+)
+
+// circuitBreaker opens after threshold consecutive failed calls and rejects calls for
+// cooldown. It then lets one probe call through: success closes it, failure reopens it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	breakerStateGauge.set(breakerClosed)
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go ahead
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only the probe call goes through until it has a result
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record feeds the outcome of an allowed call back into the breaker
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.transition(breakerOpen)
+	}
+}
+
+// abandon releases a probe slot without an outcome
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) transition(to int) {
+	from := b.state
+	b.state = to
+	breakerStateGauge.set(float64(to))
+	breakerTransitions.add(1, "from", breakerStateNames[from], "to", breakerStateNames[to])
+	log.Printf("Metadata store circuit breaker %s -> %s (%d consecutive failures)",
+		breakerStateNames[from], breakerStateNames[to], b.failures)
+}
+
+// breakerDynamoDB fails metadata calls fast with ErrCircuitOpen while DynamoDB keeps
+// erroring, so a fleet stops hammering a struggling table. Expected outcomes such as
+// failed conditions or a missing table, and calls cancelled by their caller, do not
+// count as failures.
+type breakerDynamoDB struct {
+	next    DynamoDBAPIForLease
+	breaker *circuitBreaker
+}
+
+// newBreakerDynamoDBFromEnv wraps client using KDS_BREAKER_FAILURES (consecutive
+// failures that open the breaker, default 5, 0 disables) and KDS_BREAKER_COOLDOWN
+// (how long it stays open, default 30s)
+func newBreakerDynamoDBFromEnv(client DynamoDBAPIForLease) DynamoDBAPIForLease {
+	threshold := int(getEnvFloat("KDS_BREAKER_FAILURES", 5))
+	if threshold <= 0 {
+		return client
+	}
+	cooldown := getEnvDuration("KDS_BREAKER_COOLDOWN", 30*time.Second)
+	return &breakerDynamoDB{next: client, breaker: newCircuitBreaker(threshold, cooldown)}
+}
+
+// call runs fn through the breaker
+func (d *breakerDynamoDB) call(ctx context.Context, fn func() error) error {
+	if !d.breaker.allow() {
+		breakerRejectedRequests.add(1)
+		return ErrCircuitOpen
+	}
+	err := fn()
+	if err != nil && ctx.Err() != nil {
+		// Cancelled by the caller; says nothing about the table
+		d.breaker.abandon()
+		return err
+	}
+	d.breaker.record(isMetadataStoreFailure(err))
+	return err
+}
+
+func isMetadataStoreFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var condCheckErr *types.ConditionalCheckFailedException
+	var notFound *types.ResourceNotFoundException
+	var inUse *types.ResourceInUseException
+	return !errors.As(err, &condCheckErr) && !errors.As(err, &notFound) && !errors.As(err, &inUse)
+}
+
+func (d *breakerDynamoDB) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.CreateTableOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.CreateTable(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.DescribeTableOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.DescribeTable(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.GetItemOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.GetItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.PutItemOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.PutItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.ScanOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.Scan(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.BatchGetItemOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.BatchGetItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.DeleteItemOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.DeleteItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (d *breakerDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.UpdateItemOutput, err error) {
+	err = d.call(ctx, func() error {
+		out, err = d.next.UpdateItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// Candidate lease policy states
+const (
+	CandidateStatusPending    = "pending"
+	CandidateStatusPromoted   = "promoted"
+	CandidateStatusRolledBack = "rolled_back"
+)
+
+// canaryPodLabel marks a pod as a canary; KDS_CANARY=true does the same outside Kubernetes
+const canaryPodLabel = "kds-lease-canary"
+
+// LeaseCandidate is a max leases value published for canary workers only. After its
+// observation window passes without regression it is promoted to the coordinator
+// value used by the whole fleet.
+type LeaseCandidate struct {
+	MaxLeasesPerWorker int
+	PublishedAt        time.Time
+	ObservationWindow  time.Duration
+	Status             string
+	Reason             string
+}
+
+// CanaryHealth is a canary worker's processing health
+type CanaryHealth struct {
+	Errors int64         // cumulative processing errors
+	Lag    time.Duration // current aggregate lag
+}
+
+// CanaryPolicy decides when a canary's observations count as a regression
+type CanaryPolicy struct {
+	MaxLag    time.Duration // lag above this rolls the candidate back (0 disables the check)
+	MaxErrors int64         // errors since the candidate was applied above this roll it back
+}
+
+// canaryPolicyFromEnv reads KDS_CANARY_MAX_LAG and KDS_CANARY_MAX_ERRORS
+func canaryPolicyFromEnv() CanaryPolicy {
+	policy := CanaryPolicy{
+		MaxLag:    getEnvDuration("KDS_CANARY_MAX_LAG", 5*time.Minute),
+		MaxErrors: 0,
+	}
+	if v := os.Getenv("KDS_CANARY_MAX_ERRORS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("WARN: invalid KDS_CANARY_MAX_ERRORS=%q, using 0", v)
+		} else {
+			policy.MaxErrors = n
+		}
+	}
+	return policy
+}
+
+// EnableCanary sets the health source and regression policy used while this worker
+// runs a candidate value; health may be nil when no signal is available
+func (lm *KDSLeaseManager) EnableCanary(health func() CanaryHealth, policy CanaryPolicy) {
+	lm.canaryHealth = health
+	lm.canaryPolicy = policy
+}
+
+func (lm *KDSLeaseManager) getCandidateKey() string {
+	return lm.keys().Prefix() + "candidate"
+}
+
+func (lm *KDSLeaseManager) getCanaryReportKey(workerID string) string {
+	return lm.keys().Prefix() + "canary#" + workerID
+}
+
+// isCanary reports whether this worker should apply candidate values, either through
+// KDS_CANARY=true or the kds-lease-canary=true pod label
+func (lm *KDSLeaseManager) isCanary(ctx context.Context) bool {
+	if os.Getenv("KDS_CANARY") == "true" {
+		return true
+	}
+	if lm.k8sClient == nil {
+		return false
+	}
+	pod, err := lm.k8sClient.GetPod(ctx, currentNamespace(), lm.workerID)
+	if err != nil {
+		log.Printf("WARN: Failed to read pod labels for canary check: %v", err)
+		return false
+	}
+	return pod.Labels[canaryPodLabel] == "true"
+}
+
+// PublishCandidate publishes maxLeases for canary workers. It fails while another
+// candidate is still pending.
+func (lm *KDSLeaseManager) PublishCandidate(ctx context.Context, maxLeases int, window time.Duration) (*LeaseCandidate, error) {
+	if maxLeases < 1 || maxLeases > leasemanager.MaxLeasePerWorkerLimit {
+		return nil, fmt.Errorf("candidate max leases %d outside 1-%d", maxLeases, leasemanager.MaxLeasePerWorkerLimit)
+	}
+
+	candidate := &LeaseCandidate{
+		MaxLeasesPerWorker: maxLeases,
+		PublishedAt:        time.Now().UTC(),
+		ObservationWindow:  window,
+		Status:             CandidateStatusPending,
+	}
+
+	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(lm.metadataTable),
+		Item:                      lm.candidateItem(candidate),
+		ConditionExpression:       aws.String("attribute_not_exists(worker_id) OR #status <> :pending"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pending": &types.AttributeValueMemberS{Value: CandidateStatusPending}},
+	})
+	if err != nil {
+		var condCheckErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condCheckErr) {
+			return nil, errors.New("a candidate is already pending, abort it first")
+		}
+		return nil, fmt.Errorf("failed to publish candidate: %w", err)
+	}
+
+	log.Printf("Published lease candidate: maxLeases=%d window=%s", maxLeases, window)
+	return candidate, nil
+}
+
+// GetCandidate returns the most recent candidate, or nil when none was ever published
+func (lm *KDSLeaseManager) GetCandidate(ctx context.Context) (*LeaseCandidate, error) {
+	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.getCandidateKey()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease candidate: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	publishedAt, _ := time.Parse(time.RFC3339Nano, attrString(result.Item, "published_at"))
+	return &LeaseCandidate{
+		MaxLeasesPerWorker: attrInt(result.Item, "max_leases_per_worker"),
+		PublishedAt:        publishedAt,
+		ObservationWindow:  time.Duration(attrInt(result.Item, "observation_window_seconds")) * time.Second,
+		Status:             attrString(result.Item, "status"),
+		Reason:             attrString(result.Item, "reason"),
+	}, nil
+}
+
+// ApplyCandidate returns the pending candidate value on canary workers and fleetValue
+// everywhere else
+func (lm *KDSLeaseManager) ApplyCandidate(ctx context.Context, fleetValue int) int {
+	candidate, err := lm.GetCandidate(ctx)
+	if err != nil {
+		log.Printf("WARN: %v, using fleet value %d", err, fleetValue)
+		return fleetValue
+	}
+	if candidate == nil || candidate.Status != CandidateStatusPending || !lm.isCanary(ctx) {
+		return fleetValue
+	}
+	if !leasemanager.ValidMaxLeases(candidate.MaxLeasesPerWorker) {
+		log.Printf("WARN: Lease candidate has invalid max leases %d (allowed 1-%d), using fleet value %d",
+			candidate.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit, fleetValue)
+		return fleetValue
+	}
+
+	if !lm.canaryAppliedAt.Equal(candidate.PublishedAt) {
+		lm.canaryAppliedAt = candidate.PublishedAt
+		lm.canaryBaselineErrors = 0
+		if lm.canaryHealth != nil {
+			lm.canaryBaselineErrors = lm.canaryHealth().Errors
+		}
+		log.Printf("🐤 Canary worker %s applying candidate max leases %d (fleet value %d)",
+			lm.workerID, candidate.MaxLeasesPerWorker, fleetValue)
+	}
+	return candidate.MaxLeasesPerWorker
+}
+
+// CheckCanary advances a pending candidate. Canary workers report their health and
+// roll the candidate back on regression; once the observation window has elapsed any
+// worker promotes it, provided at least one canary reported and none regressed.
+func (lm *KDSLeaseManager) CheckCanary(ctx context.Context) error {
+	candidate, err := lm.GetCandidate(ctx)
+	if err != nil {
+		return err
+	}
+	if candidate == nil || candidate.Status != CandidateStatusPending {
+		return nil
+	}
+
+	if lm.canaryAppliedAt.Equal(candidate.PublishedAt) && lm.isCanary(ctx) {
+		regression := lm.observeCanary()
+		if err := lm.saveCanaryReport(ctx, candidate, regression); err != nil {
+			log.Printf("WARN: Failed to save canary report: %v", err)
+		}
+		if regression != "" {
+			return lm.RollbackCandidate(ctx, candidate, lm.workerID+": "+regression)
+		}
+	}
+
+	if time.Since(candidate.PublishedAt) < candidate.ObservationWindow {
+		return nil
+	}
+
+	reports, regression, err := lm.canaryReports(ctx, candidate)
+	if err != nil {
+		return err
+	}
+	if regression != "" {
+		return lm.RollbackCandidate(ctx, candidate, regression)
+	}
+	if reports == 0 {
+		log.Printf("WARN: Lease candidate %d past its observation window but no canary reported, not promoting",
+			candidate.MaxLeasesPerWorker)
+		return nil
+	}
+	return lm.PromoteCandidate(ctx, candidate)
+}
+
+// observeCanary compares this worker's health against the canary policy and returns
+// a regression description, or "" when healthy
+func (lm *KDSLeaseManager) observeCanary() string {
+	if lm.canaryHealth == nil {
+		return ""
+	}
+	health := lm.canaryHealth()
+	if errs := health.Errors - lm.canaryBaselineErrors; errs > lm.canaryPolicy.MaxErrors {
+		return fmt.Sprintf("%d errors since candidate applied (max %d)", errs, lm.canaryPolicy.MaxErrors)
+	}
+	if lm.canaryPolicy.MaxLag > 0 && health.Lag > lm.canaryPolicy.MaxLag {
+		return fmt.Sprintf("lag %s exceeds %s", health.Lag, lm.canaryPolicy.MaxLag)
+	}
+	return ""
+}
+
+func (lm *KDSLeaseManager) saveCanaryReport(ctx context.Context, candidate *LeaseCandidate, regression string) error {
+	item := map[string]types.AttributeValue{
+		"worker_id":    &types.AttributeValueMemberS{Value: lm.getCanaryReportKey(lm.workerID)},
+		"app_name":     &types.AttributeValueMemberS{Value: lm.appName},
+		"stream_name":  &types.AttributeValueMemberS{Value: lm.streamName},
+		"published_at": &types.AttributeValueMemberS{Value: candidate.PublishedAt.Format(time.RFC3339Nano)},
+	}
+	timestampItem(item, time.Now())
+	if regression != "" {
+		item["regression"] = &types.AttributeValueMemberS{Value: regression}
+	}
+
+	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Item:      item,
+	})
+	return err
+}
+
+// canaryReports counts the canary reports for candidate and returns the first
+// regression reported, if any
+func (lm *KDSLeaseManager) canaryReports(ctx context.Context, candidate *LeaseCandidate) (int, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(lm.metadataTable),
+		FilterExpression: aws.String("begins_with(worker_id, :prefix) AND published_at = :published"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix":    &types.AttributeValueMemberS{Value: lm.getCanaryReportKey("")},
+			":published": &types.AttributeValueMemberS{Value: candidate.PublishedAt.Format(time.RFC3339Nano)},
+		},
+	}
+
+	reports := 0
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to scan canary reports: %w", err)
+		}
+		for _, item := range result.Items {
+			reports++
+			if regression := attrString(item, "regression"); regression != "" {
+				worker := strings.TrimPrefix(attrString(item, "worker_id"), lm.getCanaryReportKey(""))
+				return reports, worker + ": " + regression, nil
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return reports, "", nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// PromoteCandidate makes the candidate the coordinator value for the whole fleet. The
+// coordinator row is written first, on the condition that it still holds the counts
+// and value read, and the candidate is resolved only once that write succeeded: a
+// lost race or a failed write leaves it pending, and the next check tries again.
+// Writing the same value twice is harmless, so workers promoting together are fine.
+//
+// The promoted value lasts until the counts change: the background refresh
+// (KDS_REFRESH_INTERVAL), or the next worker start, then recalculates the coordinator
+// value from the formula or KDS_MAX_LEASES_EXPR.
+func (lm *KDSLeaseManager) PromoteCandidate(ctx context.Context, candidate *LeaseCandidate) error {
+	coordinator, err := lm.GetCoordinatorMetadata(ctx)
+	if err != nil {
+		return err
+	}
+	if coordinator == nil {
+		return errors.New("cannot promote lease candidate: no coordinator metadata")
+	}
+
+	promoted := *coordinator
+	promoted.MaxLeasesPerWorker = candidate.MaxLeasesPerWorker
+	err = lm.writeCoordinator(ctx, &promoted, func(item map[string]types.AttributeValue) error {
+		return lm.table().ReplaceCoordinator(ctx, item, coordinator)
+	})
+	if errors.Is(err, leasemanager.ErrCoordinatorChanged) {
+		return fmt.Errorf("cannot promote lease candidate %d yet: %w", candidate.MaxLeasesPerWorker, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	won, err := lm.resolveCandidate(ctx, candidate, CandidateStatusPromoted, "observation window passed without regression")
+	if err != nil {
+		return fmt.Errorf("promoted lease candidate %d but could not mark it promoted: %w", candidate.MaxLeasesPerWorker, err)
+	}
+	if won {
+		log.Printf("✅ Promoted lease candidate to fleet: maxLeases %d -> %d",
+			coordinator.MaxLeasesPerWorker, candidate.MaxLeasesPerWorker)
+		return nil
+	}
+
+	// Another worker resolved it first; if that was a rollback, the value written above
+	// must not stay
+	current, err := lm.GetCandidate(ctx)
+	if err != nil || current == nil || current.Status != CandidateStatusRolledBack || !current.PublishedAt.Equal(candidate.PublishedAt) {
+		return err
+	}
+	restored := *coordinator
+	err = lm.writeCoordinator(ctx, &restored, func(item map[string]types.AttributeValue) error {
+		return lm.table().ReplaceCoordinator(ctx, item, &promoted)
+	})
+	if err != nil && !errors.Is(err, leasemanager.ErrCoordinatorChanged) {
+		return fmt.Errorf("lease candidate %d was rolled back while promoted, restoring maxLeases %d: %w",
+			candidate.MaxLeasesPerWorker, coordinator.MaxLeasesPerWorker, err)
+	}
+	log.Printf("⚠️  Lease candidate %d was rolled back while being promoted, kept maxLeases %d",
+		candidate.MaxLeasesPerWorker, coordinator.MaxLeasesPerWorker)
+	return nil
+}
+
+// RollbackCandidate stops canaries from applying the candidate; the fleet value is untouched
+func (lm *KDSLeaseManager) RollbackCandidate(ctx context.Context, candidate *LeaseCandidate, reason string) error {
+	won, err := lm.resolveCandidate(ctx, candidate, CandidateStatusRolledBack, reason)
+	if err == nil && won {
+		log.Printf("⚠️  Rolled back lease candidate %d: %s", candidate.MaxLeasesPerWorker, reason)
+	}
+	return err
+}
+
+// resolveCandidate moves candidate out of pending; it returns false when another
+// worker (or a newer publish) got there first
+func (lm *KDSLeaseManager) resolveCandidate(ctx context.Context, candidate *LeaseCandidate, status, reason string) (bool, error) {
+	resolved := *candidate
+	resolved.Status = status
+	resolved.Reason = reason
+
+	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(lm.metadataTable),
+		Item:                     lm.candidateItem(&resolved),
+		ConditionExpression:      aws.String("#status = :pending AND published_at = :published"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending":   &types.AttributeValueMemberS{Value: CandidateStatusPending},
+			":published": &types.AttributeValueMemberS{Value: candidate.PublishedAt.Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var condCheckErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condCheckErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to update lease candidate: %w", err)
+	}
+
+	*candidate = resolved
+	return true, nil
+}
+
+func (lm *KDSLeaseManager) candidateItem(candidate *LeaseCandidate) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"worker_id":                  &types.AttributeValueMemberS{Value: lm.getCandidateKey()},
+		"max_leases_per_worker":      &types.AttributeValueMemberN{Value: strconv.Itoa(candidate.MaxLeasesPerWorker)},
+		"stream_name":                &types.AttributeValueMemberS{Value: lm.streamName},
+		"app_name":                   &types.AttributeValueMemberS{Value: lm.appName},
+		"published_at":               &types.AttributeValueMemberS{Value: candidate.PublishedAt.Format(time.RFC3339Nano)},
+		"observation_window_seconds": &types.AttributeValueMemberN{Value: strconv.Itoa(int(candidate.ObservationWindow / time.Second))},
+		"status":                     &types.AttributeValueMemberS{Value: candidate.Status},
+	}
+	timestampItem(item, time.Now())
+	if candidate.Reason != "" {
+		item["reason"] = &types.AttributeValueMemberS{Value: candidate.Reason}
+	}
+	return item
+}
+
+// runCanaryCommand implements "canary publish <max-leases>", "canary status" and
+// "canary abort" and returns the process exit code
+func runCanaryCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: canary publish <max-leases> | status | abort")
+		return 2
+	}
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "publish":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: canary publish <max-leases>")
+			return 2
+		}
+		maxLeases, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid max leases %q\n", args[1])
+			return 2
+		}
+		window := getEnvDuration("KDS_CANARY_WINDOW", 30*time.Minute)
+		if _, err := lm.PublishCandidate(ctx, maxLeases, window); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Published candidate %d, promotion after %s without regression\n", maxLeases, window)
+
+	case "status":
+		candidate, err := lm.GetCandidate(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if candidate == nil {
+			fmt.Println("No lease candidate published")
+			return 0
+		}
+		fmt.Printf("candidate=%d status=%s published=%s window=%s reason=%q\n",
+			candidate.MaxLeasesPerWorker, candidate.Status,
+			candidate.PublishedAt.Format(time.RFC3339), candidate.ObservationWindow, candidate.Reason)
+
+	case "abort":
+		candidate, err := lm.GetCandidate(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if candidate == nil || candidate.Status != CandidateStatusPending {
+			fmt.Println("No pending lease candidate")
+			return 0
+		}
+		if err := lm.RollbackCandidate(ctx, candidate, "aborted by operator"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Aborted candidate %d\n", candidate.MaxLeasesPerWorker)
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown canary command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+func attrString(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func attrInt(item map[string]types.AttributeValue, name string) int {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.Atoi(v.Value)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// kclParentShardKey is the lease attribute linking a child shard to its parent
+const kclParentShardKey = "ParentShardId"
+
+// checkpointSnapshot is the exported form of a KCL lease table: the checkpoint of
+// every shard, without lease ownership, so another application can resume from it
+type checkpointSnapshot struct {
+	AppName     string            `json:"app_name"`
+	StreamName  string            `json:"stream_name"`
+	Region      string            `json:"region"`
+	Table       string            `json:"table"`
+	ExportedAt  time.Time         `json:"exported_at"`
+	Checkpoints []shardCheckpoint `json:"checkpoints"`
+}
+
+type shardCheckpoint struct {
+	ShardID       string `json:"shard_id"`
+	Checkpoint    string `json:"checkpoint"`
+	ParentShardID string `json:"parent_shard_id,omitempty"`
+}
+
+// runCheckpointsCommand implements "checkpoints export [destination]" and
+// "checkpoints import <source> [table]" for blue/green migrations to a new KCL
+// application name, and "checkpoints rewind" for replays, see rewind.go.
+// Destinations and sources are files, s3://bucket/key or "-" for stdout/stdin.
+// Exports read KDS_KCL_LEASE_TABLE (default APP_NAME).
+func runCheckpointsCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: checkpoints export [file|s3://bucket/key|-] | import <file|s3://bucket/key|-> [table] | rewind <shard-id,...|all> at=<timestamp>|after=<sequence>")
+		return 2
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client := dynamodb.NewFromConfig(awsCfg)
+
+	switch args[0] {
+	case "export":
+		location := "-"
+		if len(args) > 1 {
+			location = args[1]
+		}
+		table := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+		snapshot, err := exportCheckpoints(ctx, client, table)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		snapshot.AppName, snapshot.StreamName, snapshot.Region = cfg.appName, cfg.streamName, cfg.region
+
+		data, err := json.MarshalIndent(snapshot, "", "  ")
+		if err == nil {
+			err = writeSnapshot(ctx, awsCfg, cfg.endpoint, location, data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d checkpoints from %s to %s\n", len(snapshot.Checkpoints), table, location)
+
+	case "import":
+		if len(args) < 2 || len(args) > 3 {
+			fmt.Fprintln(os.Stderr, "usage: checkpoints import <file|s3://bucket/key|-> [table]")
+			return 2
+		}
+		table := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+		if len(args) == 3 {
+			table = args[2]
+		}
+
+		data, err := readSnapshot(ctx, awsCfg, cfg.endpoint, args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var snapshot checkpointSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid checkpoint snapshot %s: %v\n", args[1], err)
+			return 1
+		}
+		// Shard IDs are only meaningful on the stream they were read from
+		if snapshot.StreamName != cfg.streamName || snapshot.Region != cfg.region {
+			fmt.Fprintf(os.Stderr, "snapshot is of stream %s in %s, not %s in %s\n",
+				snapshot.StreamName, snapshot.Region, cfg.streamName, cfg.region)
+			return 1
+		}
+		if snapshot.Table == table {
+			fmt.Fprintf(os.Stderr, "refusing to import into the table the snapshot was exported from (%s)\n", table)
+			return 1
+		}
+
+		overwrite := getEnv("KDS_CHECKPOINT_IMPORT_OVERWRITE", "false") == "true"
+		imported, skipped, err := importCheckpoints(ctx, client, table, snapshot.Checkpoints, overwrite)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Imported %d checkpoints into %s (%d shards already had a lease and were skipped)\n",
+			imported, table, skipped)
+
+	case "rewind":
+		return runRewind(ctx, cfg, awsCfg, args[1:])
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown checkpoints command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// exportCheckpoints reads the checkpoint of every shard in the lease table. Shards
+// that were never checkpointed are left out, so the importing application starts
+// them from its own initial position.
+func exportCheckpoints(ctx context.Context, client *dynamodb.Client, table string) (*checkpointSnapshot, error) {
+	snapshot := &checkpointSnapshot{Table: table, ExportedAt: time.Now().UTC(), Checkpoints: []shardCheckpoint{}}
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(table),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#k, #c, #p"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": kclLeaseKeyKey, "#c": kclCheckpointKey, "#p": kclParentShardKey,
+		},
+	}
+	for {
+		result, err := client.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lease table %s: %w", table, err)
+		}
+		for _, item := range result.Items {
+			checkpoint := attrString(item, kclCheckpointKey)
+			if checkpoint == "" {
+				continue
+			}
+			snapshot.Checkpoints = append(snapshot.Checkpoints, shardCheckpoint{
+				ShardID:       attrString(item, kclLeaseKeyKey),
+				Checkpoint:    checkpoint,
+				ParentShardID: attrString(item, kclParentShardKey),
+			})
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return snapshot, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// importCheckpoints writes unowned leases carrying the snapshot checkpoints, so the
+// new application's workers claim them and resume where the old one was. The table
+// is created with the KCL schema when missing; shards that already have a lease are
+// skipped unless overwrite is set.
+func importCheckpoints(ctx context.Context, client *dynamodb.Client, table string, checkpoints []shardCheckpoint, overwrite bool) (imported, skipped int, err error) {
+	if err := ensureKCLLeaseTable(ctx, client, table); err != nil {
+		return 0, 0, err
+	}
+
+	for _, cp := range checkpoints {
+		item := map[string]types.AttributeValue{
+			kclLeaseKeyKey:   &types.AttributeValueMemberS{Value: cp.ShardID},
+			kclCheckpointKey: &types.AttributeValueMemberS{Value: cp.Checkpoint},
+		}
+		if cp.ParentShardID != "" {
+			item[kclParentShardKey] = &types.AttributeValueMemberS{Value: cp.ParentShardID}
+		}
+		input := &dynamodb.PutItemInput{TableName: aws.String(table), Item: item}
+		if !overwrite {
+			input.ConditionExpression = aws.String("attribute_not_exists(#k)")
+			input.ExpressionAttributeNames = map[string]string{"#k": kclLeaseKeyKey}
+		}
+
+		if _, err := client.PutItem(ctx, input); err != nil {
+			var condCheckErr *types.ConditionalCheckFailedException
+			if errors.As(err, &condCheckErr) {
+				skipped++
+				continue
+			}
+			return imported, skipped, fmt.Errorf("failed to import checkpoint of shard %s: %w", cp.ShardID, err)
+		}
+		imported++
+	}
+	return imported, skipped, nil
+}
+
+// ensureKCLLeaseTable creates a lease table with the schema KCL expects unless it
+// exists, and waits until it is active
+func ensureKCLLeaseTable(ctx context.Context, client *dynamodb.Client, table string) error {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err == nil {
+		return nil
+	}
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to describe lease table %s: %w", table, err)
+	}
+
+	_, err = client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(kclLeaseKeyKey), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(kclLeaseKeyKey), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	var inUse *types.ResourceInUseException
+	if err != nil && !errors.As(err, &inUse) {
+		return fmt.Errorf("failed to create lease table %s: %w", table, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("lease table %s did not become active: %w", table, err)
+	}
+	return nil
+}
+
+func writeSnapshot(ctx context.Context, awsCfg aws.Config, endpoint, location string, data []byte) error {
+	if location == "-" {
+		_, err := os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	if object, ok, err := parseS3URI(location); ok {
+		if err != nil {
+			return err
+		}
+		return object.put(ctx, awsCfg, endpoint, data)
+	}
+	return writeFileAtomic(location, data)
+}
+
+func readSnapshot(ctx context.Context, awsCfg aws.Config, endpoint, location string) ([]byte, error) {
+	if location == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	if object, ok, err := parseS3URI(location); ok {
+		if err != nil {
+			return nil, err
+		}
+		return object.get(ctx, awsCfg, endpoint)
+	}
+	return os.ReadFile(location)
+}
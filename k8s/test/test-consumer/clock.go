@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go/middleware"
+
+	"expr_mohan/leasemanager"
+)
+
+// clockOffsetKey is the row attribute holding how far the writer's clock runs ahead
+// of AWS
+const clockOffsetKey = "clock_offset_ms"
+
+// clockOffsetWindow is how long a clock offset sample counts
+const clockOffsetWindow = time.Minute
+
+var (
+	clockOffsetSeconds = metrics.gauge("kds_clock_offset_seconds", "How far this worker's clock runs ahead of AWS, from the Date of its AWS responses")
+	fleetClockSkew     = metrics.gauge("kds_fleet_clock_skew_seconds", "Spread between the fastest and slowest worker clocks, from the offsets on the worker rows")
+)
+
+// awsClock estimates how far this process's clock runs ahead of AWS. Heartbeat ages
+// compare a time written by one worker's clock with another's; on nodes whose clocks
+// drift apart by more than the heartbeat timeout, live workers look dead (or dead ones
+// alive) without it.
+var awsClock = &clockOffset{now: time.Now}
+
+// clockOffset keeps the offsets seen in the last clockOffsetWindow
+type clockOffset struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	samples []clockSample
+}
+
+type clockSample struct {
+	at    time.Time
+	ahead time.Duration
+}
+
+func (c *clockOffset) observe(ahead time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.samples = append(c.samples, clockSample{at: now, ahead: ahead})
+	for len(c.samples) > 0 && now.Sub(c.samples[0].at) > clockOffsetWindow {
+		c.samples = c.samples[1:]
+	}
+	if offset, ok := c.estimate(now); ok {
+		clockOffsetSeconds.set(offset.Seconds())
+	}
+}
+
+// offset returns how far this clock runs ahead of AWS, negative when behind; false
+// without a response in the last clockOffsetWindow
+func (c *clockOffset) offset() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estimate(c.now())
+}
+
+// estimate is the smallest recent sample: a response's Date is truncated to the
+// second and stamped before the response travels, so each sample overstates the
+// offset by up to a second plus the latency; the caller holds c.mu
+func (c *clockOffset) estimate(now time.Time) (time.Duration, bool) {
+	var offset time.Duration
+	found := false
+	for _, s := range c.samples {
+		if now.Sub(s.at) > clockOffsetWindow {
+			continue
+		}
+		if !found || s.ahead < offset {
+			offset = s.ahead
+		}
+		found = true
+	}
+	return offset, found
+}
+
+// clockOffsetObserving samples the clock offset from every AWS response carrying a
+// Date, after the retryer so each attempt counts
+func clockOffsetObserving(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("ClockOffsetObserving",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			if skew, ok := awsmiddleware.GetAttemptSkew(metadata); ok {
+				awsClock.observe(-skew)
+			}
+			return out, metadata, err
+		}), middleware.After)
+}
+
+// timestampItem sets the last update of a row to t, see leasemanager.Timestamp. With
+// a known clock offset, it is written as well.
+func timestampItem(item map[string]types.AttributeValue, t time.Time) {
+	leasemanager.Timestamp(item, t)
+	if offset, ok := awsClock.offset(); ok {
+		item[clockOffsetKey] = &types.AttributeValueMemberN{Value: strconv.FormatInt(offset.Milliseconds(), 10)}
+	}
+}
+
+// parseClockOffset reads the writer's clock offset of a row
+func parseClockOffset(item map[string]types.AttributeValue, metadata *leasemanager.Metadata) {
+	if val, ok := item[clockOffsetKey].(*types.AttributeValueMemberN); ok {
+		if millis, err := strconv.ParseInt(val.Value, 10, 64); err == nil {
+			metadata.ClockOffset, metadata.ClockOffsetKnown = time.Duration(millis)*time.Millisecond, true
+		}
+	}
+}
+
+// heartbeatAge is how long ago, in AWS time, a worker whose clock runs writerOffset
+// ahead wrote lastUpdate, with now read from this worker's clock
+func heartbeatAge(now, lastUpdate time.Time, writerOffset time.Duration) time.Duration {
+	mine, _ := awsClock.offset()
+	return now.Sub(lastUpdate) - mine + writerOffset
+}
+
+// clockSkewTolerance is added to heartbeat timeouts for the error of the offsets:
+// KDS_CLOCK_SKEW_TOLERANCE, default 2s since a Date has whole seconds
+func clockSkewTolerance() time.Duration {
+	return getEnvDuration("KDS_CLOCK_SKEW_TOLERANCE", 2*time.Second)
+}
+
+// exportClockSkew publishes the spread of the clock offsets on the worker rows
+func exportClockSkew(rows []*leasemanager.Metadata) {
+	var lowest, highest time.Duration
+	found := false
+	for _, row := range rows {
+		if !row.ClockOffsetKnown {
+			continue
+		}
+		if !found || row.ClockOffset < lowest {
+			lowest = row.ClockOffset
+		}
+		if !found || row.ClockOffset > highest {
+			highest = row.ClockOffset
+		}
+		found = true
+	}
+	if found {
+		fleetClockSkew.set((highest - lowest).Seconds())
+	}
+}
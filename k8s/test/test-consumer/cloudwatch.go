@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// metricDataQueriesPerCall is how many queries one GetMetricData call may carry
+const metricDataQueriesPerCall = 500
+
+// metricQuery is one CloudWatch metric of the AWS/Kinesis namespace, aggregated with
+// stat over every period
+type metricQuery struct {
+	id         string
+	metric     string
+	stat       string
+	dimensions [][2]string // name, value
+}
+
+// metricSeries are the datapoints of a query by period start
+type metricSeries map[time.Time]float64
+
+// getMetricDataResponse is the part of the GetMetricData XML response read here
+type getMetricDataResponse struct {
+	Results []struct {
+		ID         string      `xml:"Id"`
+		StatusCode string      `xml:"StatusCode"`
+		Timestamps []time.Time `xml:"Timestamps>member"`
+		Values     []float64   `xml:"Values>member"`
+	} `xml:"GetMetricDataResult>MetricDataResults>member"`
+	NextToken string `xml:"GetMetricDataResult>NextToken"`
+}
+
+// getMetricData fetches the queries between start and end through the CloudWatch
+// query API with SigV4-signed requests, as s3Object does for S3, so it needs no SDK
+// module. Queries are sent in batches of metricDataQueriesPerCall and every page of a
+// batch is followed. Series are keyed by query ID; a query without datapoints has an
+// empty series.
+func getMetricData(ctx context.Context, awsCfg aws.Config, endpoint string, queries []metricQuery, start, end time.Time, period time.Duration) (map[string]metricSeries, error) {
+	series := make(map[string]metricSeries, len(queries))
+	for len(queries) > 0 {
+		batch := queries[:min(len(queries), metricDataQueriesPerCall)]
+		queries = queries[len(batch):]
+		for _, q := range batch {
+			series[q.id] = metricSeries{}
+		}
+
+		nextToken := ""
+		for {
+			form := metricDataForm(batch, start, end, period, nextToken)
+			data, err := postCloudWatch(ctx, awsCfg, endpoint, form)
+			if err != nil {
+				return nil, err
+			}
+			var resp getMetricDataResponse
+			if err := xml.Unmarshal(data, &resp); err != nil {
+				return nil, fmt.Errorf("failed to parse GetMetricData response: %w", err)
+			}
+			for _, r := range resp.Results {
+				if r.StatusCode == "Forbidden" || r.StatusCode == "InternalError" {
+					return nil, fmt.Errorf("GetMetricData query %s: %s", r.ID, r.StatusCode)
+				}
+				for i, t := range r.Timestamps {
+					if i < len(r.Values) && series[r.ID] != nil {
+						series[r.ID][t.UTC()] = r.Values[i]
+					}
+				}
+			}
+			if resp.NextToken == "" {
+				break
+			}
+			nextToken = resp.NextToken
+		}
+	}
+	return series, nil
+}
+
+// metricDataForm encodes a GetMetricData call in the query protocol
+func metricDataForm(queries []metricQuery, start, end time.Time, period time.Duration, nextToken string) url.Values {
+	form := url.Values{
+		"Action":    {"GetMetricData"},
+		"Version":   {"2010-08-01"},
+		"StartTime": {start.UTC().Format(time.RFC3339)},
+		"EndTime":   {end.UTC().Format(time.RFC3339)},
+		"ScanBy":    {"TimestampAscending"},
+	}
+	if nextToken != "" {
+		form.Set("NextToken", nextToken)
+	}
+	seconds := strconv.Itoa(int(period.Seconds()))
+	for i, q := range queries {
+		prefix := fmt.Sprintf("MetricDataQueries.member.%d.", i+1)
+		form.Set(prefix+"Id", q.id)
+		form.Set(prefix+"ReturnData", "true")
+		form.Set(prefix+"MetricStat.Stat", q.stat)
+		form.Set(prefix+"MetricStat.Period", seconds)
+		form.Set(prefix+"MetricStat.Metric.Namespace", "AWS/Kinesis")
+		form.Set(prefix+"MetricStat.Metric.MetricName", q.metric)
+		for j, d := range q.dimensions {
+			dim := fmt.Sprintf("%sMetricStat.Metric.Dimensions.member.%d.", prefix, j+1)
+			form.Set(dim+"Name", d[0])
+			form.Set(dim+"Value", d[1])
+		}
+	}
+	return form
+}
+
+// postCloudWatch sends one signed query API call and returns the response body
+func postCloudWatch(ctx context.Context, awsCfg aws.Config, endpoint string, form url.Values) ([]byte, error) {
+	target := fmt.Sprintf("https://monitoring.%s.amazonaws.com/", awsCfg.Region)
+	if endpoint != "" {
+		target = strings.TrimSuffix(endpoint, "/") + "/"
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	creds, err := awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve credentials for CloudWatch: %w", err)
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, "monitoring", awsCfg.Region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	client := awsCfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", form.Get("Action"), target, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", form.Get("Action"), target, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", form.Get("Action"), target, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
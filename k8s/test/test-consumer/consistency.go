@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Anomaly kinds flagged by CheckConsistency
+const (
+	anomalyOverCap               = "over_cap"
+	anomalyStaleOwner            = "stale_owner"
+	anomalyMissingLease          = "missing_lease"
+	anomalyUnfinishedClosedShard = "unfinished_closed_shard"
+)
+
+var anomalyKinds = []string{anomalyOverCap, anomalyStaleOwner, anomalyMissingLease, anomalyUnfinishedClosedShard}
+
+var consistencyAnomalies = metrics.gauge("kds_consistency_anomalies", "Anomalies found by the last lease consistency check, by kind")
+
+// Anomaly is one disagreement between the KCL lease table, the metadata table and the stream
+type Anomaly struct {
+	Kind   string `json:"kind"`
+	Worker string `json:"worker,omitempty"`
+	Shard  string `json:"shard,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// subject is the shard or worker the anomaly is about
+func (a Anomaly) subject() string {
+	if a.Shard != "" {
+		return a.Shard
+	}
+	return a.Worker
+}
+
+// ConsistencyReport is the result of one consistency check
+type ConsistencyReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Anomalies []Anomaly `json:"anomalies"`
+	// Orphans are the leases, live or expired, still assigned to stale owners
+	Orphans []KCLLease `json:"orphans,omitempty"`
+	// Partial is set when only some worker rows could be read
+	Partial string `json:"partial,omitempty"`
+}
+
+// Heartbeat refreshes last_update_time and the runtime stats on this worker's row;
+// the consistency check uses the former to tell live lease owners from dead ones. It
+// never recreates a row that was deleted by a drain. A row written by another process
+// means two processes report this worker ID, see resolveWorkerIDConflict.
+func (lm *KDSLeaseManager) Heartbeat(ctx context.Context) error {
+	err := lm.writeHeartbeat(ctx, "attribute_not_exists(#process_id) OR #process_id = :process_id", nil)
+	var condCheckErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condCheckErr) {
+		return fmt.Errorf("failed to heartbeat worker %s: %w", lm.workerID, err)
+	}
+	if err == nil {
+		return nil
+	}
+
+	item := condCheckErr.Item
+	if item == nil {
+		// A deleted row, or a store that does not return the item on a failed condition
+		row, err := lm.workerRow(ctx)
+		if err != nil || row == nil || row.ProcessID == "" || row.ProcessID == lm.processID {
+			return nil
+		}
+		return lm.resolveWorkerIDConflict(ctx, row)
+	}
+	other := parseWorkerMetadata(item, lm.keys().Worker(""))
+	if other.ProcessID == "" || other.ProcessID == lm.processID {
+		return nil
+	}
+	return lm.resolveWorkerIDConflict(ctx, other)
+}
+
+// writeHeartbeat sets the last update and clock offset, the runtime stats and the process ID on this
+// worker's row if it exists and condition holds
+func (lm *KDSLeaseManager) writeHeartbeat(ctx context.Context, condition string, extra map[string]types.AttributeValue) error {
+	item := map[string]types.AttributeValue{}
+	timestampItem(item, time.Now())
+	lm.runtimeStatsItem(item)
+	lm.identityItem(item)
+	names := make(map[string]string, len(item))
+	values := make(map[string]types.AttributeValue, len(item)+len(extra))
+	var sets []string
+	for attr, value := range item {
+		names["#"+attr] = attr
+		values[":"+attr] = value
+		sets = append(sets, "#"+attr+" = :"+attr)
+	}
+	for name, value := range extra {
+		values[name] = value
+	}
+	sort.Strings(sets)
+	_, err := lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(lm.workerID)},
+		},
+		UpdateExpression:                    aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:                 aws.String("attribute_exists(worker_id) AND (" + condition + ")"),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	return err
+}
+
+// CheckConsistency compares the KCL lease table with the metadata table and the
+// stream. It flags workers owning more leases than their cap, leases owned by workers
+// without a heartbeat within heartbeatTimeout, shards without a lease row, and closed
+// shards nobody owns that were never checkpointed SHARD_END. Every call is a read.
+func (lm *KDSLeaseManager) CheckConsistency(ctx context.Context, leaseTable string, heartbeatTimeout time.Duration) (*ConsistencyReport, error) {
+	view, err := lm.ViewLeaseTable(ctx, leaseTable)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := lm.listShards(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &ConsistencyReport{CheckedAt: time.Now(), Anomalies: []Anomaly{}, Partial: view.Partial}
+
+	stale := map[string]bool{}
+	for _, o := range view.Owners {
+		if o.Leases+o.Expired == 0 {
+			continue
+		}
+		limit := o.MaxLeases
+		if limit == 0 {
+			limit = view.Coordinator
+		}
+		if limit > 0 && o.Leases > limit {
+			report.Anomalies = append(report.Anomalies, Anomaly{Kind: anomalyOverCap, Worker: o.WorkerID,
+				Detail: fmt.Sprintf("owns %d leases, cap %d", o.Leases, limit)})
+		}
+		switch {
+		case !o.Registered && view.Partial == "":
+			stale[o.WorkerID] = true
+			report.Anomalies = append(report.Anomalies, Anomaly{Kind: anomalyStaleOwner, Worker: o.WorkerID,
+				Detail: fmt.Sprintf("owns %d leases (%d expired) without a worker row", o.Leases+o.Expired, o.Expired)})
+		case o.Registered && o.heartbeatAge(report.CheckedAt) > heartbeatTimeout+clockSkewTolerance():
+			stale[o.WorkerID] = true
+			report.Anomalies = append(report.Anomalies, Anomaly{Kind: anomalyStaleOwner, Worker: o.WorkerID,
+				Detail: fmt.Sprintf("owns %d leases (%d expired), last heartbeat %s ago", o.Leases+o.Expired, o.Expired,
+					o.heartbeatAge(report.CheckedAt).Round(time.Second))})
+		}
+	}
+	for _, lease := range view.Leases {
+		if stale[lease.Owner] && (lease.State == kclLeaseOwned || lease.State == kclLeaseExpired) {
+			report.Orphans = append(report.Orphans, lease)
+		}
+	}
+
+	leases := make(map[string]KCLLease, len(view.Leases))
+	for _, lease := range view.Leases {
+		leases[lease.ShardID] = lease
+	}
+	for _, shard := range shards {
+		shardID := aws.ToString(shard.ShardId)
+		closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+		lease, ok := leases[shardID]
+		switch {
+		case !ok:
+			state := "open"
+			if closed {
+				state = "closed"
+			}
+			report.Anomalies = append(report.Anomalies, Anomaly{Kind: anomalyMissingLease, Shard: shardID,
+				Detail: state + " shard has no lease row"})
+		case closed && lease.State != kclLeaseFinished && lease.State != kclLeaseOwned:
+			// An owned closed shard is still reading its last records
+			report.Anomalies = append(report.Anomalies, Anomaly{Kind: anomalyUnfinishedClosedShard, Shard: shardID,
+				Detail: fmt.Sprintf("closed shard is %s at checkpoint %s, its children wait for SHARD_END", lease.State, dash(lease.Checkpoint))})
+		}
+	}
+
+	sort.SliceStable(report.Anomalies, func(i, j int) bool { return report.Anomalies[i].Kind < report.Anomalies[j].Kind })
+	return report, nil
+}
+
+func exportConsistencyReport(report *ConsistencyReport) {
+	counts := map[string]int{}
+	for _, a := range report.Anomalies {
+		counts[a.Kind]++
+	}
+	for _, kind := range anomalyKinds {
+		consistencyAnomalies.set(float64(counts[kind]), "kind", kind)
+	}
+}
+
+// defaultHeartbeatTimeout is three poll intervals of a worker in a fleet of this
+// size, since workers heartbeat once per status tick
+func defaultHeartbeatTimeout(p adaptivePolling, workers int) time.Duration {
+	return 3 * p.intervalFor(workers)
+}
+
+// consistencyChecker runs CheckConsistency as a coordinator duty, at most every interval
+type consistencyChecker struct {
+	lm         *KDSLeaseManager
+	leaseTable string
+	polling    adaptivePolling
+	interval   time.Duration
+	last       time.Time
+	recovery   *orphanRecovery
+}
+
+// newConsistencyCheckerFromEnv reads KDS_CONSISTENCY_CHECK_INTERVAL (0 disables) and
+// the orphan recovery settings
+func newConsistencyCheckerFromEnv(lm *KDSLeaseManager, leaseTable string, p adaptivePolling) *consistencyChecker {
+	interval := getEnvDuration("KDS_CONSISTENCY_CHECK_INTERVAL", 5*time.Minute)
+	if interval <= 0 {
+		return nil
+	}
+	return &consistencyChecker{lm: lm, leaseTable: leaseTable, polling: p, interval: interval, recovery: newOrphanRecoveryFromEnv()}
+}
+
+// maybeRun checks and logs the anomalies when this worker is the coordinator and the
+// last check is an interval old
+func (c *consistencyChecker) maybeRun(ctx context.Context) {
+	if c == nil || !c.lm.isCoordinator.Load() || time.Since(c.last) < c.interval {
+		return
+	}
+	c.last = time.Now()
+	timeout := getEnvDuration("KDS_HEARTBEAT_TIMEOUT", defaultHeartbeatTimeout(c.polling, int(c.lm.observedWorkers.Load())))
+	report, err := c.lm.CheckConsistency(ctx, c.leaseTable, timeout)
+	if err != nil {
+		log.Printf("WARN: Consistency check failed: %v", err)
+		return
+	}
+	exportConsistencyReport(report)
+	for _, a := range report.Anomalies {
+		log.Printf("⚠️  Lease anomaly %s: %s %s", a.Kind, a.subject(), a.Detail)
+	}
+	log.Printf("Consistency check found %d anomalies", len(report.Anomalies))
+	c.recovery.reclaim(ctx, c.lm, c.leaseTable, report.Orphans)
+}
+
+// runCheckCommand implements "check [json]": one consistency check, exiting 1 when it
+// finds anomalies so scripts and CronJobs can alert on it
+func runCheckCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "json") {
+		fmt.Fprintln(os.Stderr, "usage: check [json]")
+		return 2
+	}
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lm.SetAllowPartialReads(true)
+	leaseTable := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+	timeout := getEnvDuration("KDS_HEARTBEAT_TIMEOUT", 0)
+	if timeout <= 0 {
+		workers, _, err := lm.FleetWorkerMetadata(ctx)
+		var partial *PartialError
+		if err != nil && !errors.As(err, &partial) {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		timeout = defaultHeartbeatTimeout(adaptivePollingFromEnv(), len(workers))
+	}
+	report, err := lm.CheckConsistency(ctx, leaseTable, timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(args) == 1 {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, a := range report.Anomalies {
+			fmt.Printf("%s\t%s\t%s\n", a.Kind, a.subject(), a.Detail)
+		}
+		fmt.Printf("%d anomalies (heartbeat timeout %s)\n", len(report.Anomalies), timeout)
+		if report.Partial != "" {
+			fmt.Fprintf(os.Stderr, "WARN: %s\n", report.Partial)
+		}
+	}
+	if len(report.Anomalies) > 0 {
+		return 1
+	}
+	return 0
+}
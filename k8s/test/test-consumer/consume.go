@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+var (
+	recordsProcessed   = metrics.counter("kds_records_processed_total", "Records read from the stream")
+	leasesHeld         = metrics.gauge("kds_leases_held", "KCL leases this worker consumes")
+	leasesAcquired     = metrics.counter("kds_leases_acquired_total", "KCL leases taken, by the lease's previous state")
+	leaseClaims        = metrics.counter("kds_lease_claims_total", "Claims placed on leases of overloaded workers")
+	checkpointsWritten = metrics.counter("kds_checkpoints_total", "Checkpoints written to the KCL lease table")
+)
+
+// activeConsumer is set once records are consumed; cordon, emergency stop and drain
+// stop its shard consumers, which checkpoint, before releasing leases
+var activeConsumer atomic.Pointer[recordConsumer]
+
+// KinesisAPIForRecords defines the Kinesis operations needed to read shards
+type KinesisAPIForRecords interface {
+	GetShardIterator(ctx context.Context, params *kinesis.GetShardIteratorInput, optFns ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *kinesis.GetRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error)
+}
+
+// recordConsumer reads the stream under the vmware-go-kcl lease protocol, so it shares
+// a lease table with KCL workers and exercises the same lease taking, stealing and
+// checkpointing. It holds at most maxLeases leases: every lease sync it takes
+// unowned or expired leases of shards whose parents are finished, then claims a lease
+// of the most loaded worker while it holds less than its fair share. An owner that
+// sees a claim on renewal checkpoints and lets the lease go.
+type recordConsumer struct {
+	lm         *KDSLeaseManager
+	reader     KinesisAPIForRecords
+	leaseTable string
+
+	failover        time.Duration
+	syncInterval    time.Duration
+	checkpointEvery time.Duration
+	idle            time.Duration
+	initialPosition kinesistypes.ShardIteratorType
+	stealing        bool
+
+	// efo is the application's enhanced fan-out registration with KDS_EFO=true, which
+	// shards are read through with subscriber; nil without it or when the stream has
+	// no free slot, and shards are read with GetRecords
+	efo        *streamConsumer
+	subscriber KinesisAPIForSubscriptions
+	// merge orders the records by event time before handing them on with KDS_MERGE=true,
+	// see merge.go; without it records are counted and dropped
+	merge *mergeStage
+
+	mu        sync.Mutex
+	maxLeases int
+	shards    map[string]*shardConsumer
+	lag       map[string]int64 // shard ID -> last MillisBehindLatest
+	shardRead map[string]int64 // shard ID -> records read since the last stats call
+
+	// Records read, and the count and time of the last stats call for the rate
+	processed  atomic.Int64
+	statsCount int64
+	statsAt    time.Time
+}
+
+// shardConsumer is one running shard read loop
+type shardConsumer struct {
+	shardID  string
+	stopOnce sync.Once
+	stop     chan struct{} // closed to checkpoint and release the lease
+	done     chan struct{}
+}
+
+func (sc *shardConsumer) requestStop() {
+	sc.stopOnce.Do(func() { close(sc.stop) })
+}
+
+// newRecordConsumerFromEnv returns nil when KDS_CONSUME=false. It reads
+// KDS_KCL_FAILOVER_TIME, KDS_LEASE_SYNC_INTERVAL, KDS_CHECKPOINT_INTERVAL,
+// KDS_GET_RECORDS_INTERVAL, KDS_INITIAL_POSITION, KDS_LEASE_STEALING, KDS_EFO and
+// KDS_MERGE, creates the lease table when it is missing and registers the enhanced
+// fan-out consumer, see efo.go.
+func newRecordConsumerFromEnv(ctx context.Context, cfg appConfig, lm *KDSLeaseManager, leaseTable string, maxLeases int) (*recordConsumer, error) {
+	if getEnv("KDS_CONSUME", "true") != "true" {
+		return nil, nil
+	}
+	position := kinesistypes.ShardIteratorType(getEnv("KDS_INITIAL_POSITION", string(kinesistypes.ShardIteratorTypeTrimHorizon)))
+	if position != kinesistypes.ShardIteratorTypeTrimHorizon && position != kinesistypes.ShardIteratorTypeLatest {
+		return nil, noRetry(fmt.Errorf("KDS_INITIAL_POSITION must be TRIM_HORIZON or LATEST, got %q", position))
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	reader := kinesis.NewFromConfig(awsCfg)
+	merge, err := newMergeStageFromEnv(reader, cfg.streamName)
+	if err != nil {
+		return nil, noRetry(err)
+	}
+	if err := ensureKCLLeaseTable(ctx, dynamodb.NewFromConfig(awsCfg), leaseTable); err != nil {
+		return nil, err
+	}
+	var efo *streamConsumer
+	if getEnv("KDS_EFO", "false") == "true" {
+		if efo, err = registerEFOConsumer(ctx, cfg, reader); err != nil {
+			return nil, err
+		}
+	}
+	return &recordConsumer{
+		lm:              lm,
+		reader:          reader,
+		leaseTable:      leaseTable,
+		failover:        getEnvDuration("KDS_KCL_FAILOVER_TIME", 10*time.Second),
+		syncInterval:    getEnvDuration("KDS_LEASE_SYNC_INTERVAL", 10*time.Second),
+		checkpointEvery: getEnvDuration("KDS_CHECKPOINT_INTERVAL", 10*time.Second),
+		idle:            getEnvDuration("KDS_GET_RECORDS_INTERVAL", time.Second),
+		initialPosition: position,
+		stealing:        getEnv("KDS_LEASE_STEALING", "true") == "true",
+		efo:             efo,
+		subscriber:      reader,
+		merge:           merge,
+		maxLeases:       maxLeases,
+		shards:          make(map[string]*shardConsumer),
+		lag:             make(map[string]int64),
+		shardRead:       make(map[string]int64),
+		statsAt:         time.Now(),
+	}, nil
+}
+
+// run syncs leases until ctx ends
+func (c *recordConsumer) run(ctx context.Context) {
+	if c.merge != nil {
+		go c.merge.run(ctx, c.idle, c.syncInterval)
+	}
+	ticker := time.NewTicker(c.syncInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := c.sync(ctx)
+		subsystems.observe(subsystemKCLWorker, start, err)
+		if err != nil {
+			log.Printf("WARN: Lease sync failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// hold sets how many leases the worker may consume; extra leases are handed back on
+// the next sync
+func (c *recordConsumer) hold(maxLeases int) {
+	if c == nil {
+		return
+	}
+	// sync indexes the running shards by the cap
+	maxLeases = max(maxLeases, 0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxLeases != c.maxLeases {
+		log.Printf("Consuming up to %d leases (was %d)", maxLeases, c.maxLeases)
+	}
+	c.maxLeases = maxLeases
+}
+
+// releaseAll stops taking leases and stops every shard consumer, each checkpointing
+// and releasing its lease, and waits for them until ctx ends. hold resumes.
+func (c *recordConsumer) releaseAll(ctx context.Context) []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.maxLeases = 0
+	running := make([]*shardConsumer, 0, len(c.shards))
+	for _, sc := range c.shards {
+		running = append(running, sc)
+	}
+	c.mu.Unlock()
+
+	stopped := []string{}
+	for _, sc := range running {
+		sc.requestStop()
+	}
+	for _, sc := range running {
+		select {
+		case <-sc.done:
+			stopped = append(stopped, sc.shardID)
+		case <-ctx.Done():
+			return stopped
+		}
+	}
+	return stopped
+}
+
+// sync hands back leases above maxLeases, takes free ones up to it and, when none are
+// free, claims one from the most loaded worker
+func (c *recordConsumer) sync(ctx context.Context) error {
+	leases, err := c.lm.ListKCLLeases(ctx, c.leaseTable)
+	if err != nil {
+		return err
+	}
+	shards, err := c.lm.listShards(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	running := make([]string, 0, len(c.shards))
+	for shardID := range c.shards {
+		running = append(running, shardID)
+	}
+	sort.Strings(running)
+	held := len(running)
+	for held > c.maxLeases {
+		held--
+		log.Printf("Handing back lease of shard %s, over max leases %d", running[held], c.maxLeases)
+		c.shards[running[held]].requestStop()
+	}
+	leasesHeld.set(float64(held))
+	if held >= c.maxLeases {
+		return nil
+	}
+
+	local := make(map[string]bool, len(c.shards))
+	for shardID := range c.shards {
+		local[shardID] = true
+	}
+	for _, free := range freeLeases(shards, leases, c.lm.workerID, local, time.Now()) {
+		if held >= c.maxLeases {
+			break
+		}
+		acquired, err := c.acquire(ctx, free.shardID, free.parentID, free.lease, free.exists)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			continue
+		}
+		if !acquired {
+			continue
+		}
+		state := free.lease.State
+		if !free.exists {
+			state = "new"
+		}
+		leasesAcquired.add(1, "from", state)
+		log.Printf("🔑 Took lease of shard %s (%s)", free.shardID, state)
+		c.start(ctx, free.shardID, free.lease.Checkpoint)
+		held++
+	}
+	leasesHeld.set(float64(held))
+
+	if held < c.maxLeases && c.stealing {
+		return c.claim(ctx, leases, held)
+	}
+	return nil
+}
+
+// freeLease is a shard workerID may take a lease of
+type freeLease struct {
+	shardID  string
+	parentID string
+	lease    KCLLease
+	exists   bool // false when the shard has no lease row yet
+}
+
+// freeLeases lists, in shard order, the shards not in local whose lease is new,
+// unowned, expired or already workerID's and whose parents are finished, so records
+// of a key stay in order. A lease its owner released for a claim stays reserved for
+// the claimant until its lease timeout passes, so the owner does not take it back.
+func freeLeases(shards []kinesistypes.Shard, leases []KCLLease, workerID string, local map[string]bool, now time.Time) []freeLease {
+	byShard := make(map[string]KCLLease, len(leases))
+	for _, lease := range leases {
+		byShard[lease.ShardID] = lease
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.ToString(shard.ShardId)] = true
+	}
+	finished := func(parentID string) bool {
+		if parentID == "" {
+			return true
+		}
+		parent, ok := byShard[parentID]
+		if !ok {
+			return !listed[parentID]
+		}
+		return parent.State == kclLeaseFinished
+	}
+
+	sorted := append([]kinesistypes.Shard(nil), shards...)
+	sort.Slice(sorted, func(i, j int) bool { return aws.ToString(sorted[i].ShardId) < aws.ToString(sorted[j].ShardId) })
+	var free []freeLease
+	for _, shard := range sorted {
+		shardID := aws.ToString(shard.ShardId)
+		if local[shardID] {
+			continue
+		}
+		lease, exists := byShard[shardID]
+		reserved := lease.State == kclLeaseUnowned && lease.ClaimRequest != "" && lease.ClaimRequest != workerID &&
+			lease.LeaseTimeout.After(now)
+		takeable := !exists || (lease.State == kclLeaseUnowned && !reserved) || lease.State == kclLeaseExpired ||
+			(lease.State == kclLeaseOwned && lease.Owner == workerID)
+		if !takeable || !finished(aws.ToString(shard.ParentShardId)) || !finished(aws.ToString(shard.AdjacentParentShardId)) {
+			continue
+		}
+		free = append(free, freeLease{shardID: shardID, parentID: aws.ToString(shard.ParentShardId), lease: lease, exists: exists})
+	}
+	return free
+}
+
+// acquire takes a lease that is new, unowned, expired or already this worker's,
+// conditional on it being as read, and drops any claim on it
+func (c *recordConsumer) acquire(ctx context.Context, shardID, parentID string, lease KCLLease, exists bool) (bool, error) {
+	timeout := &types.AttributeValueMemberS{Value: time.Now().Add(c.failover).UTC().Format(time.RFC3339)}
+	me := &types.AttributeValueMemberS{Value: c.lm.workerID}
+	var err error
+	if !exists {
+		item := map[string]types.AttributeValue{
+			kclLeaseKeyKey:     &types.AttributeValueMemberS{Value: shardID},
+			kclLeaseOwnerKey:   me,
+			kclLeaseTimeoutKey: timeout,
+		}
+		if parentID != "" {
+			item[kclParentShardKey] = &types.AttributeValueMemberS{Value: parentID}
+		}
+		_, err = c.lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                aws.String(c.leaseTable),
+			Item:                     item,
+			ConditionExpression:      aws.String("attribute_not_exists(#k)"),
+			ExpressionAttributeNames: map[string]string{"#k": kclLeaseKeyKey},
+		})
+	} else {
+		condition := "attribute_not_exists(#o)"
+		values := map[string]types.AttributeValue{":me": me, ":timeout": timeout}
+		if lease.Owner != "" {
+			condition = "#o = :owner AND #t = :old"
+			values[":owner"] = &types.AttributeValueMemberS{Value: lease.Owner}
+			values[":old"] = &types.AttributeValueMemberS{Value: lease.rawLeaseTimeout}
+		}
+		_, err = c.lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(c.leaseTable),
+			Key:                       map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}},
+			UpdateExpression:          aws.String("SET #o = :me, #t = :timeout REMOVE #r"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  map[string]string{"#o": kclLeaseOwnerKey, "#t": kclLeaseTimeoutKey, "#r": kclClaimRequestKey},
+			ExpressionAttributeValues: values,
+		})
+	}
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to take lease of shard %s: %w", shardID, err)
+	}
+	return true, nil
+}
+
+// claimVictim picks the most loaded other worker, the lowest ID on a tie, while
+// workerID holds less than target, an even share of the owned leases. victim is
+// empty when nobody holds more than target. owned are the victim's leases in shard
+// order, so the claimed lease does not depend on the scan order of the lease table.
+func claimVictim(leases []KCLLease, workerID string, held int) (victim string, owned []KCLLease, target int) {
+	byOwner := map[string][]KCLLease{}
+	total := held
+	for _, lease := range leases {
+		if lease.State == kclLeaseOwned && lease.Owner != workerID {
+			byOwner[lease.Owner] = append(byOwner[lease.Owner], lease)
+			total++
+		}
+	}
+	target = (total + len(byOwner)) / (len(byOwner) + 1) // ceil over the owners and this worker
+	if held >= target {
+		return "", nil, target
+	}
+	for owner, ls := range byOwner {
+		if len(ls) > target && (victim == "" || len(ls) > len(byOwner[victim]) || (len(ls) == len(byOwner[victim]) && owner < victim)) {
+			victim = owner
+		}
+	}
+	owned = byOwner[victim]
+	sort.Slice(owned, func(i, j int) bool { return owned[i].ShardID < owned[j].ShardID })
+	return victim, owned, target
+}
+
+// claim marks a lease of the most loaded worker for this one while this worker holds
+// less than an even share of the owned leases; its owner hands it over on renewal
+func (c *recordConsumer) claim(ctx context.Context, leases []KCLLease, held int) error {
+	victim, owned, target := claimVictim(leases, c.lm.workerID, held)
+	for _, lease := range owned {
+		if lease.ClaimRequest != "" {
+			continue
+		}
+		_, err := c.lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(c.leaseTable),
+			Key:                 map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: lease.ShardID}},
+			UpdateExpression:    aws.String("SET #r = :me"),
+			ConditionExpression: aws.String("#o = :owner AND attribute_not_exists(#r)"),
+			ExpressionAttributeNames: map[string]string{
+				"#o": kclLeaseOwnerKey, "#r": kclClaimRequestKey,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":me":    &types.AttributeValueMemberS{Value: c.lm.workerID},
+				":owner": &types.AttributeValueMemberS{Value: victim},
+			},
+		})
+		var condCheckErr *types.ConditionalCheckFailedException
+		switch {
+		case errors.As(err, &condCheckErr):
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to claim lease of shard %s: %w", lease.ShardID, err)
+		}
+		leaseClaims.add(1)
+		log.Printf("🤝 Claimed lease of shard %s from %s (%d leases, even share %d)", lease.ShardID, victim, len(owned), target)
+		return nil
+	}
+	return nil
+}
+
+// start runs a shard consumer; the caller holds c.mu
+func (c *recordConsumer) start(ctx context.Context, shardID, checkpoint string) {
+	sc := &shardConsumer{shardID: shardID, stop: make(chan struct{}), done: make(chan struct{})}
+	c.shards[shardID] = sc
+	go func() {
+		defer close(sc.done)
+		c.consume(ctx, sc, checkpoint)
+		c.merge.closeSource(c.lm.streamName, shardID)
+		c.mu.Lock()
+		delete(c.shards, shardID)
+		delete(c.lag, shardID)
+		delete(c.shardRead, shardID)
+		leasesHeld.set(float64(len(c.shards)))
+		c.mu.Unlock()
+	}()
+}
+
+// consume reads a shard from its checkpoint until the shard ends, the lease is lost
+// or claimed, or a stop is requested, checkpointing every checkpointEvery. Records
+// are polled with GetRecords, or pushed through a subscription with enhanced fan-out.
+// With the merge stage, checkpoints stop short of the records it still holds, and a
+// finished shard keeps its lease until they are emitted.
+func (c *recordConsumer) consume(ctx context.Context, sc *shardConsumer, checkpoint string) {
+	shardID, stream := sc.shardID, c.lm.streamName
+	var iterator *string
+	var sub *shardSubscription
+	if c.efo != nil {
+		sub = &shardSubscription{api: c.subscriber, consumer: c.efo, shardID: shardID, initial: c.initialPosition}
+		defer sub.close()
+	} else {
+		var err error
+		if iterator, err = c.iterator(ctx, shardID, checkpoint); err != nil {
+			log.Printf("WARN: %v, releasing shard %s", err, shardID)
+			c.lm.releaseKCLLease(ctx, c.leaseTable, shardID)
+			return
+		}
+	}
+	// ended is set once the shard is read to its end
+	ended := sub == nil && iterator == nil
+
+	lastSeq := checkpoint
+	lastCheckpoint, lastRenew := time.Now(), time.Now()
+	// finish checkpoints what was read and lets the lease go
+	finish := func(reason string) {
+		if seq := c.merge.checkpointable(stream, shardID, lastSeq); seq != checkpoint {
+			if _, err := c.checkpoint(ctx, shardID, seq); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		}
+		if _, err := c.lm.releaseKCLLease(ctx, c.leaseTable, shardID); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		log.Printf("Released lease of shard %s at %s (%s)", shardID, dash(lastSeq), reason)
+	}
+	// end checkpoints SHARD_END, so children may start, once nothing is held
+	end := func() bool {
+		if c.merge.holds(stream, shardID) {
+			return false
+		}
+		if _, err := c.checkpoint(ctx, shardID, kclShardEnd); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		c.lm.releaseKCLLease(ctx, c.leaseTable, shardID)
+		log.Printf("🏁 Shard %s finished, checkpointed %s", shardID, kclShardEnd)
+		return true
+	}
+
+	for {
+		// A subscription waits for records itself
+		wait := c.idle
+		if sub != nil && !ended {
+			wait = 0
+		}
+		select {
+		case <-sc.stop:
+			finish("stopped")
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if ended {
+			// Read to the end, waiting for the merge stage
+			if end() {
+				return
+			}
+		} else {
+			var records []kinesistypes.Record
+			var behind *int64
+			if sub != nil {
+				event, err := sub.next(ctx, sc.stop, c.idle, lastSeq)
+				if err != nil {
+					log.Printf("WARN: %v", err)
+					// Subscribing again too soon is refused
+					select {
+					case <-sc.stop:
+					case <-ctx.Done():
+					case <-time.After(c.idle):
+					}
+					continue
+				}
+				if event != nil {
+					records, behind = event.Records, event.MillisBehindLatest
+					ended = event.ContinuationSequenceNumber == nil
+				}
+			} else {
+				out, err := c.reader.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+				var expired *kinesistypes.ExpiredIteratorException
+				var throttled *kinesistypes.ProvisionedThroughputExceededException
+				switch {
+				case errors.As(err, &expired):
+					if iterator, err = c.iterator(ctx, shardID, lastSeq); err != nil {
+						log.Printf("WARN: %v", err)
+						finish("iterator lost")
+						return
+					}
+					continue
+				case errors.As(err, &throttled):
+					continue
+				case err != nil:
+					log.Printf("WARN: Failed to read shard %s: %v", shardID, err)
+					continue
+				}
+				records, behind = out.Records, out.MillisBehindLatest
+				iterator = out.NextShardIterator
+				ended = iterator == nil
+			}
+
+			if n := len(records); n > 0 {
+				c.merge.push(stream, shardID, lastSeq, records)
+				lastSeq = aws.ToString(records[n-1].SequenceNumber)
+				recordsProcessed.add(float64(n))
+				c.processed.Add(int64(n))
+				// A scenario may slow processing down, past lease renewal if long enough
+				if delay := activeScenario.Load().processed(shardID, n); delay > 0 {
+					select {
+					case <-sc.stop:
+						finish("stopped")
+						return
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
+				}
+			}
+			c.mu.Lock()
+			if behind != nil {
+				c.lag[shardID] = *behind
+			}
+			c.shardRead[shardID] += int64(len(records))
+			c.mu.Unlock()
+			// Closed and read to the end
+			if ended {
+				c.merge.closeSource(stream, shardID)
+				if end() {
+					return
+				}
+			}
+		}
+
+		if time.Since(lastRenew) >= c.failover/3 {
+			claimant, lost, err := c.renew(ctx, shardID)
+			switch {
+			case lost:
+				log.Printf("Lost lease of shard %s", shardID)
+				return
+			case claimant != "":
+				finish("claimed by " + claimant)
+				return
+			case err == nil:
+				lastRenew = time.Now()
+			case time.Since(lastRenew) >= c.failover:
+				// Expired by now, and possibly taken: stop without checkpointing
+				log.Printf("WARN: %v, giving up shard %s", err, shardID)
+				return
+			default:
+				log.Printf("WARN: %v", err)
+			}
+		}
+		if seq := c.merge.checkpointable(stream, shardID, lastSeq); seq != checkpoint && time.Since(lastCheckpoint) >= c.checkpointEvery {
+			ok, err := c.checkpoint(ctx, shardID, seq)
+			if err != nil {
+				log.Printf("WARN: %v", err)
+			} else if !ok {
+				log.Printf("Lost lease of shard %s", shardID)
+				return
+			} else {
+				checkpoint, lastCheckpoint = seq, time.Now()
+			}
+		}
+	}
+}
+
+// stats reports the leases held, the record rate in total and per shard since the
+// previous call and the largest lag of the shards held, for the worker row
+func (c *recordConsumer) stats() RuntimeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := RuntimeStats{LeasesHeld: len(c.shards), ShardRecordsPerSecond: make(map[string]float64, len(c.shards))}
+	for _, lag := range c.lag {
+		stats.LagMillis = max(stats.LagMillis, lag)
+	}
+	now, count := time.Now(), c.processed.Load()
+	if elapsed := now.Sub(c.statsAt).Seconds(); elapsed > 0 {
+		stats.RecordsPerSecond = float64(count-c.statsCount) / elapsed
+		for shardID := range c.shards {
+			stats.ShardRecordsPerSecond[shardID] = float64(c.shardRead[shardID]) / elapsed
+			c.shardRead[shardID] = 0
+		}
+	}
+	c.statsCount, c.statsAt = count, now
+	return stats
+}
+
+// iterator returns a shard iterator right after checkpoint, or at the initial position
+func (c *recordConsumer) iterator(ctx context.Context, shardID, checkpoint string) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(c.lm.streamName),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: c.initialPosition,
+	}
+	if checkpoint != "" {
+		input.ShardIteratorType = kinesistypes.ShardIteratorTypeAfterSequenceNumber
+		input.StartingSequenceNumber = aws.String(checkpoint)
+	}
+	out, err := c.reader.GetShardIterator(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get iterator of shard %s: %w", shardID, err)
+	}
+	return out.ShardIterator, nil
+}
+
+// renew extends the lease unless another worker claimed it, returning the claimant;
+// lost means another worker owns the lease now
+func (c *recordConsumer) renew(ctx context.Context, shardID string) (claimant string, lost bool, err error) {
+	key := map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}}
+	_, err = c.lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(c.leaseTable),
+		Key:                      key,
+		UpdateExpression:         aws.String("SET #t = :timeout"),
+		ConditionExpression:      aws.String("#o = :me AND attribute_not_exists(#r)"),
+		ExpressionAttributeNames: map[string]string{"#o": kclLeaseOwnerKey, "#t": kclLeaseTimeoutKey, "#r": kclClaimRequestKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":me":      &types.AttributeValueMemberS{Value: c.lm.workerID},
+			":timeout": &types.AttributeValueMemberS{Value: time.Now().Add(c.failover).UTC().Format(time.RFC3339)},
+		},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case err == nil:
+		return "", false, nil
+	case !errors.As(err, &condCheckErr):
+		return "", false, fmt.Errorf("failed to renew lease of shard %s: %w", shardID, err)
+	}
+
+	result, err := c.lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(c.leaseTable),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read lease of shard %s: %w", shardID, err)
+	}
+	if attrString(result.Item, kclLeaseOwnerKey) != c.lm.workerID {
+		return "", true, nil
+	}
+	return attrString(result.Item, kclClaimRequestKey), false, nil
+}
+
+// checkpoint records seq for the shard while this worker owns its lease; false means
+// the lease was lost
+func (c *recordConsumer) checkpoint(ctx context.Context, shardID, seq string) (bool, error) {
+	if activeScenario.Load().refusesCheckpoint(shardID) {
+		return false, fmt.Errorf("checkpoint of shard %s refused by scenario", shardID)
+	}
+	_, err := c.lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(c.leaseTable),
+		Key:                      map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}},
+		UpdateExpression:         aws.String("SET #c = :seq"),
+		ConditionExpression:      aws.String("#o = :me"),
+		ExpressionAttributeNames: map[string]string{"#o": kclLeaseOwnerKey, "#c": kclCheckpointKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":me":  &types.AttributeValueMemberS{Value: c.lm.workerID},
+			":seq": &types.AttributeValueMemberS{Value: seq},
+		},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to checkpoint shard %s: %w", shardID, err)
+	}
+	checkpointsWritten.add(1)
+	return true, nil
+}
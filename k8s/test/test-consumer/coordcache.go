@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+// cachedCoordinator is the on-disk form of the last coordinator row read. The
+// identity fields guard against reusing a file from another app, stream or group.
+type cachedCoordinator struct {
+	AppName            string    `json:"app_name"`
+	StreamName         string    `json:"stream_name"`
+	Region             string    `json:"region"`
+	ConsumerGroup      string    `json:"consumer_group"`
+	MaxLeasesPerWorker int       `json:"max_leases_per_worker"`
+	ShardCount         int       `json:"shard_count"`
+	WorkerCount        int       `json:"worker_count"`
+	SavedAt            time.Time `json:"saved_at"`
+}
+
+// SetCoordinatorCache persists every coordinator value read to path, typically on an
+// emptyDir volume that survives container restarts. If initialization later fails
+// because the metadata store is unreachable, the cached value is used instead.
+func (lm *KDSLeaseManager) SetCoordinatorCache(path string) {
+	lm.coordinatorCache = path
+}
+
+// saveCoordinatorCache writes metadata to the cache file when it differs from the
+// previous value. Errors only warn: the cache is an optimization.
+func (lm *KDSLeaseManager) saveCoordinatorCache(metadata, previous *leasemanager.Metadata) {
+	if lm.coordinatorCache == "" {
+		return
+	}
+	if previous != nil && previous.MaxLeasesPerWorker == metadata.MaxLeasesPerWorker &&
+		previous.ShardCount == metadata.ShardCount && previous.WorkerCount == metadata.WorkerCount {
+		return
+	}
+
+	data, err := json.Marshal(cachedCoordinator{
+		AppName:            lm.appName,
+		StreamName:         lm.streamName,
+		Region:             lm.region,
+		ConsumerGroup:      lm.consumerGroup,
+		MaxLeasesPerWorker: metadata.MaxLeasesPerWorker,
+		ShardCount:         metadata.ShardCount,
+		WorkerCount:        metadata.WorkerCount,
+		SavedAt:            time.Now(),
+	})
+	if err == nil {
+		err = writeFileAtomic(lm.coordinatorCache, data)
+	}
+	if err != nil {
+		log.Printf("WARN: Failed to cache coordinator value in %s: %v", lm.coordinatorCache, err)
+	}
+}
+
+// loadCoordinatorCache returns the cached coordinator value for this app, stream,
+// region and group
+func (lm *KDSLeaseManager) loadCoordinatorCache() (*cachedCoordinator, error) {
+	if lm.coordinatorCache == "" {
+		return nil, fmt.Errorf("no coordinator cache configured (KDS_COORDINATOR_CACHE)")
+	}
+	data, err := os.ReadFile(lm.coordinatorCache)
+	if err != nil {
+		return nil, err
+	}
+
+	var cached cachedCoordinator
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("corrupt coordinator cache %s: %w", lm.coordinatorCache, err)
+	}
+	if cached.AppName != lm.appName || cached.StreamName != lm.streamName ||
+		cached.Region != lm.region || cached.ConsumerGroup != lm.consumerGroup {
+		return nil, fmt.Errorf("coordinator cache %s belongs to app=%s stream=%s region=%s group=%s",
+			lm.coordinatorCache, cached.AppName, cached.StreamName, cached.Region, cached.ConsumerGroup)
+	}
+	if !leasemanager.ValidMaxLeases(cached.MaxLeasesPerWorker) {
+		return nil, fmt.Errorf("coordinator cache %s has invalid max leases %d", lm.coordinatorCache, cached.MaxLeasesPerWorker)
+	}
+	return &cached, nil
+}
+
+// writeFileAtomic replaces path with data so a crash mid-write never leaves a
+// truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var cordonedGauge = metrics.gauge("kds_worker_cordoned", "1 while this worker is cordoned")
+
+// Cordon marks a worker that hands its leases to peers and takes no new ones while
+// staying up for debugging, like kubectl cordon for consumer pods. Cordons are rows
+// of their own rather than an attribute of the worker row, which every SaveMetadata
+// overwrites.
+type Cordon struct {
+	WorkerID   string    `json:"worker_id"`
+	CordonedAt time.Time `json:"cordoned_at"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func (lm *KDSLeaseManager) getCordonKey(workerID string) string {
+	return lm.keys().Prefix() + "cordon#" + workerID
+}
+
+// CordonWorker marks workerID cordoned; cordoning a cordoned worker updates the reason
+func (lm *KDSLeaseManager) CordonWorker(ctx context.Context, workerID, reason string) error {
+	item := map[string]types.AttributeValue{
+		"worker_id":   &types.AttributeValueMemberS{Value: lm.getCordonKey(workerID)},
+		"cordoned_at": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if reason != "" {
+		item["reason"] = &types.AttributeValueMemberS{Value: reason}
+	}
+	if _, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("failed to cordon worker %s: %w", workerID, err)
+	}
+	log.Printf("Cordoned worker %s (reason=%q)", workerID, reason)
+	return nil
+}
+
+// UncordonWorker lets workerID take leases again
+func (lm *KDSLeaseManager) UncordonWorker(ctx context.Context, workerID string) error {
+	if _, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.getCordonKey(workerID)},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to uncordon worker %s: %w", workerID, err)
+	}
+	log.Printf("Uncordoned worker %s", workerID)
+	return nil
+}
+
+// IsCordoned reports whether this worker is cordoned
+func (lm *KDSLeaseManager) IsCordoned(ctx context.Context) (bool, error) {
+	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.getCordonKey(lm.workerID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read cordon of worker %s: %w", lm.workerID, err)
+	}
+	return result.Item != nil, nil
+}
+
+// CordonedWorkers lists the cordoned workers of the group
+func (lm *KDSLeaseManager) CordonedWorkers(ctx context.Context) ([]Cordon, error) {
+	prefix := lm.getCordonKey("")
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(lm.metadataTable),
+		FilterExpression: aws.String("begins_with(worker_id, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: prefix},
+		},
+	}
+	cordons := []Cordon{}
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list cordoned workers: %w", err)
+		}
+		for _, item := range result.Items {
+			cordonedAt, _ := time.Parse(time.RFC3339, attrString(item, "cordoned_at"))
+			cordons = append(cordons, Cordon{
+				WorkerID:   strings.TrimPrefix(attrString(item, "worker_id"), prefix),
+				CordonedAt: cordonedAt,
+				Reason:     attrString(item, "reason"),
+			})
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return cordons, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// cordonWatcher applies this worker's cordon on every status tick: while cordoned it
+// releases whatever KCL leases it holds, so it ends up with none
+type cordonWatcher struct {
+	lm         *KDSLeaseManager
+	leaseTable string
+	cordoned   bool
+}
+
+// activeCordon serves the cordon endpoints once the lease manager is initialized
+var activeCordon atomic.Pointer[cordonWatcher]
+
+// check reads the cordon and releases leases while cordoned; errors keep the last state
+func (w *cordonWatcher) check(ctx context.Context) bool {
+	cordoned, err := w.lm.IsCordoned(ctx)
+	if err != nil {
+		log.Printf("WARN: %v", err)
+		return w.cordoned
+	}
+	if cordoned != w.cordoned {
+		if cordoned {
+			log.Printf("🚧 Worker %s is cordoned, handing its leases to peers", w.lm.workerID)
+		} else {
+			log.Printf("Worker %s is uncordoned, taking leases again", w.lm.workerID)
+		}
+		w.cordoned = cordoned
+	}
+	if cordoned {
+		cordonedGauge.set(1)
+		// Shard consumers checkpoint and release their own leases first
+		released := activeConsumer.Load().releaseAll(ctx)
+		rest, err := w.lm.releaseKCLLeases(ctx, w.leaseTable)
+		released = append(released, rest...)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		if len(released) > 0 {
+			log.Printf("🚧 Released %d leases of cordoned worker %s: %s", len(released), w.lm.workerID, strings.Join(released, ", "))
+		}
+	} else {
+		cordonedGauge.set(0)
+	}
+	return cordoned
+}
+
+// cordonHandler serves POST /cordon and /uncordon with an optional worker query
+// parameter (default this worker) and reason, and GET /cordons
+func cordonHandler(w http.ResponseWriter, r *http.Request) {
+	watcher := activeCordon.Load()
+	if watcher == nil {
+		http.Error(w, "lease manager not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	lm := watcher.lm
+	if r.URL.Path != "/cordons" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		workerID := r.URL.Query().Get("worker")
+		if workerID == "" {
+			workerID = lm.workerID
+		}
+		var err error
+		if r.URL.Path == "/cordon" {
+			err = lm.CordonWorker(r.Context(), workerID, r.URL.Query().Get("reason"))
+		} else {
+			err = lm.UncordonWorker(r.Context(), workerID)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	cordons, err := lm.CordonedWorkers(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cordons)
+}
+
+// runCordonCommand implements "cordon [worker [reason]]" and "uncordon <worker>";
+// cordon without a worker lists the cordoned workers
+func runCordonCommand(ctx context.Context, cfg appConfig, uncordon bool, args []string) int {
+	if uncordon && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: uncordon <worker>")
+		return 2
+	}
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch {
+	case uncordon:
+		err = lm.UncordonWorker(ctx, args[0])
+	case len(args) > 0:
+		err = lm.CordonWorker(ctx, args[0], strings.Join(args[1:], " "))
+	default:
+		var cordons []Cordon
+		if cordons, err = lm.CordonedWorkers(ctx); err == nil {
+			if len(cordons) == 0 {
+				fmt.Println("No cordoned workers")
+			}
+			for _, c := range cordons {
+				fmt.Printf("%s cordoned=%s reason=%q\n", c.WorkerID, c.CordonedAt.Format(time.RFC3339), c.Reason)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Degradation reasons besides the failure policy's, see failure.go
+const (
+	reasonWorkerCountDefault = "worker_count_default"
+	reasonKubernetesClient   = "kubernetes_client"
+	reasonNamespaceDefault   = "namespace_default"
+	reasonMaxLeasesFallback  = "max_leases_fallback"
+	reasonInvalidSetting     = "invalid_setting"
+)
+
+var degradedGauge = metrics.gauge("kds_degraded", "1 while the worker runs degraded after a failure or fallback, by reason")
+
+// degradation is one way the worker runs on less than it was configured for
+type degradation struct {
+	Reason string    `json:"reason"`
+	Detail string    `json:"detail"`
+	Since  time.Time `json:"since"`
+}
+
+// degradationTracker holds the active degradations. Fallbacks that used to be a log
+// line, such as a worker count of 1 when RBAC forbids the lookup, quietly change the
+// lease math; here they are kds_degraded{reason} and listed by /health and /ready.
+type degradationTracker struct {
+	mu      sync.Mutex
+	active  map[string]degradation
+	invalid map[string]string // setting -> rejected value
+}
+
+var degradations = &degradationTracker{active: map[string]degradation{}, invalid: map[string]string{}}
+
+// set marks reason active, logging when it starts or its detail changes
+func (t *degradationTracker) set(reason, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.active[reason]
+	if ok && current.Detail == detail {
+		return
+	}
+	if !ok {
+		current.Since = time.Now()
+	}
+	current.Reason, current.Detail = reason, detail
+	t.active[reason] = current
+	degradedGauge.set(1, "reason", reason)
+	log.Printf("⚠️  Degraded (%s): %s", reason, detail)
+}
+
+// clear ends reason, logging the recovery when it was active
+func (t *degradationTracker) clear(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.active[reason]
+	if !ok {
+		return
+	}
+	delete(t.active, reason)
+	degradedGauge.set(0, "reason", reason)
+	log.Printf("Recovered (%s) after %s", reason, time.Since(current.Since).Round(time.Second))
+}
+
+// invalidSetting records a setting whose value was rejected for its default; they
+// share one reason, detailed with every rejected setting
+func (t *degradationTracker) invalidSetting(key, value, defaultValue string) {
+	log.Printf("WARN: invalid %s=%q, using default %s", key, value, defaultValue)
+	t.mu.Lock()
+	t.invalid[key] = value
+	keys := make([]string, 0, len(t.invalid))
+	for k, v := range t.invalid {
+		keys = append(keys, fmt.Sprintf("%s=%q", k, v))
+	}
+	t.mu.Unlock()
+	sort.Strings(keys)
+	t.set(reasonInvalidSetting, "ignored "+strings.Join(keys, ", "))
+}
+
+// list returns the active degradations by reason
+func (t *degradationTracker) list() []degradation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]degradation, 0, len(t.active))
+	for _, d := range t.active {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Reason < list[j].Reason })
+	return list
+}
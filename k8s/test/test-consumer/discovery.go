@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// shardPageSize is the most shards a ListShards page holds
+const shardPageSize = 1000
+
+var (
+	shardDiscoverySeconds = metrics.gauge("kds_shard_discovery_seconds", "Duration of the last shard listing")
+	shardDiscoveryPages   = metrics.gauge("kds_shard_discovery_pages", "ListShards pages read by the last shard listing")
+	shardDiscoveryShards  = metrics.gauge("kds_shard_discovery_shards", "Shards returned by the last shard listing, open and closed")
+	shardDiscoveries      = metrics.counter("kds_shard_discoveries_total", "Shard listings, by mode (sequential or parallel)")
+	shardCountLookups     = metrics.counter("kds_shard_count_lookups_total", "Shard count lookups, by source (summary or list)")
+)
+
+// summaryShardCount reads the open shard count from DescribeStreamSummary: one call
+// whatever the stream size, where counting listed shards takes a page per thousand.
+// ok is false when the call fails, so the caller lists instead, or the summary has no
+// OpenShardCount, as with older emulators; the summary is not asked again then.
+func (lm *KDSLeaseManager) summaryShardCount(ctx context.Context) (int, bool) {
+	if lm.noSummaryCount.Load() {
+		return 0, false
+	}
+	summary, err := lm.kinesisClient.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(lm.streamName),
+	})
+	if err != nil {
+		log.Printf("WARN: Counting shards by listing them, stream summary failed: %v", err)
+		return 0, false
+	}
+	if summary.StreamDescriptionSummary == nil || summary.StreamDescriptionSummary.OpenShardCount == nil {
+		log.Printf("Stream summary of %s has no open shard count, counting shards by listing them", lm.streamName)
+		lm.noSummaryCount.Store(true)
+		return 0, false
+	}
+	return int(aws.ToInt32(summary.StreamDescriptionSummary.OpenShardCount)), true
+}
+
+// shardRange is a run of shard indexes listed by one goroutine: from up to, not
+// including, to; to is -1 for the last range, which runs to the end of the stream
+type shardRange struct {
+	from, to int
+}
+
+// listShards returns every shard the stream still lists, open and closed, in shard ID
+// order. ListShards pages are chained by token, so a stream with thousands of shards
+// takes one round trip per thousand. When the first page is not the last, the rest of
+// the stream is split by shard index into up to KDS_SHARD_DISCOVERY_CONCURRENCY
+// ranges, each listed from its own ExclusiveStartShardId at the same time.
+func (lm *KDSLeaseManager) listShards(ctx context.Context) ([]kinesistypes.Shard, error) {
+	start := time.Now()
+	first, err := lm.kinesisClient.ListShards(ctx, &kinesis.ListShardsInput{StreamName: aws.String(lm.streamName)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards: %w", err)
+	}
+	shards, pages, mode := first.Shards, 1, "sequential"
+	if first.NextToken != nil {
+		var rest []kinesistypes.Shard
+		var n int
+		if ranges := lm.shardRanges(ctx, first.Shards); len(ranges) > 1 {
+			mode = "parallel"
+			rest, n, err = lm.listShardRanges(ctx, ranges)
+		} else {
+			rest, n, err = lm.listShardPages(ctx, &kinesis.ListShardsInput{NextToken: first.NextToken}, -1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		shards, pages = append(shards, rest...), pages+n
+	}
+
+	shardDiscoverySeconds.set(time.Since(start).Seconds())
+	shardDiscoveryPages.set(float64(pages))
+	shardDiscoveryShards.set(float64(len(shards)))
+	shardDiscoveries.add(1, "mode", mode)
+	return shards, nil
+}
+
+// shardRanges splits the shards after the first page into ranges of at least a page
+// each, nil when the rest is to be read sequentially: parallel listing is disabled,
+// shard IDs are not shardId-<index> or the stream summary is unavailable. Open shards
+// are the newest, so the first page's last index plus the open shard count estimates
+// the end of the stream; the last range is open-ended in case it is further.
+func (lm *KDSLeaseManager) shardRanges(ctx context.Context, first []kinesistypes.Shard) []shardRange {
+	if lm.discoveryConcurrency <= 1 || len(first) == 0 {
+		return nil
+	}
+	last, ok := shardIndex(aws.ToString(first[len(first)-1].ShardId))
+	if !ok {
+		return nil
+	}
+	summary, err := lm.kinesisClient.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(lm.streamName),
+	})
+	if err != nil || summary.StreamDescriptionSummary == nil || summary.StreamDescriptionSummary.OpenShardCount == nil {
+		log.Printf("WARN: Listing shards sequentially, stream summary unavailable: %v", err)
+		return nil
+	}
+	remaining := int(aws.ToInt32(summary.StreamDescriptionSummary.OpenShardCount))
+	return splitShardRanges(last+1, remaining, lm.discoveryConcurrency)
+}
+
+// splitShardRanges splits about remaining shard indexes from start into at most
+// concurrency ranges of at least shardPageSize each
+func splitShardRanges(start, remaining, concurrency int) []shardRange {
+	n := min(concurrency, (remaining+shardPageSize-1)/shardPageSize)
+	if n <= 1 {
+		return nil
+	}
+	width := (remaining + n - 1) / n
+	ranges := make([]shardRange, n)
+	for i := range ranges {
+		ranges[i] = shardRange{from: start + i*width, to: start + (i+1)*width}
+	}
+	ranges[n-1].to = -1
+	return ranges
+}
+
+// listShardRanges lists every range at once, returning the shards in range order and
+// the pages read; the first error cancels the other ranges
+func (lm *KDSLeaseManager) listShardRanges(ctx context.Context, ranges []shardRange) ([]kinesistypes.Shard, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]kinesistypes.Shard, len(ranges))
+	pages := make([]int, len(ranges))
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r shardRange) {
+			defer wg.Done()
+			input := &kinesis.ListShardsInput{
+				StreamName:            aws.String(lm.streamName),
+				ExclusiveStartShardId: aws.String(shardIDForIndex(r.from - 1)),
+			}
+			var err error
+			if results[i], pages[i], err = lm.listShardPages(ctx, input, r.to); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+
+	var shards []kinesistypes.Shard
+	total := 0
+	seen := map[string]bool{}
+	for i, result := range results {
+		total += pages[i]
+		for _, shard := range result {
+			// Ranges are disjoint by index; IDs that are not shardId-<index> are kept
+			// by every range reaching them
+			if id := aws.ToString(shard.ShardId); !seen[id] {
+				seen[id] = true
+				shards = append(shards, shard)
+			}
+		}
+	}
+	return shards, total, nil
+}
+
+// listShardPages follows input's pages until the end of the stream or, with to >= 0,
+// the first shard at index to or beyond, returning the shards before it and the pages read
+func (lm *KDSLeaseManager) listShardPages(ctx context.Context, input *kinesis.ListShardsInput, to int) ([]kinesistypes.Shard, int, error) {
+	var shards []kinesistypes.Shard
+	for pages := 1; ; pages++ {
+		resp, err := lm.kinesisClient.ListShards(ctx, input)
+		if err != nil {
+			return nil, pages, fmt.Errorf("failed to list shards: %w", err)
+		}
+		last := -1
+		for _, shard := range resp.Shards {
+			i, ok := shardIndex(aws.ToString(shard.ShardId))
+			if ok && to >= 0 && i >= to {
+				return shards, pages, nil
+			}
+			if ok {
+				last = i
+			}
+			shards = append(shards, shard)
+		}
+		// A page ending on the range's last index needs no look at the next one
+		if resp.NextToken == nil || (to >= 0 && last == to-1) {
+			return shards, pages, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
+	}
+}
+
+// shardIndex parses the index of a shardId-000000000042 style ID; other spellings
+// would not sort like their index
+func shardIndex(shardID string) (int, bool) {
+	digits, ok := strings.CutPrefix(shardID, "shardId-")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(digits)
+	return i, err == nil && i >= 0 && shardIDForIndex(i) == shardID
+}
+
+// shardIDForIndex is the shard ID Kinesis assigns to index i
+func shardIDForIndex(i int) string {
+	return fmt.Sprintf("shardId-%012d", i)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// latestLeaseView is the most recent observer lease table view served on /shards
+var latestLeaseView atomic.Pointer[LeaseTableView]
+
+// Output formats of the lease table view
+const (
+	viewFormatTable   = "table"
+	viewFormatJSON    = "json"
+	viewFormatHeatmap = "heatmap"
+	viewFormatHTML    = "html"
+)
+
+// shardDistribution lays the open shards of a lease table view out as a grid of
+// workers by shards, for spotting imbalance during load tests
+type shardDistribution struct {
+	Table       string
+	ObservedAt  time.Time
+	Coordinator int
+	Shards      []string // open shards, in shard order
+	Finished    int      // shards read to SHARD_END, left out of the grid
+	Rows        []distributionRow
+	// MaxRate is the busiest shard's records/s, the top of the heat scale; 0 when no
+	// owner reports per-shard rates
+	MaxRate float64
+	Partial string
+}
+
+// distributionRow is one owner, or the unowned and expired leases, across the shards
+type distributionRow struct {
+	Name   string
+	Leases int
+	Rate   float64
+	Cells  []distributionCell // one per shard of the distribution
+}
+
+type distributionCell struct {
+	Shard string
+	Held  bool
+	Rate  *float64
+}
+
+// newShardDistribution groups the open leases of view by owner. Expired leases count
+// toward no worker; they are shown on their own row like the unowned ones.
+func newShardDistribution(view *LeaseTableView) *shardDistribution {
+	d := &shardDistribution{Table: view.LeaseTable, ObservedAt: view.ObservedAt, Coordinator: view.Coordinator, Partial: view.Partial}
+	holder := map[string]string{}
+	rates := map[string]*float64{}
+	for _, lease := range view.Leases {
+		switch lease.State {
+		case kclLeaseFinished:
+			d.Finished++
+			continue
+		case kclLeaseOwned:
+			holder[lease.ShardID] = lease.Owner
+		case kclLeaseExpired:
+			holder[lease.ShardID] = "(expired)"
+		default:
+			holder[lease.ShardID] = "(unowned)"
+		}
+		d.Shards = append(d.Shards, lease.ShardID)
+		rates[lease.ShardID] = lease.RecordsPerSecond
+		if lease.RecordsPerSecond != nil {
+			d.MaxRate = max(d.MaxRate, *lease.RecordsPerSecond)
+		}
+	}
+
+	// Every worker gets a row, also the ones holding nothing
+	names := map[string]bool{}
+	for _, o := range view.Owners {
+		names[o.WorkerID] = true
+	}
+	for _, name := range holder {
+		names[name] = true
+	}
+	for name := range names {
+		row := distributionRow{Name: name, Cells: make([]distributionCell, len(d.Shards))}
+		for i, shard := range d.Shards {
+			row.Cells[i].Shard = shard
+			if holder[shard] != name {
+				continue
+			}
+			row.Cells[i].Held, row.Cells[i].Rate = true, rates[shard]
+			row.Leases++
+			if rate := rates[shard]; rate != nil {
+				row.Rate += *rate
+			}
+		}
+		d.Rows = append(d.Rows, row)
+	}
+	sort.Slice(d.Rows, func(i, j int) bool {
+		// Workers first, then (expired) and (unowned)
+		pi, pj := strings.HasPrefix(d.Rows[i].Name, "("), strings.HasPrefix(d.Rows[j].Name, "(")
+		if pi != pj {
+			return pj
+		}
+		return d.Rows[i].Name < d.Rows[j].Name
+	})
+	return d
+}
+
+// workers returns the rows of actual workers
+func (d *shardDistribution) workers() []distributionRow {
+	for i, row := range d.Rows {
+		if strings.HasPrefix(row.Name, "(") {
+			return d.Rows[:i]
+		}
+	}
+	return d.Rows
+}
+
+// Imbalance summarizes the spread of leases and throughput across the workers
+func (d *shardDistribution) Imbalance() string {
+	workers := d.workers()
+	if len(workers) == 0 {
+		return "no workers"
+	}
+	minLeases, maxLeases, total, maxRate := math.MaxInt, 0, 0.0, 0.0
+	for _, row := range workers {
+		minLeases, maxLeases = min(minLeases, row.Leases), max(maxLeases, row.Leases)
+		total += row.Rate
+		maxRate = max(maxRate, row.Rate)
+	}
+	summary := fmt.Sprintf("leases per worker %d-%d", minLeases, maxLeases)
+	if total > 0 {
+		summary += fmt.Sprintf(", busiest worker at %.1fx the mean throughput", maxRate/(total/float64(len(workers))))
+	}
+	return summary
+}
+
+// heat is a held cell's share of the busiest shard's rate, from 0 to 9; -1 without a
+// reported rate
+func (d *shardDistribution) heat(c distributionCell) int {
+	if c.Rate == nil || d.MaxRate <= 0 {
+		return -1
+	}
+	return min(9, int(*c.Rate/d.MaxRate*10))
+}
+
+// writeHeatmap renders the distribution as text: a column per open shard, "." where
+// the row does not hold the shard, 0-9 for its throughput relative to the busiest
+// shard, or "#" when the owner reports no per-shard rate
+func (d *shardDistribution) writeHeatmap(out io.Writer) {
+	fmt.Fprintf(out, "%s: %d open shards, %d finished, coordinator max leases %d\n",
+		d.Table, len(d.Shards), d.Finished, d.Coordinator)
+	if d.MaxRate > 0 {
+		fmt.Fprintf(out, "heat: 0-9 = share of the busiest shard (%.1f records/s), # = held without a rate, . = not held\n", d.MaxRate)
+	} else {
+		fmt.Fprintln(out, "# = held, . = not held (no per-shard rates reported)")
+	}
+
+	// A ruler every 10 shards over the grid
+	var ruler strings.Builder
+	for i := range d.Shards {
+		if i%10 == 0 {
+			ruler.WriteString("|")
+		} else {
+			ruler.WriteString(" ")
+		}
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "WORKER\tLEASES\tRECORDS/S\t%s\n", ruler.String())
+	for _, row := range d.Rows {
+		var cells strings.Builder
+		for _, c := range row.Cells {
+			switch heat := d.heat(c); {
+			case !c.Held:
+				cells.WriteByte('.')
+			case heat < 0:
+				cells.WriteByte('#')
+			default:
+				cells.WriteByte(byte('0' + heat))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%s\n", row.Name, row.Leases, row.Rate, cells.String())
+	}
+	w.Flush()
+	fmt.Fprintln(out, d.Imbalance())
+	if d.Partial != "" {
+		fmt.Fprintf(out, "WARN: %s\n", d.Partial)
+	}
+}
+
+// CellStyle is the background of a cell in the HTML heatmap
+func (d *shardDistribution) CellStyle(c distributionCell) template.CSS {
+	switch heat := d.heat(c); {
+	case !c.Held:
+		return "background:#f4f4f4"
+	case heat < 0:
+		return "background:#6a8cc7"
+	default:
+		// Light yellow for idle shards to dark red for the busiest
+		return template.CSS(fmt.Sprintf("background:hsl(%d,85%%,%d%%)", 50-heat*5, 85-heat*5))
+	}
+}
+
+// CellTitle is the tooltip of a cell in the HTML heatmap
+func (d *shardDistribution) CellTitle(c distributionCell) string {
+	if c.Rate != nil {
+		return fmt.Sprintf("%s: %.1f records/s", c.Shard, *c.Rate)
+	}
+	return c.Shard
+}
+
+var distributionHTML = template.Must(template.New("distribution").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Shard distribution: {{.Table}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table.grid { border-collapse: collapse; }
+table.grid td.cell { width: 12px; height: 18px; border: 1px solid #fff; padding: 0; }
+td, th { padding: 2px 8px; text-align: left; font-size: 13px; }
+.warn { color: #b00; }
+</style>
+</head>
+<body>
+<h2>{{.Table}}</h2>
+<p>{{len .Shards}} open shards, {{.Finished}} finished, coordinator max leases {{.Coordinator}}.
+{{.Imbalance}}. Observed {{.ObservedAt.Format "2006-01-02 15:04:05 MST"}}.</p>
+{{if .Partial}}<p class="warn">{{.Partial}}</p>{{end}}
+<table class="grid">
+<tr><th>Worker</th><th>Leases</th><th>Records/s</th><th colspan="{{len .Shards}}">Shards</th></tr>
+{{range $row := .Rows}}<tr><td>{{$row.Name}}</td><td>{{$row.Leases}}</td><td>{{printf "%.1f" $row.Rate}}</td>
+{{range $row.Cells}}<td class="cell" style="{{$.CellStyle .}}" title="{{$.CellTitle .}}"></td>{{end}}</tr>
+{{end}}</table>
+<p>Gray: not held. Blue: held, no rate reported. Yellow to red: share of the busiest shard{{if .MaxRate}} ({{printf "%.1f" .MaxRate}} records/s){{end}}.</p>
+</body>
+</html>
+`))
+
+// renderLeaseTableView writes view in one of the view formats
+func renderLeaseTableView(out io.Writer, view *LeaseTableView, format string) error {
+	switch format {
+	case viewFormatTable:
+		printLeaseTableView(out, view)
+	case viewFormatJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(view)
+	case viewFormatHeatmap:
+		newShardDistribution(view).writeHeatmap(out)
+	case viewFormatHTML:
+		return distributionHTML.Execute(out, newShardDistribution(view))
+	default:
+		return fmt.Errorf("unknown format %q, use table, json, heatmap or html", format)
+	}
+	return nil
+}
+
+// shardDistributionHandler serves the observer's latest lease table view on /shards,
+// as an HTML heatmap or ?format=heatmap|json
+func shardDistributionHandler(w http.ResponseWriter, r *http.Request) {
+	view := latestLeaseView.Load()
+	if view == nil {
+		http.Error(w, "no lease table view yet (run the observe subcommand)", http.StatusServiceUnavailable)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", viewFormatHTML:
+		format = viewFormatHTML
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case viewFormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+	case viewFormatHeatmap:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		http.Error(w, "format must be html, heatmap or json", http.StatusBadRequest)
+		return
+	}
+	renderLeaseTableView(w, view, format)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// draining is set once a drain starts; the main loop stops its periodic work so the
+// worker row is not written again after it was deregistered
+var draining atomic.Bool
+
+// activeDrainer is set once the lease manager is initialized; before that the worker
+// holds nothing and /drain has nothing to do
+var activeDrainer atomic.Pointer[drainer]
+
+// DrainResult is the /drain response body
+type DrainResult struct {
+	Released     []string `json:"released"`
+	Deregistered bool     `json:"deregistered"`
+	Errors       []string `json:"errors,omitempty"`
+	DurationMs   int64    `json:"duration_ms"`
+}
+
+// drainer runs the scale-down sequence once: stop reporting ready, stop the shard
+// consumers, which checkpoint, release the KCL leases this worker holds so peers take
+// them at once instead of after the failover time, and delete the worker row so the
+// coordinator stops counting it.
+type drainer struct {
+	lm         *KDSLeaseManager
+	leaseTable string
+	timeout    time.Duration
+
+	once   sync.Once
+	done   chan struct{}
+	result DrainResult
+}
+
+func newDrainer(lm *KDSLeaseManager, leaseTable string) *drainer {
+	return &drainer{
+		lm:         lm,
+		leaseTable: leaseTable,
+		timeout:    getEnvDuration("KDS_DRAIN_TIMEOUT", 25*time.Second),
+		done:       make(chan struct{}),
+	}
+}
+
+// drain starts the sequence unless it already ran and waits for it until ctx ends;
+// the sequence itself keeps going under its own timeout
+func (d *drainer) drain(ctx context.Context) (DrainResult, error) {
+	d.once.Do(func() { go d.run() })
+	select {
+	case <-d.done:
+		return d.result, nil
+	case <-ctx.Done():
+		return DrainResult{}, ctx.Err()
+	}
+}
+
+func (d *drainer) run() {
+	defer close(d.done)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	log.Printf("🚰 Draining worker %s", d.lm.workerID)
+	draining.Store(true)
+	isReady.Store(false)
+
+	// Shard consumers checkpoint and release their own leases first
+	released := activeConsumer.Load().releaseAll(ctx)
+	rest, err := d.lm.releaseKCLLeases(ctx, d.leaseTable)
+	released = append(released, rest...)
+	d.result.Released = released
+	if err != nil {
+		d.result.Errors = append(d.result.Errors, err.Error())
+	}
+	if err := d.lm.deregisterWorker(ctx); err != nil {
+		d.result.Errors = append(d.result.Errors, err.Error())
+	} else {
+		d.result.Deregistered = true
+	}
+
+	d.result.DurationMs = time.Since(start).Milliseconds()
+	log.Printf("🚰 Drained worker %s: released %d leases, deregistered=%t, %d errors (took %dms)",
+		d.lm.workerID, len(released), d.result.Deregistered, len(d.result.Errors), d.result.DurationMs)
+}
+
+// releaseKCLLeases clears the owner of every lease this worker holds, conditional on
+// it still being the owner, as the KCL does when a shard consumer stops
+func (lm *KDSLeaseManager) releaseKCLLeases(ctx context.Context, leaseTable string) ([]string, error) {
+	released := []string{}
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(leaseTable),
+		ProjectionExpression:      aws.String("#k"),
+		FilterExpression:          aws.String("#o = :me"),
+		ExpressionAttributeNames:  map[string]string{"#k": kclLeaseKeyKey, "#o": kclLeaseOwnerKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":me": &types.AttributeValueMemberS{Value: lm.workerID}},
+	}
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			return released, fmt.Errorf("failed to list leases held by %s: %w", lm.workerID, err)
+		}
+		for _, item := range result.Items {
+			shardID := attrString(item, kclLeaseKeyKey)
+			ok, err := lm.releaseKCLLease(ctx, leaseTable, shardID)
+			if err != nil {
+				return released, err
+			}
+			if ok {
+				released = append(released, shardID)
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return released, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// releaseKCLLease clears the owner of one lease if it is still this worker; false
+// means it was stolen or expired in the meantime
+func (lm *KDSLeaseManager) releaseKCLLease(ctx context.Context, leaseTable, shardID string) (bool, error) {
+	_, err := lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(leaseTable),
+		Key:                       map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}},
+		UpdateExpression:          aws.String("REMOVE #o"),
+		ConditionExpression:       aws.String("#o = :me"),
+		ExpressionAttributeNames:  map[string]string{"#o": kclLeaseOwnerKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":me": &types.AttributeValueMemberS{Value: lm.workerID}},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to release lease of shard %s: %w", shardID, err)
+	}
+	return true, nil
+}
+
+// deregisterWorker deletes this worker's metadata row
+func (lm *KDSLeaseManager) deregisterWorker(ctx context.Context) error {
+	_, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(lm.workerID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to deregister worker %s: %w", lm.workerID, err)
+	}
+	return nil
+}
+
+// drainHandler runs the drain on POST /drain and answers once it is done, or 504
+// when the request's deadline passes first
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	d := activeDrainer.Load()
+	if d == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DrainResult{Released: []string{}})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d.timeout+time.Second)
+	defer cancel()
+	result, err := d.drain(ctx)
+	if err != nil {
+		http.Error(w, "drain still running: "+err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// runDrainCommand asks the worker in this container to drain and waits for it, for
+// use as the preStop hook. It calls ADMIN_ADDR (or HEALTH_ADDR) on localhost with
+// the health server's token and TLS settings.
+func runDrainCommand(ctx context.Context) int {
+	addr := getEnv("ADMIN_ADDR", getEnv("HEALTH_ADDR", ":8080"))
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if getEnv("HEALTH_TLS_CERT_FILE", "") != "" {
+		scheme = "https"
+		// Our own server on localhost; its certificate names the Service, not 127.0.0.1
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+addr+"/drain", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drain: %v\n", err)
+		return 1
+	}
+	auth, err := newHealthAuth()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drain: %v\n", err)
+		return 1
+	}
+	if auth != nil {
+		if auth.header != "" {
+			req.Header.Set(auth.header, string(auth.token))
+		} else {
+			req.Header.Set("Authorization", "Bearer "+string(auth.token))
+		}
+	}
+
+	client := &http.Client{Transport: transport, Timeout: getEnvDuration("KDS_DRAIN_TIMEOUT", 25*time.Second) + 5*time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drain: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s", body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "drain: %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
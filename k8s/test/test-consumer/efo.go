@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// streamConsumerLimit is how many enhanced fan-out consumers a stream may register
+const streamConsumerLimit = 20
+
+// reasonEFOConsumerLimit is the degradation of a worker that found no free consumer slot
+const reasonEFOConsumerLimit = "efo_consumer_limit"
+
+// ErrStreamConsumerLimit is returned when every consumer slot of the stream is taken
+var ErrStreamConsumerLimit = errors.New("stream has no free enhanced fan-out consumer slot")
+
+var efoRegistrations = metrics.counter("kds_efo_consumer_registrations_total", "Enhanced fan-out consumer registrations at startup, by result (reused, registered, limit)")
+
+// efoPollInterval is how often a registration in progress is checked
+const efoPollInterval = 2 * time.Second
+
+// KinesisAPIForConsumers defines the Kinesis operations needed to manage enhanced
+// fan-out consumer registrations
+type KinesisAPIForConsumers interface {
+	DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error)
+	DescribeStreamConsumer(ctx context.Context, params *kinesis.DescribeStreamConsumerInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamConsumerOutput, error)
+	RegisterStreamConsumer(ctx context.Context, params *kinesis.RegisterStreamConsumerInput, optFns ...func(*kinesis.Options)) (*kinesis.RegisterStreamConsumerOutput, error)
+	DeregisterStreamConsumer(ctx context.Context, params *kinesis.DeregisterStreamConsumerInput, optFns ...func(*kinesis.Options)) (*kinesis.DeregisterStreamConsumerOutput, error)
+	ListStreamConsumers(ctx context.Context, params *kinesis.ListStreamConsumersInput, optFns ...func(*kinesis.Options)) (*kinesis.ListStreamConsumersOutput, error)
+}
+
+// KinesisAPIForSubscriptions defines the Kinesis operation needed to read shards
+// through an enhanced fan-out consumer
+type KinesisAPIForSubscriptions interface {
+	SubscribeToShard(ctx context.Context, params *kinesis.SubscribeToShardInput, optFns ...func(*kinesis.Options)) (*kinesis.SubscribeToShardOutput, error)
+}
+
+// streamConsumer is a registered enhanced fan-out consumer
+type streamConsumer struct {
+	Name   string
+	ARN    string
+	Status kinesistypes.ConsumerStatus
+}
+
+// efoConsumerName is the consumer an application registers: KDS_EFO_CONSUMER_NAME,
+// default APP_NAME. Every worker of the application subscribes through the same
+// registration, so it is found again by name after restarts and rollouts.
+func efoConsumerName(cfg appConfig) string {
+	return getEnv("KDS_EFO_CONSUMER_NAME", cfg.appName)
+}
+
+// streamARN returns the ARN of the stream, which the consumer operations address it by
+func streamARN(ctx context.Context, api KinesisAPIForConsumers, streamName string) (string, error) {
+	summary, err := api.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(streamName)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe stream %s: %w", streamName, err)
+	}
+	if summary.StreamDescriptionSummary == nil || summary.StreamDescriptionSummary.StreamARN == nil {
+		return "", fmt.Errorf("stream summary of %s has no ARN", streamName)
+	}
+	return aws.ToString(summary.StreamDescriptionSummary.StreamARN), nil
+}
+
+// describeStreamConsumer returns the consumer registered under name, nil when there is none
+func describeStreamConsumer(ctx context.Context, api KinesisAPIForConsumers, arn, name string) (*streamConsumer, error) {
+	out, err := api.DescribeStreamConsumer(ctx, &kinesis.DescribeStreamConsumerInput{
+		StreamARN:    aws.String(arn),
+		ConsumerName: aws.String(name),
+	})
+	var notFound *kinesistypes.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to describe stream consumer %s: %w", name, err)
+	}
+	d := out.ConsumerDescription
+	return &streamConsumer{Name: aws.ToString(d.ConsumerName), ARN: aws.ToString(d.ConsumerARN), Status: d.ConsumerStatus}, nil
+}
+
+// listStreamConsumers returns every consumer registered with the stream, by name
+func listStreamConsumers(ctx context.Context, api KinesisAPIForConsumers, arn string) ([]streamConsumer, error) {
+	var consumers []streamConsumer
+	input := &kinesis.ListStreamConsumersInput{StreamARN: aws.String(arn)}
+	for {
+		out, err := api.ListStreamConsumers(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stream consumers: %w", err)
+		}
+		for _, c := range out.Consumers {
+			consumers = append(consumers, streamConsumer{Name: aws.ToString(c.ConsumerName), ARN: aws.ToString(c.ConsumerARN), Status: c.ConsumerStatus})
+		}
+		if out.NextToken == nil {
+			break
+		}
+		// The token carries the stream; it may not be sent with it
+		input = &kinesis.ListStreamConsumersInput{NextToken: out.NextToken}
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].Name < consumers[j].Name })
+	return consumers, nil
+}
+
+// ensureStreamConsumer returns the active consumer registered under name, registering
+// it when there is none. A registration found by name is reused, so restarts do not
+// churn consumers; one still being created is waited for, one being deleted is
+// waited out and registered again. Workers starting together may register at once:
+// the losers find the winner's registration. When all streamConsumerLimit slots are
+// taken the error wraps ErrStreamConsumerLimit and names the registered consumers.
+func ensureStreamConsumer(ctx context.Context, api KinesisAPIForConsumers, arn, name string) (*streamConsumer, error) {
+	for {
+		consumer, err := describeStreamConsumer(ctx, api, arn, name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case consumer == nil:
+			_, err = api.RegisterStreamConsumer(ctx, &kinesis.RegisterStreamConsumerInput{
+				StreamARN:    aws.String(arn),
+				ConsumerName: aws.String(name),
+			})
+			var inUse *kinesistypes.ResourceInUseException
+			var limit *kinesistypes.LimitExceededException
+			switch {
+			case err == nil:
+				log.Printf("Registered enhanced fan-out consumer %s", name)
+			case errors.As(err, &inUse):
+				// Registered by another worker since the describe
+			case errors.As(err, &limit):
+				// The same exception also throttles registrations; only a full stream is final
+				consumers, listErr := listStreamConsumers(ctx, api, arn)
+				if listErr == nil && len(consumers) >= streamConsumerLimit {
+					names := make([]string, len(consumers))
+					for i, c := range consumers {
+						names[i] = c.Name
+					}
+					return nil, fmt.Errorf("%w: %d of %d registered (%v); deregister one with \"efo deregister <name>\"",
+						ErrStreamConsumerLimit, len(consumers), streamConsumerLimit, names)
+				}
+			default:
+				return nil, fmt.Errorf("failed to register stream consumer %s: %w", name, err)
+			}
+		case consumer.Status == kinesistypes.ConsumerStatusActive:
+			return consumer, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stream consumer %s not active: %w", name, ctx.Err())
+		case <-time.After(efoPollInterval):
+		}
+	}
+}
+
+// deregisterStreamConsumer removes the consumer registered under name; false when there
+// was none. Every worker of the application subscribes through it, so it is only
+// removed when the application is retired or moves off enhanced fan-out.
+func deregisterStreamConsumer(ctx context.Context, api KinesisAPIForConsumers, arn, name string) (bool, error) {
+	_, err := api.DeregisterStreamConsumer(ctx, &kinesis.DeregisterStreamConsumerInput{
+		StreamARN:    aws.String(arn),
+		ConsumerName: aws.String(name),
+	})
+	var notFound *kinesistypes.ResourceNotFoundException
+	switch {
+	case errors.As(err, &notFound):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to deregister stream consumer %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// registerEFOConsumer ensures the application's consumer registration at startup with
+// KDS_EFO=true; shards are then read through it with SubscribeToShard. A full stream
+// is not a startup failure: the worker reads with GetRecords instead and reports the
+// efo_consumer_limit degradation.
+func registerEFOConsumer(ctx context.Context, cfg appConfig, api KinesisAPIForConsumers) (*streamConsumer, error) {
+	name := efoConsumerName(cfg)
+	arn, err := streamARN(ctx, api, cfg.streamName)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := describeStreamConsumer(ctx, api, arn, name)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := ensureStreamConsumer(ctx, api, arn, name)
+	switch {
+	case errors.Is(err, ErrStreamConsumerLimit):
+		efoRegistrations.add(1, "result", "limit")
+		degradations.set(reasonEFOConsumerLimit, err.Error())
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case existing != nil && existing.Status != kinesistypes.ConsumerStatusDeleting:
+		efoRegistrations.add(1, "result", "reused")
+		log.Printf("Reusing enhanced fan-out consumer %s (%s)", consumer.Name, consumer.ARN)
+	default:
+		efoRegistrations.add(1, "result", "registered")
+	}
+	degradations.clear(reasonEFOConsumerLimit)
+	return consumer, nil
+}
+
+// shardSubscription reads one shard through the application's consumer. Kinesis
+// pushes the records over a subscription that lasts up to five minutes; next
+// subscribes again after the last record read whenever it ended or failed.
+type shardSubscription struct {
+	api      KinesisAPIForSubscriptions
+	consumer *streamConsumer
+	shardID  string
+	// initial is where a shard without a checkpoint is first read from
+	initial kinesistypes.ShardIteratorType
+	stream  *kinesis.SubscribeToShardEventStream
+}
+
+// next waits up to wait for the next event, subscribing after lastSeq (or at the
+// initial position without one) when no subscription is open. It returns nil when
+// no event arrived in time, stop was closed or the subscription ended. An event
+// without a continuation sequence number is the last: the shard is closed and read
+// to its end.
+func (s *shardSubscription) next(ctx context.Context, stop <-chan struct{}, wait time.Duration, lastSeq string) (*kinesistypes.SubscribeToShardEvent, error) {
+	if s.stream == nil {
+		position := &kinesistypes.StartingPosition{Type: s.initial}
+		if lastSeq != "" {
+			position = &kinesistypes.StartingPosition{Type: kinesistypes.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: aws.String(lastSeq)}
+		}
+		out, err := s.api.SubscribeToShard(ctx, &kinesis.SubscribeToShardInput{
+			ConsumerARN:      aws.String(s.consumer.ARN),
+			ShardId:          aws.String(s.shardID),
+			StartingPosition: position,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe to shard %s through %s: %w", s.shardID, s.consumer.Name, err)
+		}
+		s.stream = out.GetStream()
+	}
+
+	select {
+	case event, ok := <-s.stream.Events():
+		if !ok {
+			err := s.stream.Err()
+			s.close()
+			if err != nil {
+				return nil, fmt.Errorf("subscription to shard %s through %s failed: %w", s.shardID, s.consumer.Name, err)
+			}
+			return nil, nil
+		}
+		if e, ok := event.(*kinesistypes.SubscribeToShardEventStreamMemberSubscribeToShardEvent); ok {
+			return &e.Value, nil
+		}
+		return nil, nil
+	case <-stop:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, nil
+	case <-time.After(wait):
+		return nil, nil
+	}
+}
+
+// close ends the open subscription, if any
+func (s *shardSubscription) close() {
+	if s.stream != nil {
+		s.stream.Close()
+		s.stream = nil
+	}
+}
+
+// runEFOCommand implements "efo list", "efo register" and "efo deregister [name]",
+// which manage the stream's enhanced fan-out consumers. The name defaults to the
+// application's, see efoConsumerName.
+func runEFOCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "register" && args[0] != "deregister") || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: efo list | register [name] | deregister [name]")
+		return 2
+	}
+	name := efoConsumerName(cfg)
+	if len(args) == 2 {
+		name = args[1]
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	api := kinesis.NewFromConfig(awsCfg)
+	arn, err := streamARN(ctx, api, cfg.streamName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		var consumers []streamConsumer
+		if consumers, err = listStreamConsumers(ctx, api, arn); err == nil {
+			fmt.Printf("%d of %d consumer slots used on %s\n", len(consumers), streamConsumerLimit, cfg.streamName)
+			for _, c := range consumers {
+				mark := ""
+				if c.Name == name {
+					mark = " (this application)"
+				}
+				fmt.Printf("%s %s %s%s\n", c.Name, c.Status, c.ARN, mark)
+			}
+		}
+	case "register":
+		var consumer *streamConsumer
+		if consumer, err = ensureStreamConsumer(ctx, api, arn, name); err == nil {
+			fmt.Printf("%s %s %s\n", consumer.Name, consumer.Status, consumer.ARN)
+		}
+	case "deregister":
+		var removed bool
+		if removed, err = deregisterStreamConsumer(ctx, api, arn, name); err == nil {
+			if removed {
+				fmt.Printf("Deregistered %s\n", name)
+			} else {
+				fmt.Printf("No consumer %s registered\n", name)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
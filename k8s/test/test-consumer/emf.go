@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emfMaxMetrics is the most metrics CloudWatch accepts in one EMF document
+const emfMaxMetrics = 100
+
+// emfEmitter writes the registry to stdout in CloudWatch Embedded Metric Format, so a
+// fleet already shipping container logs to CloudWatch Logs gets its metrics without
+// a scraper. Metrics with the same labels share one JSON line; the labels, app and
+// stream become dimensions and the worker ID a searchable property. Counters are
+// emitted as the increase since the previous flush.
+type emfEmitter struct {
+	registry  *metricsRegistry
+	out       io.Writer
+	namespace string
+	interval  time.Duration
+	base      []string // name/value pairs added as dimensions to every document
+	worker    string
+
+	last map[string]float64 // counter name + label set -> value at the last flush
+}
+
+// newEMFEmitterFromEnv returns nil unless KDS_METRICS_EMF=true; it reads
+// KDS_METRICS_EMF_NAMESPACE and KDS_METRICS_EMF_INTERVAL
+func newEMFEmitterFromEnv(cfg appConfig) *emfEmitter {
+	if getEnv("KDS_METRICS_EMF", "false") != "true" {
+		return nil
+	}
+	return &emfEmitter{
+		registry:  metrics,
+		out:       os.Stdout,
+		namespace: getEnv("KDS_METRICS_EMF_NAMESPACE", "KDS/LeaseManager"),
+		interval:  getEnvDuration("KDS_METRICS_EMF_INTERVAL", time.Minute),
+		base:      []string{"app", cfg.appName, "stream", cfg.streamName},
+		worker:    cfg.workerID,
+		last:      map[string]float64{},
+	}
+}
+
+// run flushes every interval and once more when ctx ends
+func (e *emfEmitter) run(ctx context.Context) {
+	log.Printf("📈 Writing metrics to stdout in CloudWatch EMF every %s (namespace %s)", e.interval, e.namespace)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flush(time.Now())
+		case <-ctx.Done():
+			e.flush(time.Now())
+			return
+		}
+	}
+}
+
+// emfDocument collects the metrics of one label set
+type emfDocument struct {
+	labels []string
+	names  []string
+	units  []string
+	values []float64
+}
+
+func (e *emfEmitter) flush(now time.Time) {
+	docs := map[string]*emfDocument{}
+	var order []string
+
+	e.registry.mu.Lock()
+	for _, name := range e.registry.order {
+		f := e.registry.families[name]
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := f.values[k]
+			unit := "None"
+			if f.kind == "counter" {
+				// Counters restart at zero with the process
+				prev, seen := e.last[name+k]
+				e.last[name+k] = v
+				if seen && v >= prev {
+					v -= prev
+				}
+				unit = "Count"
+			}
+			if strings.HasSuffix(name, "_seconds") {
+				unit = "Seconds"
+			}
+			doc := docs[k]
+			if doc == nil {
+				doc = &emfDocument{labels: f.labels[k]}
+				docs[k] = doc
+				order = append(order, k)
+			}
+			doc.names = append(doc.names, name)
+			doc.units = append(doc.units, unit)
+			doc.values = append(doc.values, v)
+		}
+	}
+	e.registry.mu.Unlock()
+
+	sort.Strings(order)
+	for _, k := range order {
+		doc := docs[k]
+		for start := 0; start < len(doc.names); start += emfMaxMetrics {
+			end := min(start+emfMaxMetrics, len(doc.names))
+			line, err := json.Marshal(e.document(now, doc, start, end))
+			if err != nil {
+				log.Printf("WARN: Failed to encode EMF document: %v", err)
+				continue
+			}
+			e.out.Write(append(line, '\n'))
+		}
+	}
+}
+
+// document renders metrics [start, end) of doc as one EMF JSON object
+func (e *emfEmitter) document(now time.Time, doc *emfDocument, start, end int) map[string]any {
+	root := map[string]any{}
+	var dimensions []string
+	for _, pairs := range [][]string{e.base, doc.labels} {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if _, dup := root[pairs[i]]; !dup {
+				dimensions = append(dimensions, pairs[i])
+			}
+			root[pairs[i]] = pairs[i+1]
+		}
+	}
+	if _, ok := root["worker"]; !ok {
+		root["worker"] = e.worker
+	}
+	definitions := make([]map[string]string, 0, end-start)
+	for i := start; i < end; i++ {
+		definitions = append(definitions, map[string]string{"Name": doc.names[i], "Unit": doc.units[i]})
+		root[doc.names[i]] = doc.values[i]
+	}
+	root["_aws"] = map[string]any{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  e.namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    definitions,
+		}},
+	}
+	return root
+}
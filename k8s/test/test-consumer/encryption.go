@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// streamDescriber is the Kinesis call needed to verify stream encryption
+type streamDescriber interface {
+	DescribeStream(ctx context.Context, params *kinesis.DescribeStreamInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamOutput, error)
+}
+
+// encryptionPolicy is the server-side encryption a stream must have before the
+// worker consumes it
+type encryptionPolicy struct {
+	// keyID is the expected KMS key: key ID, key ARN, alias name or alias ARN
+	keyID string
+	// enforce refuses to start on a mismatch instead of only warning
+	enforce bool
+}
+
+// encryptionPolicyFromEnv returns nil unless KDS_EXPECTED_KMS_KEY is set.
+// KDS_KMS_ENFORCEMENT is "fail" (default) or "warn".
+func encryptionPolicyFromEnv() (*encryptionPolicy, error) {
+	keyID := getEnv("KDS_EXPECTED_KMS_KEY", "")
+	if keyID == "" {
+		return nil, nil
+	}
+	switch mode := getEnv("KDS_KMS_ENFORCEMENT", "fail"); mode {
+	case "fail":
+		return &encryptionPolicy{keyID: keyID, enforce: true}, nil
+	case "warn":
+		return &encryptionPolicy{keyID: keyID}, nil
+	default:
+		return nil, fmt.Errorf("KDS_KMS_ENFORCEMENT %q must be fail or warn", mode)
+	}
+}
+
+// check verifies with DescribeStream that streamName uses KMS server-side encryption
+// with the expected key
+func (p *encryptionPolicy) check(ctx context.Context, client streamDescriber, streamName string) error {
+	out, err := client.DescribeStream(ctx, &kinesis.DescribeStreamInput{
+		StreamName: aws.String(streamName),
+		Limit:      aws.Int32(1),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot verify encryption of stream %s: %w", streamName, err)
+	}
+
+	desc := out.StreamDescription
+	if desc.EncryptionType != kinesistypes.EncryptionTypeKms {
+		return fmt.Errorf("stream %s is not encrypted with KMS (encryption type %q)", streamName, desc.EncryptionType)
+	}
+	if actual := aws.ToString(desc.KeyId); !kmsKeyMatches(actual, p.keyID) {
+		return fmt.Errorf("stream %s is encrypted with KMS key %s, expected %s", streamName, actual, p.keyID)
+	}
+	return nil
+}
+
+// kmsKeyMatches compares the key reported by Kinesis with the expected one. Kinesis
+// reports the key as it was configured on the stream, so a key ID also matches the
+// key ARN and an alias name also matches the alias ARN. An alias and the key it
+// points to are not matched, since that needs kms:DescribeKey.
+func kmsKeyMatches(actual, expected string) bool {
+	if actual == expected {
+		return true
+	}
+	if strings.HasPrefix(expected, "alias/") {
+		return strings.HasSuffix(actual, ":"+expected)
+	}
+	return strings.HasSuffix(actual, ":key/"+expected)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var emergencyStopGauge = metrics.gauge("kds_emergency_stop", "1 while the fleet-wide emergency stop is engaged")
+
+// EmergencyStop is the fleet-wide brake for when downstream systems are corrupting
+// data: while it is engaged every worker of the group releases its leases and idles
+type EmergencyStop struct {
+	EngagedAt time.Time
+	EngagedBy string
+	Reason    string
+}
+
+func (lm *KDSLeaseManager) getEmergencyStopKey() string {
+	return lm.keys().Prefix() + "emergency-stop"
+}
+
+// EngageEmergencyStop stops the whole group within one polling interval
+func (lm *KDSLeaseManager) EngageEmergencyStop(ctx context.Context, reason string) error {
+	item := map[string]types.AttributeValue{
+		"worker_id":  &types.AttributeValueMemberS{Value: lm.getEmergencyStopKey()},
+		"engaged_at": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		"engaged_by": &types.AttributeValueMemberS{Value: lm.workerID},
+	}
+	if reason != "" {
+		item["reason"] = &types.AttributeValueMemberS{Value: reason}
+	}
+	if _, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("failed to engage emergency stop: %w", err)
+	}
+	log.Printf("🛑 Engaged emergency stop (reason=%q)", reason)
+	return nil
+}
+
+// ReleaseEmergencyStop lets the group take leases again
+func (lm *KDSLeaseManager) ReleaseEmergencyStop(ctx context.Context) error {
+	if _, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.getEmergencyStopKey()},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to release emergency stop: %w", err)
+	}
+	log.Printf("Released emergency stop")
+	return nil
+}
+
+// GetEmergencyStop returns the engaged emergency stop, nil when there is none
+func (lm *KDSLeaseManager) GetEmergencyStop(ctx context.Context) (*EmergencyStop, error) {
+	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.getEmergencyStopKey()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read emergency stop: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	engagedAt, _ := time.Parse(time.RFC3339, attrString(result.Item, "engaged_at"))
+	return &EmergencyStop{
+		EngagedAt: engagedAt,
+		EngagedBy: attrString(result.Item, "engaged_by"),
+		Reason:    attrString(result.Item, "reason"),
+	}, nil
+}
+
+// emergencyStopWatcher applies the emergency stop on every status tick: the shard
+// consumers checkpoint and stop, and every KCL lease of the worker is released.
+type emergencyStopWatcher struct {
+	lm         *KDSLeaseManager
+	leaseTable string
+	engaged    bool
+}
+
+// check reads the emergency stop and releases leases while it is engaged; errors keep
+// the last state, so a worker does not resume because the table is unreachable
+func (w *emergencyStopWatcher) check(ctx context.Context) bool {
+	stop, err := w.lm.GetEmergencyStop(ctx)
+	if err != nil {
+		log.Printf("WARN: %v", err)
+		return w.engaged
+	}
+	engaged := stop != nil
+	if engaged != w.engaged {
+		if engaged {
+			log.Printf("🛑 Emergency stop engaged by %s at %s (reason=%q), releasing leases and idling",
+				stop.EngagedBy, stop.EngagedAt.Format(time.RFC3339), stop.Reason)
+		} else {
+			log.Printf("Emergency stop released, taking leases again")
+		}
+		w.engaged = engaged
+	}
+	if engaged {
+		emergencyStopGauge.set(1)
+		// Shard consumers checkpoint and release their own leases first
+		released := activeConsumer.Load().releaseAll(ctx)
+		rest, err := w.lm.releaseKCLLeases(ctx, w.leaseTable)
+		released = append(released, rest...)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		if len(released) > 0 {
+			log.Printf("🛑 Released %d leases: %s", len(released), strings.Join(released, ", "))
+		}
+	} else {
+		emergencyStopGauge.set(0)
+	}
+	return engaged
+}
+
+// runEmergencyStopCommand implements "estop engage [reason]", "estop status" and
+// "estop release" and returns the process exit code
+func runEmergencyStopCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: estop engage [reason] | status | release")
+		return 2
+	}
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "engage":
+		if err := lm.EngageEmergencyStop(ctx, strings.Join(args[1:], " ")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Emergency stop engaged, workers release their leases within one polling interval")
+
+	case "status":
+		stop, err := lm.GetEmergencyStop(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if stop == nil {
+			fmt.Println("Emergency stop not engaged")
+			return 0
+		}
+		fmt.Printf("engaged=%s by=%s reason=%q\n", stop.EngagedAt.Format(time.RFC3339), stop.EngagedBy, stop.Reason)
+
+	case "release":
+		if err := lm.ReleaseEmergencyStop(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Emergency stop released")
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown estop command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"expr_mohan/leasemanager"
+)
+
+// DefaultLeaseExpression reproduces the built-in formula min(80, ceil(shards/workers))
+const DefaultLeaseExpression = "min(limit, ceil(shards / workers))"
+
+// leaseExpressionVars are the built-in variables available to lease expressions;
+// custom scalars declared at compile time are added to these
+var leaseExpressionVars = map[string]bool{
+	"shards":  true, // active shard count
+	"workers": true, // worker count (at least 1)
+	"limit":   true, // leasemanager.MaxLeasePerWorkerLimit
+	"lag_ms":  true, // current aggregate lag (max MillisBehindLatest across shards)
+	"hour":    true, // hour of day 0-23 in the configured time zone
+	"weekday": true, // day of week 0-6, Sunday = 0
+}
+
+// customExprVarPrefix marks environment variables exposed to expressions as custom
+// scalars: KDS_EXPR_VAR_BACKFILL=1 becomes the variable "backfill"
+const customExprVarPrefix = "KDS_EXPR_VAR_"
+
+// LeaseExpressionInputs are the values a lease expression is evaluated with
+type LeaseExpressionInputs struct {
+	Shards    int
+	Workers   int
+	LagMillis int64
+	Time      time.Time
+	Custom    map[string]float64
+}
+
+// LeaseExpressionEnv supplies the inputs beyond shard and worker counts
+type LeaseExpressionEnv struct {
+	Custom   map[string]float64   // custom scalars by variable name
+	Location *time.Location       // time zone for hour/weekday, UTC when nil
+	Lag      func() time.Duration // current aggregate lag, 0 when nil
+}
+
+// LoadLeaseExpressionEnv reads custom scalars (KDS_EXPR_VAR_<NAME>) and the time zone
+// (KDS_EXPR_TIMEZONE, an IANA name such as "America/New_York") from the environment
+func LoadLeaseExpressionEnv() (LeaseExpressionEnv, error) {
+	env := LeaseExpressionEnv{Custom: map[string]float64{}, Location: time.UTC}
+
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, customExprVarPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, customExprVarPrefix))
+		if leaseExpressionVars[name] {
+			return env, fmt.Errorf("%s shadows built-in variable %q", key, name)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return env, fmt.Errorf("%s=%q is not a number", key, value)
+		}
+		env.Custom[name] = v
+	}
+
+	if tz := os.Getenv("KDS_EXPR_TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return env, fmt.Errorf("invalid KDS_EXPR_TIMEZONE: %w", err)
+		}
+		env.Location = loc
+	}
+
+	return env, nil
+}
+
+// CustomNames returns the custom variable names to declare at compile time
+func (env LeaseExpressionEnv) CustomNames() []string {
+	names := make([]string, 0, len(env.Custom))
+	for name := range env.Custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Inputs builds the evaluation inputs for the current moment
+func (env LeaseExpressionEnv) Inputs(shards, workers int) LeaseExpressionInputs {
+	loc := env.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	var lag time.Duration
+	if env.Lag != nil {
+		lag = env.Lag()
+	}
+	return LeaseExpressionInputs{
+		Shards:    shards,
+		Workers:   workers,
+		LagMillis: lag.Milliseconds(),
+		Time:      time.Now().In(loc),
+		Custom:    env.Custom,
+	}
+}
+
+// leaseExpressionFuncs maps function names to their arity
+var leaseExpressionFuncs = map[string]int{
+	"min":   -2, // two or more arguments
+	"max":   -2,
+	"ceil":  1,
+	"floor": 1,
+	"round": 1,
+	"abs":   1,
+	"if":    3, // if(cond, then, else); cond is true when non-zero
+}
+
+// LeaseExpression is a compiled max-leases formula such as
+// "min(limit, ceil(shards*1.2/workers))". Supported syntax: numbers, the variables
+// in leaseExpressionVars plus declared custom scalars, + - * / %, comparisons (< <= > >= == !=, yielding 1 or 0),
+// && ||, unary - and !, parentheses and the functions in leaseExpressionFuncs.
+type LeaseExpression struct {
+	source string
+	root   exprNode
+	custom []string
+}
+
+// CompileLeaseExpression parses src and rejects unknown variables, unknown functions
+// and wrong argument counts up front, so a typo fails at startup rather than at the
+// first recalculation. customVars declares additional scalar variables.
+func CompileLeaseExpression(src string, customVars ...string) (*LeaseExpression, error) {
+	known := make(map[string]bool, len(leaseExpressionVars)+len(customVars))
+	for name := range leaseExpressionVars {
+		known[name] = true
+	}
+	for _, name := range customVars {
+		known[name] = true
+	}
+
+	p := &exprParser{src: src, vars: known}
+	if err := p.tokenize(); err != nil {
+		return nil, fmt.Errorf("invalid lease expression %q: %w", src, err)
+	}
+
+	root, err := p.parseExpr(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease expression %q: %w", src, err)
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("invalid lease expression %q: unexpected %q at offset %d", src, tok.text, tok.pos)
+	}
+
+	expr := &LeaseExpression{source: src, root: root, custom: customVars}
+	if err := expr.validate(); err != nil {
+		return nil, fmt.Errorf("invalid lease expression %q: %w", src, err)
+	}
+	return expr, nil
+}
+
+// validationShards and validationWorkers are the inputs an expression is probed with
+// at compile time; every combination must evaluate without error, both with the
+// auxiliary inputs (lag, time, custom scalars) at zero and at busy values
+var (
+	validationShards  = []int{0, 1, 7, 80, 1000, 10000}
+	validationWorkers = []int{1, 2, 5, 50, 500}
+	validationLags    = []int64{0, int64(6 * time.Hour / time.Millisecond)}
+)
+
+// validate evaluates the expression over a grid of plausible inputs so failures that
+// only depend on the formula (division by zero, non-finite results) are rejected at
+// startup instead of at the first recalculation
+func (e *LeaseExpression) validate() error {
+	for i, lag := range validationLags {
+		custom := make(map[string]float64, len(e.custom))
+		for _, name := range e.custom {
+			custom[name] = float64(i)
+		}
+		at := time.Date(2024, 1, 7, 23*i, 0, 0, 0, time.UTC)
+
+		for _, shards := range validationShards {
+			for _, workers := range validationWorkers {
+				in := LeaseExpressionInputs{Shards: shards, Workers: workers, LagMillis: lag, Time: at, Custom: custom}
+				if _, _, err := e.EvaluateMaxLeases(in); err != nil {
+					return fmt.Errorf("fails for shards=%d workers=%d lag_ms=%d: %w", shards, workers, lag, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// EvaluateMaxLeases evaluates the expression for the given inputs and clamps the
+// rounded-down result to [1, leasemanager.MaxLeasePerWorkerLimit], so a bad policy can never set
+// max leases to 0 or an unbounded number fleet-wide. clamped reports whether the
+// raw result was out of bounds.
+func (e *LeaseExpression) EvaluateMaxLeases(in LeaseExpressionInputs) (maxLeases int, clamped bool, err error) {
+	workers := in.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	vars := map[string]float64{
+		"shards":  float64(in.Shards),
+		"workers": float64(workers),
+		"limit":   float64(leasemanager.MaxLeasePerWorkerLimit),
+		"lag_ms":  float64(in.LagMillis),
+		"hour":    float64(in.Time.Hour()),
+		"weekday": float64(in.Time.Weekday()),
+	}
+	for name, v := range in.Custom {
+		vars[name] = v
+	}
+
+	value, err := e.Evaluate(vars)
+	if err != nil {
+		return 0, false, err
+	}
+
+	value = math.Floor(value)
+	switch {
+	case value < 1:
+		return 1, true, nil
+	case value > leasemanager.MaxLeasePerWorkerLimit:
+		return leasemanager.MaxLeasePerWorkerLimit, true, nil
+	}
+	return int(value), false, nil
+}
+
+// String returns the expression source
+func (e *LeaseExpression) String() string {
+	return e.source
+}
+
+// Evaluate computes the expression with the given variable values. Variables that
+// are referenced but missing, division by zero and non-finite results are errors.
+func (e *LeaseExpression) Evaluate(vars map[string]float64) (float64, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("lease expression %q produced non-finite result", e.source)
+	}
+	return v, nil
+}
+
+// ---- AST ----
+
+type exprNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) { return float64(n), nil }
+
+type varNode string
+
+func (n varNode) eval(vars map[string]float64) (float64, error) {
+	v, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("variable %q has no value", string(n))
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(vars map[string]float64) (float64, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return boolToFloat(v == 0), nil
+	}
+	return -v, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(vars map[string]float64) (float64, error) {
+	l, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	// Short-circuit logical operators
+	switch n.op {
+	case "&&":
+		if l == 0 {
+			return 0, nil
+		}
+	case "||":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+
+	r, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return 0, errors.New("modulo by zero")
+		}
+		return math.Mod(l, r), nil
+	case "<":
+		return boolToFloat(l < r), nil
+	case "<=":
+		return boolToFloat(l <= r), nil
+	case ">":
+		return boolToFloat(l > r), nil
+	case ">=":
+		return boolToFloat(l >= r), nil
+	case "==":
+		return boolToFloat(l == r), nil
+	case "!=":
+		return boolToFloat(l != r), nil
+	case "&&", "||":
+		return boolToFloat(r != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n callNode) eval(vars map[string]float64) (float64, error) {
+	// if() only evaluates the selected branch
+	if n.name == "if" {
+		cond, err := n.args[0].eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return n.args[1].eval(vars)
+		}
+		return n.args[2].eval(vars)
+	}
+
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+
+	switch n.name {
+	case "min":
+		result := args[0]
+		for _, v := range args[1:] {
+			result = math.Min(result, v)
+		}
+		return result, nil
+	case "max":
+		result := args[0]
+		for _, v := range args[1:] {
+			result = math.Max(result, v)
+		}
+		return result, nil
+	case "ceil":
+		return math.Ceil(args[0]), nil
+	case "floor":
+		return math.Floor(args[0]), nil
+	case "round":
+		return math.Round(args[0]), nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	}
+	return 0, fmt.Errorf("unknown function %q", n.name)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ---- Parser ----
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	src    string
+	vars   map[string]bool
+	tokens []token
+	pos    int
+}
+
+// binaryPrecedence lists binary operators from loosest to tightest binding
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+func (p *exprParser) tokenize() error {
+	src := p.src
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			p.tokens = append(p.tokens, token{kind: tokNumber, text: src[start:i], pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+				i++
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+		case c == '(':
+			p.tokens = append(p.tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			p.tokens = append(p.tokens, token{kind: tokComma, text: ",", pos: i})
+			i++
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "<=", ">=", "==", "!=", "+", "-", "*", "/", "%", "<", ">", "!"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			p.tokens = append(p.tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokEOF, text: "end of expression", pos: len(src)})
+	return nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseExpr parses binary operators with precedence climbing
+func (p *exprParser) parseExpr(minPrec int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrecedence[tok.text]
+		if tok.kind != tokOp || !ok || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseExpr(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "-" || tok.text == "!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: tok.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return numberNode(v), nil
+
+	case tokLParen:
+		inner, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at offset %d, got %q", closing.pos, closing.text)
+		}
+		return inner, nil
+
+	case tokIdent:
+		if p.peek().kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		if !p.vars[tok.text] {
+			return nil, fmt.Errorf("unknown variable %q at offset %d", tok.text, tok.pos)
+		}
+		return varNode(tok.text), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	arity, ok := leaseExpressionFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+	p.next() // (
+
+	var args []exprNode
+	if p.peek().kind != tokRParen {
+		for {
+			arg, err := p.parseExpr(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if closing := p.next(); closing.kind != tokRParen {
+		return nil, fmt.Errorf("expected ) at offset %d, got %q", closing.pos, closing.text)
+	}
+
+	switch {
+	case arity > 0 && len(args) != arity:
+		return nil, fmt.Errorf("%s() takes %d argument(s), got %d", name.text, arity, len(args))
+	case arity < 0 && len(args) < -arity:
+		return nil, fmt.Errorf("%s() takes at least %d arguments, got %d", name.text, -arity, len(args))
+	}
+
+	return callNode{name: name.text, args: args}, nil
+}
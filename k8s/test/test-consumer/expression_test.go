@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+// mustCompileLeaseExpression is like CompileLeaseExpression but panics on error, for
+// fixtures
+func mustCompileLeaseExpression(src string, customVars ...string) *LeaseExpression {
+	expr, err := CompileLeaseExpression(src, customVars...)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
+// leaseExpressionCase is an expected max leases value for a set of inputs
+type leaseExpressionCase struct {
+	LeaseExpressionInputs
+	Want int
+}
+
+// checkLeaseExpression compiles src and verifies every case, returning an error that
+// lists all mismatches, so a policy is pinned by TestLeaseExpressionPolicies before it
+// is rolled out. Custom variables not set in a case evaluate as 0.
+func checkLeaseExpression(src string, cases []leaseExpressionCase, customVars ...string) error {
+	expr, err := CompileLeaseExpression(src, customVars...)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, c := range cases {
+		in := c.LeaseExpressionInputs
+		custom := make(map[string]float64, len(customVars))
+		for _, name := range customVars {
+			custom[name] = in.Custom[name]
+		}
+		in.Custom = custom
+
+		got, _, err := expr.EvaluateMaxLeases(in)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("shards=%d workers=%d: %v", c.Shards, c.Workers, err))
+			continue
+		}
+		if got != c.Want {
+			mismatches = append(mismatches, fmt.Sprintf("shards=%d workers=%d: got %d, want %d", c.Shards, c.Workers, got, c.Want))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("lease expression %q: %s", src, strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// at builds the inputs of a case
+func at(shards, workers int, hour int, lagMillis int64, custom map[string]float64) LeaseExpressionInputs {
+	return LeaseExpressionInputs{Shards: shards, Workers: workers, LagMillis: lagMillis,
+		Time: time.Date(2024, 6, 3, hour, 0, 0, 0, time.UTC), Custom: custom}
+}
+
+// TestLeaseExpressionPolicies pins the default expression and the policies the README
+// recommends; add a policy here before rolling it out
+func TestLeaseExpressionPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		custom []string
+		cases  []leaseExpressionCase
+	}{
+		{"default", DefaultLeaseExpression, nil, []leaseExpressionCase{
+			{at(20, 3, 0, 0, nil), 7},
+			{at(30, 5, 0, 0, nil), 6},
+			{at(1, 10, 0, 0, nil), 1},
+			{at(0, 4, 0, 0, nil), 1},
+			{at(10000, 2, 0, 0, nil), 80},
+			// No workers count as one
+			{at(12, 0, 0, 0, nil), 12},
+		}},
+		{"headroom", "min(limit, ceil(shards * 1.2 / workers))", nil, []leaseExpressionCase{
+			{at(20, 3, 0, 0, nil), 8},
+			{at(100, 1, 0, 0, nil), 80},
+		}},
+		{"backfill window", "min(limit, ceil(if((hour >= 1 && hour < 5) || lag_ms > 600000, 2, 1) * shards / workers))", nil, []leaseExpressionCase{
+			{at(30, 5, 0, 0, nil), 6},
+			{at(30, 5, 1, 0, nil), 12},
+			{at(30, 5, 4, 0, nil), 12},
+			{at(30, 5, 5, 0, nil), 6},
+			{at(30, 5, 12, 600001, nil), 12},
+		}},
+		{"backfill toggle", "min(limit, ceil((1 + backfill) * shards / workers))", []string{"backfill"}, []leaseExpressionCase{
+			{at(30, 5, 0, 0, nil), 6},
+			{at(30, 5, 0, 0, map[string]float64{"backfill": 1}), 12},
+		}},
+		{"clamped", "shards * 100", nil, []leaseExpressionCase{
+			{at(1, 1, 0, 0, nil), 80},
+			{at(0, 1, 0, 0, nil), 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkLeaseExpression(tt.src, tt.cases, tt.custom...); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckLeaseExpressionListsMismatches(t *testing.T) {
+	err := checkLeaseExpression(DefaultLeaseExpression, []leaseExpressionCase{
+		{at(20, 3, 0, 0, nil), 7},
+		{at(20, 3, 0, 0, nil), 6},
+		{at(30, 5, 0, 0, nil), 5},
+	})
+	if err == nil {
+		t.Fatal("mismatches not reported")
+	}
+	for _, want := range []string{"shards=20 workers=3: got 7, want 6", "shards=30 workers=5: got 6, want 5"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%v does not report %q", err, want)
+		}
+	}
+
+	// A variable missing from a case is 0, not an evaluation error
+	if err := checkLeaseExpression("min(limit, 1 + backfill)", []leaseExpressionCase{{at(1, 1, 0, 0, nil), 1}}, "backfill"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompileLeaseExpressionRejects(t *testing.T) {
+	for src, want := range map[string]string{
+		"":                         "unexpected",
+		"shards / wrokers":         `unknown variable "wrokers"`,
+		"median(shards, workers)":  `unknown function "median"`,
+		"ceil(shards, workers)":    "ceil() takes 1 argument(s), got 2",
+		"min(shards)":              "min() takes at least 2 arguments, got 1",
+		"(shards / workers":        "expected )",
+		"shards / workers)":        `unexpected ")"`,
+		"shards # workers":         "unexpected character",
+		"shards / (workers - 1)":   "division by zero",
+		"shards % (workers - 1)":   "modulo by zero",
+		"shards / (lag_ms - 0)":    "division by zero",
+		"backfill * shards / 2":    `unknown variable "backfill"`,
+		"1.2.3 * shards / workers": "invalid number",
+	} {
+		_, err := CompileLeaseExpression(src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error containing %q", src, err, want)
+		}
+	}
+}
+
+func TestMustCompileLeaseExpressionPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for an invalid expression")
+		}
+	}()
+	mustCompileLeaseExpression("min(")
+}
+
+// ExampleLeaseExpression_EvaluateMaxLeases shows the clamping of a policy result
+func ExampleLeaseExpression_EvaluateMaxLeases() {
+	expr := mustCompileLeaseExpression("shards / workers / 4")
+	for _, shards := range []int{2, 40, 4000} {
+		maxLeases, clamped, _ := expr.EvaluateMaxLeases(LeaseExpressionInputs{Shards: shards, Workers: 2})
+		fmt.Println(shards, maxLeases, clamped)
+	}
+	// Output:
+	// 2 1 true
+	// 40 5 false
+	// 4000 80 true
+}
+
+func FuzzCompileLeaseExpression(f *testing.F) {
+	f.Add(DefaultLeaseExpression, 20, 3, int64(0), int64(1717372800), 0.0)
+	f.Add("min(limit, ceil(if(backfill, 2, 1) * shards / workers))", 30, 5, int64(900000), int64(0), 1.0)
+	f.Add("if(hour >= 22 || hour < 6, limit, ceil(shards * 1.2 / workers))", 7, 1, int64(-1), int64(1<<33), -1e308)
+	f.Add("shards % workers + abs(-lag_ms) / 1e3 - !weekday", 0, -1, int64(1<<62), int64(-1<<40), 1e308)
+	f.Add("((((((((((shards))))))))))", 1<<20, 1<<10, int64(0), int64(0), 0.5)
+	f.Add("1 / (workers - workers)", 5, 5, int64(0), int64(0), 0.0)
+	f.Add("min(", 0, 0, int64(0), int64(0), 0.0)
+	f.Add("backfill.5é", 0, 0, int64(0), int64(0), 0.0)
+
+	f.Fuzz(func(t *testing.T, src string, shards, workers int, lag, unix int64, backfill float64) {
+		expr, err := CompileLeaseExpression(src, "backfill")
+		if err != nil {
+			return
+		}
+		if expr.String() != src {
+			t.Fatalf("compiled %q reports source %q", src, expr.String())
+		}
+		in := LeaseExpressionInputs{Shards: shards, Workers: workers, LagMillis: lag, Time: time.Unix(unix, 0).UTC(),
+			Custom: map[string]float64{"backfill": backfill}}
+		m, _, err := expr.EvaluateMaxLeases(in)
+		if err == nil && (m < 1 || m > leasemanager.MaxLeasePerWorkerLimit) {
+			t.Fatalf("%q with %+v: max leases %d out of [1, %d]", src, in, m, leasemanager.MaxLeasePerWorkerLimit)
+		}
+		// Evaluation is deterministic
+		if again, _, err2 := expr.EvaluateMaxLeases(in); again != m || (err == nil) != (err2 == nil) {
+			t.Fatalf("%q with %+v: %d (%v) then %d (%v)", src, in, m, err, again, err2)
+		}
+	})
+}
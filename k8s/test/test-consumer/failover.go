@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+var activeStreamGauge = metrics.gauge("kds_active_stream", "1 for the stream this worker consumes, by priority, region and stream")
+
+// streamTarget is one stream in the failover list
+type streamTarget struct {
+	region     string
+	streamName string
+}
+
+func (t streamTarget) String() string {
+	return t.region + ":" + t.streamName
+}
+
+// parseStreamTargets parses a comma-separated list of stream ARNs or region:stream
+// pairs, highest priority first
+func parseStreamTargets(spec string) ([]streamTarget, error) {
+	var targets []streamTarget
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if arn.IsARN(entry) {
+			parsed, err := arn.Parse(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stream ARN %q: %w", entry, err)
+			}
+			name, ok := strings.CutPrefix(parsed.Resource, "stream/")
+			if parsed.Service != "kinesis" || !ok || name == "" {
+				return nil, fmt.Errorf("%q is not a Kinesis stream ARN", entry)
+			}
+			targets = append(targets, streamTarget{region: parsed.Region, streamName: name})
+			continue
+		}
+
+		region, name, ok := strings.Cut(entry, ":")
+		if !ok || region == "" || name == "" {
+			return nil, fmt.Errorf("invalid stream %q: use a stream ARN or region:stream", entry)
+		}
+		targets = append(targets, streamTarget{region: region, streamName: name})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no streams in %q", spec)
+	}
+	return targets, nil
+}
+
+// streamFailover picks the highest-priority available stream at startup and, while
+// running, asks for a restart when the active stream stays unavailable or, with
+// failback enabled, when a higher-priority stream is available again. Lease metadata
+// is keyed by stream and region, so every stream keeps its own coordinator value.
+type streamFailover struct {
+	targets   []streamTarget
+	endpoint  string
+	threshold int
+	failback  bool
+	active    int
+	failures  int
+}
+
+// newStreamFailoverFromEnv returns nil unless KDS_STREAM_FAILOVER lists the streams to
+// consume, in priority order. KDS_FAILOVER_AFTER is how many consecutive failed checks
+// of the active stream trigger failover (default 3); KDS_FAILBACK=true returns to a
+// higher-priority stream once it is available again.
+func newStreamFailoverFromEnv(endpoint string) (*streamFailover, error) {
+	spec := getEnv("KDS_STREAM_FAILOVER", "")
+	if spec == "" {
+		return nil, nil
+	}
+	targets, err := parseStreamTargets(spec)
+	if err != nil {
+		return nil, fmt.Errorf("KDS_STREAM_FAILOVER: %w", err)
+	}
+	return &streamFailover{
+		targets:   targets,
+		endpoint:  endpoint,
+		threshold: max(1, int(getEnvFloat("KDS_FAILOVER_AFTER", 3))),
+		failback:  getEnv("KDS_FAILBACK", "false") == "true",
+	}, nil
+}
+
+// selectTarget returns the first available stream in priority order
+func (f *streamFailover) selectTarget(ctx context.Context) (streamTarget, error) {
+	var problems []string
+	for i, target := range f.targets {
+		if err := f.available(ctx, target); err != nil {
+			log.Printf("WARN: Stream %s unavailable: %v", target, err)
+			problems = append(problems, fmt.Sprintf("%s: %v", target, err))
+			continue
+		}
+
+		f.active, f.failures = i, 0
+		activeStreamGauge.reset()
+		activeStreamGauge.set(1, "priority", fmt.Sprint(i), "region", target.region, "stream", target.streamName)
+		if i > 0 {
+			log.Printf("🔀 Failing over to stream %s (priority %d)", target, i)
+		}
+		return target, nil
+	}
+	return streamTarget{}, fmt.Errorf("no stream available: %s", strings.Join(problems, "; "))
+}
+
+// check reports whether the worker should restart to switch streams
+func (f *streamFailover) check(ctx context.Context) (bool, string) {
+	active := f.targets[f.active]
+	if err := f.available(ctx, active); err != nil {
+		f.failures++
+		log.Printf("WARN: Active stream %s unavailable (%d/%d): %v", active, f.failures, f.threshold, err)
+		if f.failures >= f.threshold && len(f.targets) > 1 {
+			return true, fmt.Sprintf("stream %s unavailable for %d checks", active, f.failures)
+		}
+		return false, ""
+	}
+	f.failures = 0
+
+	if f.failback {
+		for i, target := range f.targets[:f.active] {
+			if f.available(ctx, target) == nil {
+				return true, fmt.Sprintf("higher-priority stream %s (priority %d) is available again", target, i)
+			}
+		}
+	}
+	return false, ""
+}
+
+// available checks that the stream exists and is ACTIVE or UPDATING
+func (f *streamFailover) available(ctx context.Context, target streamTarget) error {
+	awsCfg, err := loadAWSConfig(ctx, target.region, f.endpoint)
+	if err != nil {
+		return err
+	}
+	summary, err := kinesis.NewFromConfig(awsCfg).DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(target.streamName),
+	})
+	if err != nil {
+		return err
+	}
+	status := summary.StreamDescriptionSummary.StreamStatus
+	if status != kinesistypes.StreamStatusActive && status != kinesistypes.StreamStatusUpdating {
+		return fmt.Errorf("stream status %s", status)
+	}
+	return nil
+}
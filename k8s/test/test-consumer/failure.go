@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+)
+
+// failurePolicy is what the binary does when a startup phase runs out of attempts or
+// a server stops. Library code returns errors and leaves the decision to it.
+type failurePolicy string
+
+const (
+	// policyFailFast exits, so Kubernetes restarts the pod (the default)
+	policyFailFast failurePolicy = "fail-fast"
+	// policyRetryForever retries the startup phases and servers without a limit
+	policyRetryForever failurePolicy = "retry-forever"
+	// policyDegrade keeps running with less: the basic consumer without dynamic max
+	// leases, no record consumption, or without the failed server
+	policyDegrade failurePolicy = "degrade"
+)
+
+// failurePolicyFromEnv reads KDS_FAILURE_POLICY
+func failurePolicyFromEnv() (failurePolicy, error) {
+	switch p := failurePolicy(getEnv("KDS_FAILURE_POLICY", string(policyFailFast))); p {
+	case policyFailFast, policyRetryForever, policyDegrade:
+		return p, nil
+	default:
+		return "", fmt.Errorf("KDS_FAILURE_POLICY must be fail-fast, retry-forever or degrade, got %q", p)
+	}
+}
+
+// degrade reports whether the policy lets the worker continue without what failed,
+// recording the reason when it does
+func (p failurePolicy) degrade(reason string, err error) bool {
+	if p != policyDegrade {
+		return false
+	}
+	degradations.set(reason, err.Error())
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"expr_mohan/leasemanager"
+)
+
+var maxLeasesFallbackGauge = metrics.gauge("kds_max_leases_fallback",
+	"1 when this worker started with a fallback max leases value instead of the coordinator's, by source")
+
+// SetFallbackMaxLeases makes InitializeMaxLeasesPerWorker return maxLeases when the
+// coordinator value can neither be read nor computed and no cached value exists, so
+// consumption does not depend on the metadata table being available. 0 disables.
+func (lm *KDSLeaseManager) SetFallbackMaxLeases(maxLeases int) {
+	lm.fallbackMaxLeases = maxLeases
+}
+
+// hasStartupFallback reports whether InitializeMaxLeasesPerWorker may start without
+// the metadata table, from the coordinator cache or the configured fallback
+func (lm *KDSLeaseManager) hasStartupFallback() bool {
+	return lm.coordinatorCache != "" || lm.fallbackMaxLeases > 0
+}
+
+// fallbackMaxLeasesFromEnv reads the conservative fallback: KDS_FALLBACK_MAX_LEASES as
+// a fixed value, or else ceil(KDS_FALLBACK_SHARDS / KDS_FALLBACK_WORKERS) capped at
+// the per-worker limit. It returns 0 when neither is configured.
+func fallbackMaxLeasesFromEnv() (int, error) {
+	if v := os.Getenv("KDS_FALLBACK_MAX_LEASES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > leasemanager.MaxLeasePerWorkerLimit {
+			return 0, fmt.Errorf("KDS_FALLBACK_MAX_LEASES %q must be an integer between 1 and %d", v, leasemanager.MaxLeasePerWorkerLimit)
+		}
+		return n, nil
+	}
+
+	shardsEnv, workersEnv := os.Getenv("KDS_FALLBACK_SHARDS"), os.Getenv("KDS_FALLBACK_WORKERS")
+	if shardsEnv == "" && workersEnv == "" {
+		return 0, nil
+	}
+	shards, err := strconv.Atoi(shardsEnv)
+	if err != nil || shards < 1 {
+		return 0, fmt.Errorf("KDS_FALLBACK_SHARDS %q is not a positive integer", shardsEnv)
+	}
+	workers, err := strconv.Atoi(workersEnv)
+	if err != nil || workers < 1 {
+		return 0, fmt.Errorf("KDS_FALLBACK_WORKERS %q is not a positive integer", workersEnv)
+	}
+	return min(leasemanager.MaxLeasePerWorkerLimit, int(math.Ceil(float64(shards)/float64(workers)))), nil
+}
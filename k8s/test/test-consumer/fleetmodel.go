@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// fleetModel replays the lease protocol of recordConsumer in memory. Every step a
+// worker releases the leases claimed from it and those above maxLeases, takes free
+// leases with freeLeases and, when stealing, claims one with claimVictim.
+type fleetModel struct {
+	shards    []kinesistypes.Shard
+	leases    map[string]*KCLLease
+	workers   []string
+	maxLeases int
+	stealing  bool
+	// now advances a minute every round; a lease released for a claim is reserved for
+	// the claimant through the next round
+	now time.Time
+	// order permutes the lease list the workers see, as a table scan returns it
+	order func(leases []KCLLease)
+}
+
+// openShards returns the IDs of the shards not read to SHARD_END
+func (f *fleetModel) openShards() []string {
+	var open []string
+	for _, shard := range f.shards {
+		shardID := aws.ToString(shard.ShardId)
+		if lease, ok := f.leases[shardID]; !ok || lease.State != kclLeaseFinished {
+			open = append(open, shardID)
+		}
+	}
+	return open
+}
+
+// list returns the lease table as a worker reads it
+func (f *fleetModel) list() []KCLLease {
+	leases := f.sorted()
+	if f.order != nil {
+		f.order(leases)
+	}
+	return leases
+}
+
+func (f *fleetModel) sorted() []KCLLease {
+	leases := make([]KCLLease, 0, len(f.leases))
+	for _, lease := range f.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ShardID < leases[j].ShardID })
+	return leases
+}
+
+// held returns the shards worker owns, in shard order
+func (f *fleetModel) held(worker string) []string {
+	var held []string
+	for shardID, lease := range f.leases {
+		if lease.State == kclLeaseOwned && lease.Owner == worker {
+			held = append(held, shardID)
+		}
+	}
+	sort.Strings(held)
+	return held
+}
+
+// release removes the owner as releaseKCLLease does; a claim stays on the lease
+func (f *fleetModel) release(shardID string) {
+	lease := f.leases[shardID]
+	lease.State, lease.Owner = kclLeaseUnowned, ""
+	if lease.ClaimRequest != "" {
+		lease.LeaseTimeout = f.now.Add(2 * time.Minute)
+	}
+}
+
+// step runs one lease sync of worker
+func (f *fleetModel) step(worker string) {
+	var held []string
+	for _, shardID := range f.held(worker) {
+		// The owner's renewal sees the claim and hands the lease over
+		if f.leases[shardID].ClaimRequest != "" {
+			f.release(shardID)
+			continue
+		}
+		held = append(held, shardID)
+	}
+	for len(held) > f.maxLeases {
+		f.release(held[len(held)-1])
+		held = held[:len(held)-1]
+	}
+
+	local := make(map[string]bool, len(held))
+	for _, shardID := range held {
+		local[shardID] = true
+	}
+	n := len(held)
+	for _, free := range freeLeases(f.shards, f.list(), worker, local, f.now) {
+		if n >= f.maxLeases {
+			break
+		}
+		f.leases[free.shardID] = &KCLLease{ShardID: free.shardID, State: kclLeaseOwned, Owner: worker, ParentShardID: free.parentID}
+		n++
+	}
+	if n >= f.maxLeases || !f.stealing {
+		return
+	}
+	_, owned, _ := claimVictim(f.list(), worker, n)
+	for _, lease := range owned {
+		if lease.ClaimRequest == "" {
+			f.leases[lease.ShardID].ClaimRequest = worker
+			return
+		}
+	}
+}
+
+// assignment renders who owns and who claims what, to compare states
+func (f *fleetModel) assignment() string {
+	var b strings.Builder
+	for _, lease := range f.sorted() {
+		fmt.Fprintf(&b, "%s=%s/%s/%s ", lease.ShardID, lease.State, lease.Owner, lease.ClaimRequest)
+	}
+	return b.String()
+}
+
+// settle runs rounds of every worker's sync until a round changes nothing, checking
+// after every step that the worker stays within maxLeases
+func (f *fleetModel) settle() error {
+	for round := 0; round < 4*len(f.shards)+10; round++ {
+		before := f.assignment()
+		f.now = f.now.Add(time.Minute)
+		for _, worker := range f.workers {
+			f.step(worker)
+			if held := len(f.held(worker)); held > f.maxLeases {
+				return fmt.Errorf("%s holds %d leases, over max leases %d", worker, held, f.maxLeases)
+			}
+		}
+		if f.assignment() == before {
+			return nil
+		}
+	}
+	return fmt.Errorf("did not settle: %s", f.assignment())
+}
+
+func (f *fleetModel) String() string {
+	return fmt.Sprintf("%d shards, %d workers, max leases %d, stealing %v", len(f.openShards()), len(f.workers), f.maxLeases, f.stealing)
+}
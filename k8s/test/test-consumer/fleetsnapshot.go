@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var fleetSnapshotsWritten = metrics.counter("kds_fleet_snapshots_total", "Fleet snapshots written to S3, by result")
+
+// FleetSnapshot is one point of fleet history, written as a single JSON line so the
+// objects can be queried with Athena as they are
+type FleetSnapshot struct {
+	TakenAt       time.Time `json:"taken_at"`
+	App           string    `json:"app"`
+	Stream        string    `json:"stream"`
+	Region        string    `json:"region"`
+	ConsumerGroup string    `json:"consumer_group"`
+	ShardCount    int       `json:"shard_count"`
+	MaxLeases     int       `json:"coordinator_max_leases"`
+	WorkerCount   int       `json:"worker_count"`
+	// Fleet-wide totals of the worker rows
+	RecordsPerSecond float64 `json:"records_per_second"`
+	MaxLagMillis     int64   `json:"max_lag_ms"`
+	// KinesisCallsPerMinute is the fleet's Kinesis requests in the last full minute
+	KinesisCallsPerMinute map[string]int `json:"kinesis_calls_per_minute,omitempty"`
+
+	Leases  KCLLeaseSummary `json:"leases"`
+	Workers []LeaseOwner    `json:"workers"`
+	Partial string          `json:"partial,omitempty"`
+}
+
+// fleetSnapshotter is the coordinator duty writing a FleetSnapshot every interval to
+// <prefix>/app=<app>/stream=<stream>/dt=<YYYY-MM-DD>/hour=<HH>/<time>.json, the Hive
+// partition layout Athena prunes on
+type fleetSnapshotter struct {
+	lm         *KDSLeaseManager
+	leaseTable string
+	awsCfg     aws.Config
+	endpoint   string
+	prefix     s3Object
+	interval   time.Duration
+	last       time.Time
+}
+
+// newFleetSnapshotterFromEnv returns nil unless KDS_FLEET_SNAPSHOT_URI is set to an
+// s3://bucket/prefix; KDS_FLEET_SNAPSHOT_INTERVAL sets how often (default 5m)
+func newFleetSnapshotterFromEnv(lm *KDSLeaseManager, leaseTable string, awsCfg aws.Config, endpoint string) (*fleetSnapshotter, error) {
+	uri := getEnv("KDS_FLEET_SNAPSHOT_URI", "")
+	if uri == "" {
+		return nil, nil
+	}
+	prefix, ok, err := parseS3URI(strings.TrimSuffix(uri, "/"))
+	if !ok {
+		return nil, fmt.Errorf("KDS_FLEET_SNAPSHOT_URI must be an s3://bucket/prefix URI, got %q", uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fleetSnapshotter{
+		lm:         lm,
+		leaseTable: leaseTable,
+		awsCfg:     awsCfg,
+		endpoint:   endpoint,
+		prefix:     prefix,
+		interval:   getEnvDuration("KDS_FLEET_SNAPSHOT_INTERVAL", 5*time.Minute),
+	}, nil
+}
+
+// maybeRun writes a snapshot when this worker is the coordinator and the last one is
+// an interval old
+func (s *fleetSnapshotter) maybeRun(ctx context.Context) {
+	if s == nil || !s.lm.isCoordinator.Load() || time.Since(s.last) < s.interval {
+		return
+	}
+	s.last = time.Now()
+	snapshot, err := s.lm.TakeFleetSnapshot(ctx, s.leaseTable)
+	if err != nil {
+		fleetSnapshotsWritten.add(1, "result", "error")
+		log.Printf("WARN: Failed to take fleet snapshot: %v", err)
+		return
+	}
+	object := s.object(snapshot.TakenAt)
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = object.put(ctx, s.awsCfg, s.endpoint, append(data, '\n'))
+	}
+	if err != nil {
+		fleetSnapshotsWritten.add(1, "result", "error")
+		log.Printf("WARN: Failed to write fleet snapshot to %s: %v", object, err)
+		return
+	}
+	fleetSnapshotsWritten.add(1, "result", "ok")
+	log.Printf("📸 Wrote fleet snapshot to %s", object)
+}
+
+// object is the key of the snapshot taken at t
+func (s *fleetSnapshotter) object(t time.Time) s3Object {
+	t = t.UTC()
+	return s3Object{
+		bucket: s.prefix.bucket,
+		key: fmt.Sprintf("%s/app=%s/stream=%s/dt=%s/hour=%s/%s.json", s.prefix.key, s.lm.appName, s.lm.streamName,
+			t.Format("2006-01-02"), t.Format("15"), t.Format("20060102T150405Z")),
+	}
+}
+
+// TakeFleetSnapshot reads the coordinator value, the shard count, the lease table and
+// the worker rows into one snapshot
+func (lm *KDSLeaseManager) TakeFleetSnapshot(ctx context.Context, leaseTable string) (*FleetSnapshot, error) {
+	view, err := lm.ViewLeaseTable(ctx, leaseTable)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := lm.GetShardCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &FleetSnapshot{
+		TakenAt:       time.Now().UTC(),
+		App:           lm.appName,
+		Stream:        lm.streamName,
+		Region:        lm.region,
+		ConsumerGroup: lm.consumerGroup,
+		ShardCount:    shards,
+		MaxLeases:     view.Coordinator,
+		Leases:        KCLLeaseSummary{Total: len(view.Leases), ByOwner: map[string]int{}},
+		Workers:       view.Owners,
+		Partial:       view.Partial,
+	}
+	for _, lease := range view.Leases {
+		switch lease.State {
+		case kclLeaseFinished:
+			snapshot.Leases.Finished++
+		case kclLeaseUnowned:
+			snapshot.Leases.Unowned++
+		case kclLeaseExpired:
+			snapshot.Leases.Expired++
+		default:
+			snapshot.Leases.Owned++
+			snapshot.Leases.ByOwner[lease.Owner]++
+		}
+	}
+	for _, o := range view.Owners {
+		if o.Registered {
+			snapshot.WorkerCount++
+		}
+		snapshot.RecordsPerSecond += o.RecordsPerSecond
+		snapshot.MaxLagMillis = max(snapshot.MaxLagMillis, o.LagMillis)
+		snapshot.KinesisCallsPerMinute = addCalls(snapshot.KinesisCallsPerMinute, o.KinesisCallsPerMinute)
+	}
+	return snapshot, nil
+}
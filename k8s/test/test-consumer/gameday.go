@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"expr_mohan/leasemanager"
+)
+
+// gamedayPollInterval is how often reshard and verify poll for progress
+const gamedayPollInterval = 5 * time.Second
+
+// runGamedayCommand implements "gameday reshard <target-shards>" and "gameday verify"
+// for resharding drills and returns the process exit code. Both refuse to run unless
+// the account is explicitly allowed, see gamedayAllowed.
+func runGamedayCommand(ctx context.Context, cfg appConfig, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gameday reshard <target-shards> | verify")
+		return 2
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := gamedayAllowed(ctx, cfg, sts.NewFromConfig(awsCfg)); err != nil {
+		fmt.Fprintf(os.Stderr, "refusing to run game-day tooling: %v\n", err)
+		return 1
+	}
+
+	timeout := getEnvDuration("KDS_GAMEDAY_TIMEOUT", 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch args[0] {
+	case "reshard":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: gameday reshard <target-shards>")
+			return 2
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil || target <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid target shard count %q\n", args[1])
+			return 2
+		}
+		if err := reshardStream(ctx, kinesis.NewFromConfig(awsCfg), cfg.streamName, target); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Stream %s resharded to %d shards\n", cfg.streamName, target)
+
+	case "verify":
+		lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := lm.waitForConvergence(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown gameday command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// gamedayAllowed permits game-day tooling against a local endpoint (LocalStack) or an
+// AWS account listed in KDS_GAMEDAY_ALLOWED_ACCOUNTS, so it cannot reshard production
+// by accident
+func gamedayAllowed(ctx context.Context, cfg appConfig, client *sts.Client) error {
+	if cfg.endpoint != "" {
+		return nil
+	}
+
+	allowed := strings.Split(os.Getenv("KDS_GAMEDAY_ALLOWED_ACCOUNTS"), ",")
+	identity, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("cannot determine AWS account: %w", err)
+	}
+	account := aws.ToString(identity.Account)
+	if !slices.Contains(allowed, account) {
+		return fmt.Errorf("account %s is not in KDS_GAMEDAY_ALLOWED_ACCOUNTS", account)
+	}
+	return nil
+}
+
+// reshardStream requests UpdateShardCount with uniform scaling and waits until the
+// stream is ACTIVE with the target number of open shards
+func reshardStream(ctx context.Context, client *kinesis.Client, streamName string, target int) error {
+	_, err := client.UpdateShardCount(ctx, &kinesis.UpdateShardCountInput{
+		StreamName:       aws.String(streamName),
+		TargetShardCount: aws.Int32(int32(target)),
+		ScalingType:      kinesistypes.ScalingTypeUniformScaling,
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateShardCount failed: %w", err)
+	}
+	fmt.Printf("Requested %d shards for %s, waiting for the stream to become ACTIVE...\n", target, streamName)
+
+	for {
+		summary, err := client.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+			StreamName: aws.String(streamName),
+		})
+		if err != nil {
+			return fmt.Errorf("DescribeStreamSummary failed: %w", err)
+		}
+		desc := summary.StreamDescriptionSummary
+		open := int(aws.ToInt32(desc.OpenShardCount))
+		fmt.Printf("  status=%s openShards=%d\n", desc.StreamStatus, open)
+		if desc.StreamStatus == kinesistypes.StreamStatusActive && open == target {
+			return nil
+		}
+
+		select {
+		case <-time.After(gamedayPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stream did not reach %d shards: %w", target, ctx.Err())
+		}
+	}
+}
+
+// waitForConvergence polls until the coordinator and every worker row agree on the
+// current shard count and max leases, and the fleet covers every shard
+func (lm *KDSLeaseManager) waitForConvergence(ctx context.Context) error {
+	for {
+		problems, err := lm.convergenceProblems(ctx)
+		if err == nil && len(problems) == 0 {
+			fmt.Println("✅ Lease manager and workers converged")
+			return nil
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		fmt.Printf("Not converged yet: %s\n", strings.Join(problems, "; "))
+
+		select {
+		case <-time.After(gamedayPollInterval):
+		case <-ctx.Done():
+			return errors.New("lease manager did not converge: " + strings.Join(problems, "; "))
+		}
+	}
+}
+
+func (lm *KDSLeaseManager) convergenceProblems(ctx context.Context) ([]string, error) {
+	shards, err := lm.GetShardCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	coordinator, err := lm.GetCoordinatorMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if coordinator == nil {
+		return []string{"no coordinator metadata"}, nil
+	}
+
+	var problems []string
+	if coordinator.ShardCount != shards {
+		problems = append(problems, fmt.Sprintf("coordinator shard_count=%d, stream has %d", coordinator.ShardCount, shards))
+	}
+	if coordinator.WorkerCount*coordinator.MaxLeasesPerWorker < shards {
+		problems = append(problems, fmt.Sprintf("%d workers x %d leases cannot cover %d shards",
+			coordinator.WorkerCount, coordinator.MaxLeasesPerWorker, shards))
+	}
+
+	workers, exact, err := lm.FleetWorkerMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exact {
+		// Rows of pods that were scaled away are never deleted, so only the most
+		// recently written rows, one per current worker, are checked
+		slices.SortFunc(workers, func(a, b *leasemanager.Metadata) int {
+			return b.LastUpdateTime.Compare(a.LastUpdateTime)
+		})
+		if len(workers) > coordinator.WorkerCount {
+			workers = workers[:coordinator.WorkerCount]
+		}
+	}
+
+	if len(workers) < coordinator.WorkerCount {
+		problems = append(problems, fmt.Sprintf("%d of %d worker rows present", len(workers), coordinator.WorkerCount))
+	}
+	for _, row := range workers {
+		if row.MaxLeasesPerWorker != coordinator.MaxLeasesPerWorker || row.ShardCount != shards {
+			problems = append(problems, fmt.Sprintf("worker %s has maxLeases=%d shards=%d",
+				row.WorkerID, row.MaxLeasesPerWorker, row.ShardCount))
+		}
+	}
+	return problems, nil
+}
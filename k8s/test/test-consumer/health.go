@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthShutdownTimeout bounds how long in-flight probe requests may take to drain
+const healthShutdownTimeout = 5 * time.Second
+
+// startHealthServer serves the liveness/readiness/startup probes, /metrics,
+// /recommendation, /fleet and /drain on addr using dedicated muxes, so other HTTP handlers
+// registered in the process are never exposed on them. With adminAddr set the probes
+// stay on addr and everything else moves to adminAddr, so a NetworkPolicy can open
+// the two ports to different peers. With HEALTH_AUTH_TOKEN everything but the probes
+// requires the token, and with HEALTH_TLS_CERT_FILE both listeners serve HTTPS.
+// A listener that stops is retried or dropped as policy says; otherwise its error is
+// sent on the returned channel for the caller to act on.
+func startHealthServer(addr, adminAddr string, policy failurePolicy) ([]*http.Server, <-chan error, error) {
+	probes := http.NewServeMux()
+
+	probes.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeStatus(w, isHealthy.Load(), "ok", "unhealthy")
+	})
+
+	probes.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeProbeStatus(w, isReady.Load(), "ready", "not_ready")
+	})
+
+	probes.HandleFunc("/startup", func(w http.ResponseWriter, r *http.Request) {
+		status := startup.status()
+		w.Header().Set("Content-Type", "application/json")
+		if status.Started {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	admin := probes
+	if adminAddr != "" && adminAddr != addr {
+		admin = http.NewServeMux()
+	}
+	admin.HandleFunc("/metrics", metrics.handler)
+	admin.HandleFunc("/recommendation", recommendationHandler)
+	admin.HandleFunc("/fleet", fleetStatusHandler)
+	admin.HandleFunc("/shards", shardDistributionHandler)
+	admin.HandleFunc("/drain", drainHandler)
+	admin.HandleFunc("/cordon", cordonHandler)
+	admin.HandleFunc("/uncordon", cordonHandler)
+	admin.HandleFunc("/cordons", cordonHandler)
+
+	auth, err := newHealthAuth()
+	if err != nil {
+		return nil, nil, fmt.Errorf("health server auth: %w", err)
+	}
+	tlsConfig, err := healthTLSConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("health server TLS: %w", err)
+	}
+
+	errs := make(chan error, 2)
+	servers := []*http.Server{listenHealth("Health check", addr, probes, auth, tlsConfig, policy, errs)}
+	if admin != probes {
+		servers = append(servers, listenHealth("Admin", adminAddr, admin, auth, tlsConfig, policy, errs))
+	}
+	return servers, errs, nil
+}
+
+// writeProbeStatus answers a probe with 200 or 503 and the subsystem detail as JSON
+func writeProbeStatus(w http.ResponseWriter, ok bool, okStatus, failStatus string) {
+	w.Header().Set("Content-Type", "application/json")
+	status := subsystems.status(okStatus)
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		status.Status = failStatus
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// listenHealth serves mux on addr in the background behind the optional auth and TLS
+func listenHealth(name, addr string, mux *http.ServeMux, auth *healthAuth, tlsConfig *tls.Config, policy failurePolicy, errs chan<- error) *http.Server {
+	var handler http.Handler = mux
+	if auth != nil {
+		handler = auth.wrap(mux)
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		backoff := time.Second
+		for {
+			log.Printf("%s server listening on %s (tls=%t, auth=%t)", name, addr, tlsConfig != nil, auth != nil)
+			var err error
+			if tlsConfig != nil {
+				// Certificates come from TLSConfig.GetCertificate
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err == nil || errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			err = fmt.Errorf("%s server on %s failed: %w", name, addr, err)
+			switch {
+			case policy == policyRetryForever:
+				log.Printf("WARN: %v; retrying in %s", err, backoff)
+				time.Sleep(backoff)
+				backoff = min(2*backoff, maxPhaseBackoff)
+			case policy.degrade(strings.ToLower(strings.ReplaceAll(name, " ", "_"))+"_server", err):
+				return
+			default:
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return server
+}
+
+// shutdownHealthServer stops accepting probe and admin connections and waits for
+// in-flight requests to finish
+func shutdownHealthServer(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("WARN: Health server shutdown on %s: %v", server.Addr, err)
+			continue
+		}
+		log.Printf("Health server on %s stopped", server.Addr)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probePaths are the kubelet probes, left open unless HEALTH_AUTH_PROBES=true: the
+// kubelet cannot read a token from a Secret. Everything else on the health server,
+// /metrics and the admin endpoints, requires the token once one is configured.
+var probePaths = map[string]bool{"/health": true, "/ready": true, "/startup": true}
+
+// healthAuth checks a bearer token, or a token in a custom header, on the health server
+type healthAuth struct {
+	token  []byte
+	header string // empty for Authorization: Bearer
+	probes bool
+}
+
+// newHealthAuth reads HEALTH_AUTH_TOKEN or HEALTH_AUTH_TOKEN_FILE; nil when neither is set
+func newHealthAuth() (*healthAuth, error) {
+	token := os.Getenv("HEALTH_AUTH_TOKEN")
+	if file := getEnv("HEALTH_AUTH_TOKEN_FILE", ""); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HEALTH_AUTH_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return nil, nil
+	}
+	return &healthAuth{
+		token:  []byte(token),
+		header: getEnv("HEALTH_AUTH_HEADER", ""),
+		probes: getEnv("HEALTH_AUTH_PROBES", "false") == "true",
+	}, nil
+}
+
+func (a *healthAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] && !a.probes {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.allowed(r) {
+			if a.header == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="kds-consumer"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *healthAuth) allowed(r *http.Request) bool {
+	var presented string
+	if a.header != "" {
+		presented = r.Header.Get(a.header)
+	} else {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return false
+		}
+		presented = token
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), a.token) == 1
+}
+
+// reloadingCertificate serves HEALTH_TLS_CERT_FILE and HEALTH_TLS_KEY_FILE, loading
+// them again when the certificate file changes so rotated Secrets (e.g. from
+// cert-manager) are picked up without a restart
+type reloadingCertificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func newReloadingCertificate(certFile, keyFile string) (*reloadingCertificate, error) {
+	c := &reloadingCertificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.get(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *reloadingCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to stat %s: %w", c.certFile, err)
+	}
+	if c.cert != nil && info.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Mid-rotation the key may not match yet; keep serving the previous pair
+			log.Printf("WARN: Failed to reload health server certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load health server certificate: %w", err)
+	}
+	c.cert, c.modTime = &cert, info.ModTime()
+	return c.cert, nil
+}
+
+// healthTLSConfig returns the TLS config for the health server, nil for plain HTTP
+func healthTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := getEnv("HEALTH_TLS_CERT_FILE", ""), getEnv("HEALTH_TLS_KEY_FILE", "")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("HEALTH_TLS_CERT_FILE and HEALTH_TLS_KEY_FILE must be set together")
+	}
+	cert, err := newReloadingCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: cert.get, MinVersion: tls.VersionTLS12}, nil
+}
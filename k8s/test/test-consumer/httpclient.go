@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// httpTransportHooks adjust the HTTP transport shared by every AWS client after the
+// environment settings are applied, for customizations env vars do not cover
+var httpTransportHooks []func(*http.Transport)
+
+// httpClientOptionsFromEnv builds the AWS SDK HTTP client from:
+//   - KDS_HTTP_PROXY: proxy URL for all AWS calls (the standard HTTPS_PROXY and
+//     NO_PROXY are honored when unset)
+//   - KDS_CA_BUNDLE: PEM file of extra CAs, e.g. for a TLS-intercepting proxy
+//   - KDS_HTTP_MAX_CONNS_PER_HOST, KDS_HTTP_MAX_IDLE_CONNS_PER_HOST and
+//     KDS_HTTP_IDLE_CONN_TIMEOUT: connection pool sizing
+//   - KDS_HTTP_TIMEOUT, KDS_HTTP_DIAL_TIMEOUT and KDS_HTTP_TLS_HANDSHAKE_TIMEOUT:
+//     whole-request, connect and TLS handshake timeouts
+//
+// Unset values keep the SDK defaults.
+func httpClientOptionsFromEnv() ([]func(*config.LoadOptions) error, error) {
+	var transportOpts []func(*http.Transport)
+
+	if v := os.Getenv("KDS_HTTP_PROXY"); v != "" {
+		proxy, err := url.Parse(v)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("KDS_HTTP_PROXY %q is not a valid URL", v)
+		}
+		transportOpts = append(transportOpts, func(t *http.Transport) { t.Proxy = http.ProxyURL(proxy) })
+	}
+	if n := int(getEnvFloat("KDS_HTTP_MAX_CONNS_PER_HOST", 0)); n > 0 {
+		transportOpts = append(transportOpts, func(t *http.Transport) { t.MaxConnsPerHost = n })
+	}
+	if n := int(getEnvFloat("KDS_HTTP_MAX_IDLE_CONNS_PER_HOST", 0)); n > 0 {
+		transportOpts = append(transportOpts, func(t *http.Transport) {
+			t.MaxIdleConnsPerHost = n
+			t.MaxIdleConns = max(t.MaxIdleConns, n)
+		})
+	}
+	if d := getEnvDuration("KDS_HTTP_IDLE_CONN_TIMEOUT", 0); d > 0 {
+		transportOpts = append(transportOpts, func(t *http.Transport) { t.IdleConnTimeout = d })
+	}
+	if d := getEnvDuration("KDS_HTTP_TLS_HANDSHAKE_TIMEOUT", 0); d > 0 {
+		transportOpts = append(transportOpts, func(t *http.Transport) { t.TLSHandshakeTimeout = d })
+	}
+	transportOpts = append(transportOpts, httpTransportHooks...)
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(transportOpts...)
+	if d := getEnvDuration("KDS_HTTP_DIAL_TIMEOUT", 0); d > 0 {
+		client = client.WithDialerOptions(func(dialer *net.Dialer) { dialer.Timeout = d })
+	}
+	if d := getEnvDuration("KDS_HTTP_TIMEOUT", 0); d > 0 {
+		client = client.WithTimeout(d)
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithHTTPClient(client)}
+	if path := os.Getenv("KDS_CA_BUNDLE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("KDS_CA_BUNDLE: %w", err)
+		}
+		opts = append(opts, config.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+	return opts, nil
+}
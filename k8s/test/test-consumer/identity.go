@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// processIDKey is the worker row attribute naming the process writing it
+const processIDKey = "process_id"
+
+// ErrWorkerIDConflict is returned by Heartbeat when an older live process reports the
+// same worker ID; this process must exit
+var ErrWorkerIDConflict = errors.New("another live process reports this worker ID")
+
+var workerIDConflicts = metrics.counter("kds_worker_id_conflicts_total", "Heartbeats that found another live process reporting this worker ID, by action (kept or yielded)")
+
+// processID tells processes apart, including restarts of the same pod. Two processes
+// with the same worker ID (a copy-pasted HOSTNAME, a scaled compose service) share one
+// worker row and one KCL lease owner: they count as one worker in the lease math and
+// both renew the same leases.
+var processID = newProcessID()
+
+// newProcessID returns a random (version 4) UUID
+func newProcessID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Only a broken system random source fails; fall back to the clock
+		return fmt.Sprintf("pid-%d", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// identityItem adds the process ID to this worker's row
+func (lm *KDSLeaseManager) identityItem(item map[string]types.AttributeValue) {
+	item[processIDKey] = &types.AttributeValueMemberS{Value: lm.processID}
+}
+
+// workerRow reads this worker's row, nil when there is none
+func (lm *KDSLeaseManager) workerRow(ctx context.Context) (*leasemanager.Metadata, error) {
+	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(lm.workerID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || result.Item == nil {
+		return nil, err
+	}
+	return parseWorkerMetadata(result.Item, lm.keys().Worker("")), nil
+}
+
+// checkWorkerIdentity warns when the worker row about to be overwritten still names
+// another process, which did not stop cleanly: either this pod's previous run or a
+// second process with the same worker ID. If the latter, the newer of the two exits
+// at a heartbeat.
+func (lm *KDSLeaseManager) checkWorkerIdentity(ctx context.Context) {
+	row, err := lm.workerRow(ctx)
+	if err != nil || row == nil || row.ProcessID == "" || row.ProcessID == lm.processID {
+		return
+	}
+	log.Printf("WARN: Worker row %s was last refreshed %s ago by process %s (started %s), which did not stop cleanly. "+
+		"If it is still running with the same worker ID, the newer process exits at its next heartbeat.",
+		lm.workerID, heartbeatAge(time.Now(), row.LastUpdateTime, row.ClockOffset).Round(time.Second), row.ProcessID, row.StartedAt.Format(time.RFC3339))
+}
+
+// resolveWorkerIDConflict decides between this process and other, the process found on
+// the worker row at a heartbeat. The older process keeps the worker ID and takes the
+// row back; the newer one gets ErrWorkerIDConflict. Start times are whole seconds, so
+// ties go to the smaller process ID.
+func (lm *KDSLeaseManager) resolveWorkerIDConflict(ctx context.Context, other *leasemanager.Metadata) error {
+	mine := lm.startedAt.UTC().Truncate(time.Second)
+	theirs := other.StartedAt.UTC()
+	if theirs.Before(mine) || (theirs.Equal(mine) && other.ProcessID < lm.processID) {
+		workerIDConflicts.add(1, "action", "yielded")
+		return fmt.Errorf("%w: worker %s is also reported by process %s started %s, before this process (%s started %s)",
+			ErrWorkerIDConflict, lm.workerID, other.ProcessID, theirs.Format(time.RFC3339), lm.processID, mine.Format(time.RFC3339))
+	}
+
+	workerIDConflicts.add(1, "action", "kept")
+	log.Printf("❌ Worker %s is also reported by process %s started %s, after this process; keeping the worker ID, "+
+		"the newer process exits at its next heartbeat. Give every process its own worker ID.",
+		lm.workerID, other.ProcessID, theirs.Format(time.RFC3339))
+	err := lm.writeHeartbeat(ctx, "#process_id = :other", map[string]types.AttributeValue{
+		":other": &types.AttributeValueMemberS{Value: other.ProcessID},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condCheckErr) {
+		return fmt.Errorf("failed to take back worker %s: %w", lm.workerID, err)
+	}
+	// A failed condition means the row changed again; the next heartbeat decides
+	return nil
+}
+
+// ReleaseWorkerIdentity removes this process's ID from the worker row on a clean
+// shutdown, so the next process with the worker ID knows it was not left running
+func (lm *KDSLeaseManager) ReleaseWorkerIdentity(ctx context.Context) error {
+	_, err := lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(lm.workerID)},
+		},
+		UpdateExpression:          aws.String("REMOVE #p"),
+		ConditionExpression:       aws.String("#p = :p"),
+		ExpressionAttributeNames:  map[string]string{"#p": processIDKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":p": &types.AttributeValueMemberS{Value: lm.processID}},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condCheckErr) {
+		return fmt.Errorf("failed to release worker %s: %w", lm.workerID, err)
+	}
+	return nil
+}
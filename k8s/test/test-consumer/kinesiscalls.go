@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var (
+	kinesisCallsTotal          = metrics.counter("kds_kinesis_calls_total", "Kinesis API requests sent by this process, retries included, by operation")
+	kinesisCallsPerMinute      = metrics.gauge("kds_kinesis_calls_per_minute", "Kinesis API requests sent by this process in the last full minute, by operation")
+	fleetKinesisCallsPerMinute = metrics.gauge("kds_fleet_kinesis_calls_per_minute", "Kinesis API requests per minute summed over the worker rows, by operation")
+	fleetKinesisBudgetUsed     = metrics.gauge("kds_fleet_kinesis_call_budget_ratio", "Fleet Kinesis requests per minute over KDS_KINESIS_CALL_BUDGET, by operation")
+)
+
+// kinesisCalls counts the Kinesis requests of this process; the worker row carries its
+// last full minute, see runtimestats.go
+var kinesisCalls = &callCounter{now: time.Now}
+
+// callCounter counts calls by operation per wall-clock minute, keeping the minute being
+// counted and the last full one
+type callCounter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	minute  time.Time      // start of the minute being counted
+	current map[string]int // operation -> calls this minute
+	last    map[string]int // operation -> calls in the last full minute
+}
+
+func (c *callCounter) record(operation string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll()
+	c.current[operation]++
+}
+
+// lastMinute returns a copy of the calls of the last full minute, empty when the
+// process made none
+func (c *callCounter) lastMinute() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roll()
+	calls := make(map[string]int, len(c.last))
+	for op, n := range c.last {
+		calls[op] = n
+	}
+	return calls
+}
+
+// roll starts a new minute once the current one is over. A minute without calls
+// leaves the last full minute empty.
+func (c *callCounter) roll() {
+	minute := c.now().Truncate(time.Minute)
+	if c.current != nil && !minute.After(c.minute) {
+		return
+	}
+	if minute.Sub(c.minute) == time.Minute {
+		c.last = c.current
+	} else {
+		c.last = nil
+	}
+	c.current = map[string]int{}
+	c.minute = minute
+
+	kinesisCallsPerMinute.reset()
+	for op, n := range c.last {
+		kinesisCallsPerMinute.set(float64(n), "operation", op)
+	}
+}
+
+// kinesisCallCounting counts every Kinesis request by operation. It is added at the
+// end of the finalize step, after the retryer, so each attempt counts, throttled or
+// not, as it does against the account limits.
+func kinesisCallCounting(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("KinesisCallCounting",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if awsmiddleware.GetServiceID(ctx) == kinesis.ServiceID {
+				operation := awsmiddleware.GetOperationName(ctx)
+				kinesisCalls.record(operation)
+				kinesisCallsTotal.add(1, "operation", operation)
+			}
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+}
+
+// addCalls adds calls into total, allocating it on first use
+func addCalls(total map[string]int, calls map[string]int) map[string]int {
+	for op, n := range calls {
+		if total == nil {
+			total = map[string]int{}
+		}
+		total[op] += n
+	}
+	return total
+}
+
+// totalCalls sums the calls of every operation
+func totalCalls(calls map[string]int) int {
+	total := 0
+	for _, n := range calls {
+		total += n
+	}
+	return total
+}
+
+// callBudgetFromEnv reads KDS_KINESIS_CALL_BUDGET, the Kinesis requests per minute the
+// whole fleet may make by operation, e.g. "ListShards=3000,DescribeStreamSummary=600";
+// nil when unset
+func callBudgetFromEnv() (map[string]int, error) {
+	spec := getEnv("KDS_KINESIS_CALL_BUDGET", "")
+	if spec == "" {
+		return nil, nil
+	}
+	budget := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		op, value, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(op) == "" || err != nil || n <= 0 {
+			return nil, fmt.Errorf("KDS_KINESIS_CALL_BUDGET: invalid entry %q, want Operation=<calls per minute>", entry)
+		}
+		budget[strings.TrimSpace(op)] = n
+	}
+	return budget, nil
+}
+
+// overBudget lists the operations whose fleet calls per minute exceed the budget, as
+// "Operation used/budget", sorted by operation
+func overBudget(calls, budget map[string]int) []string {
+	var over []string
+	for op, limit := range budget {
+		if calls[op] > limit {
+			over = append(over, fmt.Sprintf("%s %d/%d", op, calls[op], limit))
+		}
+	}
+	sort.Strings(over)
+	return over
+}
+
+// exportFleetCalls publishes the fleet calls per minute and, with a budget, the share
+// of it used by every budgeted operation
+func exportFleetCalls(calls, budget map[string]int) {
+	fleetKinesisCallsPerMinute.reset()
+	for op, n := range calls {
+		fleetKinesisCallsPerMinute.set(float64(n), "operation", op)
+	}
+	fleetKinesisBudgetUsed.reset()
+	for op, limit := range budget {
+		fleetKinesisBudgetUsed.set(float64(calls[op])/float64(limit), "operation", op)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// KubernetesAPIForLease defines the Kubernetes lookups needed to derive the worker count
+type KubernetesAPIForLease interface {
+	GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
+	GetStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error)
+	GetReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error)
+}
+
+// KubernetesAPIForScaling defines the Kubernetes writes used to act on replica
+// recommendations; only configured when explicitly enabled
+type KubernetesAPIForScaling interface {
+	GetHPA(ctx context.Context, namespace, name string) (*autoscalingv2.HorizontalPodAutoscaler, error)
+	PatchHPAMinReplicas(ctx context.Context, namespace, name string, minReplicas int32) error
+	ScaleWorkload(ctx context.Context, namespace, kind, name string, replicas int32) error
+}
+
+// kubernetesPermission is a single RBAC rule required by KubernetesAPIForLease
+type kubernetesPermission struct {
+	group    string
+	resource string
+	verb     string
+}
+
+// kubernetesPermissions is the API access the lease manager uses for lookups;
+// preflight verifies it and the rbac subcommand renders it as a Role
+var kubernetesPermissions = []kubernetesPermission{
+	{group: "", resource: "pods", verb: "get"},
+	{group: "apps", resource: "replicasets", verb: "get"},
+	{group: "apps", resource: "statefulsets", verb: "get"},
+}
+
+// hpaPermissions are the additional rules needed when KDS_RECOMMENDER_HPA is set
+var hpaPermissions = []kubernetesPermission{
+	{group: "autoscaling", resource: "horizontalpodautoscalers", verb: "get"},
+	{group: "autoscaling", resource: "horizontalpodautoscalers", verb: "patch"},
+}
+
+// scalePermissions are the additional rules needed when KDS_AUTOSCALE is enabled
+var scalePermissions = []kubernetesPermission{
+	{group: "apps", resource: "statefulsets", verb: "patch"},
+	{group: "apps", resource: "deployments", verb: "patch"},
+}
+
+// requiredKubernetesPermissions returns kubernetesPermissions plus the rules for the
+// opt-in HPA and autoscale features enabled in the environment
+func requiredKubernetesPermissions() []kubernetesPermission {
+	permissions := append([]kubernetesPermission{}, kubernetesPermissions...)
+	if os.Getenv("KDS_RECOMMENDER_HPA") != "" {
+		permissions = append(permissions, hpaPermissions...)
+	}
+	if os.Getenv("KDS_AUTOSCALE") == "true" {
+		permissions = append(permissions, scalePermissions...)
+	}
+	return permissions
+}
+
+// kubernetesLookupEnabled reports whether the worker count may be read from the
+// Kubernetes API. When disabled, client-go is never configured and the worker count
+// must come from KDS_WORKER_COUNT.
+func kubernetesLookupEnabled() bool {
+	return getEnv("KDS_ENABLE_K8S_LOOKUP", "true") == "true"
+}
+
+// currentNamespace returns POD_NAMESPACE, falling back to the service account
+// namespace file and finally "default"
+func currentNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	// Try to read from service account namespace file (standard location in K8s)
+	namespaceBytes, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		degradations.set(reasonNamespaceDefault, "POD_NAMESPACE not set and no service account namespace file, using \"default\"")
+		return "default"
+	}
+	namespace := strings.TrimSpace(string(namespaceBytes))
+	log.Printf("Read namespace from service account: %s", namespace)
+	return namespace
+}
+
+// newKubernetesClientset creates a clientset from the in-cluster service account
+func newKubernetesClientset() (*kubernetes.Clientset, error) {
+	k8sConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-cluster K8s config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create K8s client: %w", err)
+	}
+	return clientset, nil
+}
+
+// clientsetAPI adapts a client-go clientset to KubernetesAPIForLease
+type clientsetAPI struct {
+	clientset kubernetes.Interface
+}
+
+func (c clientsetAPI) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	return c.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetAPI) GetStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	return c.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetAPI) GetReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	return c.clientset.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetAPI) GetHPA(ctx context.Context, namespace, name string) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	return c.clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetAPI) PatchHPAMinReplicas(ctx context.Context, namespace, name string, minReplicas int32) error {
+	patch := fmt.Sprintf(`{"spec":{"minReplicas":%d}}`, minReplicas)
+	_, err := c.clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
+// ScaleWorkload sets spec.replicas of a StatefulSet or Deployment
+func (c clientsetAPI) ScaleWorkload(ctx context.Context, namespace, kind, name string, replicas int32) error {
+	patch := []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas))
+	var err error
+	switch kind {
+	case "StatefulSet":
+		_, err = c.clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case "Deployment":
+		_, err = c.clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("cannot scale %s %s", kind, name)
+	}
+	return err
+}
+
+// minimalRoleYAML renders the smallest Role granting permissions
+func minimalRoleYAML(name, namespace string, permissions []kubernetesPermission) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "apiVersion: rbac.authorization.k8s.io/v1\n")
+	fmt.Fprintf(&b, "kind: Role\n")
+	fmt.Fprintf(&b, "metadata:\n")
+	fmt.Fprintf(&b, "  name: %s\n", name)
+	fmt.Fprintf(&b, "  namespace: %s\n", namespace)
+	fmt.Fprintf(&b, "rules:\n")
+	for _, p := range permissions {
+		fmt.Fprintf(&b, "- apiGroups: [%q]\n", p.group)
+		fmt.Fprintf(&b, "  resources: [%q]\n", p.resource)
+		fmt.Fprintf(&b, "  verbs: [%q]\n", p.verb)
+	}
+	return b.String()
+}
@@ -8,36 +8,28 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+
+	"expr_mohan/leasemanager"
 )
 
+// Initialization phases reported through OnInitPhase
 const (
-	MaxLeasePerWorkerLimit = 80 // Maximum number of leases a single worker can handle
+	InitPhaseTableReady          = "table_ready"
+	InitPhaseCoordinatorResolved = "coordinator_resolved"
 )
 
-// LeaseMetadata represents the metadata stored in DynamoDB for a worker
-type LeaseMetadata struct {
-	WorkerID           string    `dynamodbav:"worker_id"`
-	MaxLeasesPerWorker int       `dynamodbav:"max_leases_per_worker"`
-	StreamName         string    `dynamodbav:"stream_name"`
-	AppName            string    `dynamodbav:"app_name"`
-	LastUpdateTime     time.Time `dynamodbav:"last_update_time"`
-	ShardCount         int       `dynamodbav:"shard_count"`
-	WorkerCount        int       `dynamodbav:"worker_count"`
-}
-
 // KinesisAPIForLease defines the Kinesis operations needed for lease management
 type KinesisAPIForLease interface {
 	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+	DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error)
 }
 
 // DynamoDBAPIForLease defines the DynamoDB operations needed for lease management
@@ -47,7 +39,9 @@ type DynamoDBAPIForLease interface {
 	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
 	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
 	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
 	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
 }
 
 // KDSLeaseManager manages the calculation and storage of max leases per worker
@@ -56,32 +50,64 @@ type KDSLeaseManager struct {
 	streamName     string
 	appName        string
 	workerID       string
+	consumerGroup  string
 	kinesisClient  KinesisAPIForLease
 	dynamodbClient DynamoDBAPIForLease
 	metadataTable  string
-	k8sClient      *kubernetes.Clientset
+	k8sClient      KubernetesAPIForLease
+	workerCounter  WorkerCountProvider
+	leaseExpr      *LeaseExpression
+	exprEnv        LeaseExpressionEnv
+	phaseHook      func(phase string)
+	scaler         *fleetScaler
+
+	// allowPartialReads, see partial.go
+	allowPartialReads bool
+	// coordinatorCache is the local file holding the last coordinator value, see coordcache.go
+	coordinatorCache string
+	// fallbackMaxLeases is used when coordination is unavailable, see fallback.go
+	fallbackMaxLeases int
+	// discoveryConcurrency bounds the ranges of a shard listing, and noSummaryCount is
+	// set once the stream summary lacks OpenShardCount, see discovery.go
+	discoveryConcurrency int
+	noSummaryCount       atomic.Bool
+	// streamCreatedAt identifies the stream incarnation, see streamreset.go
+	streamCreatedAt time.Time
+
+	// Max leases change notifications, see watch.go. initialMaxLeases is what
+	// InitializeMaxLeasesPerWorker returned, the starting point of the background
+	// refresh (refresh.go) and of the notifications.
+	notifyMu          sync.Mutex
+	initialMaxLeases  int
+	notifiedMaxLeases int
+	subscribers       map[int]maxLeasesSubscriber
+	nextSubscriber    int
+
+	// Fleet view for adaptive polling, see polling.go
+	observedWorkers atomic.Int64
+	isCoordinator   atomic.Bool
+
+	// lastCoordinator is the last coordinator row read, served while the metadata
+	// store circuit breaker is open, see breaker.go
+	lastCoordinator atomic.Pointer[leasemanager.Metadata]
+
+	// Process start time and runtime stats source for the worker row, see runtimestats.go
+	startedAt    time.Time
+	runtimeStats func() RuntimeStats
+	// processID is written to the worker row to detect duplicate worker IDs, see identity.go
+	processID string
+
+	// Canary rollout state, see canary.go
+	canaryHealth         func() CanaryHealth
+	canaryPolicy         CanaryPolicy
+	canaryAppliedAt      time.Time
+	canaryBaselineErrors int64
 }
 
 // NewKDSLeaseManager creates a new lease manager
 func NewKDSLeaseManager(ctx context.Context, region, streamName, appName, workerID, endpoint string) (*KDSLeaseManager, error) {
 	// Load AWS configuration
-	opts := []func(*config.LoadOptions) error{
-		config.WithRegion(region),
-	}
-
-	if endpoint != "" {
-		opts = append(opts, config.WithEndpointResolverWithOptions(
-			aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-				return aws.Endpoint{
-					URL:               endpoint,
-					HostnameImmutable: true,
-					SigningRegion:     region,
-				}, nil
-			}),
-		))
-	}
-
-	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	awsCfg, err := loadAWSConfig(ctx, region, endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
@@ -89,217 +115,242 @@ func NewKDSLeaseManager(ctx context.Context, region, streamName, appName, worker
 	kinesisClient := kinesis.NewFromConfig(awsCfg)
 	dynamodbClient := dynamodb.NewFromConfig(awsCfg)
 
-	// Create Kubernetes client
-	k8sConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Printf("Failed to get in-cluster K8s config, will use fallback methods: %v: %v", err)
-	}
-
-	var k8sClient *kubernetes.Clientset
-	if k8sConfig != nil {
-		k8sClient, err = kubernetes.NewForConfig(k8sConfig)
+	// Create Kubernetes client (skipped entirely when lookups are disabled)
+	var k8sClient KubernetesAPIForLease
+	if kubernetesLookupEnabled() {
+		clientset, err := newKubernetesClientset()
 		if err != nil {
-			log.Printf("Failed to create K8s client, will use fallback methods: %v: %v", err)
+			subsystems.observe(subsystemKubernetes, time.Now(), err)
+			degradations.set(reasonKubernetesClient, fmt.Sprintf("%v, will use fallback methods", err))
+		} else {
+			k8sClient = clientsetAPI{clientset: clientset}
 		}
+	} else {
+		subsystems.disable(subsystemKubernetes)
+		log.Printf("Kubernetes lookups disabled (KDS_ENABLE_K8S_LOOKUP=false), worker count must come from KDS_WORKER_COUNT")
 	}
 
-	metadataTable := appName + "_meta"
+	// Independent fleets reading the same stream keep isolated metadata per group
+	consumerGroup := getEnv("KDS_CONSUMER_GROUP", leasemanager.DefaultConsumerGroup)
+	if !leasemanager.ValidConsumerGroup(consumerGroup) {
+		return nil, fmt.Errorf("invalid KDS_CONSUMER_GROUP %q: use 1-64 letters, digits, '.', '_' or '-'", consumerGroup)
+	}
+
+	metadataTable := leasemanager.Keys{App: appName}.Table()
+	timeouts := callTimeoutsFromEnv()
 
 	manager := &KDSLeaseManager{
 		region:         region,
 		streamName:     streamName,
 		appName:        appName,
 		workerID:       workerID,
-		kinesisClient:  kinesisClient,
-		dynamodbClient: dynamodbClient,
+		consumerGroup:  consumerGroup,
+		kinesisClient:  &timeoutKinesis{next: kinesisClient, timeouts: timeouts},
+		dynamodbClient: newBreakerDynamoDBFromEnv(newRateLimitedDynamoDBFromEnv(&timeoutDynamoDB{next: dynamodbClient, timeouts: timeouts})),
 		metadataTable:  metadataTable,
 		k8sClient:      k8sClient,
+		startedAt:      processStart,
+		processID:      processID,
+
+		discoveryConcurrency: int(getEnvFloat("KDS_SHARD_DISCOVERY_CONCURRENCY", 8)),
 	}
 
 	return manager, nil
 }
 
-// GetShardCount retrieves the number of shards in the KDS stream
-func (lm *KDSLeaseManager) GetShardCount(ctx context.Context) (int, error) {
-	log.Printf("Getting shard count from KDS stream",
-		lm.streamName)
+// SetWorkerCountProvider makes provider the authoritative worker count source,
+// consulted after KDS_WORKER_COUNT and instead of Kubernetes lookups
+func (lm *KDSLeaseManager) SetWorkerCountProvider(provider WorkerCountProvider) {
+	lm.workerCounter = provider
+}
 
-	var shardCount int
-	var nextToken *string
+// SetLeaseExpression replaces the built-in max leases formula with expr, evaluated
+// with the lag, time zone and custom scalars from env
+func (lm *KDSLeaseManager) SetLeaseExpression(expr *LeaseExpression, env LeaseExpressionEnv) {
+	lm.leaseExpr = expr
+	lm.exprEnv = env
+}
 
-	for {
-		input := &kinesis.ListShardsInput{
-			StreamName: aws.String(lm.streamName),
-			NextToken:  nextToken,
-		}
+// OnInitPhase registers a callback invoked as InitializeMaxLeasesPerWorker completes
+// each InitPhase* step, e.g. to drive a startup probe
+func (lm *KDSLeaseManager) OnInitPhase(fn func(phase string)) {
+	lm.phaseHook = fn
+}
 
-		resp, err := lm.kinesisClient.ListShards(ctx, input)
-		if err != nil {
-			return 0, fmt.Errorf("failed to list shards: %w", err)
-		}
+func (lm *KDSLeaseManager) reportPhase(phase string) {
+	if lm.phaseHook != nil {
+		lm.phaseHook(phase)
+	}
+}
 
-		// Count only active shards (those without EndingSequenceNumber)
-		for _, shard := range resp.Shards {
-			if shard.SequenceNumberRange.EndingSequenceNumber == nil {
-				shardCount++
-			}
-		}
+// GetShardCount retrieves the number of open shards in the KDS stream, from the stream
+// summary when it has one, see summaryShardCount
+func (lm *KDSLeaseManager) GetShardCount(ctx context.Context) (int, error) {
+	log.Printf("Getting shard count from KDS stream %s", lm.streamName)
 
-		if resp.NextToken == nil {
-			break
-		}
-		nextToken = resp.NextToken
+	if shardCount, ok := lm.summaryShardCount(ctx); ok {
+		shardCountLookups.add(1, "source", "summary")
+		log.Printf("Retrieved shard count from KDS stream %s summary: %d", lm.streamName, shardCount)
+		return shardCount, nil
+	}
+	shardCountLookups.add(1, "source", "list")
+	shards, err := lm.listShards(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	log.Printf("Retrieved shard count from KDS",
-		lm.streamName,
-		shardCount)
+	// Count only active shards (those without EndingSequenceNumber)
+	shardCount := leasemanager.CountOpenShards(shards)
+
+	log.Printf("Retrieved shard count from KDS stream %s: %d", lm.streamName, shardCount)
 
 	return shardCount, nil
 }
 
-// GetWorkerCount retrieves the number of pods/workers in the deployment or statefulset
+// GetWorkerCount retrieves the number of pods/workers in the deployment or statefulset.
+// A count of 1 used because none could be found is reported as a degradation, since
+// it gives every worker the whole stream's worth of leases.
 func (lm *KDSLeaseManager) GetWorkerCount(ctx context.Context) (int, error) {
-	log.Printf("Getting worker count from Kubernetes")
+	count, fallback, err := lm.lookupWorkerCount(ctx)
+	switch {
+	case err != nil:
+	case fallback != "":
+		degradations.set(reasonWorkerCountDefault, fallback+", using default worker count of 1")
+	default:
+		degradations.clear(reasonWorkerCountDefault)
+	}
+	return count, err
+}
+
+// lookupWorkerCount is GetWorkerCount, returning why when it falls back to 1
+func (lm *KDSLeaseManager) lookupWorkerCount(ctx context.Context) (int, string, error) {
+	log.Printf("Getting worker count")
 
 	// First, try to get from environment variable (for testing or manual configuration)
 	if workerCountEnv := os.Getenv("KDS_WORKER_COUNT"); workerCountEnv != "" {
 		count, err := strconv.Atoi(workerCountEnv)
 		if err == nil && count > 0 {
-			log.Printf("Using worker count from environment variable",
-				count)
-			return count, nil
+			log.Printf("Using worker count from environment variable: %d", count)
+			return count, "", nil
+		}
+		degradations.invalidSetting("KDS_WORKER_COUNT", workerCountEnv, "lookup")
+	}
+
+	// An external control plane, when configured, is authoritative; failures are
+	// surfaced instead of guessing a count
+	if lm.workerCounter != nil {
+		count, err := lm.workerCounter.WorkerCount(ctx)
+		if err != nil {
+			return 0, "", fmt.Errorf("worker count provider: %w", err)
 		}
+		log.Printf("Using worker count from control-plane provider: %d", count)
+		return count, "", nil
 	}
 
-	// If K8s client is not available, use default
+	// If K8s lookups are disabled or the client is not available, use default
 	if lm.k8sClient == nil {
-		log.Printf("WARN: K8s client not available, using default worker count of 1")
-		return 1, nil
+		return 1, "K8s client not available", nil
 	}
 
 	// Get current pod's name from HOSTNAME (automatically set in K8s)
 	podName := os.Getenv("HOSTNAME")
 	if podName == "" {
-		log.Printf("WARN: HOSTNAME not set, cannot determine pod name, using default worker count of 1")
-		return 1, nil
+		return 1, "HOSTNAME not set, cannot determine pod name", nil
 	}
 
 	// Get current namespace
-	namespace := os.Getenv("POD_NAMESPACE")
-	if namespace == "" {
-		// Try to read from service account namespace file (standard location in K8s)
-		namespaceBytes, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
-		if err == nil {
-			namespace = string(namespaceBytes)
-			log.Printf("Read namespace from service account: %v: %v", namespace)
-		} else {
-			namespace = "default"
-			log.Printf("WARN: Could not determine namespace, using default")
-		}
-	}
+	namespace := currentNamespace()
 
 	// Get the current pod
-	pod, err := lm.k8sClient.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	lookupStart := time.Now()
+	pod, err := lm.k8sClient.GetPod(ctx, namespace, podName)
+	subsystems.observe(subsystemKubernetes, lookupStart, err)
 	if err != nil {
-		log.Printf("WARN: Failed to get pod info, using default worker count of 1",
-			err,
-			podName,
-			namespace)
-		return 1, nil
+		return 1, fmt.Sprintf("failed to get pod info: pod=%s namespace=%s: %v", podName, namespace, err), nil
 	}
 
 	// Find the owner reference (could be ReplicaSet, StatefulSet, etc.)
 	if len(pod.OwnerReferences) == 0 {
-		log.Printf("WARN: Pod has no owner references, using default worker count of 1",
-			podName)
-		return 1, nil
+		return 1, fmt.Sprintf("pod %s has no owner references", podName), nil
 	}
 
 	// Check each owner reference
 	for _, owner := range pod.OwnerReferences {
 		switch owner.Kind {
 		case "StatefulSet":
-			statefulset, err := lm.k8sClient.AppsV1().StatefulSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+			statefulset, err := lm.k8sClient.GetStatefulSet(ctx, namespace, owner.Name)
 			if err == nil && statefulset.Spec.Replicas != nil {
 				workerCount := int(*statefulset.Spec.Replicas)
-				log.Printf("Retrieved worker count from StatefulSet (via pod owner)",
-					owner.Name,
-					podName,
-					workerCount)
-				return workerCount, nil
+				log.Printf("Retrieved worker count from StatefulSet %s (via pod %s): %d",
+					owner.Name, podName, workerCount)
+				return workerCount, "", nil
 			}
-			log.Printf("WARN: Failed to get statefulset info: %v: %v", err)
+			log.Printf("WARN: Failed to get statefulset info: %v", err)
 
 		case "ReplicaSet":
-			replicaset, err := lm.k8sClient.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+			replicaset, err := lm.k8sClient.GetReplicaSet(ctx, namespace, owner.Name)
 			if err == nil && replicaset.Spec.Replicas != nil {
 				// ReplicaSet is likely owned by a Deployment, but we can use its replica count
 				workerCount := int(*replicaset.Spec.Replicas)
 
 				// Try to find the parent Deployment for better logging
 				deploymentName := ""
-				if len(replicaset.OwnerReferences) > 0 {
-					for _, rsOwner := range replicaset.OwnerReferences {
-						if rsOwner.Kind == "Deployment" {
-							deploymentName = rsOwner.Name
-							break
-						}
+				for _, rsOwner := range replicaset.OwnerReferences {
+					if rsOwner.Kind == "Deployment" {
+						deploymentName = rsOwner.Name
+						break
 					}
 				}
 
 				if deploymentName != "" {
-					log.Printf("Retrieved worker count from Deployment (via pod -> replicaset -> deployment)",
-						deploymentName,
-						owner.Name,
-						podName,
-						workerCount)
+					log.Printf("Retrieved worker count from Deployment %s (via pod %s -> replicaset %s): %d",
+						deploymentName, podName, owner.Name, workerCount)
 				} else {
-					log.Printf("Retrieved worker count from ReplicaSet (via pod owner)",
-						owner.Name,
-						podName,
-						workerCount)
+					log.Printf("Retrieved worker count from ReplicaSet %s (via pod %s): %d",
+						owner.Name, podName, workerCount)
 				}
-				return workerCount, nil
+				return workerCount, "", nil
 			}
-			log.Printf("WARN: Failed to get replicaset info: %v: %v", err)
+			log.Printf("WARN: Failed to get replicaset info: %v", err)
 		}
 	}
 
 	// Fallback
-	log.Printf("WARN: Unable to determine worker count from pod owners, using default of 1",
-		podName)
-	return 1, nil
+	return 1, fmt.Sprintf("unable to determine worker count from owners of pod %s", podName), nil
 }
 
 // CalculateMaxLeasesPerWorker calculates the maximum number of leases per worker
-// Formula: min(80, ceil(shardCount / workerCount))
+// Formula: min(80, ceil(shardCount / workerCount)), or the operator-supplied lease
+// expression when one is set via SetLeaseExpression
 func (lm *KDSLeaseManager) CalculateMaxLeasesPerWorker(shardCount, workerCount int) int {
 	if workerCount <= 0 {
 		workerCount = 1
 	}
 
-	// Calculate shards per worker
-	shardsPerWorker := int(math.Ceil(float64(shardCount) / float64(workerCount)))
-
-	// Apply the limit of 80
-	maxLeases := shardsPerWorker
-	if maxLeases > MaxLeasePerWorkerLimit {
-		maxLeases = MaxLeasePerWorkerLimit
+	if lm.leaseExpr != nil {
+		maxLeases, clamped, err := lm.leaseExpr.EvaluateMaxLeases(lm.exprEnv.Inputs(shardCount, workerCount))
+		if err == nil {
+			if clamped {
+				log.Printf("WARN: Lease expression %q result out of bounds, clamped to %d (allowed 1-%d)",
+					lm.leaseExpr, maxLeases, leasemanager.MaxLeasePerWorkerLimit)
+			}
+			log.Printf("Calculated max leases per worker from expression %q: shards=%d workers=%d result=%d",
+				lm.leaseExpr, shardCount, workerCount, maxLeases)
+			return maxLeases
+		}
+		log.Printf("WARN: Lease expression %q failed, using built-in formula: %v", lm.leaseExpr, err)
 	}
 
-	log.Printf("Calculated max leases per worker",
-		shardCount,
-		workerCount,
-		shardsPerWorker,
-		maxLeases)
+	maxLeases := leasemanager.BuiltinMaxLeases(shardCount, workerCount)
+	log.Printf("Calculated max leases per worker: shards=%d workers=%d shardsPerWorker=%d maxLeases=%d",
+		shardCount, workerCount, int(math.Ceil(float64(shardCount)/float64(workerCount))), maxLeases)
 
 	return maxLeases
 }
 
 // InitializeMetadataTable creates the metadata table if it doesn't exist
 func (lm *KDSLeaseManager) InitializeMetadataTable(ctx context.Context) error {
-	log.Printf("Initializing metadata table: %v: %v", lm.metadataTable)
+	log.Printf("Initializing metadata table: %s", lm.metadataTable)
 
 	// Check if table exists
 	_, err := lm.dynamodbClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
@@ -307,7 +358,7 @@ func (lm *KDSLeaseManager) InitializeMetadataTable(ctx context.Context) error {
 	})
 
 	if err == nil {
-		log.Printf("Metadata table already exists: %v: %v", lm.metadataTable)
+		log.Printf("Metadata table already exists: %s", lm.metadataTable)
 		return nil
 	}
 
@@ -342,7 +393,7 @@ func (lm *KDSLeaseManager) InitializeMetadataTable(ctx context.Context) error {
 			TableName: aws.String(lm.metadataTable),
 		})
 		if err == nil && desc.Table != nil && desc.Table.TableStatus == types.TableStatusActive {
-			log.Printf("Metadata table created successfully: %v: %v", lm.metadataTable)
+			log.Printf("Metadata table created successfully: %s", lm.metadataTable)
 			return nil
 		}
 		if time.Since(waitStart) > waitTimeout {
@@ -353,29 +404,20 @@ func (lm *KDSLeaseManager) InitializeMetadataTable(ctx context.Context) error {
 }
 
 // SaveMetadata saves the lease metadata to DynamoDB
-func (lm *KDSLeaseManager) SaveMetadata(ctx context.Context, metadata *LeaseMetadata) error {
+func (lm *KDSLeaseManager) SaveMetadata(ctx context.Context, metadata *leasemanager.Metadata) error {
 	metadata.LastUpdateTime = time.Now()
+	lm.checkWorkerIdentity(ctx)
 
-	item := map[string]types.AttributeValue{
-		"worker_id":             &types.AttributeValueMemberS{Value: metadata.WorkerID},
-		"max_leases_per_worker": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.MaxLeasesPerWorker)},
-		"stream_name":           &types.AttributeValueMemberS{Value: metadata.StreamName},
-		"app_name":              &types.AttributeValueMemberS{Value: metadata.AppName},
-		"last_update_time":      &types.AttributeValueMemberS{Value: metadata.LastUpdateTime.Format(time.RFC3339)},
-		"shard_count":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.ShardCount)},
-		"worker_count":          &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.WorkerCount)},
-	}
-
-	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(lm.metadataTable),
-		Item:      item,
-	})
+	item := leasemanager.Item(lm.keys().Worker(metadata.WorkerID), metadata)
+	timestampItem(item, metadata.LastUpdateTime)
+	lm.runtimeStatsItem(item)
+	lm.identityItem(item)
 
-	if err != nil {
-		return fmt.Errorf("failed to save metadata to DynamoDB: %w", err)
+	if err := lm.table().PutWorker(ctx, item); err != nil {
+		return err
 	}
 
-	log.Printf("Saved lease metadata to DynamoDB",
+	log.Printf("Saved lease metadata to DynamoDB: worker=%s maxLeases=%d table=%s",
 		metadata.WorkerID,
 		metadata.MaxLeasesPerWorker,
 		lm.metadataTable)
@@ -384,11 +426,11 @@ func (lm *KDSLeaseManager) SaveMetadata(ctx context.Context, metadata *LeaseMeta
 }
 
 // GetMetadata retrieves the lease metadata for this worker from DynamoDB
-func (lm *KDSLeaseManager) GetMetadata(ctx context.Context) (*LeaseMetadata, error) {
+func (lm *KDSLeaseManager) GetMetadata(ctx context.Context) (*leasemanager.Metadata, error) {
 	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(lm.metadataTable),
 		Key: map[string]types.AttributeValue{
-			"worker_id": &types.AttributeValueMemberS{Value: lm.workerID},
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(lm.workerID)},
 		},
 		ConsistentRead: aws.Bool(true),
 	})
@@ -401,86 +443,46 @@ func (lm *KDSLeaseManager) GetMetadata(ctx context.Context) (*LeaseMetadata, err
 		return nil, nil // No metadata exists yet
 	}
 
-	metadata := &LeaseMetadata{
-		WorkerID:   lm.workerID,
-		StreamName: lm.streamName,
-		AppName:    lm.appName,
-	}
-
-	if val, ok := result.Item["max_leases_per_worker"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			maxLeases, _ := strconv.Atoi(numVal.Value)
-			metadata.MaxLeasesPerWorker = maxLeases
-		}
-	}
-
-	if val, ok := result.Item["shard_count"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			shardCount, _ := strconv.Atoi(numVal.Value)
-			metadata.ShardCount = shardCount
-		}
-	}
-
-	if val, ok := result.Item["worker_count"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			workerCount, _ := strconv.Atoi(numVal.Value)
-			metadata.WorkerCount = workerCount
-		}
-	}
+	metadata := leasemanager.ParseWorker(result.Item, lm.keys().Worker(""))
+	metadata.WorkerID, metadata.StreamName, metadata.AppName = lm.workerID, lm.streamName, lm.appName
+	parseRuntimeStats(result.Item, metadata)
 
 	return metadata, nil
 }
 
-// getCoordinatorKey returns the coordinator key for this deployment/statefulset
-func (lm *KDSLeaseManager) getCoordinatorKey() string {
-	// Use app_name as coordinator key - all pods in same deployment/statefulset share the same app_name
-	return lm.appName + "_coordinator"
+// keys names the metadata rows of this worker's fleet
+func (lm *KDSLeaseManager) keys() leasemanager.Keys {
+	return leasemanager.Keys{App: lm.appName, Stream: lm.streamName, Region: lm.region, Group: lm.consumerGroup}
 }
 
-// GetCoordinatorMetadata retrieves the coordinator metadata (computed max leases)
-func (lm *KDSLeaseManager) GetCoordinatorMetadata(ctx context.Context) (*LeaseMetadata, error) {
-	coordinatorKey := lm.getCoordinatorKey()
-	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(lm.metadataTable),
-		Key: map[string]types.AttributeValue{
-			"worker_id": &types.AttributeValueMemberS{Value: coordinatorKey},
-		},
-		ConsistentRead: aws.Bool(true),
-	})
+// table reads and writes the fleet's rows in the metadata table
+func (lm *KDSLeaseManager) table() leasemanager.Table {
+	return leasemanager.Table{DB: lm.dynamodbClient, Name: lm.metadataTable, Keys: lm.keys()}
+}
 
+// GetCoordinatorMetadata retrieves the coordinator metadata (computed max leases)
+func (lm *KDSLeaseManager) GetCoordinatorMetadata(ctx context.Context) (*leasemanager.Metadata, error) {
+	metadata, err := lm.table().Coordinator(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get coordinator metadata from DynamoDB: %w", err)
-	}
-
-	if result.Item == nil {
-		return nil, nil // No coordinator metadata exists yet
-	}
-
-	metadata := &LeaseMetadata{
-		WorkerID:   coordinatorKey,
-		StreamName: lm.streamName,
-		AppName:    lm.appName,
-	}
-
-	if val, ok := result.Item["max_leases_per_worker"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			maxLeases, _ := strconv.Atoi(numVal.Value)
-			metadata.MaxLeasesPerWorker = maxLeases
+		if cached := lm.lastCoordinator.Load(); cached != nil && errors.Is(err, ErrCircuitOpen) {
+			log.Printf("WARN: Metadata store unavailable, using last known coordinator value (max leases %d)",
+				cached.MaxLeasesPerWorker)
+			copied := *cached
+			return &copied, nil
 		}
+		return nil, err
 	}
 
-	if val, ok := result.Item["shard_count"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			shardCount, _ := strconv.Atoi(numVal.Value)
-			metadata.ShardCount = shardCount
-		}
+	if metadata == nil {
+		return nil, nil // No coordinator metadata exists yet
 	}
 
-	if val, ok := result.Item["worker_count"]; ok {
-		if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-			workerCount, _ := strconv.Atoi(numVal.Value)
-			metadata.WorkerCount = workerCount
-		}
+	lm.observedWorkers.Store(int64(metadata.WorkerCount))
+	// An invalid value must not replace the last known good one
+	if leasemanager.ValidMaxLeases(metadata.MaxLeasesPerWorker) {
+		cached := *metadata
+		lm.saveCoordinatorCache(&cached, lm.lastCoordinator.Swap(&cached))
+		lm.notifyMaxLeases(&cached)
 	}
 
 	return metadata, nil
@@ -488,136 +490,206 @@ func (lm *KDSLeaseManager) GetCoordinatorMetadata(ctx context.Context) (*LeaseMe
 
 // UpdateCoordinatorMetadata updates existing coordinator metadata with new values
 // Uses conditional update to ensure the old values match (prevents race conditions)
-func (lm *KDSLeaseManager) UpdateCoordinatorMetadata(ctx context.Context, newMetadata *LeaseMetadata, expectedShardCount, expectedWorkerCount int) error {
-	coordinatorKey := lm.getCoordinatorKey()
-	newMetadata.WorkerID = coordinatorKey
-	newMetadata.LastUpdateTime = time.Now()
-
-	item := map[string]types.AttributeValue{
-		"worker_id":             &types.AttributeValueMemberS{Value: newMetadata.WorkerID},
-		"max_leases_per_worker": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", newMetadata.MaxLeasesPerWorker)},
-		"stream_name":           &types.AttributeValueMemberS{Value: newMetadata.StreamName},
-		"app_name":              &types.AttributeValueMemberS{Value: newMetadata.AppName},
-		"last_update_time":      &types.AttributeValueMemberS{Value: newMetadata.LastUpdateTime.Format(time.RFC3339)},
-		"shard_count":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", newMetadata.ShardCount)},
-		"worker_count":          &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", newMetadata.WorkerCount)},
-	}
-
+func (lm *KDSLeaseManager) UpdateCoordinatorMetadata(ctx context.Context, newMetadata *leasemanager.Metadata, expectedShardCount, expectedWorkerCount int) error {
 	// Use conditional update: only update if shard_count and worker_count still match expected values
 	// This prevents race conditions when multiple workers restart simultaneously
-	conditionExpr := "shard_count = :expected_shard_count AND worker_count = :expected_worker_count"
-	exprAttrValues := map[string]types.AttributeValue{
-		":expected_shard_count":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedShardCount)},
-		":expected_worker_count": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedWorkerCount)},
+	err := lm.writeCoordinator(ctx, newMetadata, func(item map[string]types.AttributeValue) error {
+		return lm.table().UpdateCoordinator(ctx, item, expectedShardCount, expectedWorkerCount)
+	})
+	if errors.Is(err, leasemanager.ErrCoordinatorChanged) {
+		log.Printf("Another worker already updated coordinator metadata with different values: key=%s",
+			lm.keys().Coordinator())
+		return nil // Not an error - another worker successfully updated
 	}
+	return err
+}
 
-	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName:                 aws.String(lm.metadataTable),
-		Item:                      item,
-		ConditionExpression:       aws.String(conditionExpr),
-		ExpressionAttributeValues: exprAttrValues,
-	})
+// writeCoordinator renders newMetadata as the coordinator row and stores it with put,
+// one of the table's conditional writes. leasemanager.ErrCoordinatorChanged is
+// returned as is when the condition failed.
+func (lm *KDSLeaseManager) writeCoordinator(ctx context.Context, newMetadata *leasemanager.Metadata, put func(item map[string]types.AttributeValue) error) error {
+	coordinatorKey := lm.keys().Coordinator()
+	newMetadata.WorkerID = coordinatorKey
+	newMetadata.LastUpdateTime = time.Now()
+
+	item := leasemanager.Item(coordinatorKey, newMetadata)
+	timestampItem(item, newMetadata.LastUpdateTime)
+	lm.streamIdentityItem(item)
 
+	err := put(item)
+	if errors.Is(err, leasemanager.ErrCoordinatorChanged) {
+		return err
+	}
 	if err != nil {
-		// Check if it's a conditional check failed error (another worker already updated it)
-		var condCheckErr *types.ConditionalCheckFailedException
-		if errors.As(err, &condCheckErr) {
-			log.Printf("Another worker already updated coordinator metadata with different values",
-				coordinatorKey)
-			return nil // Not an error - another worker successfully updated
-		}
 		return fmt.Errorf("failed to update coordinator metadata: %w", err)
 	}
 
-	log.Printf("Successfully updated coordinator metadata",
+	log.Printf("Successfully updated coordinator metadata: key=%s maxLeases=%d shards=%d workers=%d",
 		coordinatorKey,
 		newMetadata.MaxLeasesPerWorker,
 		newMetadata.ShardCount,
 		newMetadata.WorkerCount)
+	lm.isCoordinator.Store(true)
+	lm.notifyMaxLeases(newMetadata)
 	return nil
 }
 
 // TryCreateCoordinatorMetadata attempts to create coordinator metadata using conditional write
 // Returns true if this worker successfully became the coordinator, false otherwise
-func (lm *KDSLeaseManager) TryCreateCoordinatorMetadata(ctx context.Context, metadata *LeaseMetadata) (bool, error) {
-	coordinatorKey := lm.getCoordinatorKey()
+func (lm *KDSLeaseManager) TryCreateCoordinatorMetadata(ctx context.Context, metadata *leasemanager.Metadata) (bool, error) {
+	coordinatorKey := lm.keys().Coordinator()
 	metadata.WorkerID = coordinatorKey
 	metadata.LastUpdateTime = time.Now()
 
-	item := map[string]types.AttributeValue{
-		"worker_id":             &types.AttributeValueMemberS{Value: metadata.WorkerID},
-		"max_leases_per_worker": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.MaxLeasesPerWorker)},
-		"stream_name":           &types.AttributeValueMemberS{Value: metadata.StreamName},
-		"app_name":              &types.AttributeValueMemberS{Value: metadata.AppName},
-		"last_update_time":      &types.AttributeValueMemberS{Value: metadata.LastUpdateTime.Format(time.RFC3339)},
-		"shard_count":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.ShardCount)},
-		"worker_count":          &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.WorkerCount)},
-	}
+	item := leasemanager.Item(coordinatorKey, metadata)
+	timestampItem(item, metadata.LastUpdateTime)
+	lm.streamIdentityItem(item)
 
 	// Use conditional write: only create if item doesn't exist (attribute_not_exists)
-	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName:           aws.String(lm.metadataTable),
-		Item:                item,
-		ConditionExpression: aws.String("attribute_not_exists(worker_id)"),
-	})
-
+	err := lm.table().CreateCoordinator(ctx, item)
+	if errors.Is(err, leasemanager.ErrCoordinatorChanged) {
+		log.Printf("Another worker already created coordinator metadata, will use existing value: key=%s",
+			coordinatorKey)
+		return false, nil
+	}
 	if err != nil {
-		// Check if it's a conditional check failed error (another worker already created it)
-		var condCheckErr *types.ConditionalCheckFailedException
-		if errors.As(err, &condCheckErr) {
-			log.Printf("Another worker already created coordinator metadata, will use existing value",
-				coordinatorKey)
-			return false, nil
-		}
 		return false, fmt.Errorf("failed to create coordinator metadata: %w", err)
 	}
 
-	log.Printf("Successfully became coordinator and created metadata",
+	log.Printf("Successfully became coordinator and created metadata: key=%s maxLeases=%d",
 		coordinatorKey,
 		metadata.MaxLeasesPerWorker)
+	lm.isCoordinator.Store(true)
+	lm.notifyMaxLeases(metadata)
 	return true, nil
 }
 
 // InitializeMaxLeasesPerWorker is the main function that orchestrates the entire process
 // Only one worker per deployment/statefulset computes the value, others reuse it from DynamoDB
 // If shard count or worker count changes, it automatically recalculates and updates the coordinator
+// If the metadata store cannot be reached, the locally cached coordinator value is used,
+// then the configured fallback value
 func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (int, error) {
-	log.Printf("Initializing max leases per worker",
+	maxLeases, err := lm.resolveMaxLeasesPerWorker(ctx)
+	if err == nil || errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, ErrStreamRecreated) {
+		// A recreated stream needs the operator, not a value computed for the old one
+		lm.setInitialMaxLeases(maxLeases)
+		return maxLeases, err
+	}
+
+	cached, cacheErr := lm.loadCoordinatorCache()
+	if cacheErr != nil {
+		if lm.coordinatorCache != "" {
+			log.Printf("WARN: No usable cached coordinator value: %v", cacheErr)
+		}
+		if lm.fallbackMaxLeases <= 0 {
+			return 0, err
+		}
+		log.Printf("WARN: %v; starting with fallback maxLeases=%d, leases may be unevenly spread until restarted with the metadata table available",
+			err, lm.fallbackMaxLeases)
+		maxLeasesFallbackGauge.set(1, "source", "configured")
+		degradations.set(reasonMaxLeasesFallback, fmt.Sprintf("configured fallback maxLeases=%d: %v", lm.fallbackMaxLeases, err))
+		lm.reportPhase(InitPhaseCoordinatorResolved)
+		lm.setInitialMaxLeases(lm.fallbackMaxLeases)
+		return lm.fallbackMaxLeases, nil
+	}
+
+	log.Printf("WARN: %v; starting with cached coordinator value maxLeases=%d (saved %s)",
+		err, cached.MaxLeasesPerWorker, cached.SavedAt.Format(time.RFC3339))
+	lm.lastCoordinator.Store(&leasemanager.Metadata{
+		WorkerID:           lm.keys().Coordinator(),
+		MaxLeasesPerWorker: cached.MaxLeasesPerWorker,
+		StreamName:         lm.streamName,
+		AppName:            lm.appName,
+		ShardCount:         cached.ShardCount,
+		WorkerCount:        cached.WorkerCount,
+	})
+	lm.observedWorkers.Store(int64(cached.WorkerCount))
+	maxLeasesFallbackGauge.set(1, "source", "cache")
+	degradations.set(reasonMaxLeasesFallback, fmt.Sprintf("cached coordinator maxLeases=%d: %v", cached.MaxLeasesPerWorker, err))
+	lm.reportPhase(InitPhaseCoordinatorResolved)
+	lm.setInitialMaxLeases(cached.MaxLeasesPerWorker)
+	return cached.MaxLeasesPerWorker, nil
+}
+
+// activeWorkerCount is the worker count the shards are split over. Cordoned workers
+// are alive but take no leases, so the rest split the shards.
+func (lm *KDSLeaseManager) activeWorkerCount(ctx context.Context) (int, error) {
+	workers, err := lm.GetWorkerCount(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get worker count: %w", err)
+	}
+	if cordons, err := lm.CordonedWorkers(ctx); err != nil {
+		log.Printf("WARN: Failed to list cordoned workers, counting them: %v", err)
+	} else if len(cordons) > 0 && workers > len(cordons) {
+		log.Printf("Excluding %d cordoned workers from the worker count %d", len(cordons), workers)
+		workers -= len(cordons)
+	}
+	return workers, nil
+}
+
+// resolveMaxLeasesPerWorker reads, or as coordinator computes and stores, the max
+// leases per worker value in the metadata table
+func (lm *KDSLeaseManager) resolveMaxLeasesPerWorker(ctx context.Context) (int, error) {
+	log.Printf("Initializing max leases per worker: stream=%s app=%s group=%s worker=%s",
 		lm.streamName,
 		lm.appName,
+		lm.consumerGroup,
 		lm.workerID)
 
+	lm.isCoordinator.Store(false)
+
 	// 1. Initialize metadata table
 	if err := lm.InitializeMetadataTable(ctx); err != nil {
 		return 0, fmt.Errorf("failed to initialize metadata table: %w", err)
 	}
+	lm.reportPhase(InitPhaseTableReady)
+
+	// Carry rows written under the pre-namespacing keys over to the new keys
+	lm.migrateLegacyKeys(ctx)
 
 	// 2. Get current shard count and worker count
 	currentShardCount, err := lm.GetShardCount(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get shard count: %w", err)
 	}
+	if err := lm.loadStreamIdentity(ctx); err != nil {
+		log.Printf("WARN: Cannot detect stream recreation: %v", err)
+	}
 
-	currentWorkerCount, err := lm.GetWorkerCount(ctx)
+	currentWorkerCount, err := lm.activeWorkerCount(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get worker count: %w", err)
+		return 0, err
 	}
 
-	log.Printf("Retrieved current system state",
+	log.Printf("Retrieved current system state: shards=%d workers=%d",
 		currentShardCount,
 		currentWorkerCount)
 
 	// 3. Check if coordinator metadata already exists
 	coordinatorMetadata, err := lm.GetCoordinatorMetadata(ctx)
+	if err == nil && coordinatorMetadata != nil && lm.streamRecreated(coordinatorMetadata) {
+		// The metadata and checkpoints belong to shards of the deleted stream
+		if err := lm.resetForRecreatedStream(ctx, coordinatorMetadata); err != nil {
+			return 0, err
+		}
+		coordinatorMetadata = nil
+	}
 	if err != nil {
-		log.Printf("WARN: Failed to get coordinator metadata, will attempt to compute: %v: %v", err)
+		log.Printf("WARN: Failed to get coordinator metadata, will attempt to compute: %v", err)
 	} else if coordinatorMetadata != nil {
 		// Coordinator metadata exists - check if shard/worker counts have changed
 		configChanged := coordinatorMetadata.ShardCount != currentShardCount ||
 			coordinatorMetadata.WorkerCount != currentWorkerCount
+		if !leasemanager.ValidMaxLeases(coordinatorMetadata.MaxLeasesPerWorker) {
+			// A corrupt row is overwritten like a stale one
+			log.Printf("WARN: Coordinator metadata has invalid max leases %d (allowed 1-%d), recalculating",
+				coordinatorMetadata.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
+			configChanged = true
+		}
 
 		if configChanged {
-			log.Printf("Detected configuration change, recalculating max leases per worker",
+			log.Printf("Detected configuration change, recalculating max leases per worker: shards %d -> %d, workers %d -> %d (was maxLeases=%d)",
 				coordinatorMetadata.ShardCount,
 				currentShardCount,
 				coordinatorMetadata.WorkerCount,
@@ -628,8 +700,8 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 			newMaxLeasesPerWorker := lm.CalculateMaxLeasesPerWorker(currentShardCount, currentWorkerCount)
 
 			// Try to update coordinator metadata (race-safe)
-			updatedMetadata := &LeaseMetadata{
-				WorkerID:           lm.getCoordinatorKey(),
+			updatedMetadata := &leasemanager.Metadata{
+				WorkerID:           lm.keys().Coordinator(),
 				MaxLeasesPerWorker: newMaxLeasesPerWorker,
 				StreamName:         lm.streamName,
 				AppName:            lm.appName,
@@ -640,7 +712,7 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 			// Attempt to update - if another worker updates first, we'll read their value
 			err = lm.UpdateCoordinatorMetadata(ctx, updatedMetadata, coordinatorMetadata.ShardCount, coordinatorMetadata.WorkerCount)
 			if err != nil {
-				log.Printf("WARN: Failed to update coordinator metadata, will read latest value",
+				log.Printf("WARN: Failed to update coordinator metadata, will read latest value: %v",
 					err)
 				// Read the latest value (another worker may have updated it)
 				coordinatorMetadata, err = lm.GetCoordinatorMetadata(ctx)
@@ -648,19 +720,27 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 					return 0, fmt.Errorf("failed to get updated coordinator metadata: %w", err)
 				}
 			} else {
-				log.Printf("Successfully updated coordinator metadata with new configuration",
+				log.Printf("Successfully updated coordinator metadata with new configuration: maxLeases=%d",
 					newMaxLeasesPerWorker)
 				coordinatorMetadata = updatedMetadata
+				lm.ensureFleetCoverage(ctx, currentShardCount, currentWorkerCount, newMaxLeasesPerWorker)
 			}
 		} else {
-			log.Printf("Configuration unchanged, using existing coordinator metadata",
+			log.Printf("Configuration unchanged, using existing coordinator metadata: maxLeases=%d shards=%d workers=%d",
 				coordinatorMetadata.MaxLeasesPerWorker,
 				coordinatorMetadata.ShardCount,
 				coordinatorMetadata.WorkerCount)
+			lm.recordStreamIdentity(ctx, coordinatorMetadata)
+		}
+		if !leasemanager.ValidMaxLeases(coordinatorMetadata.MaxLeasesPerWorker) {
+			return 0, fmt.Errorf("coordinator metadata has invalid max leases %d (allowed 1-%d)",
+				coordinatorMetadata.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
 		}
 
+		lm.reportPhase(InitPhaseCoordinatorResolved)
+
 		// Save this worker's metadata for tracking
-		workerMetadata := &LeaseMetadata{
+		workerMetadata := &leasemanager.Metadata{
 			WorkerID:           lm.workerID,
 			MaxLeasesPerWorker: coordinatorMetadata.MaxLeasesPerWorker,
 			StreamName:         lm.streamName,
@@ -669,7 +749,7 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 			WorkerCount:        coordinatorMetadata.WorkerCount,
 		}
 		if err := lm.SaveMetadata(ctx, workerMetadata); err != nil {
-			log.Printf("WARN: Failed to save worker metadata, continuing with coordinator value: %v: %v", err)
+			log.Printf("WARN: Failed to save worker metadata, continuing with coordinator value: %v", err)
 		}
 
 		return coordinatorMetadata.MaxLeasesPerWorker, nil
@@ -682,8 +762,8 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 	maxLeasesPerWorker := lm.CalculateMaxLeasesPerWorker(currentShardCount, currentWorkerCount)
 
 	// 5. Try to create coordinator metadata (only one worker will succeed)
-	coordinatorMetadata = &LeaseMetadata{
-		WorkerID:           lm.getCoordinatorKey(),
+	coordinatorMetadata = &leasemanager.Metadata{
+		WorkerID:           lm.keys().Coordinator(),
 		MaxLeasesPerWorker: maxLeasesPerWorker,
 		StreamName:         lm.streamName,
 		AppName:            lm.appName,
@@ -705,18 +785,25 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 		if coordinatorMetadata == nil {
 			return 0, fmt.Errorf("coordinator metadata not found after creation attempt")
 		}
+		if !leasemanager.ValidMaxLeases(coordinatorMetadata.MaxLeasesPerWorker) {
+			return 0, fmt.Errorf("coordinator metadata has invalid max leases %d (allowed 1-%d)",
+				coordinatorMetadata.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
+		}
 		maxLeasesPerWorker = coordinatorMetadata.MaxLeasesPerWorker
-		log.Printf("Using coordinator metadata created by another worker",
+		log.Printf("Using coordinator metadata created by another worker: maxLeases=%d",
 			maxLeasesPerWorker)
 	} else {
-		log.Printf("Successfully computed and stored coordinator metadata",
+		log.Printf("Successfully computed and stored coordinator metadata: maxLeases=%d shards=%d workers=%d",
 			maxLeasesPerWorker,
 			currentShardCount,
 			currentWorkerCount)
+		lm.ensureFleetCoverage(ctx, currentShardCount, currentWorkerCount, maxLeasesPerWorker)
 	}
 
+	lm.reportPhase(InitPhaseCoordinatorResolved)
+
 	// 6. Save this worker's metadata for tracking
-	workerMetadata := &LeaseMetadata{
+	workerMetadata := &leasemanager.Metadata{
 		WorkerID:           lm.workerID,
 		MaxLeasesPerWorker: maxLeasesPerWorker,
 		StreamName:         lm.streamName,
@@ -725,68 +812,141 @@ func (lm *KDSLeaseManager) InitializeMaxLeasesPerWorker(ctx context.Context) (in
 		WorkerCount:        currentWorkerCount,
 	}
 	if err := lm.SaveMetadata(ctx, workerMetadata); err != nil {
-		log.Printf("WARN: Failed to save worker metadata, but continuing with computed value: %v: %v", err)
+		log.Printf("WARN: Failed to save worker metadata, but continuing with computed value: %v", err)
 	}
 
 	return maxLeasesPerWorker, nil
 }
 
-// ListAllWorkerMetadata retrieves metadata for all workers in the group
-func (lm *KDSLeaseManager) ListAllWorkerMetadata(ctx context.Context) ([]*LeaseMetadata, error) {
-	result, err := lm.dynamodbClient.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(lm.metadataTable),
-	})
+// ListAllWorkerMetadata retrieves metadata for all workers in the group. Each page is
+// retried; with partial reads allowed, the rows read before a page fails are returned
+// with a *PartialError.
+func (lm *KDSLeaseManager) ListAllWorkerMetadata(ctx context.Context) ([]*leasemanager.Metadata, error) {
+	workerPrefix := lm.keys().Worker("")
+	input := lm.table().WorkerScan()
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to scan metadata table: %w", err)
+	var items []map[string]types.AttributeValue
+	var scanErr error
+	for {
+		var result *dynamodb.ScanOutput
+		err := retryRead(ctx, func() (err error) {
+			result, err = lm.dynamodbClient.Scan(ctx, input)
+			return err
+		})
+		if err != nil {
+			// A Scan cannot continue past a page it failed to read
+			scanErr = fmt.Errorf("failed to scan metadata table: %w", err)
+			break
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
 	}
 
-	var metadataList []*LeaseMetadata
-	for _, item := range result.Items {
-		metadata := &LeaseMetadata{}
+	var metadataList []*leasemanager.Metadata
+	for _, item := range items {
+		metadataList = append(metadataList, parseWorkerMetadata(item, workerPrefix))
+	}
 
-		if val, ok := item["worker_id"]; ok {
-			if strVal, ok := val.(*types.AttributeValueMemberS); ok {
-				metadata.WorkerID = strVal.Value
-			}
+	if scanErr != nil {
+		if lm.allowPartialReads && len(metadataList) > 0 {
+			return metadataList, &PartialError{Read: len(metadataList), Failed: 1, Err: scanErr}
 		}
+		return nil, scanErr
+	}
+	return metadataList, nil
+}
 
-		if val, ok := item["max_leases_per_worker"]; ok {
-			if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-				maxLeases, _ := strconv.Atoi(numVal.Value)
-				metadata.MaxLeasesPerWorker = maxLeases
-			}
+// batchGetLimit is the most keys DynamoDB accepts in one BatchGetItem request
+const batchGetLimit = 100
+
+// GetWorkerMetadata reads the rows of the given workers with BatchGetItem, which costs
+// only the rows read rather than a full table Scan. Workers without a row are omitted.
+// With partial reads allowed, batches that fail after retries are skipped and reported
+// in a *PartialError.
+func (lm *KDSLeaseManager) GetWorkerMetadata(ctx context.Context, workerIDs []string) ([]*leasemanager.Metadata, error) {
+	workerPrefix := lm.keys().Worker("")
+	var metadataList []*leasemanager.Metadata
+	var failed int
+	var batchErr error
+
+batches:
+	for start := 0; start < len(workerIDs); start += batchGetLimit {
+		var keys []map[string]types.AttributeValue
+		for _, id := range workerIDs[start:min(start+batchGetLimit, len(workerIDs))] {
+			keys = append(keys, map[string]types.AttributeValue{
+				"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Worker(id)},
+			})
 		}
-
-		if val, ok := item["stream_name"]; ok {
-			if strVal, ok := val.(*types.AttributeValueMemberS); ok {
-				metadata.StreamName = strVal.Value
-			}
+		request := map[string]types.KeysAndAttributes{
+			lm.metadataTable: {Keys: keys, ConsistentRead: aws.Bool(true)},
 		}
 
-		if val, ok := item["app_name"]; ok {
-			if strVal, ok := val.(*types.AttributeValueMemberS); ok {
-				metadata.AppName = strVal.Value
+		// Throttled keys come back as UnprocessedKeys and are retried with backoff
+		backoff := 100 * time.Millisecond
+		for len(request) > 0 {
+			var result *dynamodb.BatchGetItemOutput
+			err := retryRead(ctx, func() (err error) {
+				result, err = lm.dynamodbClient.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+				return err
+			})
+			if err != nil {
+				failed++
+				batchErr = fmt.Errorf("failed to batch get worker metadata: %w", err)
+				if !lm.allowPartialReads {
+					return nil, batchErr
+				}
+				continue batches
 			}
-		}
-
-		if val, ok := item["shard_count"]; ok {
-			if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-				shardCount, _ := strconv.Atoi(numVal.Value)
-				metadata.ShardCount = shardCount
+			for _, item := range result.Responses[lm.metadataTable] {
+				metadataList = append(metadataList, parseWorkerMetadata(item, workerPrefix))
 			}
-		}
 
-		if val, ok := item["worker_count"]; ok {
-			if numVal, ok := val.(*types.AttributeValueMemberN); ok {
-				workerCount, _ := strconv.Atoi(numVal.Value)
-				metadata.WorkerCount = workerCount
+			request = result.UnprocessedKeys
+			if len(request) == 0 {
+				break
+			}
+			select {
+			case <-time.After(jitter(backoff, pollJitter)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
+			backoff = min(2*backoff, 5*time.Second)
 		}
-
-		metadataList = append(metadataList, metadata)
 	}
 
+	if failed > 0 {
+		if len(metadataList) == 0 {
+			return nil, batchErr
+		}
+		return metadataList, &PartialError{Read: len(metadataList), Failed: failed, Err: batchErr}
+	}
 	return metadataList, nil
 }
 
+// FleetWorkerMetadata returns the rows of the current fleet. When the pod names of
+// the fleet are known (StatefulSet ordinals) they are batch-read and exact is true;
+// otherwise every worker row in the group is scanned, including rows left behind by
+// pods that were scaled away.
+func (lm *KDSLeaseManager) FleetWorkerMetadata(ctx context.Context) (rows []*leasemanager.Metadata, exact bool, err error) {
+	if ids, err := lm.knownWorkerIDs(ctx); err == nil {
+		rows, err := lm.GetWorkerMetadata(ctx, ids)
+		exportClockSkew(rows)
+		return rows, true, err
+	}
+	rows, err = lm.ListAllWorkerMetadata(ctx)
+	exportClockSkew(rows)
+	return rows, false, err
+}
+
+// parseWorkerMetadata decodes a worker row, stripping workerPrefix from its key
+func parseWorkerMetadata(item map[string]types.AttributeValue, workerPrefix string) *leasemanager.Metadata {
+	metadata := leasemanager.ParseWorker(item, workerPrefix)
+	parseClockOffset(item, metadata)
+	parseRuntimeStats(item, metadata)
+	metadata.ProcessID = attrString(item, processIDKey)
+
+	return metadata
+}
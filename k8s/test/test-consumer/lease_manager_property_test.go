@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"pgregory.net/rapid"
+
+	"expr_mohan/leasemanager"
+)
+
+// The invariants of the lease math and of the lease protocol a pluggable assignment
+// strategy has to keep, checked against random inputs. A failure prints the shrunk
+// counterexample and the -rapid.failfile that replays it; -rapid.checks=5000 searches
+// further than the default 100 inputs.
+
+// genShards draws a shard count, mostly small, sometimes up to 5000
+func genShards(t *rapid.T) int {
+	return rapid.OneOf(rapid.IntRange(0, 200), rapid.IntRange(0, 200), rapid.IntRange(0, 200), rapid.IntRange(0, 5000)).Draw(t, "shards")
+}
+
+// genWorkers draws a worker count, mostly small, sometimes up to 500
+func genWorkers(t *rapid.T) int {
+	return rapid.OneOf(rapid.IntRange(1, 50), rapid.IntRange(1, 50), rapid.IntRange(1, 50), rapid.IntRange(1, 500)).Draw(t, "workers")
+}
+
+// genInputs draws expression inputs within a day of lag and any time of the week
+func genInputs(t *rapid.T, shards, workers int) LeaseExpressionInputs {
+	return LeaseExpressionInputs{Shards: shards, Workers: workers,
+		LagMillis: rapid.Int64Range(0, int64(24*time.Hour/time.Millisecond)).Draw(t, "lag_ms"),
+		Time:      time.Unix(rapid.Int64Range(0, 1<<31).Draw(t, "unix"), 0).UTC()}
+}
+
+// TestMaxLeasesCoverage: the built-in formula stays within [0, limit], is at least 1
+// while there are shards and leaves no shard unassigned when the fleet can hold them
+func TestMaxLeasesCoverage(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		shards, workers := genShards(t), genWorkers(t)
+		m := leasemanager.BuiltinMaxLeases(shards, workers)
+		switch {
+		case m < 0 || m > leasemanager.MaxLeasePerWorkerLimit:
+			t.Fatalf("max leases %d out of [0, %d]", m, leasemanager.MaxLeasePerWorkerLimit)
+		case shards > 0 && m < 1:
+			t.Fatalf("max leases %d leaves every shard unassigned", m)
+		case shards <= workers*leasemanager.MaxLeasePerWorkerLimit && workers*m < shards:
+			t.Fatalf("max leases %d leaves %d shards unassigned", m, shards-workers*m)
+		}
+	})
+}
+
+// TestMaxLeasesMonotonic: adding a worker never raises max leases, adding a shard
+// never lowers it
+func TestMaxLeasesMonotonic(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		shards, workers := genShards(t), genWorkers(t)
+		m := leasemanager.BuiltinMaxLeases(shards, workers)
+		if out := leasemanager.BuiltinMaxLeases(shards, workers+1); out > m {
+			t.Fatalf("max leases rose from %d to %d scaling out to %d workers", m, out, workers+1)
+		}
+		if up := leasemanager.BuiltinMaxLeases(shards+1, workers); up < m {
+			t.Fatalf("max leases fell from %d to %d resharding to %d shards", m, up, shards+1)
+		}
+	})
+}
+
+// TestDefaultExpression: the default expression evaluates like the built-in formula.
+// With no shards the expression clamps to 1 where the formula gives 0; both assign
+// nothing, so zero shards are left out.
+func TestDefaultExpression(t *testing.T) {
+	expr := mustCompileLeaseExpression(DefaultLeaseExpression)
+	rapid.Check(t, func(t *rapid.T) {
+		shards, workers := 1+genShards(t), genWorkers(t)
+		got, _, err := expr.EvaluateMaxLeases(genInputs(t, shards, workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := leasemanager.BuiltinMaxLeases(shards, workers); got != want {
+			t.Fatalf("expression gives %d, built-in formula %d", got, want)
+		}
+	})
+}
+
+// TestOperatorExpression checks KDS_MAX_LEASES_EXPR, when set, against the same
+// inputs: it stays within [1, limit] and gives the same result for the same inputs.
+//
+//	KDS_MAX_LEASES_EXPR='min(limit, ceil(1.5*shards/workers))' go test -run TestOperatorExpression
+func TestOperatorExpression(t *testing.T) {
+	src := os.Getenv("KDS_MAX_LEASES_EXPR")
+	if src == "" {
+		t.Skip("KDS_MAX_LEASES_EXPR is not set")
+	}
+	env, err := LoadLeaseExpressionEnv()
+	if err != nil {
+		t.Fatalf("failed to load lease expression variables: %v", err)
+	}
+	custom := env.CustomNames()
+	expr, err := CompileLeaseExpression(src, custom...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rapid.Check(t, func(t *rapid.T) {
+		in := genInputs(t, genShards(t), genWorkers(t))
+		in.Custom = make(map[string]float64, len(custom))
+		for _, name := range custom {
+			in.Custom[name] = float64(rapid.IntRange(0, 10).Draw(t, name))
+		}
+		m, _, err := expr.EvaluateMaxLeases(in)
+		if err != nil {
+			// CalculateMaxLeasesPerWorker falls back to the built-in formula
+			return
+		}
+		if m < 1 || m > leasemanager.MaxLeasePerWorkerLimit {
+			t.Fatalf("max leases %d out of [1, %d]", m, leasemanager.MaxLeasePerWorkerLimit)
+		}
+		if again, _, _ := expr.EvaluateMaxLeases(in); again != m {
+			t.Fatalf("max leases %d, then %d", m, again)
+		}
+	})
+}
+
+// TestLeaseSpread: the settled spread the simulator assumes respects the cap, holds
+// every shard the fleet can and differs by at most one lease between workers
+func TestLeaseSpread(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		shards, workers := genShards(t), genWorkers(t)
+		m := leasemanager.BuiltinMaxLeases(shards, workers)
+		if rapid.Bool().Draw(t, "any cap") {
+			m = rapid.IntRange(1, leasemanager.MaxLeasePerWorkerLimit).Draw(t, "max leases")
+		}
+		spread := leaseSpread(shards, workers, m)
+		sum, lo, hi := 0, spread[0], spread[0]
+		for _, held := range spread {
+			sum += held
+			lo, hi = min(lo, held), max(hi, held)
+		}
+		switch {
+		case hi > m:
+			t.Fatalf("a worker holds %d", hi)
+		case sum != min(shards, workers*m):
+			t.Fatalf("%d shards held", sum)
+		case hi-lo > 1:
+			t.Fatalf("workers hold %d to %d", lo, hi)
+		}
+		if moves := expectedMoves(shards, workers, m, shards, workers, m); moves != 0 {
+			t.Fatalf("%d moves without a change", moves)
+		}
+	})
+}
+
+// genFleet draws a fleet: open shards, some of them children of finished or trimmed
+// parents, and a lease table left behind by earlier workers
+func genFleet(t *rapid.T) *fleetModel {
+	f := &fleetModel{leases: map[string]*KCLLease{}, stealing: rapid.Bool().Draw(t, "stealing"), now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	open, workers := rapid.IntRange(0, 80).Draw(t, "open shards"), rapid.IntRange(1, 12).Draw(t, "workers")
+	for i := 0; i < workers; i++ {
+		f.workers = append(f.workers, fmt.Sprintf("consumer-pod-%d", i))
+	}
+	var parents []string
+	for i := rapid.IntRange(0, 5).Draw(t, "parents"); i > 0; i-- {
+		parentID := fmt.Sprintf("shardId-%012d", open+len(parents))
+		parents = append(parents, parentID)
+		// A trimmed parent is neither listed nor leased
+		if !rapid.Bool().Draw(t, "parent trimmed") {
+			f.shards = append(f.shards, kinesistypes.Shard{ShardId: aws.String(parentID)})
+			f.leases[parentID] = &KCLLease{ShardID: parentID, State: kclLeaseFinished, Checkpoint: kclShardEnd}
+		}
+	}
+	for i := 0; i < open; i++ {
+		shard := kinesistypes.Shard{ShardId: aws.String(fmt.Sprintf("shardId-%012d", i))}
+		if len(parents) > 0 && rapid.Bool().Draw(t, "child") {
+			shard.ParentShardId = aws.String(rapid.SampledFrom(parents).Draw(t, "parent"))
+		}
+		f.shards = append(f.shards, shard)
+		shardID := aws.ToString(shard.ShardId)
+		switch rapid.IntRange(0, 4).Draw(t, "lease") {
+		case 0:
+		case 1:
+			f.leases[shardID] = &KCLLease{ShardID: shardID, State: kclLeaseUnowned}
+		case 2:
+			// Left by a worker that is gone
+			f.leases[shardID] = &KCLLease{ShardID: shardID, State: kclLeaseExpired,
+				Owner: fmt.Sprintf("consumer-pod-%d", workers+rapid.IntRange(0, 2).Draw(t, "gone"))}
+		default:
+			f.leases[shardID] = &KCLLease{ShardID: shardID, State: kclLeaseOwned, Owner: rapid.SampledFrom(f.workers).Draw(t, "owner")}
+		}
+	}
+	f.maxLeases = leasemanager.BuiltinMaxLeases(open, workers)
+	if rapid.Bool().Draw(t, "any cap") {
+		// An expression may set any cap
+		f.maxLeases = rapid.IntRange(1, f.maxLeases+3).Draw(t, "max leases")
+	}
+	return f
+}
+
+// clone copies the fleet, so it can be settled again under other conditions
+func (f *fleetModel) clone() *fleetModel {
+	c := *f
+	c.shards = append([]kinesistypes.Shard(nil), f.shards...)
+	c.workers = append([]string(nil), f.workers...)
+	c.leases = make(map[string]*KCLLease, len(f.leases))
+	for shardID, lease := range f.leases {
+		copied := *lease
+		c.leases[shardID] = &copied
+	}
+	return &c
+}
+
+// checkSettled checks a settled fleet: every open shard is owned when the workers can
+// hold them all, and with stealing nobody holds more than an even share. Idle workers
+// do not see each other in the lease table, so the share is over the workers holding
+// leases plus one while any worker is idle.
+func (f *fleetModel) checkSettled() error {
+	open := f.openShards()
+	owned := 0
+	for _, shardID := range open {
+		if lease, ok := f.leases[shardID]; ok && lease.State == kclLeaseOwned {
+			owned++
+		} else if len(open) <= len(f.workers)*f.maxLeases {
+			return fmt.Errorf("shard %s unassigned with %d workers of max leases %d for %d shards", shardID, len(f.workers), f.maxLeases, len(open))
+		}
+	}
+	if !f.stealing {
+		return nil
+	}
+	visible := 0
+	for _, worker := range f.workers {
+		if len(f.held(worker)) > 0 {
+			visible++
+		}
+	}
+	if visible < len(f.workers) {
+		visible++
+	}
+	share := (owned + visible - 1) / visible
+	for _, worker := range f.workers {
+		if held := len(f.held(worker)); held > share {
+			return fmt.Errorf("%s holds %d leases, over the even share %d of %d", worker, held, share, owned)
+		}
+	}
+	return nil
+}
+
+// TestAssignmentCoverage: a settled fleet owns every open shard when the workers can
+// hold them, no worker exceeds the cap and, with stealing, nobody exceeds an even share
+func TestAssignmentCoverage(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		f := genFleet(t)
+		if err := f.settle(); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		if err := f.checkSettled(); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+	})
+}
+
+// TestAssignmentDeterminism: the same fleet settles to the same assignment whatever
+// order the lease table and the shard list come in
+func TestAssignmentDeterminism(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		f := genFleet(t)
+		shuffled := f.clone()
+		if err := f.settle(); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+
+		r := rand.New(rand.NewSource(rapid.Int64().Draw(t, "order")))
+		r.Shuffle(len(shuffled.shards), func(i, j int) { shuffled.shards[i], shuffled.shards[j] = shuffled.shards[j], shuffled.shards[i] })
+		shuffled.order = func(leases []KCLLease) {
+			r.Shuffle(len(leases), func(i, j int) { leases[i], leases[j] = leases[j], leases[i] })
+		}
+		if err := shuffled.settle(); err != nil {
+			t.Fatalf("%s, shuffled: %v", shuffled, err)
+		}
+		if a, b := f.assignment(), shuffled.assignment(); a != b {
+			t.Fatalf("%s: settled to\n  %s\nand shuffled to\n  %s", f, a, b)
+		}
+	})
+}
+
+// TestAssignmentScaling: with the built-in formula, adding a worker keeps every shard
+// owned and never raises the most leases a worker holds; removing it again, its leases
+// expiring, keeps every shard owned
+func TestAssignmentScaling(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		f := genFleet(t)
+		open := len(f.openShards())
+		f.maxLeases = leasemanager.BuiltinMaxLeases(open, len(f.workers))
+		if err := f.settle(); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		busiest := func() int {
+			most := 0
+			for _, worker := range f.workers {
+				most = max(most, len(f.held(worker)))
+			}
+			return most
+		}
+		before := busiest()
+
+		f.workers = append(f.workers, fmt.Sprintf("consumer-pod-%d", len(f.workers)))
+		f.maxLeases = leasemanager.BuiltinMaxLeases(open, len(f.workers))
+		if err := f.settle(); err != nil {
+			t.Fatalf("%s, scaled out: %v", f, err)
+		}
+		if err := f.checkSettled(); err != nil {
+			t.Fatalf("%s, scaled out: %v", f, err)
+		}
+		if after := busiest(); after > before {
+			t.Fatalf("%s: the busiest worker went from %d to %d leases scaling out", f, before, after)
+		}
+
+		gone := f.workers[len(f.workers)-1]
+		f.workers = f.workers[:len(f.workers)-1]
+		for _, lease := range f.leases {
+			if lease.State == kclLeaseOwned && lease.Owner == gone {
+				lease.State = kclLeaseExpired
+			}
+		}
+		f.maxLeases = leasemanager.BuiltinMaxLeases(open, len(f.workers))
+		if err := f.settle(); err != nil {
+			t.Fatalf("%s, scaled in: %v", f, err)
+		}
+		if err := f.checkSettled(); err != nil {
+			t.Fatalf("%s, scaled in: %v", f, err)
+		}
+	})
+}
+
+// malformedValues are attribute values a hand-edited row may hold
+var malformedValues = []string{"", "0", "-1", "81", "12", "1.5", "NaN", "-Inf", "+Inf", "1e309",
+	"99999999999999999999", "abc", "2024-01-01T00:00:00Z", "2024-13-45T99:99:99Z", "\x00\xff", "shardId-000000000000"}
+
+// genMalformed draws one of malformedValues or arbitrary bytes
+func genMalformed(t *rapid.T, label string) string {
+	bytes := rapid.Map(rapid.SliceOfN(rapid.Byte(), 0, 15), func(b []byte) string { return string(b) })
+	return rapid.OneOf(rapid.SampledFrom(malformedValues), rapid.SampledFrom(malformedValues), rapid.SampledFrom(malformedValues), bytes).Draw(t, label)
+}
+
+// genAttribute wraps a malformed value in any attribute type, not necessarily the
+// expected one
+func genAttribute(t *rapid.T, label string) types.AttributeValue {
+	v := genMalformed(t, label)
+	switch rapid.IntRange(0, 4).Draw(t, label+" type") {
+	case 0:
+		return &types.AttributeValueMemberS{Value: v}
+	case 1:
+		return &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			v: &types.AttributeValueMemberN{Value: genMalformed(t, label+" entry")}, "shardId-000000000000": &types.AttributeValueMemberS{Value: v}}}
+	case 2:
+		return &types.AttributeValueMemberBOOL{Value: true}
+	}
+	return &types.AttributeValueMemberN{Value: v}
+}
+
+// TestMalformedWorkerRow: a worker row with arbitrary values and types parses, and
+// the lease table views render it, without failing; rates stay finite so the JSON
+// views can encode them
+func TestMalformedWorkerRow(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		item := map[string]types.AttributeValue{}
+		for _, key := range []string{"worker_id", "max_leases_per_worker", "stream_name", "app_name", "shard_count",
+			"worker_count", leasemanager.LastUpdateKey, leasemanager.LastUpdateMillisKey, clockOffsetKey, startedAtKey, leasesHeldKey, recordsPerSecondKey, lagMillisKey, shardRecordsKey,
+			kinesisCallsKey, processIDKey} {
+			if rapid.IntRange(0, 3).Draw(t, key+" set") > 0 {
+				item[key] = genAttribute(t, key)
+			}
+		}
+		m := parseWorkerMetadata(item, "app#stream#")
+
+		view := &LeaseTableView{LeaseTable: "leases", Coordinator: m.MaxLeasesPerWorker,
+			Owners: []LeaseOwner{{WorkerID: m.WorkerID, MaxLeases: m.MaxLeasesPerWorker, RecordsPerSecond: m.RecordsPerSecond,
+				LagMillis: m.LagMillis, StartedAt: m.StartedAt, LastUpdate: m.LastUpdateTime, Registered: true,
+				KinesisCallsPerMinute: m.KinesisCallsPerMinute}}}
+		for op, n := range m.KinesisCallsPerMinute {
+			if n < 0 {
+				t.Fatalf("%s: %d %s calls per minute", describeItem(item), n, op)
+			}
+		}
+		for shardID, rate := range m.ShardRecordsPerSecond {
+			rate := rate
+			view.Leases = append(view.Leases, KCLLease{ShardID: shardID, State: kclLeaseOwned, Owner: m.WorkerID, RecordsPerSecond: &rate})
+		}
+		for _, format := range []string{viewFormatTable, viewFormatJSON, viewFormatHeatmap, viewFormatHTML} {
+			if err := renderLeaseTableView(io.Discard, view, format); err != nil {
+				t.Fatalf("%s: %s view: %v", describeItem(item), format, err)
+			}
+		}
+	})
+}
+
+// describeItem renders an item as sorted name=type:value pairs
+func describeItem(item map[string]types.AttributeValue) string {
+	names := make([]string, 0, len(item))
+	for name := range item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		switch v := item[name].(type) {
+		case *types.AttributeValueMemberS:
+			parts = append(parts, fmt.Sprintf("%s=S:%q", name, v.Value))
+		case *types.AttributeValueMemberN:
+			parts = append(parts, fmt.Sprintf("%s=N:%q", name, v.Value))
+		case *types.AttributeValueMemberM:
+			parts = append(parts, fmt.Sprintf("%s=M:{%s}", name, describeItem(v.Value)))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%T", name, v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestMalformedExpression: arbitrary sources either fail to compile or evaluate to a
+// clamped value or an error, for any inputs
+func TestMalformedExpression(t *testing.T) {
+	tokens := []string{"shards", "workers", "limit", "lag_ms", "hour", "weekday", "x", "min", "max", "ceil", "if", "abs",
+		"(", ")", ",", "+", "-", "*", "/", "%", "<", "==", "&&", "||", "!", "0", "1.5", ".", "1e3", " ", "é"}
+	rapid.Check(t, func(t *rapid.T) {
+		src := strings.Join(rapid.SliceOfN(rapid.SampledFrom(tokens), 0, 24).Draw(t, "tokens"), "")
+		expr, err := CompileLeaseExpression(src, "x")
+		if err != nil {
+			return
+		}
+		in := LeaseExpressionInputs{Shards: rapid.IntRange(0, 1<<20).Draw(t, "shards"), Workers: rapid.IntRange(-1, 1<<10).Draw(t, "workers"),
+			LagMillis: rapid.Int64().Draw(t, "lag_ms"), Time: time.Unix(rapid.Int64Range(0, 1<<33).Draw(t, "unix"), 0),
+			Custom: map[string]float64{"x": rapid.Float64().Draw(t, "x")}}
+		m, _, err := expr.EvaluateMaxLeases(in)
+		if err == nil && (m < 1 || m > leasemanager.MaxLeasePerWorkerLimit) {
+			t.Fatalf("%q with %+v: max leases %d out of [1, %d]", expr, in, m, leasemanager.MaxLeasePerWorkerLimit)
+		}
+	})
+}
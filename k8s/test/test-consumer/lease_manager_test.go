@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// fuzzAttribute wraps v in the attribute type selected by the low two bits of kind:
+// a number, a string, a map holding v, or nothing, so a fuzzed row mixes the types a
+// hand-edited row may hold
+func fuzzAttribute(item map[string]types.AttributeValue, name, v string, kind uint32) {
+	switch kind & 3 {
+	case 0:
+		item[name] = &types.AttributeValueMemberN{Value: v}
+	case 1:
+		item[name] = &types.AttributeValueMemberS{Value: v}
+	case 2:
+		item[name] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			v: &types.AttributeValueMemberN{Value: v}}}
+	}
+}
+
+func FuzzParseWorkerMetadata(f *testing.F) {
+	f.Add("app#stream#us-east-1#worker#pod-0", "10", "20", "2", "2024-01-01T00:00:00Z", "12.5", "300", "shardId-000000000000", "4.5", uint32(0x1100))
+	f.Add("pod-1", "-1", "abc", "", "2024-13-45T99:99:99Z", "NaN", "99999999999999999999", "", "+Inf", uint32(0))
+	f.Add("\x00\xff", "81", "1e309", "0", "", "-Inf", "-1", "shardId-000000000001", "1.5", uint32(0xffffffff))
+	f.Add("", "1.5", "-0", "12", "1700000000000", "0", "0", "x", "NaN", uint32(0x5555))
+
+	f.Fuzz(func(t *testing.T, workerID, maxLeases, shards, workers, startedAt, rate, lag, shardID, shardRate string, kinds uint32) {
+		item := map[string]types.AttributeValue{}
+		fuzzAttribute(item, "worker_id", workerID, kinds^1)
+		fuzzAttribute(item, "max_leases_per_worker", maxLeases, kinds>>2)
+		fuzzAttribute(item, "shard_count", shards, kinds>>4)
+		fuzzAttribute(item, "worker_count", workers, kinds>>6)
+		fuzzAttribute(item, leasemanager.LastUpdateKey, startedAt, kinds>>8)
+		fuzzAttribute(item, startedAtKey, startedAt, (kinds>>10)^1)
+		fuzzAttribute(item, recordsPerSecondKey, rate, kinds>>12)
+		fuzzAttribute(item, lagMillisKey, lag, kinds>>14)
+		fuzzAttribute(item, leasesHeldKey, maxLeases, kinds>>16)
+		fuzzAttribute(item, processIDKey, workerID, (kinds>>18)^1)
+		if kinds>>20&1 == 0 {
+			item[shardRecordsKey] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+				shardID: &types.AttributeValueMemberN{Value: shardRate}}}
+		}
+
+		m := parseWorkerMetadata(item, "app#stream#us-east-1#worker#")
+
+		view := &LeaseTableView{LeaseTable: "leases", Coordinator: m.MaxLeasesPerWorker,
+			Owners: []LeaseOwner{{WorkerID: m.WorkerID, MaxLeases: m.MaxLeasesPerWorker, RecordsPerSecond: m.RecordsPerSecond,
+				LagMillis: m.LagMillis, StartedAt: m.StartedAt, LastUpdate: m.LastUpdateTime, Registered: true}}}
+		for id, rate := range m.ShardRecordsPerSecond {
+			rate := rate
+			view.Leases = append(view.Leases, KCLLease{ShardID: id, State: kclLeaseOwned, Owner: m.WorkerID, RecordsPerSecond: &rate})
+		}
+		for _, format := range []string{viewFormatTable, viewFormatJSON, viewFormatHeatmap, viewFormatHTML} {
+			if err := renderLeaseTableView(io.Discard, view, format); err != nil {
+				t.Errorf("%s view of %+v: %v", format, m, err)
+			}
+		}
+	})
+}
+
+func FuzzCoordinatorMetadata(f *testing.F) {
+	f.Add("10", "20", "2", "2024-01-01T00:00:00Z", uint32(0x100))
+	f.Add("-1", "abc", "", "not a time", uint32(0))
+	f.Add("81", "1e309", "0", "", uint32(0xff))
+	f.Add("99999999999999999999", "-5", "1.5", "2024-01-01T00:00:00+14:00", uint32(0x155))
+
+	lm := &KDSLeaseManager{region: "us-east-1", streamName: "stream", appName: "app", consumerGroup: leasemanager.DefaultConsumerGroup}
+	f.Fuzz(func(t *testing.T, maxLeases, shards, workers, createdAt string, kinds uint32) {
+		item := map[string]types.AttributeValue{"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Coordinator()}}
+		fuzzAttribute(item, "max_leases_per_worker", maxLeases, kinds)
+		fuzzAttribute(item, "shard_count", shards, kinds>>2)
+		fuzzAttribute(item, "worker_count", workers, kinds>>4)
+		fuzzAttribute(item, leasemanager.StreamCreatedAtKey, createdAt, kinds>>6)
+
+		m := leasemanager.ParseCoordinator(lm.keys(), item)
+		if m.WorkerID != lm.keys().Coordinator() || m.AppName != "app" || m.StreamName != "stream" {
+			t.Fatalf("coordinator identity not kept: %+v", m)
+		}
+		// A well-formed value reads back as written; anything else must fail validation
+		// rather than reach the workers as a cap
+		want, err := strconv.Atoi(maxLeases)
+		switch {
+		case kinds&3 == 0 && err == nil:
+			if m.MaxLeasesPerWorker != want {
+				t.Fatalf("max leases %q read as %d", maxLeases, m.MaxLeasesPerWorker)
+			}
+		case leasemanager.ValidMaxLeases(m.MaxLeasesPerWorker):
+			t.Fatalf("malformed max leases %q (kind %d) read as valid %d", maxLeases, kinds&3, m.MaxLeasesPerWorker)
+		}
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"expr_mohan/leasemanager"
+)
+
+// kclClaimRequestKey names the worker asking to steal a lease from its owner
+const kclClaimRequestKey = "ClaimRequest"
+
+// KCL lease states, as counted in KCLLeaseSummary
+const (
+	kclLeaseOwned    = "owned"
+	kclLeaseUnowned  = "unowned"
+	kclLeaseExpired  = "expired"
+	kclLeaseFinished = "finished"
+)
+
+// kclLeaseState classifies a lease table row
+func kclLeaseState(owner, checkpoint string, timeout, now time.Time) string {
+	switch {
+	case checkpoint == kclShardEnd:
+		return kclLeaseFinished
+	case owner == "":
+		return kclLeaseUnowned
+	case !timeout.IsZero() && timeout.Before(now):
+		return kclLeaseExpired
+	default:
+		return kclLeaseOwned
+	}
+}
+
+// KCLLease is one row of the vmware-go-kcl lease table. The library keeps no lease
+// counter: ownership is the owner plus a timeout it renews.
+type KCLLease struct {
+	ShardID       string    `json:"shard_id"`
+	State         string    `json:"state"`
+	Owner         string    `json:"owner,omitempty"`
+	LeaseTimeout  time.Time `json:"lease_timeout"`
+	Checkpoint    string    `json:"checkpoint,omitempty"`
+	ParentShardID string    `json:"parent_shard_id,omitempty"`
+	ClaimRequest  string    `json:"claim_request,omitempty"`
+	// RecordsPerSecond is the rate the owner's worker row reports for the shard, nil
+	// when the owner does not report one
+	RecordsPerSecond *float64 `json:"records_per_second,omitempty"`
+
+	// rawLeaseTimeout is LeaseTimeout as stored, for conditional writes
+	rawLeaseTimeout string
+}
+
+// LeaseOwner correlates a worker holding leases, or having a metadata row, with that row
+type LeaseOwner struct {
+	WorkerID string `json:"worker_id"`
+	Leases   int    `json:"leases"`
+	// Expired counts leases still assigned to the worker but past their timeout
+	Expired int `json:"expired"`
+	// MaxLeases, LastUpdate and the runtime stats come from the worker row; Registered
+	// is false without one
+	MaxLeases        int       `json:"max_leases,omitempty"`
+	LastUpdate       time.Time `json:"last_update"`
+	RecordsPerSecond float64   `json:"records_per_second"`
+	LagMillis        int64     `json:"lag_ms"`
+	StartedAt        time.Time `json:"started_at"`
+	Registered       bool      `json:"registered"`
+	Cordoned         bool      `json:"cordoned"`
+	// KinesisCallsPerMinute is the worker's Kinesis requests in the last full minute
+	KinesisCallsPerMinute map[string]int `json:"kinesis_calls_per_minute,omitempty"`
+	// ClockOffsetMillis is how far the worker's clock runs ahead of AWS
+	ClockOffsetMillis int64 `json:"clock_offset_ms"`
+}
+
+// heartbeatAge is how long ago the worker row was last updated, corrected for the
+// clocks of the worker and of this process
+func (o LeaseOwner) heartbeatAge(now time.Time) time.Duration {
+	return heartbeatAge(now, o.LastUpdate, time.Duration(o.ClockOffsetMillis)*time.Millisecond)
+}
+
+// LeaseTableView is who owns what: every lease and every owner
+type LeaseTableView struct {
+	LeaseTable  string       `json:"lease_table"`
+	ObservedAt  time.Time    `json:"observed_at"`
+	Coordinator int          `json:"coordinator_max_leases,omitempty"`
+	Leases      []KCLLease   `json:"leases"`
+	Owners      []LeaseOwner `json:"owners"`
+	// Partial is set when only some worker rows could be read
+	Partial string `json:"partial,omitempty"`
+}
+
+// ListKCLLeases reads every row of the KCL lease table, sorted by shard
+func (lm *KDSLeaseManager) ListKCLLeases(ctx context.Context, leaseTable string) ([]KCLLease, error) {
+	now := time.Now()
+	leases := []KCLLease{}
+	input := &dynamodb.ScanInput{TableName: aws.String(leaseTable)}
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lease table %s: %w", leaseTable, err)
+		}
+		for _, item := range result.Items {
+			lease := KCLLease{
+				ShardID:       attrString(item, kclLeaseKeyKey),
+				Owner:         attrString(item, kclLeaseOwnerKey),
+				Checkpoint:    attrString(item, kclCheckpointKey),
+				ParentShardID: attrString(item, kclParentShardKey),
+				ClaimRequest:  attrString(item, kclClaimRequestKey),
+
+				rawLeaseTimeout: attrString(item, kclLeaseTimeoutKey),
+			}
+			lease.LeaseTimeout, _ = time.Parse(time.RFC3339, lease.rawLeaseTimeout)
+			lease.State = kclLeaseState(lease.Owner, lease.Checkpoint, lease.LeaseTimeout, now)
+			leases = append(leases, lease)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ShardID < leases[j].ShardID })
+	return leases, nil
+}
+
+// ViewLeaseTable joins the lease table with the worker rows, cordons and coordinator
+func (lm *KDSLeaseManager) ViewLeaseTable(ctx context.Context, leaseTable string) (*LeaseTableView, error) {
+	view := &LeaseTableView{LeaseTable: leaseTable, ObservedAt: time.Now()}
+	var err error
+	if view.Leases, err = lm.ListKCLLeases(ctx, leaseTable); err != nil {
+		return nil, err
+	}
+	coordinator, err := lm.GetCoordinatorMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if coordinator != nil {
+		view.Coordinator = coordinator.MaxLeasesPerWorker
+	}
+	workers, _, err := lm.FleetWorkerMetadata(ctx)
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		view.Partial = partial.Error()
+	} else if err != nil {
+		return nil, err
+	}
+	cordons, err := lm.CordonedWorkers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]*LeaseOwner{}
+	owner := func(workerID string) *LeaseOwner {
+		if owners[workerID] == nil {
+			owners[workerID] = &LeaseOwner{WorkerID: workerID}
+		}
+		return owners[workerID]
+	}
+	for _, lease := range view.Leases {
+		switch lease.State {
+		case kclLeaseOwned:
+			owner(lease.Owner).Leases++
+		case kclLeaseExpired:
+			owner(lease.Owner).Expired++
+		}
+	}
+	rows := make(map[string]*leasemanager.Metadata, len(workers))
+	for _, row := range workers {
+		rows[row.WorkerID] = row
+		o := owner(row.WorkerID)
+		o.Registered = true
+		o.MaxLeases = row.MaxLeasesPerWorker
+		o.LastUpdate = row.LastUpdateTime
+		o.RecordsPerSecond, o.LagMillis, o.StartedAt = row.RecordsPerSecond, row.LagMillis, row.StartedAt
+		o.KinesisCallsPerMinute = row.KinesisCallsPerMinute
+		o.ClockOffsetMillis = row.ClockOffset.Milliseconds()
+	}
+	for _, c := range cordons {
+		owner(c.WorkerID).Cordoned = true
+	}
+	for i := range view.Leases {
+		lease := &view.Leases[i]
+		if row := rows[lease.Owner]; row != nil && lease.State == kclLeaseOwned {
+			if rate, ok := row.ShardRecordsPerSecond[lease.ShardID]; ok {
+				lease.RecordsPerSecond = &rate
+			}
+		}
+	}
+	view.Owners = make([]LeaseOwner, 0, len(owners))
+	for _, o := range owners {
+		view.Owners = append(view.Owners, *o)
+	}
+	sort.Slice(view.Owners, func(i, j int) bool { return view.Owners[i].WorkerID < view.Owners[j].WorkerID })
+	return view, nil
+}
+
+// printLeaseTableView pretty-prints the leases, then the owners
+func printLeaseTableView(out io.Writer, view *LeaseTableView) {
+	now := time.Now()
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARD\tSTATE\tOWNER\tRECORDS/S\tLEASE EXPIRES\tCHECKPOINT\tPARENT\tCLAIM REQUEST")
+	for _, lease := range view.Leases {
+		expires, rate := "-", "-"
+		if !lease.LeaseTimeout.IsZero() {
+			expires = lease.LeaseTimeout.Sub(now).Round(time.Second).String()
+		}
+		if lease.RecordsPerSecond != nil {
+			rate = fmt.Sprintf("%.1f", *lease.RecordsPerSecond)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", lease.ShardID, lease.State, dash(lease.Owner),
+			rate, expires, dash(lease.Checkpoint), dash(lease.ParentShardID), dash(lease.ClaimRequest))
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%s: %d leases, coordinator max leases %d\n", view.LeaseTable, len(view.Leases), view.Coordinator)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tLEASES\tEXPIRED\tMAX LEASES\tRECORDS/S\tLAG\tKINESIS CALLS/MIN\tUPTIME\tLAST UPDATE\tREGISTERED\tCORDONED")
+	for _, o := range view.Owners {
+		lastUpdate, uptime := "-", "-"
+		if !o.LastUpdate.IsZero() {
+			lastUpdate = o.heartbeatAge(now).Round(time.Second).String() + " ago"
+		}
+		if !o.StartedAt.IsZero() {
+			uptime = now.Sub(o.StartedAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%s\t%d\t%s\t%s\t%t\t%t\n", o.WorkerID, o.Leases, o.Expired, o.MaxLeases,
+			o.RecordsPerSecond, time.Duration(o.LagMillis)*time.Millisecond, totalCalls(o.KinesisCallsPerMinute),
+			uptime, lastUpdate, o.Registered, o.Cordoned)
+	}
+	w.Flush()
+	if view.Partial != "" {
+		fmt.Fprintf(os.Stderr, "WARN: %s\n", view.Partial)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runLeasesCommand implements "leases [table|json|heatmap|html]": a table of every KCL
+// lease and its owner's metadata, the same as JSON for scripts, or the shard to worker
+// mapping as a text or HTML heatmap, see distribution.go
+func runLeasesCommand(ctx context.Context, cfg appConfig, args []string) int {
+	format := viewFormatTable
+	if len(args) == 1 {
+		format = args[0]
+	}
+	switch {
+	case len(args) > 1,
+		format != viewFormatTable && format != viewFormatJSON && format != viewFormatHeatmap && format != viewFormatHTML:
+		fmt.Fprintln(os.Stderr, "usage: leases [table|json|heatmap|html]")
+		return 2
+	}
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// A browser is read-only; show what could be read
+	lm.SetAllowPartialReads(true)
+	view, err := lm.ViewLeaseTable(ctx, getEnv("KDS_KCL_LEASE_TABLE", cfg.appName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := renderLeaseTableView(os.Stdout, view, format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis"
 )
@@ -29,8 +29,72 @@ type dynamodbClient struct {
 var (
 	isHealthy atomic.Bool
 	isReady   atomic.Bool
+
+	startup = newStartupTracker(phaseConfigLoaded, phaseAWSConfigLoaded, phaseTableReady, phaseCoordinatorResolved, phaseWorkerStarted)
 )
 
+// appConfig holds the settings read from the environment
+type appConfig struct {
+	region        string
+	streamName    string
+	appName       string
+	workerID      string
+	endpoint      string
+	enableDynamic bool
+}
+
+// startupConfig is the optional configuration parsed in the config_loaded phase,
+// before any client exists, so a typo fails the pod without touching AWS
+type startupConfig struct {
+	failover          *streamFailover
+	encryption        *encryptionPolicy
+	workerCounter     WorkerCountProvider
+	leaseExpr         *LeaseExpression
+	leaseExprEnv      LeaseExpressionEnv
+	fleetScaler       *fleetScaler
+	fallbackMaxLeases int
+}
+
+func loadStartupConfig(cfg appConfig) (*startupConfig, error) {
+	var sc startupConfig
+	var err error
+	if sc.failover, err = newStreamFailoverFromEnv(cfg.endpoint); err != nil {
+		return nil, fmt.Errorf("failed to configure stream failover: %w", err)
+	}
+	if sc.encryption, err = encryptionPolicyFromEnv(); err != nil {
+		return nil, fmt.Errorf("failed to configure encryption verification: %w", err)
+	}
+	if sc.workerCounter, err = newWorkerCountProviderFromEnv(cfg.appName, cfg.streamName, cfg.workerID); err != nil {
+		return nil, fmt.Errorf("failed to configure worker count provider: %w", err)
+	}
+	if exprSource := os.Getenv("KDS_MAX_LEASES_EXPR"); exprSource != "" {
+		if sc.leaseExprEnv, err = LoadLeaseExpressionEnv(); err != nil {
+			return nil, fmt.Errorf("failed to load lease expression variables: %w", err)
+		}
+		if sc.leaseExpr, err = CompileLeaseExpression(exprSource, sc.leaseExprEnv.CustomNames()...); err != nil {
+			return nil, fmt.Errorf("failed to compile KDS_MAX_LEASES_EXPR: %w", err)
+		}
+	}
+	if sc.fleetScaler, err = newFleetScalerFromEnv(); err != nil {
+		return nil, fmt.Errorf("failed to configure fleet autoscaling: %w", err)
+	}
+	if sc.fallbackMaxLeases, err = fallbackMaxLeasesFromEnv(); err != nil {
+		return nil, fmt.Errorf("failed to configure fallback max leases: %w", err)
+	}
+	return &sc, nil
+}
+
+func loadAppConfig() appConfig {
+	return appConfig{
+		region:        getEnv("AWS_REGION", "us-east-1"),
+		streamName:    getEnv("STREAM_NAME", "test-stream"),
+		appName:       getEnv("APP_NAME", "kds-consumer-app"),
+		workerID:      getEnv("HOSTNAME", "worker-unknown"),
+		endpoint:      os.Getenv("AWS_ENDPOINT_URL"),
+		enableDynamic: getEnv("ENABLE_DYNAMIC_MAX_LEASES", "true") == "true",
+	}
+}
+
 func init() {
 	isHealthy.Store(true)
 	isReady.Store(false)
@@ -43,67 +107,337 @@ func main() {
 	defer cancel()
 
 	// Get configuration from environment
-	region := getEnv("AWS_REGION", "us-east-1")
-	streamName := getEnv("STREAM_NAME", "test-stream")
-	appName := getEnv("APP_NAME", "kds-consumer-app")
-	workerID := getEnv("HOSTNAME", "worker-unknown")
-	endpoint := os.Getenv("AWS_ENDPOINT_URL")
-	enableDynamic := getEnv("ENABLE_DYNAMIC_MAX_LEASES", "true") == "true"
-
+	cfg := loadAppConfig()
 	log.Printf("Configuration: region=%s, stream=%s, app=%s, worker=%s, endpoint=%s, dynamic=%v",
-		region, streamName, appName, workerID, endpoint, enableDynamic)
+		cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint, cfg.enableDynamic)
+
+	// Subcommands: "preflight" verifies permissions and connectivity, "canary" manages
+	// candidate lease values, "gameday" reshards the stream and verifies convergence
+	// in non-prod accounts, "observe" exports fleet status read-only, "checkpoints"
+	// exports and imports KCL checkpoints, "rbac" prints the minimal Role needed for
+	// Kubernetes worker count lookups, "drain" asks the running worker to release its
+	// leases and deregister (preStop hook), "cordon" and "uncordon" mark a worker to
+	// hand its leases to peers while it stays up, "estop" engages or releases the
+	// fleet-wide emergency stop, "leases" prints who owns which KCL lease, "check" flags
+	// disagreements between the lease table, metadata and stream, "scenario" validates
+	// a chaos scenario file, "simulate" replays a timeline through the lease expression,
+	// "efo" lists, registers and deregisters enhanced fan-out consumers, "replay" projects
+	// per-worker load from the stream's CloudWatch history under a lease policy
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "preflight":
+			os.Exit(runPreflight(ctx, cfg))
+		case "canary":
+			os.Exit(runCanaryCommand(ctx, cfg, os.Args[2:]))
+		case "gameday":
+			os.Exit(runGamedayCommand(ctx, cfg, os.Args[2:]))
+		case "checkpoints":
+			os.Exit(runCheckpointsCommand(ctx, cfg, os.Args[2:]))
+		case "observe":
+			observeCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+			code := runObserver(observeCtx, cfg)
+			stop()
+			os.Exit(code)
+		case "drain":
+			os.Exit(runDrainCommand(ctx))
+		case "cordon", "uncordon":
+			os.Exit(runCordonCommand(ctx, cfg, os.Args[1] == "uncordon", os.Args[2:]))
+		case "estop":
+			os.Exit(runEmergencyStopCommand(ctx, cfg, os.Args[2:]))
+		case "leases":
+			os.Exit(runLeasesCommand(ctx, cfg, os.Args[2:]))
+		case "check":
+			os.Exit(runCheckCommand(ctx, cfg, os.Args[2:]))
+		case "scenario":
+			os.Exit(runScenarioCommand(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulateCommand(os.Args[2:]))
+		case "efo":
+			os.Exit(runEFOCommand(ctx, cfg, os.Args[2:]))
+		case "replay":
+			os.Exit(runReplayCommand(ctx, cfg, os.Args[2:]))
+		case "rbac":
+			fmt.Print(minimalRoleYAML(getEnv("RBAC_ROLE_NAME", "kds-consumer-lease-lookup"), getEnv("POD_NAMESPACE", "default"), requiredKubernetesPermissions()))
+			return
+		}
+	}
+
+	// Library code returns its failures; KDS_FAILURE_POLICY decides whether this
+	// binary exits, retries or continues degraded
+	failures, err := failurePolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startup.retryForever = failures == policyRetryForever
 
 	// Start health check server
-	go startHealthServer()
+	healthServers, healthErrs, err := startHealthServer(getEnv("HEALTH_ADDR", ":8080"), getEnv("ADMIN_ADDR", ""), failures)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownHealthServer(healthServers)
 
-	// Give LocalStack time to be ready
-	log.Println("Waiting for services to be ready...")
-	time.Sleep(5 * time.Second)
+	// Metrics also go to stdout for CloudWatch when KDS_METRICS_EMF=true
+	if emf := newEMFEmitterFromEnv(cfg); emf != nil {
+		go emf.run(ctx)
+	}
+	// and to the Datadog agent or a StatsD server when KDS_METRICS_STATSD_ADDR is set
+	statsd, err := newStatsDEmitterFromEnv(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure StatsD metrics: %v", err)
+	}
+	if statsd != nil {
+		go statsd.run(ctx)
+	}
+
+	// Initialization runs as the phases /startup reports, each with its own timeout
+	// and retries (KDS_STARTUP_<PHASE>_*); what a phase out of attempts does depends
+	// on the failure policy
+	var sc *startupConfig
+	if err := startup.run(ctx, phaseConfigLoaded, func(context.Context) error {
+		sc, err = loadStartupConfig(cfg)
+		return err
+	}); err != nil {
+		log.Fatalf("Startup failed: %v", err)
+	}
+
+	// Consume the highest-priority available stream of a multi-region setup
+	failover := sc.failover
+	if failover != nil {
+		target, err := failover.selectTarget(ctx)
+		if err != nil {
+			log.Fatalf("Failed to select a stream: %v", err)
+		}
+		cfg.region, cfg.streamName = target.region, target.streamName
+		log.Printf("Consuming stream %s in %s", cfg.streamName, cfg.region)
+	}
 
 	// Initialize AWS clients
-	awsCfg, err := loadAWSConfig(ctx, region, endpoint)
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
+	var awsCfg aws.Config
+	if err := startup.run(ctx, phaseAWSConfigLoaded, func(ctx context.Context) error {
+		awsCfg, err = loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+		return err
+	}); err != nil {
+		log.Fatalf("Startup failed: %v", err)
 	}
 
 	kinesisClient := kinesis.NewFromConfig(awsCfg)
 	dynamodbClient := dynamodb.NewFromConfig(awsCfg)
 
-	// Test AWS connectivity
-	if err := testAWSConnectivity(ctx, kinesisClient, dynamodbClient, streamName); err != nil {
+	// Wait for LocalStack/AWS to become reachable (slow cluster DNS, cold starts)
+	waitTimeout := getEnvDuration("STARTUP_WAIT_TIMEOUT", 2*time.Minute)
+	waitCtx, stopWait := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	// Standalone runs need neither DynamoDB nor Kubernetes, see standalone.go
+	standalone := standaloneEnabled()
+	probedDynamoDB := dynamodbClient
+	if standalone {
+		probedDynamoDB = nil
+	}
+	prober := newConnectivityProberFromEnv(kinesisClient, probedDynamoDB, cfg.streamName)
+	err = waitForDependencies(waitCtx, waitTimeout, prober.probe)
+	stopWait()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Println("Shutdown requested while waiting for services, exiting")
+			return
+		}
 		log.Printf("WARNING: AWS connectivity test failed: %v", err)
 		log.Println("Will retry in consumer loop...")
 	}
 
-	if !enableDynamic {
-		log.Println("Dynamic max leases disabled, running in basic mode")
+	// Compliance: refuse to consume a stream without the expected KMS encryption
+	if encryption := sc.encryption; encryption != nil {
+		if err := encryption.check(ctx, kinesisClient, cfg.streamName); err != nil {
+			if encryption.enforce {
+				log.Fatalf("Refusing to start: %v", err)
+			}
+			log.Printf("WARN: %v", err)
+		} else {
+			log.Printf("✅ Stream %s is encrypted with KMS key %s", cfg.streamName, encryption.keyID)
+		}
+	}
+
+	if standalone {
+		go prober.run(ctx)
+		runCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+		code := runStandalone(runCtx, cfg, sc, kinesisClient, healthErrs, failures)
+		stop()
+		shutdownHealthServer(healthServers)
+		os.Exit(code)
+	}
+
+	runBasic := func() {
+		go func() {
+			err := <-healthErrs
+			log.Fatalf("%v, exiting (KDS_FAILURE_POLICY=%s)", err, failures)
+		}()
+		startup.skip(phaseTableReady)
+		startup.skip(phaseCoordinatorResolved)
+		startup.complete(phaseWorkerStarted)
 		isReady.Store(true)
-		runBasicConsumer(ctx, kinesisClient, streamName, workerID)
+		runBasicConsumer(ctx, kinesisClient, cfg.streamName, cfg.workerID)
+	}
+	if !cfg.enableDynamic {
+		log.Println("Dynamic max leases disabled, running in basic mode")
+		go prober.run(ctx)
+		runBasic()
 		return
 	}
 
 	// Initialize lease manager (similar to the actual consumer code)
 	log.Println("Initializing KDS Lease Manager...")
-	leaseManager, err := NewKDSLeaseManager(ctx, region, streamName, appName, workerID, endpoint)
+	leaseManager, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
 	if err != nil {
 		log.Fatalf("Failed to create lease manager: %v", err)
 	}
+	leaseManager.OnInitPhase(startup.complete)
+
+	// Keep probing AWS and the Kubernetes API for the health endpoints and metrics
+	prober.attach(leaseManager)
+	go prober.run(ctx)
 
-	// Initialize max leases per worker
-	maxLeases, err := leaseManager.InitializeMaxLeasesPerWorker(ctx)
+	if sc.workerCounter != nil {
+		leaseManager.SetWorkerCountProvider(sc.workerCounter)
+	}
+	if sc.leaseExpr != nil {
+		log.Printf("Using lease expression: %s (custom variables: %v)", sc.leaseExpr, sc.leaseExprEnv.Custom)
+		leaseManager.SetLeaseExpression(sc.leaseExpr, sc.leaseExprEnv)
+	}
+	if sc.fleetScaler != nil {
+		leaseManager.SetFleetScaler(sc.fleetScaler)
+	}
+	if cachePath := os.Getenv("KDS_COORDINATOR_CACHE"); cachePath != "" {
+		leaseManager.SetCoordinatorCache(cachePath)
+	}
+	leaseManager.SetFallbackMaxLeases(sc.fallbackMaxLeases)
+
+	// Canary workers run a published candidate value before the rest of the fleet
+	leaseManager.EnableCanary(nil, canaryPolicyFromEnv())
+
+	// Initialize max leases per worker within a fixed budget, so a hung metadata
+	// store bounds startup latency no matter how many attempts the phases make
+	initBudget := getEnvDuration("KDS_INIT_TIMEOUT", 2*time.Minute)
+	initCtx, cancelInit := context.WithTimeout(ctx, initBudget)
+	if failures == policyRetryForever {
+		cancelInit()
+		initCtx, cancelInit = context.WithCancel(ctx)
+	}
+	var maxLeases int
+	err = startup.run(initCtx, phaseTableReady, func(ctx context.Context) error {
+		err := leaseManager.InitializeMetadataTable(ctx)
+		if err != nil && leaseManager.hasStartupFallback() {
+			// Coordination falls back to the cached or configured value without the table
+			log.Printf("WARN: Metadata table not ready, leaving it to the fallback: %v", err)
+			startup.skip(phaseTableReady)
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = startup.run(initCtx, phaseCoordinatorResolved, func(ctx context.Context) error {
+			var err error
+			maxLeases, err = leaseManager.InitializeMaxLeasesPerWorker(ctx)
+			if errors.Is(err, ErrStreamRecreated) {
+				// A recreated stream needs the operator, not another attempt
+				return noRetry(err)
+			}
+			return err
+		})
+	}
+	budgetSpent := initCtx.Err() != nil
+	cancelInit()
+	if errors.Is(err, context.DeadlineExceeded) && budgetSpent && ctx.Err() == nil {
+		err = fmt.Errorf("not initialized within KDS_INIT_TIMEOUT=%s: %w", initBudget, err)
+	}
+	if err != nil && ctx.Err() == nil && !errors.Is(err, ErrStreamRecreated) && failures.degrade("basic_mode", err) {
+		// Without max leases per worker the worker consumes like the basic consumer
+		startup.degrade(phaseTableReady)
+		startup.degrade(phaseCoordinatorResolved)
+		runBasic()
+		return
+	}
 	if err != nil {
 		log.Fatalf("Failed to initialize max leases per worker: %v", err)
 	}
+	// fleetMaxLeases is the coordinator value, maxLeases the one this worker applies
+	fleetMaxLeases := maxLeases
+	maxLeases = leaseManager.ApplyCandidate(ctx, fleetMaxLeases)
+
+	// Replica recommendations from shard count and throughput (opt-in)
+	if getEnv("KDS_RECOMMENDER", "false") == "true" {
+		hpa, err := newHPAFloorFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to configure HPA updates: %v", err)
+		}
+		go runRecommender(ctx, leaseManager, newReplicaRecommenderFromEnv(), hpa,
+			getEnvDuration("KDS_RECOMMENDER_INTERVAL", time.Minute))
+	}
 
+	// Recalculate max leases when the shard or worker count drifts, without a restart (opt-in)
+	var refreshes <-chan MaxLeasesChange
+	if interval := getEnvDuration("KDS_REFRESH_INTERVAL", 0); interval > 0 {
+		refreshes = leaseManager.StartBackgroundRefresh(ctx, interval)
+	}
+	// Changes of the coordinator value, whoever wrote them
+	coordinatorChanges := leaseManager.Watch(ctx)
+
+	leaseTable := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+	activeDrainer.Store(newDrainer(leaseManager, leaseTable))
+	cordon := &cordonWatcher{lm: leaseManager, leaseTable: leaseTable}
+	activeCordon.Store(cordon)
+	emergencyStop := &emergencyStopWatcher{lm: leaseManager, leaseTable: leaseTable}
+
+	var records *recordConsumer
+	if err := startup.run(ctx, phaseWorkerStarted, func(phaseCtx context.Context) error {
+		// The consumer outlives the phase; only its setup calls are bounded
+		records, err = newRecordConsumerFromEnv(phaseCtx, cfg, leaseManager, leaseTable, maxLeases)
+		return err
+	}); err != nil {
+		var permanent permanentPhaseError
+		if errors.As(err, &permanent) || !failures.degrade("no_consumption", err) {
+			log.Fatalf("Startup failed: %v", err)
+		}
+		// Keep computing max leases for the fleet without consuming records
+		startup.degrade(phaseWorkerStarted)
+		subsystems.observe(subsystemKCLWorker, time.Now(), err)
+		records = nil
+	}
 	log.Printf("✅ Successfully initialized! Max leases per worker: %d", maxLeases)
 	isReady.Store(true)
+	if records != nil {
+		activeConsumer.Store(records)
+		leaseManager.SetRuntimeStats(records.stats)
+		// A worker starting cordoned or stopped takes no leases
+		emergencyStop.check(ctx)
+		cordon.check(ctx)
+		go records.run(ctx)
+	} else if getEnv("KDS_CONSUME", "true") != "true" {
+		subsystems.disable(subsystemKCLWorker)
+	}
+
+	// Chaos scenarios of the k8s harness act on the records being consumed
+	scenario, err := newScenarioRunnerFromEnv(cfg.workerID)
+	if err != nil {
+		log.Fatalf("Failed to load scenario: %v", err)
+	}
+	if scenario != nil {
+		activeScenario.Store(scenario)
+		go scenario.run(ctx)
+	}
 
-	// Simulate consumer running
+	// Records are consumed in the background unless KDS_CONSUME=false
 	log.Println("Consumer is now running and processing records...")
-	log.Printf("Worker %s will acquire up to %d leases", workerID, maxLeases)
+	log.Printf("Worker %s will acquire up to %d leases", cfg.workerID, maxLeases)
 
 	// Periodic status updates
-	ticker := time.NewTicker(30 * time.Second)
+	polling := adaptivePollingFromEnv()
+	ticker := newAdaptiveJitterTicker(leaseManager.pollIntervalFunc(polling), pollJitter)
+	consistency := newConsistencyCheckerFromEnv(leaseManager, leaseTable, polling)
+	gc := newShardGCFromEnv(leaseManager, leaseTable)
+	snapshots, err := newFleetSnapshotterFromEnv(leaseManager, leaseTable, awsCfg, cfg.endpoint)
+	if err != nil {
+		log.Fatalf("Failed to configure fleet snapshots: %v", err)
+	}
 	defer ticker.Stop()
 
 	// Setup signal handling
@@ -113,6 +447,40 @@ func main() {
 	for {
 		select {
 		case <-ticker.C:
+			// A drained worker only waits for SIGTERM
+			if draining.Load() {
+				continue
+			}
+
+			heartbeatStart := time.Now()
+			err := leaseManager.Heartbeat(ctx)
+			if errors.Is(err, ErrWorkerIDConflict) {
+				// The leases belong to the worker ID the older process keeps using, so
+				// they are left to it rather than released
+				log.Printf("❌ %v, exiting. Give every process its own worker ID (HOSTNAME).", err)
+				isReady.Store(false)
+				shutdownHealthServer(healthServers)
+				os.Exit(1)
+			}
+			subsystems.observe(subsystemMetadata, heartbeatStart, err)
+			if err != nil {
+				log.Printf("WARN: %v", err)
+			}
+			consistency.maybeRun(ctx)
+			gc.maybeRun(ctx)
+			snapshots.maybeRun(ctx)
+
+			// The whole fleet idles without leases while the emergency stop is engaged
+			if emergencyStop.check(ctx) {
+				continue
+			}
+
+			// A cordoned worker releases its leases and takes none until uncordoned
+			if cordon.check(ctx) {
+				log.Printf("Status: worker=%s is cordoned, holding no leases", cfg.workerID)
+				continue
+			}
+
 			// Log periodic status
 			metadata, err := leaseManager.GetMetadata(ctx)
 			if err != nil {
@@ -123,22 +491,89 @@ func main() {
 					metadata.ShardCount, metadata.WorkerCount)
 			}
 
-			// Check if configuration changed
-			coordMetadata, err := leaseManager.GetCoordinatorMetadata(ctx)
-			if err != nil {
-				log.Printf("Failed to get coordinator metadata: %v", err)
-			} else if coordMetadata != nil {
-				if coordMetadata.MaxLeasesPerWorker != maxLeases {
-					log.Printf("⚠️  Configuration changed detected! Old: %d, New: %d",
-						maxLeases, coordMetadata.MaxLeasesPerWorker)
+			// Advance any canary rollout (report health, roll back or promote)
+			if err := leaseManager.CheckCanary(ctx); err != nil {
+				log.Printf("Failed to check lease canary: %v", err)
+			}
+
+			// A canary candidate can change the value applied without the coordinator value
+			// changing; coordinator changes arrive from Watch
+			effective := leaseManager.ApplyCandidate(ctx, fleetMaxLeases)
+			if effective != maxLeases {
+				log.Printf("⚠️  Configuration changed detected! Old: %d, New: %d",
+					maxLeases, effective)
+				if records == nil {
 					log.Println("In real scenario, this would trigger reconfiguration")
 				}
+				maxLeases = effective
+			}
+			records.hold(effective)
+
+			if failover != nil {
+				if restart, reason := failover.check(ctx); restart {
+					log.Printf("🔀 %s, exiting so the restarted worker switches streams", reason)
+					isReady.Store(false)
+					shutdownHealthServer(healthServers)
+					os.Exit(1)
+				}
 			}
 
+			// A recreated stream has new shard IDs; restart to reset against it
+			if recreated, err := leaseManager.CheckStreamIdentity(ctx); err != nil {
+				log.Printf("WARN: Failed to check stream identity: %v", err)
+			} else if recreated {
+				log.Printf("🔁 Stream %s was recreated, exiting so the restarted worker resets against the new stream", cfg.streamName)
+				isReady.Store(false)
+				shutdownHealthServer(healthServers)
+				os.Exit(1)
+			}
+
+		case change, ok := <-coordinatorChanges:
+			if !ok {
+				coordinatorChanges = nil
+				continue
+			}
+			log.Printf("🔄 Max leases per worker changed: %d -> %d (shards=%d, workers=%d)",
+				change.OldMaxLeases, change.NewMaxLeases, change.ShardCount, change.WorkerCount)
+			fleetMaxLeases = change.NewMaxLeases
+			// Drained, stopped and cordoned workers keep holding no leases
+			if draining.Load() || emergencyStop.engaged || cordon.cordoned {
+				continue
+			}
+			maxLeases = leaseManager.ApplyCandidate(ctx, fleetMaxLeases)
+			records.hold(maxLeases)
+
+		case change, ok := <-refreshes:
+			if !ok {
+				refreshes = nil
+				continue
+			}
+			// Watch delivers the new value; this only says where it came from
+			if change.Recalculated {
+				log.Printf("🔄 Recalculated max leases per worker %d -> %d after drift (shards=%d, workers=%d)",
+					change.OldMaxLeases, change.NewMaxLeases, change.ShardCount, change.WorkerCount)
+			}
+
+		case err := <-healthErrs:
+			log.Printf("%v, exiting (KDS_FAILURE_POLICY=%s)", err, failures)
+			isReady.Store(false)
+			releaseCtx, cancelRelease := context.WithTimeout(ctx, 10*time.Second)
+			records.releaseAll(releaseCtx)
+			cancelRelease()
+			shutdownHealthServer(healthServers)
+			os.Exit(1)
+
 		case sig := <-sigChan:
 			log.Printf("Received signal %s, shutting down gracefully...", sig)
 			isReady.Store(false)
 			isHealthy.Store(false)
+			// Checkpoint and hand the leases to peers instead of letting them expire
+			releaseCtx, cancelRelease := context.WithTimeout(ctx, 10*time.Second)
+			records.releaseAll(releaseCtx)
+			if err := leaseManager.ReleaseWorkerIdentity(releaseCtx); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+			cancelRelease()
 			time.Sleep(2 * time.Second) // Grace period
 			return
 
@@ -148,46 +583,51 @@ func main() {
 	}
 }
 
-func loadAWSConfig(ctx context.Context, region, endpoint string) (aws.Config, error) {
-	opts := []func(*config.LoadOptions) error{
-		config.WithRegion(region),
-	}
-
-	if endpoint != "" {
-		opts = append(opts, config.WithEndpointResolverWithOptions(
-			aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-				return aws.Endpoint{
-					URL:               endpoint,
-					HostnameImmutable: true,
-					SigningRegion:     region,
-				}, nil
-			}),
-		))
-	}
+// waitForDependencies retries check with exponential backoff until it succeeds,
+// the timeout elapses, or ctx is cancelled. It returns the last check error on timeout.
+func waitForDependencies(ctx context.Context, timeout time.Duration, check func(context.Context) error) error {
+	const (
+		initialBackoff = 500 * time.Millisecond
+		maxBackoff     = 15 * time.Second
+	)
+
+	log.Printf("Waiting up to %s for services to be ready...", timeout)
+
+	deadline := time.Now().Add(timeout)
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithDeadline(ctx, deadline)
+		err := check(attemptCtx)
+		cancel()
+		if err == nil {
+			log.Printf("Services ready after %d attempt(s)", attempt)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
-	return config.LoadDefaultConfig(ctx, opts...)
-}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("services not ready after %s (%d attempts): %w", timeout, attempt, err)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
 
-func testAWSConnectivity(ctx context.Context, kc *kinesis.Client, dc *dynamodb.Client, streamName string) error {
-	log.Println("Testing AWS connectivity...")
+		log.Printf("Services not ready (attempt %d): %v; retrying in %s", attempt, err, backoff)
 
-	// Test Kinesis
-	_, err := kc.DescribeStream(ctx, &kinesis.DescribeStreamInput{
-		StreamName: aws.String(streamName),
-	})
-	if err != nil {
-		return fmt.Errorf("kinesis test failed: %w", err)
-	}
-	log.Println("✅ Kinesis connectivity OK")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-	// Test DynamoDB
-	_, err = dc.ListTables(ctx, &dynamodb.ListTablesInput{})
-	if err != nil {
-		return fmt.Errorf("dynamodb test failed: %w", err)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
-	log.Println("✅ DynamoDB connectivity OK")
-
-	return nil
 }
 
 func runBasicConsumer(ctx context.Context, kc *kinesis.Client, streamName, workerID string) {
@@ -206,33 +646,6 @@ func runBasicConsumer(ctx context.Context, kc *kinesis.Client, streamName, worke
 	}
 }
 
-func startHealthServer() {
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		if isHealthy.Load() {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "OK")
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			fmt.Fprintf(w, "Unhealthy")
-		}
-	})
-
-	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		if isReady.Load() {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "Ready")
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			fmt.Fprintf(w, "Not Ready")
-		}
-	})
-
-	log.Println("Health check server listening on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Health server failed: %v", err)
-	}
-}
-
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -240,3 +653,30 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDuration parses a Go duration (e.g. "90s", "2m") from the environment
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		degradations.invalidSetting(key, value, defaultValue.String())
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvFloat parses a float from the environment
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		degradations.invalidSetting(key, value, strconv.FormatFloat(defaultValue, 'g', -1, 64))
+		return defaultValue
+	}
+	return f
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+func FuzzLoadConfig(f *testing.F) {
+	f.Add("stream-a@us-east-1,stream-b@us-west-2", "3", "fail", "http://control-plane/workers", "min(limit, ceil(shards / workers))", "1", "America/New_York", "", "20", "4")
+	f.Add("", "NaN", "warn", "://", "if(backfill, 2, 1) * shards / workers", "abc", "Nowhere/Else", "0", "", "")
+	f.Add("@,,", "1e309", "block", "not a url", "shards / (workers - workers)", "-Inf", "../../etc/passwd", "81", "-1", "0")
+	f.Add("stream", "-1", "", "", "min(", "1e308", "UTC", "12", "x", "y")
+
+	f.Fuzz(func(t *testing.T, failover, failoverAfter, kmsMode, workerCountURL, expr, backfill, timeZone, fallback, fallbackShards, fallbackWorkers string) {
+		env := map[string]string{
+			"KDS_STREAM_FAILOVER":     failover,
+			"KDS_FAILOVER_AFTER":      failoverAfter,
+			"KDS_EXPECTED_KMS_KEY":    "alias/kinesis",
+			"KDS_KMS_ENFORCEMENT":     kmsMode,
+			"KDS_WORKER_COUNT_URL":    workerCountURL,
+			"KDS_MAX_LEASES_EXPR":     expr,
+			"KDS_EXPR_VAR_BACKFILL":   backfill,
+			"KDS_EXPR_TIMEZONE":       timeZone,
+			"KDS_FALLBACK_MAX_LEASES": fallback,
+			"KDS_FALLBACK_SHARDS":     fallbackShards,
+			"KDS_FALLBACK_WORKERS":    fallbackWorkers,
+		}
+		for key, value := range env {
+			// The environment cannot hold NUL bytes
+			if strings.ContainsRune(value, 0) {
+				t.Skip()
+			}
+			t.Setenv(key, value)
+		}
+
+		sc, err := loadStartupConfig(appConfig{region: "us-east-1", streamName: "stream", appName: "app", workerID: "pod-0"})
+		if err != nil {
+			return
+		}
+		if sc.fallbackMaxLeases < 0 || sc.fallbackMaxLeases > leasemanager.MaxLeasePerWorkerLimit {
+			t.Fatalf("fallback max leases %d out of [0, %d]", sc.fallbackMaxLeases, leasemanager.MaxLeasePerWorkerLimit)
+		}
+		if sc.failover != nil && (len(sc.failover.targets) == 0 || sc.failover.threshold < 1) {
+			t.Fatalf("failover %q accepted with %d targets, threshold %d", failover, len(sc.failover.targets), sc.failover.threshold)
+		}
+		// An expression accepted at startup evaluates within bounds at any time of day
+		if sc.leaseExpr != nil {
+			in := LeaseExpressionInputs{Shards: 40, Workers: 3, Time: time.Now().In(sc.leaseExprEnv.Location), Custom: sc.leaseExprEnv.Custom}
+			if m, _, err := sc.leaseExpr.EvaluateMaxLeases(in); err == nil && (m < 1 || m > leasemanager.MaxLeasePerWorkerLimit) {
+				t.Fatalf("%q evaluated to %d", expr, m)
+			}
+		}
+	})
+}
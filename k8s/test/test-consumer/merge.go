@@ -0,0 +1,444 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+var (
+	mergeEmitted   = metrics.counter("kds_merge_records_emitted_total", "Records emitted by the merge stage, by stream")
+	mergeLate      = metrics.counter("kds_merge_late_records_total", "Records that arrived behind the merge watermark and were emitted out of order, by stream")
+	mergeNoTime    = metrics.counter("kds_merge_event_time_fallbacks_total", "Records without a readable event time field, ordered by arrival time instead, by stream")
+	mergeBuffered  = metrics.gauge("kds_merge_buffered", "Records held by the merge stage until the watermark passes them")
+	mergeWatermark = metrics.gauge("kds_merge_watermark_seconds", "Event time up to which the merge stage has emitted, as Unix seconds")
+)
+
+// KinesisAPIForMerge defines the Kinesis operations needed to read control streams
+type KinesisAPIForMerge interface {
+	KinesisAPIForRecords
+	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+}
+
+// mergedRecord is a record leaving the merge stage
+type mergedRecord struct {
+	Stream         string
+	ShardID        string
+	SequenceNumber string
+	EventTime      time.Time
+	Data           []byte
+	// Late is set when the record arrived behind the watermark and so leaves after
+	// records with later event times
+	Late bool
+}
+
+// recordHandler receives the merged records one at a time, in emission order
+type recordHandler func(mergedRecord)
+
+// mergeStage fans records of the shards a worker holds, and of the control streams
+// every worker reads in full, into one sequence approximately ordered by event time.
+// Records are held until the watermark passes them: the lowest event time read by an
+// active source minus KDS_MERGE_LATENESS. A source is a shard; it stops holding the
+// watermark back once it has read nothing for KDS_MERGE_SOURCE_IDLE, so a quiet
+// control stream does not stall the data. Records arriving behind the watermark are
+// emitted at once and counted as late.
+//
+// Shard consumers checkpoint only up to the records emitted (see checkpointable), so a
+// restart reads the held records again.
+type mergeStage struct {
+	lateness        time.Duration
+	idle            time.Duration
+	timeField       string // top-level JSON field with the event time, "" for arrival time
+	controlStreams  []string
+	controlPosition kinesistypes.ShardIteratorType
+	api             KinesisAPIForMerge
+	handlers        []recordHandler
+	now             func() time.Time
+
+	emitMu   sync.Mutex // serializes emission, so records reach handlers in order
+	mu       sync.Mutex
+	buffer   recordHeap
+	sources  map[string]*mergeSource // stream/shard ID -> source
+	order    uint64                  // push order, breaking event time ties
+	released time.Time               // highest watermark emitted up to
+}
+
+// mergeSource is the merge state of one shard
+type mergeSource struct {
+	maxSeen    time.Time
+	lastRecord time.Time
+	queue      []*bufferedRecord // held records in shard order
+	closed     bool
+}
+
+type bufferedRecord struct {
+	mergedRecord
+	source  *mergeSource
+	prevSeq string // sequence number of the record before it in the shard
+	order   uint64
+	emitted bool
+}
+
+// recordHeap orders held records by event time, then arrival
+type recordHeap []*bufferedRecord
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if !h[i].EventTime.Equal(h[j].EventTime) {
+		return h[i].EventTime.Before(h[j].EventTime)
+	}
+	return h[i].order < h[j].order
+}
+func (h recordHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x any)   { *h = append(*h, x.(*bufferedRecord)) }
+func (h *recordHeap) Pop() any {
+	old := *h
+	b := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return b
+}
+
+// newMergeStageFromEnv returns nil unless KDS_MERGE=true. It reads KDS_MERGE_LATENESS,
+// KDS_MERGE_SOURCE_IDLE, KDS_MERGE_EVENT_TIME_FIELD, KDS_MERGE_CONTROL_STREAMS and
+// KDS_MERGE_CONTROL_POSITION.
+func newMergeStageFromEnv(api KinesisAPIForMerge, dataStream string) (*mergeStage, error) {
+	if getEnv("KDS_MERGE", "false") != "true" {
+		return nil, nil
+	}
+	position := kinesistypes.ShardIteratorType(getEnv("KDS_MERGE_CONTROL_POSITION", string(kinesistypes.ShardIteratorTypeTrimHorizon)))
+	if position != kinesistypes.ShardIteratorTypeTrimHorizon && position != kinesistypes.ShardIteratorTypeLatest {
+		return nil, fmt.Errorf("KDS_MERGE_CONTROL_POSITION must be TRIM_HORIZON or LATEST, got %q", position)
+	}
+	m := &mergeStage{
+		lateness:        getEnvDuration("KDS_MERGE_LATENESS", 5*time.Second),
+		idle:            getEnvDuration("KDS_MERGE_SOURCE_IDLE", 30*time.Second),
+		timeField:       getEnv("KDS_MERGE_EVENT_TIME_FIELD", ""),
+		controlPosition: position,
+		api:             api,
+		now:             time.Now,
+		sources:         map[string]*mergeSource{},
+	}
+	for _, stream := range strings.Split(getEnv("KDS_MERGE_CONTROL_STREAMS", ""), ",") {
+		if stream = strings.TrimSpace(stream); stream == "" {
+			continue
+		}
+		if stream == dataStream {
+			return nil, fmt.Errorf("KDS_MERGE_CONTROL_STREAMS: %s is the consumed stream", stream)
+		}
+		m.controlStreams = append(m.controlStreams, stream)
+	}
+	return m, nil
+}
+
+// handle adds a handler of the merged records
+func (m *mergeStage) handle(h recordHandler) {
+	m.handlers = append(m.handlers, h)
+}
+
+// eventTime reads the record's event time from timeField, an RFC 3339 string or Unix
+// milliseconds, falling back to the arrival time
+func (m *mergeStage) eventTime(stream string, r kinesistypes.Record) time.Time {
+	arrival := aws.ToTime(r.ApproximateArrivalTimestamp)
+	if m.timeField == "" {
+		return arrival
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(r.Data, &fields); err == nil {
+		var text string
+		var millis int64
+		if err := json.Unmarshal(fields[m.timeField], &text); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+				return t
+			}
+		} else if err := json.Unmarshal(fields[m.timeField], &millis); err == nil {
+			return time.UnixMilli(millis)
+		}
+	}
+	mergeNoTime.add(1, "stream", stream)
+	return arrival
+}
+
+// push adds records read from a shard after prevSeq and emits what the watermark
+// passed
+func (m *mergeStage) push(stream, shardID, prevSeq string, records []kinesistypes.Record) {
+	if m == nil || len(records) == 0 {
+		return
+	}
+	m.mu.Lock()
+	key := stream + "/" + shardID
+	s := m.sources[key]
+	if s == nil {
+		s = &mergeSource{}
+		m.sources[key] = s
+	}
+	// A shard taken again reopens its source
+	s.closed = false
+	now := m.now()
+	for _, r := range records {
+		b := &bufferedRecord{
+			mergedRecord: mergedRecord{
+				Stream:         stream,
+				ShardID:        shardID,
+				SequenceNumber: aws.ToString(r.SequenceNumber),
+				EventTime:      m.eventTime(stream, r),
+				Data:           r.Data,
+			},
+			source:  s,
+			prevSeq: prevSeq,
+			order:   m.order,
+		}
+		m.order++
+		prevSeq = b.SequenceNumber
+		b.Late = b.EventTime.Before(m.released)
+		if b.EventTime.After(s.maxSeen) {
+			s.maxSeen = b.EventTime
+		}
+		s.lastRecord = now
+		heap.Push(&m.buffer, b)
+		s.queue = append(s.queue, b)
+	}
+	m.mu.Unlock()
+	m.emitReady()
+}
+
+// watermark returns the event time up to which records are emitted; the caller holds
+// m.mu. With every source idle or closed, everything held is released.
+func (m *mergeStage) watermark() time.Time {
+	now := m.now()
+	var lowest, highest time.Time
+	active := false
+	for _, s := range m.sources {
+		if s.maxSeen.After(highest) {
+			highest = s.maxSeen
+		}
+		if s.closed || now.Sub(s.lastRecord) >= m.idle {
+			continue
+		}
+		if !active || s.maxSeen.Before(lowest) {
+			lowest = s.maxSeen
+		}
+		active = true
+	}
+	if !active {
+		return highest
+	}
+	return lowest.Add(-m.lateness)
+}
+
+// emitReady hands every record the watermark passed to the handlers
+func (m *mergeStage) emitReady() {
+	m.emitMu.Lock()
+	defer m.emitMu.Unlock()
+
+	m.mu.Lock()
+	// A source starting behind the others lowers the watermark; what was released stays
+	// released, and its records behind it are late
+	if watermark := m.watermark(); watermark.After(m.released) {
+		m.released = watermark
+		mergeWatermark.set(float64(watermark.UnixMilli()) / 1000)
+	}
+	var ready []*bufferedRecord
+	for m.buffer.Len() > 0 && !m.buffer[0].EventTime.After(m.released) {
+		ready = append(ready, heap.Pop(&m.buffer).(*bufferedRecord))
+	}
+	mergeBuffered.set(float64(m.buffer.Len()))
+	m.mu.Unlock()
+
+	for _, b := range ready {
+		for _, h := range m.handlers {
+			h(b.mergedRecord)
+		}
+		mergeEmitted.add(1, "stream", b.Stream)
+		if b.Late {
+			mergeLate.add(1, "stream", b.Stream)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range ready {
+		b.emitted = true
+		s := b.source
+		for len(s.queue) > 0 && s.queue[0].emitted {
+			s.queue = s.queue[1:]
+		}
+	}
+	for key, s := range m.sources {
+		if s.closed && len(s.queue) == 0 {
+			delete(m.sources, key)
+		}
+	}
+}
+
+// checkpointable returns the sequence number a shard consumer at lastSeq may
+// checkpoint: the one before its first record still held
+func (m *mergeStage) checkpointable(stream, shardID, lastSeq string) string {
+	if m == nil {
+		return lastSeq
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sources[stream+"/"+shardID]; s != nil && len(s.queue) > 0 {
+		return s.queue[0].prevSeq
+	}
+	return lastSeq
+}
+
+// holds reports whether records of the shard are still held
+func (m *mergeStage) holds(stream, shardID string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sources[stream+"/"+shardID]
+	return s != nil && len(s.queue) > 0
+}
+
+// closeSource stops a shard from holding the watermark back once it is no longer
+// read; its held records are still emitted
+func (m *mergeStage) closeSource(stream, shardID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	key := stream + "/" + shardID
+	if s := m.sources[key]; s != nil {
+		s.closed = true
+		if len(s.queue) == 0 {
+			delete(m.sources, key)
+		}
+	}
+	m.mu.Unlock()
+	m.emitReady()
+}
+
+// run reads the control streams and emits held records as sources go idle, until ctx
+// ends. Records still held then are not checkpointed and are read again.
+func (m *mergeStage) run(ctx context.Context, pollInterval, listInterval time.Duration) {
+	for _, stream := range m.controlStreams {
+		go m.runControl(ctx, stream, pollInterval, listInterval)
+	}
+	ticker := time.NewTicker(max(m.lateness/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.emitReady()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runControl reads every shard of a control stream, without leases or checkpoints,
+// listing the stream every listInterval for shards created by resharding. The shards
+// found first start at KDS_MERGE_CONTROL_POSITION, later ones at their beginning.
+// Parents and children are read at once; the merge orders them by event time.
+func (m *mergeStage) runControl(ctx context.Context, stream string, pollInterval, listInterval time.Duration) {
+	started := map[string]bool{}
+	position := m.controlPosition
+	for {
+		shards, err := m.controlShards(ctx, stream)
+		if err != nil {
+			log.Printf("WARN: Failed to list control stream %s: %v", stream, err)
+		}
+		for _, shardID := range shards {
+			if !started[shardID] {
+				started[shardID] = true
+				go m.readControlShard(ctx, stream, shardID, position, pollInterval)
+			}
+		}
+		if err == nil {
+			position = kinesistypes.ShardIteratorTypeTrimHorizon
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listInterval):
+		}
+	}
+}
+
+// controlShards lists the shard IDs of a control stream
+func (m *mergeStage) controlShards(ctx context.Context, stream string) ([]string, error) {
+	var ids []string
+	input := &kinesis.ListShardsInput{StreamName: aws.String(stream)}
+	for {
+		out, err := m.api.ListShards(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range out.Shards {
+			ids = append(ids, aws.ToString(shard.ShardId))
+		}
+		if out.NextToken == nil {
+			return ids, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// readControlShard reads a control stream shard to its end or until ctx ends
+func (m *mergeStage) readControlShard(ctx context.Context, stream, shardID string, position kinesistypes.ShardIteratorType, pollInterval time.Duration) {
+	defer m.closeSource(stream, shardID)
+	lastSeq := ""
+	iterator := func() (*string, error) {
+		input := &kinesis.GetShardIteratorInput{StreamName: aws.String(stream), ShardId: aws.String(shardID), ShardIteratorType: position}
+		if lastSeq != "" {
+			input.ShardIteratorType = kinesistypes.ShardIteratorTypeAfterSequenceNumber
+			input.StartingSequenceNumber = aws.String(lastSeq)
+		}
+		out, err := m.api.GetShardIterator(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get iterator of control shard %s/%s: %w", stream, shardID, err)
+		}
+		return out.ShardIterator, nil
+	}
+
+	it, err := iterator()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			it, err = iterator()
+			continue
+		}
+
+		out, readErr := m.api.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: it})
+		var expired *kinesistypes.ExpiredIteratorException
+		var throttled *kinesistypes.ProvisionedThroughputExceededException
+		switch {
+		case errors.As(readErr, &expired):
+			it, err = iterator()
+			continue
+		case errors.As(readErr, &throttled):
+			continue
+		case readErr != nil:
+			log.Printf("WARN: Failed to read control shard %s/%s: %v", stream, shardID, readErr)
+			continue
+		}
+		if n := len(out.Records); n > 0 {
+			m.push(stream, shardID, lastSeq, out.Records)
+			lastSeq = aws.ToString(out.Records[n-1].SequenceNumber)
+		}
+		if out.NextShardIterator == nil {
+			return
+		}
+		it = out.NextShardIterator
+	}
+}
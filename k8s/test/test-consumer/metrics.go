@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metrics is the process-wide registry served on /metrics
+var metrics = newMetricsRegistry()
+
+// metricsRegistry is a minimal gauge/counter registry rendered in the Prometheus text
+// exposition format, enough for scraping without pulling in a client library
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	order    []string
+}
+
+// metricFamily is one metric name with a value per label set
+type metricFamily struct {
+	registry *metricsRegistry
+	name     string
+	help     string
+	kind     string // "gauge" or "counter"
+	values   map[string]float64
+	labels   map[string][]string // rendered label set -> name/value pairs, for EMF
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: map[string]*metricFamily{}}
+}
+
+// gauge returns the gauge called name, registering it on first use
+func (r *metricsRegistry) gauge(name, help string) *metricFamily {
+	return r.family(name, help, "gauge")
+}
+
+// counter returns the counter called name, registering it on first use
+func (r *metricsRegistry) counter(name, help string) *metricFamily {
+	return r.family(name, help, "counter")
+}
+
+func (r *metricsRegistry) family(name, help, kind string) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		return f
+	}
+	f := &metricFamily{registry: r, name: name, help: help, kind: kind, values: map[string]float64{}, labels: map[string][]string{}}
+	r.families[name] = f
+	r.order = append(r.order, name)
+	return f
+}
+
+// set stores v for the label set given as alternating name/value pairs
+func (f *metricFamily) set(v float64, labels ...string) {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	key := renderLabels(labels)
+	f.values[key] = v
+	f.labels[key] = labels
+}
+
+// add increments the value for the label set given as alternating name/value pairs
+func (f *metricFamily) add(v float64, labels ...string) {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	key := renderLabels(labels)
+	f.values[key] += v
+	f.labels[key] = labels
+}
+
+// reset drops every label set, for families whose label values come and go
+func (f *metricFamily) reset() {
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+	f.values = map[string]float64{}
+	f.labels = map[string][]string{}
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeTo renders every family in registration order
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range r.order {
+		f := r.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", f.name, k, f.values[k])
+		}
+	}
+}
+
+func (r *metricsRegistry) handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.writeTo(w)
+}
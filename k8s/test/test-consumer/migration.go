@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// migrateLegacyKeys copies rows written before keys were namespaced by (app, stream,
+// region) to their new keys. Legacy rows are only adopted when their stream_name
+// matches, so a legacy coordinator shared by two streams goes to the stream that
+// wrote it. The legacy coordinator row is left in place for pods still running the
+// old version; this worker's own legacy row is moved. Failures are logged and
+// ignored: the worst case is one recalculation.
+func (lm *KDSLeaseManager) migrateLegacyKeys(ctx context.Context) {
+	// Legacy rows predate consumer groups and belong to the default group
+	if lm.consumerGroup != leasemanager.DefaultConsumerGroup {
+		return
+	}
+	if err := lm.copyLegacyRow(ctx, lm.keys().LegacyCoordinator(), lm.keys().Coordinator(), false); err != nil {
+		log.Printf("WARN: Failed to migrate legacy coordinator row: %v", err)
+	}
+	if err := lm.copyLegacyRow(ctx, lm.workerID, lm.keys().Worker(lm.workerID), true); err != nil {
+		log.Printf("WARN: Failed to migrate legacy worker row: %v", err)
+	}
+}
+
+// copyLegacyRow copies the row at legacyKey to newKey unless newKey already exists,
+// optionally deleting the legacy row afterwards
+func (lm *KDSLeaseManager) copyLegacyRow(ctx context.Context, legacyKey, newKey string, deleteLegacy bool) error {
+	result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: legacyKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	if result.Item == nil || attrString(result.Item, "stream_name") != lm.streamName {
+		return nil
+	}
+
+	item := make(map[string]types.AttributeValue, len(result.Item))
+	for k, v := range result.Item {
+		item[k] = v
+	}
+	item["worker_id"] = &types.AttributeValueMemberS{Value: newKey}
+
+	_, err = lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(lm.metadataTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(worker_id)"),
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		// Already migrated (by us earlier or by another worker)
+	case err != nil:
+		return err
+	default:
+		log.Printf("Migrated legacy metadata row %s -> %s", legacyKey, newKey)
+	}
+
+	if !deleteLegacy {
+		return nil
+	}
+	_, err = lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: legacyKey},
+		},
+	})
+	return err
+}
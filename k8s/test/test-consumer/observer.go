@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"expr_mohan/leasemanager"
+)
+
+// KCL lease table attributes (vmware-go-kcl checkpoint package)
+const (
+	kclLeaseKeyKey     = "ShardID"
+	kclLeaseOwnerKey   = "AssignedTo"
+	kclLeaseTimeoutKey = "LeaseTimeout"
+	kclCheckpointKey   = "Checkpoint"
+	kclShardEnd        = "SHARD_END"
+)
+
+// latestFleetStatus is the most recent observer snapshot served on /fleet
+var latestFleetStatus atomic.Pointer[FleetStatus]
+
+var (
+	observedCoordinatorMaxLeases = metrics.gauge("kds_coordinator_max_leases", "Coordinator max leases per worker")
+	observedCoordinatorWorkers   = metrics.gauge("kds_coordinator_worker_count", "Worker count recorded by the coordinator")
+	observedWorkerRows           = metrics.gauge("kds_worker_rows", "Worker metadata rows in the group")
+	observedPartial              = metrics.gauge("kds_fleet_status_partial", "1 when the last snapshot has only some worker rows")
+	observedKCLLeases            = metrics.gauge("kds_kcl_leases", "KCL leases by state")
+	observedKCLLeasesByOwner     = metrics.gauge("kds_kcl_leases_by_owner", "Held KCL leases per worker")
+)
+
+// FleetStatus is a read-only snapshot of an application's lease metadata and KCL
+// lease table
+type FleetStatus struct {
+	ObservedAt    time.Time                `json:"observed_at"`
+	ConsumerGroup string                   `json:"consumer_group"`
+	ShardCount    int                      `json:"shard_count"`
+	Coordinator   *leasemanager.Metadata   `json:"coordinator,omitempty"`
+	Workers       []*leasemanager.Metadata `json:"workers"`
+	Candidate     *LeaseCandidate          `json:"candidate,omitempty"`
+	Leases        KCLLeaseSummary          `json:"kcl_leases"`
+	// KinesisCallsPerMinute sums the Kinesis requests of the last full minute over the
+	// worker rows, by operation
+	KinesisCallsPerMinute map[string]int `json:"kinesis_calls_per_minute,omitempty"`
+	// Partial is set when only some worker rows could be read
+	Partial string `json:"partial,omitempty"`
+}
+
+// KCLLeaseSummary counts the rows of a KCL lease table
+type KCLLeaseSummary struct {
+	Total    int            `json:"total"`
+	Owned    int            `json:"owned"`
+	Unowned  int            `json:"unowned"`
+	Expired  int            `json:"expired"`
+	Finished int            `json:"finished"`
+	ByOwner  map[string]int `json:"by_owner"`
+}
+
+// runObserver attaches to the application's metadata and KCL lease table without
+// registering as a worker: it never writes to DynamoDB and is not part of any worker
+// count. Snapshots are exported on /metrics, /fleet and /shards until ctx is done.
+func runObserver(ctx context.Context, cfg appConfig) int {
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		log.Printf("Failed to create lease manager: %v", err)
+		return 1
+	}
+	lm.SetAllowPartialReads(true)
+
+	policy, err := failurePolicyFromEnv()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	budget, err := callBudgetFromEnv()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	healthServers, healthErrs, err := startHealthServer(getEnv("HEALTH_ADDR", ":8080"), getEnv("ADMIN_ADDR", ""), policy)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer shutdownHealthServer(healthServers)
+
+	leaseTable := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+	interval := getEnvDuration("KDS_OBSERVER_INTERVAL", 30*time.Second)
+	log.Printf("Observing app=%s stream=%s group=%s lease table=%s every %s (read-only)",
+		cfg.appName, cfg.streamName, lm.consumerGroup, leaseTable, interval)
+
+	ticker := newJitterTicker(interval, pollJitter)
+	defer ticker.Stop()
+
+	for {
+		status, err := lm.ObserveFleet(ctx, leaseTable)
+		if err != nil {
+			log.Printf("WARN: Fleet observation failed: %v", err)
+		} else {
+			if status.Partial != "" {
+				log.Printf("WARN: Fleet snapshot is incomplete: %s", status.Partial)
+			}
+			if over := overBudget(status.KinesisCallsPerMinute, budget); len(over) > 0 {
+				log.Printf("WARN: Fleet Kinesis calls per minute over budget: %s", strings.Join(over, ", "))
+			}
+			latestFleetStatus.Store(status)
+			exportFleetStatus(status)
+			exportFleetCalls(status.KinesisCallsPerMinute, budget)
+			isReady.Store(true)
+		}
+		// The shard to worker mapping for /shards
+		if view, err := lm.ViewLeaseTable(ctx, leaseTable); err != nil {
+			log.Printf("WARN: Lease table view failed: %v", err)
+		} else {
+			latestLeaseView.Store(view)
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-healthErrs:
+			log.Print(err)
+			return 1
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
+
+// ObserveFleet reads the shard count, coordinator, worker rows, candidate and KCL
+// lease table; every call is a read
+func (lm *KDSLeaseManager) ObserveFleet(ctx context.Context, leaseTable string) (*FleetStatus, error) {
+	status := &FleetStatus{ObservedAt: time.Now(), ConsumerGroup: lm.consumerGroup}
+
+	var err error
+	if status.ShardCount, err = lm.GetShardCount(ctx); err != nil {
+		return nil, err
+	}
+	if status.Coordinator, err = lm.GetCoordinatorMetadata(ctx); err != nil {
+		return nil, err
+	}
+	var partial *PartialError
+	if status.Workers, _, err = lm.FleetWorkerMetadata(ctx); errors.As(err, &partial) {
+		status.Partial = partial.Error()
+	} else if err != nil {
+		return nil, err
+	}
+	for _, row := range status.Workers {
+		status.KinesisCallsPerMinute = addCalls(status.KinesisCallsPerMinute, row.KinesisCallsPerMinute)
+	}
+	if status.Candidate, err = lm.GetCandidate(ctx); err != nil {
+		return nil, err
+	}
+	if status.Leases, err = lm.summarizeKCLLeases(ctx, leaseTable); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (lm *KDSLeaseManager) summarizeKCLLeases(ctx context.Context, leaseTable string) (KCLLeaseSummary, error) {
+	summary := KCLLeaseSummary{ByOwner: map[string]int{}}
+	now := time.Now()
+
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(leaseTable),
+		ProjectionExpression: aws.String("#k, #o, #t, #c"),
+		ExpressionAttributeNames: map[string]string{
+			"#k": kclLeaseKeyKey, "#o": kclLeaseOwnerKey, "#t": kclLeaseTimeoutKey, "#c": kclCheckpointKey,
+		},
+	}
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			return summary, err
+		}
+		for _, item := range result.Items {
+			summary.Total++
+			owner := attrString(item, kclLeaseOwnerKey)
+			timeout, _ := time.Parse(time.RFC3339, attrString(item, kclLeaseTimeoutKey))
+			switch kclLeaseState(owner, attrString(item, kclCheckpointKey), timeout, now) {
+			case kclLeaseFinished:
+				summary.Finished++
+			case kclLeaseUnowned:
+				summary.Unowned++
+			case kclLeaseExpired:
+				summary.Expired++
+			default:
+				summary.Owned++
+				summary.ByOwner[owner]++
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return summary, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func exportFleetStatus(status *FleetStatus) {
+	shardCountGauge.set(float64(status.ShardCount))
+	observedWorkerRows.set(float64(len(status.Workers)))
+	if status.Partial != "" {
+		observedPartial.set(1)
+	} else {
+		observedPartial.set(0)
+	}
+	if status.Coordinator != nil {
+		observedCoordinatorMaxLeases.set(float64(status.Coordinator.MaxLeasesPerWorker))
+		observedCoordinatorWorkers.set(float64(status.Coordinator.WorkerCount))
+	}
+
+	observedKCLLeases.set(float64(status.Leases.Owned), "state", "owned")
+	observedKCLLeases.set(float64(status.Leases.Unowned), "state", "unowned")
+	observedKCLLeases.set(float64(status.Leases.Expired), "state", "expired")
+	observedKCLLeases.set(float64(status.Leases.Finished), "state", "finished")
+
+	observedKCLLeasesByOwner.reset()
+	for owner, n := range status.Leases.ByOwner {
+		observedKCLLeasesByOwner.set(float64(n), "worker", owner)
+	}
+}
+
+func fleetStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	status := latestFleetStatus.Load()
+	if status == nil {
+		http.Error(w, "no fleet observation yet (run the observe subcommand)", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
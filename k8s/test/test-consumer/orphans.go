@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var orphansRecovered = metrics.counter("kds_orphan_leases_recovered_total", "Leases of dead workers whose owner the coordinator cleared")
+
+// orphanRecovery clears the owner of leases still assigned to dead workers, for when
+// KCL's own takeover is stuck. A lease is only cleared after two consistency checks
+// at least the KCL failover time apart saw it with the same owner and lease timeout,
+// so nobody renewed it in between, and the write is conditional on both still
+// matching. Peers then claim it as an unowned lease on their next lease sync.
+type orphanRecovery struct {
+	failoverTime time.Duration
+	sightings    map[string]orphanSighting // shard ID -> first sighting
+}
+
+type orphanSighting struct {
+	owner, leaseTimeout string
+	seen                time.Time
+}
+
+// newOrphanRecoveryFromEnv returns nil unless KDS_ORPHAN_RECOVERY=true.
+// KDS_KCL_FAILOVER_TIME must match the consumers' failover_time_millis.
+func newOrphanRecoveryFromEnv() *orphanRecovery {
+	if getEnv("KDS_ORPHAN_RECOVERY", "false") != "true" {
+		return nil
+	}
+	return &orphanRecovery{
+		failoverTime: getEnvDuration("KDS_KCL_FAILOVER_TIME", 10*time.Second),
+		sightings:    make(map[string]orphanSighting),
+	}
+}
+
+// reclaim clears the orphans that went unrenewed for the failover time and returns
+// the shards it released
+func (r *orphanRecovery) reclaim(ctx context.Context, lm *KDSLeaseManager, leaseTable string, orphans []KCLLease) []string {
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	recovered := []string{}
+	current := make(map[string]orphanSighting, len(orphans))
+	for _, lease := range orphans {
+		sighting := orphanSighting{owner: lease.Owner, leaseTimeout: lease.rawLeaseTimeout, seen: now}
+		if prev, ok := r.sightings[lease.ShardID]; ok && prev.owner == sighting.owner && prev.leaseTimeout == sighting.leaseTimeout {
+			sighting.seen = prev.seen
+		}
+		if now.Sub(sighting.seen) < r.failoverTime {
+			current[lease.ShardID] = sighting
+			continue
+		}
+		cleared, err := lm.clearLeaseOwner(ctx, leaseTable, lease)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			current[lease.ShardID] = sighting
+			continue
+		}
+		if cleared {
+			orphansRecovered.add(1)
+			recovered = append(recovered, lease.ShardID)
+			log.Printf("🧹 Cleared owner %s of shard %s, unrenewed for %s", lease.Owner, lease.ShardID, now.Sub(sighting.seen).Round(time.Second))
+		}
+	}
+	// Leases renewed, taken over or cleared since are forgotten
+	r.sightings = current
+	return recovered
+}
+
+// clearLeaseOwner removes the owner of a lease, conditional on owner and lease timeout
+// being as read; false means somebody renewed or took the lease since
+func (lm *KDSLeaseManager) clearLeaseOwner(ctx context.Context, leaseTable string, lease KCLLease) (bool, error) {
+	condition := "#o = :owner AND #t = :timeout"
+	values := map[string]types.AttributeValue{
+		":owner":   &types.AttributeValueMemberS{Value: lease.Owner},
+		":timeout": &types.AttributeValueMemberS{Value: lease.rawLeaseTimeout},
+	}
+	if lease.rawLeaseTimeout == "" {
+		condition = "#o = :owner AND attribute_not_exists(#t)"
+		delete(values, ":timeout")
+	}
+	_, err := lm.dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(leaseTable),
+		Key:                       map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: lease.ShardID}},
+		UpdateExpression:          aws.String("REMOVE #o"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]string{"#o": kclLeaseOwnerKey, "#t": kclLeaseTimeoutKey},
+		ExpressionAttributeValues: values,
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to clear owner of shard %s: %w", lease.ShardID, err)
+	}
+	return true, nil
+}
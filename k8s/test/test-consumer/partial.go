@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// metadataReadAttempts is how often a failing page of worker metadata is tried before
+// the listing gives up on it
+const metadataReadAttempts = 3
+
+// PartialError is returned alongside the rows that were read when partial reads are
+// allowed and some pages or batches of worker metadata failed after retries
+type PartialError struct {
+	// Read is the number of worker rows returned with the error
+	Read int
+	// Failed is the number of pages or batches that could not be read
+	Failed int
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("partial worker metadata: %d rows read, %d pages failed: %v", e.Read, e.Failed, e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// SetAllowPartialReads makes ListAllWorkerMetadata and GetWorkerMetadata return the
+// rows they could read with a *PartialError instead of nothing when DynamoDB fails
+// part way, for dashboards that should degrade rather than go blank
+func (lm *KDSLeaseManager) SetAllowPartialReads(allow bool) {
+	lm.allowPartialReads = allow
+}
+
+// retryRead calls read up to metadataReadAttempts times with jittered backoff
+func retryRead(ctx context.Context, read func() error) error {
+	backoff := 200 * time.Millisecond
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = read(); err == nil || attempt == metadataReadAttempts {
+			return err
+		}
+		select {
+		case <-time.After(jitter(backoff, pollJitter)):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// adaptivePolling scales a worker's metadata poll interval with the fleet size so the
+// table-wide request rate stays roughly constant as deployments grow
+type adaptivePolling struct {
+	base          time.Duration // interval at or below the reference fleet size
+	referenceSize int           // fleet size polling at base
+	maxInterval   time.Duration // upper bound for scaled intervals
+}
+
+// adaptivePollingFromEnv reads KDS_STATUS_INTERVAL, KDS_POLL_REFERENCE_WORKERS and
+// KDS_MAX_POLL_INTERVAL
+func adaptivePollingFromEnv() adaptivePolling {
+	referenceSize := int(getEnvFloat("KDS_POLL_REFERENCE_WORKERS", 10))
+	if referenceSize < 1 {
+		referenceSize = 1
+	}
+	return adaptivePolling{
+		base:          getEnvDuration("KDS_STATUS_INTERVAL", 30*time.Second),
+		referenceSize: referenceSize,
+		maxInterval:   getEnvDuration("KDS_MAX_POLL_INTERVAL", 10*time.Minute),
+	}
+}
+
+// PollInterval returns how long this worker should wait between metadata polls. The
+// coordinator always polls at the base interval so it notices changes promptly; other
+// workers back off linearly once the fleet exceeds the reference size, so
+// workers / interval stays constant.
+func (lm *KDSLeaseManager) PollInterval(p adaptivePolling) time.Duration {
+	if lm.isCoordinator.Load() {
+		return p.base
+	}
+	return p.intervalFor(int(lm.observedWorkers.Load()))
+}
+
+// intervalFor returns the poll interval of a non-coordinator worker in a fleet of size workers
+func (p adaptivePolling) intervalFor(workers int) time.Duration {
+	if workers <= p.referenceSize {
+		return p.base
+	}
+	interval := p.base * time.Duration(workers) / time.Duration(p.referenceSize)
+	return min(interval, p.maxInterval)
+}
+
+// pollIntervalFunc returns an interval source for newAdaptiveJitterTicker that logs
+// whenever the interval changes
+func (lm *KDSLeaseManager) pollIntervalFunc(p adaptivePolling) func() time.Duration {
+	var last time.Duration
+	return func() time.Duration {
+		interval := lm.PollInterval(p)
+		if interval != last && last != 0 {
+			log.Printf("Metadata poll interval now %s (workers=%d coordinator=%v)",
+				interval, lm.observedWorkers.Load(), lm.isCoordinator.Load())
+		}
+		last = interval
+		return interval
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// preflightTimeout bounds each individual preflight check
+const preflightTimeout = 10 * time.Second
+
+// preflightCheck is the outcome of a single preflight check
+type preflightCheck struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+// runPreflight verifies config sanity, network reachability, IAM permissions and
+// Kubernetes RBAC without modifying any state, prints a pass/fail report and returns
+// the process exit code (0 when every check passed)
+func runPreflight(ctx context.Context, cfg appConfig) int {
+	var checks []preflightCheck
+	record := func(name string, err error, okDetail string) {
+		if err != nil {
+			checks = append(checks, preflightCheck{name: name, detail: err.Error()})
+			return
+		}
+		checks = append(checks, preflightCheck{name: name, ok: true, detail: okDetail})
+	}
+
+	record("config", checkConfigSanity(cfg), "required settings present")
+	record("network", checkNetworkReachability(ctx, cfg), "AWS endpoint reachable")
+
+	lm, err := NewKDSLeaseManager(ctx, cfg.region, cfg.streamName, cfg.appName, cfg.workerID, cfg.endpoint)
+	if err != nil {
+		record("aws-config", err, "")
+		return printPreflightReport(checks)
+	}
+
+	record("kinesis:ListShards", lm.checkListShards(ctx), "stream "+cfg.streamName)
+	record("kinesis:DescribeStreamSummary", lm.checkDescribeStreamSummary(ctx), "stream "+cfg.streamName)
+
+	if policy, err := encryptionPolicyFromEnv(); err != nil || policy != nil {
+		if err == nil {
+			err = checkStreamEncryption(ctx, cfg, policy)
+		}
+		record("kinesis:DescribeStream", err, "stream encrypted with KMS key "+getEnv("KDS_EXPECTED_KMS_KEY", ""))
+	}
+
+	tableExists, err := lm.checkDescribeTable(ctx)
+	if err == nil && !tableExists {
+		record("dynamodb:DescribeTable", nil, "table "+lm.metadataTable+" missing, dynamodb:CreateTable will be required")
+	} else {
+		record("dynamodb:DescribeTable", err, "table "+lm.metadataTable)
+	}
+
+	if tableExists {
+		record("dynamodb:PutItem", lm.checkPutItem(ctx), "conditional write rejected as expected, nothing written")
+	}
+
+	provider, err := newWorkerCountProviderFromEnv(cfg.appName, cfg.streamName, cfg.workerID)
+	switch {
+	case err != nil:
+		record("worker-count-provider", err, "")
+	case provider != nil:
+		reqCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		count, err := provider.WorkerCount(reqCtx)
+		cancel()
+		record("worker-count-provider", err, fmt.Sprintf("reported %d workers", count))
+	default:
+		checks = append(checks, checkKubernetesAccess(ctx)...)
+	}
+
+	return printPreflightReport(checks)
+}
+
+func printPreflightReport(checks []preflightCheck) int {
+	failed := 0
+	fmt.Println("========================================")
+	fmt.Println("Preflight report")
+	fmt.Println("========================================")
+	for _, c := range checks {
+		status := "PASS"
+		if !c.ok {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("[%s] %-24s %s\n", status, c.name, c.detail)
+	}
+	fmt.Println("========================================")
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", len(checks))
+	return 0
+}
+
+func checkConfigSanity(cfg appConfig) error {
+	var problems []error
+	if cfg.region == "" {
+		problems = append(problems, errors.New("AWS_REGION is empty"))
+	}
+	if cfg.streamName == "" {
+		problems = append(problems, errors.New("STREAM_NAME is empty"))
+	}
+	if cfg.appName == "" {
+		problems = append(problems, errors.New("APP_NAME is empty"))
+	}
+	if os.Getenv("HOSTNAME") == "" {
+		problems = append(problems, errors.New("HOSTNAME is not set, worker ID falls back to "+cfg.workerID))
+	}
+	if cfg.endpoint != "" {
+		if u, err := url.Parse(cfg.endpoint); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("AWS_ENDPOINT_URL %q is not a valid URL", cfg.endpoint))
+		}
+	}
+	if v := os.Getenv("KDS_WORKER_COUNT"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			problems = append(problems, fmt.Errorf("KDS_WORKER_COUNT %q is not a positive integer", v))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// checkNetworkReachability opens a TCP connection to the configured endpoint, or the
+// regional Kinesis endpoint when talking to real AWS
+func checkNetworkReachability(ctx context.Context, cfg appConfig) error {
+	address := fmt.Sprintf("kinesis.%s.amazonaws.com:443", cfg.region)
+	if cfg.endpoint != "" {
+		u, err := url.Parse(cfg.endpoint)
+		if err != nil {
+			return err
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := net.Dialer{Timeout: preflightTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("cannot reach %s: %w", address, err)
+	}
+	return conn.Close()
+}
+
+func (lm *KDSLeaseManager) checkListShards(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	_, err := lm.kinesisClient.ListShards(ctx, &kinesis.ListShardsInput{
+		StreamName: aws.String(lm.streamName),
+		MaxResults: aws.Int32(1),
+	})
+	return err
+}
+
+func (lm *KDSLeaseManager) checkDescribeStreamSummary(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	_, err := lm.kinesisClient.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(lm.streamName),
+	})
+	return err
+}
+
+func checkStreamEncryption(ctx context.Context, cfg appConfig, policy *encryptionPolicy) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		return err
+	}
+	return policy.check(ctx, kinesis.NewFromConfig(awsCfg), cfg.streamName)
+}
+
+// checkDescribeTable reports whether the metadata table exists; a missing table is
+// not an error since InitializeMetadataTable creates it
+func (lm *KDSLeaseManager) checkDescribeTable(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	_, err := lm.dynamodbClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(lm.metadataTable),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkPutItem proves dynamodb:PutItem is allowed without writing anything: the
+// condition can never hold, so an authorized call fails with ConditionalCheckFailed
+func (lm *KDSLeaseManager) checkPutItem(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Item: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Prefix() + "preflight"},
+		},
+		ConditionExpression: aws.String("attribute_exists(worker_id) AND attribute_not_exists(worker_id)"),
+	})
+
+	var condCheckErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condCheckErr) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("unexpected successful write")
+	}
+	return err
+}
+
+// checkKubernetesAccess asks the API server (SelfSubjectAccessReview) whether the
+// service account has every permission in requiredKubernetesPermissions
+func checkKubernetesAccess(ctx context.Context) []preflightCheck {
+	if os.Getenv("KDS_WORKER_COUNT") != "" {
+		return []preflightCheck{{name: "k8s", ok: true, detail: "skipped, worker count comes from KDS_WORKER_COUNT"}}
+	}
+	if !kubernetesLookupEnabled() {
+		return []preflightCheck{{name: "k8s", detail: "lookups disabled and KDS_WORKER_COUNT unset, worker count would default to 1"}}
+	}
+
+	clientset, err := newKubernetesClientset()
+	if err != nil {
+		return []preflightCheck{{name: "k8s", detail: err.Error() + ", worker count would default to 1 (set KDS_WORKER_COUNT)"}}
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	var checks []preflightCheck
+	for _, p := range requiredKubernetesPermissions() {
+		name := "k8s:" + p.verb + " " + p.resource
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      p.verb,
+					Group:     p.group,
+					Resource:  p.resource,
+				},
+			},
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		resp, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(reqCtx, review, metav1.CreateOptions{})
+		cancel()
+
+		switch {
+		case err != nil:
+			checks = append(checks, preflightCheck{name: name, detail: err.Error()})
+		case !resp.Status.Allowed:
+			checks = append(checks, preflightCheck{name: name, detail: "denied in namespace " + namespace + " " + resp.Status.Reason})
+		default:
+			checks = append(checks, preflightCheck{name: name, ok: true, detail: "namespace " + namespace})
+		}
+	}
+	return checks
+}
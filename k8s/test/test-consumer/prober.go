@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+var (
+	dependencyUp    = metrics.gauge("kds_dependency_up", "1 when the last connectivity probe of the subsystem succeeded")
+	dependencyProbe = metrics.gauge("kds_dependency_probe_seconds", "Latency of the last connectivity probe of the subsystem")
+)
+
+// connectivityProber checks Kinesis, DynamoDB and, when lookups are enabled, the
+// Kubernetes API at startup and then every interval. The results are cached in the
+// subsystem tracker and the dependency metrics, so the probes and /metrics report
+// them without calling anything themselves.
+type connectivityProber struct {
+	kinesis    *kinesis.Client
+	dynamodb   *dynamodb.Client
+	streamName string
+	// Set by attach: the metadata table replaces ListTables with DescribeTable, and k8s
+	// stays nil when Kubernetes lookups are disabled
+	table    string
+	k8s      KubernetesAPIForLease
+	pod      string
+	interval time.Duration
+	timeout  time.Duration
+
+	last map[string]string // subsystem -> status of its last probe, to log changes only
+}
+
+// newConnectivityProberFromEnv reads KDS_PROBE_INTERVAL (default 30s, 0 probes only
+// at startup) and KDS_PROBE_TIMEOUT (default 5s per call)
+func newConnectivityProberFromEnv(kc *kinesis.Client, dc *dynamodb.Client, streamName string) *connectivityProber {
+	return &connectivityProber{
+		kinesis:    kc,
+		dynamodb:   dc,
+		streamName: streamName,
+		pod:        getEnv("HOSTNAME", ""),
+		interval:   getEnvDuration("KDS_PROBE_INTERVAL", 30*time.Second),
+		timeout:    getEnvDuration("KDS_PROBE_TIMEOUT", 5*time.Second),
+		last:       map[string]string{},
+	}
+}
+
+// attach narrows the DynamoDB probe to the metadata table of lm and adds its
+// Kubernetes API; call it before run
+func (p *connectivityProber) attach(lm *KDSLeaseManager) {
+	p.table = lm.metadataTable
+	p.k8s = lm.k8sClient
+}
+
+// run probes every interval until ctx ends
+func (p *connectivityProber) run(ctx context.Context) {
+	if p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.probe(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe checks every dependency once and returns the first AWS failure; the
+// Kubernetes API is optional, so its failures are only recorded. DynamoDB is skipped
+// without a client, in standalone mode.
+func (p *connectivityProber) probe(ctx context.Context) error {
+	kinesisErr := p.check(ctx, subsystemAWS, func(ctx context.Context) error {
+		_, err := p.kinesis.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(p.streamName)})
+		if err != nil {
+			return fmt.Errorf("kinesis test failed: %w", err)
+		}
+		return nil
+	})
+	var dynamodbErr error
+	if p.dynamodb != nil {
+		dynamodbErr = p.check(ctx, subsystemMetadata, func(ctx context.Context) error {
+			var err error
+			if p.table != "" {
+				_, err = p.dynamodb.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(p.table)})
+			} else {
+				_, err = p.dynamodb.ListTables(ctx, &dynamodb.ListTablesInput{Limit: aws.Int32(1)})
+			}
+			if err != nil {
+				return fmt.Errorf("dynamodb test failed: %w", err)
+			}
+			return nil
+		})
+	}
+	if p.k8s != nil && p.pod != "" {
+		p.check(ctx, subsystemKubernetes, func(ctx context.Context) error {
+			_, err := p.k8s.GetPod(ctx, currentNamespace(), p.pod)
+			return err
+		})
+	}
+	if kinesisErr != nil {
+		return kinesisErr
+	}
+	return dynamodbErr
+}
+
+// check runs one probe within the timeout and records its outcome
+func (p *connectivityProber) check(ctx context.Context, subsystem string, call func(context.Context) error) error {
+	callCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	start := time.Now()
+	err := call(callCtx)
+	subsystems.observe(subsystem, start, err)
+	dependencyProbe.set(time.Since(start).Seconds(), "subsystem", subsystem)
+	status, up := subsystemStatusOK, 1.0
+	if err != nil {
+		status, up = subsystemStatusFailing, 0
+	}
+	dependencyUp.set(up, "subsystem", subsystem)
+
+	if status != p.last[subsystem] {
+		if err != nil {
+			log.Printf("WARN: %s connectivity failed: %v", subsystem, err)
+		} else {
+			log.Printf("✅ %s connectivity OK", subsystem)
+		}
+		p.last[subsystem] = status
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// pollJitter is how much periodic metadata polls vary around their interval
+const pollJitter = 0.2
+
+var dynamodbThrottleWaits = metrics.counter("kds_dynamodb_limiter_waits_total", "DynamoDB metadata calls delayed by the client-side limiter")
+
+// tokenBucket is a per-process rate limiter: up to burst calls at once, refilled at
+// rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available or ctx is done
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		dynamodbThrottleWaits.add(1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// rateLimitedDynamoDB delays every metadata call through a shared token bucket, so a
+// burst of status, canary and recommender reads cannot exceed the per-process budget
+type rateLimitedDynamoDB struct {
+	next    DynamoDBAPIForLease
+	limiter *tokenBucket
+}
+
+// newRateLimitedDynamoDBFromEnv wraps client using KDS_DYNAMODB_RPS (default 10, 0
+// disables limiting) and KDS_DYNAMODB_BURST (default 20)
+func newRateLimitedDynamoDBFromEnv(client DynamoDBAPIForLease) DynamoDBAPIForLease {
+	rps := getEnvFloat("KDS_DYNAMODB_RPS", 10)
+	if rps <= 0 {
+		return client
+	}
+	burst := int(getEnvFloat("KDS_DYNAMODB_BURST", 20))
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitedDynamoDB{next: client, limiter: newTokenBucket(rps, burst)}
+}
+
+func (r *rateLimitedDynamoDB) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.CreateTable(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.DescribeTable(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.GetItem(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.PutItem(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.Scan(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.BatchGetItem(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.DeleteItem(ctx, params, optFns...)
+}
+
+func (r *rateLimitedDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.next.UpdateItem(ctx, params, optFns...)
+}
+
+// jitterTicker fires roughly every interval. The first tick comes after a random
+// offset within one interval and each later period varies by ±fraction, so a fleet
+// started together does not poll DynamoDB in lockstep.
+type jitterTicker struct {
+	C    <-chan time.Time
+	stop chan struct{}
+}
+
+func newJitterTicker(interval time.Duration, fraction float64) *jitterTicker {
+	return newAdaptiveJitterTicker(func() time.Duration { return interval }, fraction)
+}
+
+// newAdaptiveJitterTicker is newJitterTicker with the interval re-read from next
+// before every period
+func newAdaptiveJitterTicker(next func() time.Duration, fraction float64) *jitterTicker {
+	c := make(chan time.Time, 1)
+	t := &jitterTicker{C: c, stop: make(chan struct{})}
+
+	go func() {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(next()))))
+		defer timer.Stop()
+		for {
+			select {
+			case now := <-timer.C:
+				select {
+				case c <- now:
+				default: // receiver is behind, drop the tick like time.Ticker
+				}
+				timer.Reset(jitter(next(), fraction))
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Stop ends the ticker; no more ticks are delivered afterwards
+func (t *jitterTicker) Stop() {
+	close(t.stop)
+}
+
+// jitter returns d varied uniformly by ±fraction
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+// latestRecommendation is the most recent replica recommendation served on /recommendation
+var latestRecommendation atomic.Pointer[Recommendation]
+
+var (
+	recommendedReplicasGauge = metrics.gauge("kds_recommended_replicas", "Replica count recommended from shard count and throughput")
+	shardCountGauge          = metrics.gauge("kds_shard_count", "Active shards in the stream")
+	workerCountGauge         = metrics.gauge("kds_worker_count", "Current worker count")
+)
+
+// ReplicaRecommender turns shard count and per-shard throughput into a replica count
+type ReplicaRecommender struct {
+	// TargetShardsPerWorker is how many shards one worker should own
+	TargetShardsPerWorker float64
+	// WorkerCapacity is the records/sec one worker sustains; 0 ignores throughput
+	WorkerCapacity float64
+	// ShardThroughput returns the current records/sec per shard; nil ignores throughput
+	ShardThroughput func() float64
+}
+
+// Recommendation is the recommender output and the inputs it was computed from
+type Recommendation struct {
+	Shards             int       `json:"shards"`
+	CurrentWorkers     int       `json:"current_workers"`
+	ShardThroughput    float64   `json:"shard_throughput"`
+	ByShards           int       `json:"by_shards"`
+	ByThroughput       int       `json:"by_throughput"`
+	RecommendedWorkers int       `json:"recommended_workers"`
+	ComputedAt         time.Time `json:"computed_at"`
+}
+
+// newReplicaRecommenderFromEnv reads KDS_TARGET_SHARDS_PER_WORKER, KDS_WORKER_CAPACITY
+// and KDS_SHARD_THROUGHPUT (a fixed records/sec per shard estimate)
+func newReplicaRecommenderFromEnv() *ReplicaRecommender {
+	rec := &ReplicaRecommender{
+		TargetShardsPerWorker: getEnvFloat("KDS_TARGET_SHARDS_PER_WORKER", 10),
+		WorkerCapacity:        getEnvFloat("KDS_WORKER_CAPACITY", 0),
+	}
+	if throughput := getEnvFloat("KDS_SHARD_THROUGHPUT", 0); throughput > 0 {
+		rec.ShardThroughput = func() float64 { return throughput }
+	}
+	return rec
+}
+
+// Recommend computes the replica count: enough workers to keep each at or below the
+// target shards per worker and within capacity, never fewer than the lease cap needs
+// and never more than one per shard, since extra workers would sit idle
+func (r *ReplicaRecommender) Recommend(shards, currentWorkers int) Recommendation {
+	rec := Recommendation{Shards: shards, CurrentWorkers: currentWorkers, ComputedAt: time.Now()}
+
+	target := r.TargetShardsPerWorker
+	if target <= 0 || target > leasemanager.MaxLeasePerWorkerLimit {
+		target = leasemanager.MaxLeasePerWorkerLimit
+	}
+	rec.ByShards = int(math.Ceil(float64(shards) / target))
+
+	if r.ShardThroughput != nil && r.WorkerCapacity > 0 {
+		rec.ShardThroughput = r.ShardThroughput()
+		rec.ByThroughput = int(math.Ceil(float64(shards) * rec.ShardThroughput / r.WorkerCapacity))
+	}
+
+	recommended := max(rec.ByShards, rec.ByThroughput, 1)
+	if shards > 0 && recommended > shards {
+		recommended = shards
+	}
+	rec.RecommendedWorkers = recommended
+	return rec
+}
+
+// runRecommender recomputes the recommendation every interval until ctx is done,
+// publishing it as metrics and on /recommendation, and keeping the HPA minimum at the
+// recommendation when hpa is configured
+func runRecommender(ctx context.Context, lm *KDSLeaseManager, rec *ReplicaRecommender, hpa *hpaFloor, interval time.Duration) {
+	ticker := newJitterTicker(interval, pollJitter)
+	defer ticker.Stop()
+
+	for {
+		shards, err := lm.GetShardCount(ctx)
+		if err != nil {
+			log.Printf("WARN: Recommender failed to get shard count: %v", err)
+		} else if workers, err := lm.GetWorkerCount(ctx); err != nil {
+			log.Printf("WARN: Recommender failed to get worker count: %v", err)
+		} else {
+			r := rec.Recommend(shards, workers)
+			latestRecommendation.Store(&r)
+			shardCountGauge.set(float64(shards))
+			workerCountGauge.set(float64(workers))
+			recommendedReplicasGauge.set(float64(r.RecommendedWorkers))
+
+			if r.RecommendedWorkers != workers {
+				log.Printf("Recommended replicas: %d (current %d, shards=%d, byShards=%d, byThroughput=%d)",
+					r.RecommendedWorkers, workers, shards, r.ByShards, r.ByThroughput)
+			}
+			if hpa != nil {
+				if err := hpa.apply(ctx, int32(r.RecommendedWorkers)); err != nil {
+					log.Printf("WARN: Failed to update HPA %s: %v", hpa.name, err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// hpaFloor keeps an HPA's minReplicas at the recommended replica count, capped at its
+// maxReplicas, so the autoscaler never scales below what the lease math needs
+type hpaFloor struct {
+	client    KubernetesAPIForScaling
+	namespace string
+	name      string
+}
+
+// newHPAFloorFromEnv returns nil unless KDS_RECOMMENDER_HPA names an HPA to patch
+func newHPAFloorFromEnv() (*hpaFloor, error) {
+	name := os.Getenv("KDS_RECOMMENDER_HPA")
+	if name == "" {
+		return nil, nil
+	}
+	clientset, err := newKubernetesClientset()
+	if err != nil {
+		return nil, err
+	}
+	return &hpaFloor{client: clientsetAPI{clientset: clientset}, namespace: currentNamespace(), name: name}, nil
+}
+
+func (h *hpaFloor) apply(ctx context.Context, recommended int32) error {
+	current, err := h.client.GetHPA(ctx, h.namespace, h.name)
+	if err != nil {
+		return err
+	}
+
+	floor := min(recommended, current.Spec.MaxReplicas)
+	if current.Spec.MinReplicas != nil && *current.Spec.MinReplicas == floor {
+		return nil
+	}
+	if err := h.client.PatchHPAMinReplicas(ctx, h.namespace, h.name, floor); err != nil {
+		return err
+	}
+	log.Printf("Set HPA %s minReplicas to %d", h.name, floor)
+	return nil
+}
+
+func recommendationHandler(w http.ResponseWriter, _ *http.Request) {
+	r := latestRecommendation.Load()
+	if r == nil {
+		http.Error(w, "no recommendation computed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r)
+}
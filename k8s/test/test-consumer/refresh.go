@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+var maxLeasesRefreshes = metrics.counter("kds_max_leases_refresh_total", "Background max leases refreshes, by result")
+
+// MaxLeasesChange is a move of the fleet's max leases per worker seen by the
+// background refresh
+type MaxLeasesChange struct {
+	OldMaxLeases int       `json:"old_max_leases"`
+	NewMaxLeases int       `json:"new_max_leases"`
+	ShardCount   int       `json:"shard_count"`
+	WorkerCount  int       `json:"worker_count"`
+	Recalculated bool      `json:"recalculated"` // the value is the one this worker calculated from the counts it read
+	At           time.Time `json:"at"`
+}
+
+// StartBackgroundRefresh re-reads the shard and worker counts every interval and,
+// when they drift from the coordinator metadata, recalculates max leases per worker
+// and updates the coordinator the way InitializeMaxLeasesPerWorker does at startup.
+// Every change of the coordinator value, whichever worker wrote it, is sent on the
+// returned channel. A change the receiver has not taken yet is merged with the next,
+// so the channel never blocks the refresh. It is closed when ctx ends.
+func (lm *KDSLeaseManager) StartBackgroundRefresh(ctx context.Context, interval time.Duration) <-chan MaxLeasesChange {
+	changes := make(chan MaxLeasesChange, 1)
+	lm.notifyMu.Lock()
+	current := lm.initialMaxLeases
+	lm.notifyMu.Unlock()
+
+	go func() {
+		defer close(changes)
+		ticker := newJitterTicker(interval, pollJitter)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			change, err := lm.refreshMaxLeases(ctx, current)
+			switch {
+			case err != nil:
+				if ctx.Err() != nil {
+					return
+				}
+				maxLeasesRefreshes.add(1, "result", "error")
+				log.Printf("WARN: Background max leases refresh failed: %v", err)
+				continue
+			case change == nil:
+				maxLeasesRefreshes.add(1, "result", "unchanged")
+				continue
+			}
+			maxLeasesRefreshes.add(1, "result", "changed")
+			current = change.NewMaxLeases
+			sendMaxLeasesChange(changes, *change)
+		}
+	}()
+	return changes
+}
+
+// refreshMaxLeases is one pass of the background refresh: nil when the coordinator
+// value is still current
+func (lm *KDSLeaseManager) refreshMaxLeases(ctx context.Context, current int) (*MaxLeasesChange, error) {
+	shards, err := lm.GetShardCount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shard count: %w", err)
+	}
+	workers, err := lm.activeWorkerCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	coordinator, err := lm.GetCoordinatorMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if coordinator == nil || lm.streamRecreated(coordinator) {
+		// Creating the row, and resetting for a recreated stream, are left to startup
+		return nil, nil
+	}
+
+	recalculated := false
+	if coordinator.ShardCount != shards || coordinator.WorkerCount != workers || !leasemanager.ValidMaxLeases(coordinator.MaxLeasesPerWorker) {
+		newMaxLeases := lm.CalculateMaxLeasesPerWorker(shards, workers)
+		log.Printf("Background refresh detected drift, recalculating max leases per worker: shards %d -> %d, workers %d -> %d (was maxLeases=%d)",
+			coordinator.ShardCount, shards, coordinator.WorkerCount, workers, coordinator.MaxLeasesPerWorker)
+		updated := &leasemanager.Metadata{
+			WorkerID:           lm.keys().Coordinator(),
+			MaxLeasesPerWorker: newMaxLeases,
+			StreamName:         lm.streamName,
+			AppName:            lm.appName,
+			ShardCount:         shards,
+			WorkerCount:        workers,
+		}
+		if err := lm.UpdateCoordinatorMetadata(ctx, updated, coordinator.ShardCount, coordinator.WorkerCount); err != nil {
+			return nil, err
+		}
+		// Read back the row: another worker may have updated it first
+		if coordinator, err = lm.GetCoordinatorMetadata(ctx); err != nil {
+			return nil, err
+		}
+		if coordinator == nil {
+			return nil, fmt.Errorf("coordinator metadata not found after update")
+		}
+		recalculated = coordinator.MaxLeasesPerWorker == newMaxLeases &&
+			coordinator.ShardCount == shards && coordinator.WorkerCount == workers
+		if recalculated {
+			lm.ensureFleetCoverage(ctx, shards, workers, newMaxLeases)
+		}
+	}
+	if !leasemanager.ValidMaxLeases(coordinator.MaxLeasesPerWorker) {
+		return nil, fmt.Errorf("coordinator metadata has invalid max leases %d (allowed 1-%d)",
+			coordinator.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
+	}
+	if coordinator.MaxLeasesPerWorker == current {
+		return nil, nil
+	}
+
+	// Keep this worker's row, shown in the status log, in step with the coordinator
+	workerMetadata := &leasemanager.Metadata{
+		WorkerID:           lm.workerID,
+		MaxLeasesPerWorker: coordinator.MaxLeasesPerWorker,
+		StreamName:         lm.streamName,
+		AppName:            lm.appName,
+		ShardCount:         coordinator.ShardCount,
+		WorkerCount:        coordinator.WorkerCount,
+	}
+	if err := lm.SaveMetadata(ctx, workerMetadata); err != nil {
+		log.Printf("WARN: Failed to save worker metadata after refresh: %v", err)
+	}
+	return &MaxLeasesChange{
+		OldMaxLeases: current,
+		NewMaxLeases: coordinator.MaxLeasesPerWorker,
+		ShardCount:   coordinator.ShardCount,
+		WorkerCount:  coordinator.WorkerCount,
+		Recalculated: recalculated,
+		At:           time.Now(),
+	}, nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// Assignments a replay can project: kcl replays the lease protocol workers run, see
+// fleetModel; balanced places the busiest shards first on the least loaded worker,
+// as a load-aware policy would
+const (
+	replayAssignKCL      = "kcl"
+	replayAssignBalanced = "balanced"
+)
+
+// replayOptions are the arguments of a replay
+type replayOptions struct {
+	from, to   time.Time
+	period     time.Duration
+	workers    int
+	expr       *LeaseExpression
+	env        LeaseExpressionEnv
+	assignment string
+	metric     string
+	stealing   bool
+	// capacity is the load one worker sustains per second, 0 when unknown
+	capacity float64
+}
+
+// replayShard is a shard of the stream and the load it took in every period
+type replayShard struct {
+	id       string
+	parents  []string
+	open     bool // not closed by a reshard
+	load     metricSeries
+	firstHit time.Time
+	lastHit  time.Time
+}
+
+// replayHistory is what CloudWatch recorded over the replayed window
+type replayHistory struct {
+	periods []time.Time
+	shards  []*replayShard
+	total   metricSeries
+	lag     metricSeries
+	// shardLevel is false when the stream has no shard-level metrics, in which case the
+	// stream total is split evenly across the open shards
+	shardLevel bool
+}
+
+// ReplayPeriod is the projected fleet over one period of the history
+type ReplayPeriod struct {
+	Time      time.Time `json:"time"`
+	Shards    int       `json:"shards"`
+	Workers   int       `json:"workers"`
+	LagMillis int64     `json:"lag_ms"`
+	MaxLeases int       `json:"max_leases"`
+	// Error is set when the expression failed and the built-in formula was used, or the
+	// lease protocol did not settle within the period
+	Error string `json:"error,omitempty"`
+	// Loads are per second of the replayed metric
+	Total          float64 `json:"total"`
+	Busiest        string  `json:"busiest,omitempty"`
+	BusiestLoad    float64 `json:"busiest_load"`
+	MeanLoad       float64 `json:"mean_load"`
+	Imbalance      float64 `json:"imbalance"` // busiest over mean load, 1 when even
+	Unassigned     int     `json:"unassigned"`
+	UnassignedLoad float64 `json:"unassigned_load"`
+	// Moves counts the leases that changed owner since the previous period
+	Moves        int                `json:"moves"`
+	OverCapacity []string           `json:"over_capacity,omitempty"`
+	Load         map[string]float64 `json:"load"`
+	Leases       map[string]int     `json:"leases"`
+}
+
+// active reports whether the shard took records in the period starting at t: between
+// its first and last datapoint, and for a shard still open from its first datapoint on,
+// or throughout when it has none
+func (s *replayShard) active(t time.Time) bool {
+	if s.firstHit.IsZero() {
+		return s.open
+	}
+	if t.Before(s.firstHit) {
+		return false
+	}
+	return s.open || !t.After(s.lastHit)
+}
+
+// loadReplayHistory lists the shards of the stream and fetches the per-shard metric
+// (which needs enhanced shard-level monitoring), the stream total and the iterator age
+// from CloudWatch
+func loadReplayHistory(ctx context.Context, awsCfg aws.Config, endpoint string, api KinesisAPIForLease, stream string, opts replayOptions) (*replayHistory, error) {
+	h := &replayHistory{}
+	input := &kinesis.ListShardsInput{StreamName: aws.String(stream)}
+	for {
+		out, err := api.ListShards(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards of %s: %w", stream, err)
+		}
+		for _, shard := range out.Shards {
+			s := &replayShard{id: aws.ToString(shard.ShardId)}
+			for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+				if parent != nil {
+					s.parents = append(s.parents, aws.ToString(parent))
+				}
+			}
+			s.open = shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil
+			h.shards = append(h.shards, s)
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+
+	streamDim := [2]string{"StreamName", stream}
+	queries := []metricQuery{
+		{id: "total", metric: opts.metric, stat: "Sum", dimensions: [][2]string{streamDim}},
+		{id: "lag", metric: "GetRecords.IteratorAgeMilliseconds", stat: "Maximum", dimensions: [][2]string{streamDim}},
+	}
+	for i, s := range h.shards {
+		queries = append(queries, metricQuery{id: "s" + strconv.Itoa(i), metric: opts.metric, stat: "Sum",
+			dimensions: [][2]string{streamDim, {"ShardId", s.id}}})
+	}
+	series, err := getMetricData(ctx, awsCfg, endpoint, queries, opts.from, opts.to, opts.period)
+	if err != nil {
+		return nil, err
+	}
+	h.total, h.lag = series["total"], series["lag"]
+	for i, s := range h.shards {
+		s.load = series["s"+strconv.Itoa(i)]
+		for t := range s.load {
+			if s.firstHit.IsZero() || t.Before(s.firstHit) {
+				s.firstHit = t
+			}
+			if t.After(s.lastHit) {
+				s.lastHit = t
+			}
+		}
+		h.shardLevel = h.shardLevel || len(s.load) > 0
+	}
+	for t := opts.from.Truncate(opts.period); t.Before(opts.to); t = t.Add(opts.period) {
+		h.periods = append(h.periods, t)
+	}
+	return h, nil
+}
+
+// replay projects the per-worker load of every period: the shards active in it are
+// counted, max leases evaluated from the expression as the coordinator would, and the
+// shards assigned with the chosen algorithm. The kcl assignment carries its lease
+// table from period to period, so moves are those of the protocol rather than of a
+// fresh assignment.
+func replay(h *replayHistory, opts replayOptions) []ReplayPeriod {
+	workers := make([]string, opts.workers)
+	for i := range workers {
+		workers[i] = fmt.Sprintf("consumer-pod-%d", i)
+	}
+	fleet := &fleetModel{leases: map[string]*KCLLease{}, workers: workers, stealing: opts.stealing, now: opts.from}
+	listed := map[string]bool{}
+	owners := map[string]string{}
+	loc := opts.env.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	seconds := opts.period.Seconds()
+
+	results := make([]ReplayPeriod, 0, len(h.periods))
+	for _, t := range h.periods {
+		var active []*replayShard
+		for _, s := range h.shards {
+			if s.active(t) {
+				active = append(active, s)
+			}
+		}
+		load := make(map[string]float64, len(active))
+		for _, s := range active {
+			if h.shardLevel {
+				load[s.id] = s.load[t] / seconds
+			} else {
+				load[s.id] = h.total[t] / seconds / float64(len(active))
+			}
+		}
+
+		r := ReplayPeriod{Time: t.In(loc), Shards: len(active), Workers: opts.workers, LagMillis: int64(h.lag[t]),
+			Load: make(map[string]float64, len(workers)), Leases: make(map[string]int, len(workers))}
+		in := LeaseExpressionInputs{Shards: r.Shards, Workers: r.Workers, LagMillis: r.LagMillis, Time: r.Time, Custom: opts.env.Custom}
+		var err error
+		if r.MaxLeases, _, err = opts.expr.EvaluateMaxLeases(in); err != nil {
+			r.Error = err.Error()
+			r.MaxLeases = leasemanager.BuiltinMaxLeases(r.Shards, r.Workers)
+		}
+
+		var assigned map[string]string
+		if opts.assignment == replayAssignBalanced {
+			assigned = assignBalanced(active, load, workers, r.MaxLeases)
+		} else {
+			// Shards that stopped taking records were read to their end
+			for shardID := range listed {
+				if _, ok := load[shardID]; !ok {
+					if lease := fleet.leases[shardID]; lease != nil {
+						lease.State, lease.Owner, lease.Checkpoint = kclLeaseFinished, "", kclShardEnd
+					} else {
+						fleet.leases[shardID] = &KCLLease{ShardID: shardID, State: kclLeaseFinished, Checkpoint: kclShardEnd}
+					}
+				}
+			}
+			for _, s := range active {
+				if !listed[s.id] {
+					listed[s.id] = true
+					shard := kinesistypes.Shard{ShardId: aws.String(s.id)}
+					if len(s.parents) > 0 {
+						shard.ParentShardId = aws.String(s.parents[0])
+					}
+					if len(s.parents) > 1 {
+						shard.AdjacentParentShardId = aws.String(s.parents[1])
+					}
+					fleet.shards = append(fleet.shards, shard)
+				}
+			}
+			fleet.maxLeases = r.MaxLeases
+			if err := fleet.settle(); err != nil && r.Error == "" {
+				r.Error = err.Error()
+			}
+			assigned = map[string]string{}
+			for _, worker := range workers {
+				for _, shardID := range fleet.held(worker) {
+					assigned[shardID] = worker
+				}
+			}
+		}
+
+		for _, s := range active {
+			r.Total += load[s.id]
+			worker, ok := assigned[s.id]
+			if !ok {
+				r.Unassigned++
+				r.UnassignedLoad += load[s.id]
+				continue
+			}
+			r.Load[worker] += load[s.id]
+			r.Leases[worker]++
+			if prev, ok := owners[s.id]; ok && prev != worker {
+				r.Moves++
+			}
+			owners[s.id] = worker
+		}
+		for _, worker := range workers {
+			// Idle workers are listed with no load
+			l := r.Load[worker]
+			r.Load[worker] = l
+			if r.Busiest == "" || l > r.BusiestLoad {
+				r.Busiest, r.BusiestLoad = worker, l
+			}
+			if opts.capacity > 0 && l > opts.capacity {
+				r.OverCapacity = append(r.OverCapacity, worker)
+			}
+		}
+		r.MeanLoad = (r.Total - r.UnassignedLoad) / float64(len(workers))
+		r.Imbalance = 1
+		if r.MeanLoad > 0 {
+			r.Imbalance = r.BusiestLoad / r.MeanLoad
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// assignBalanced places the shards, busiest first, on the worker with the least load
+// among those below maxLeases, the fewest leases and then the lowest ordinal on a tie
+func assignBalanced(active []*replayShard, load map[string]float64, workers []string, maxLeases int) map[string]string {
+	order := append([]*replayShard(nil), active...)
+	sort.SliceStable(order, func(i, j int) bool {
+		if load[order[i].id] != load[order[j].id] {
+			return load[order[i].id] > load[order[j].id]
+		}
+		return order[i].id < order[j].id
+	})
+	total := make([]float64, len(workers))
+	count := make([]int, len(workers))
+	assigned := make(map[string]string, len(active))
+	for _, s := range order {
+		best := -1
+		for i := range workers {
+			if count[i] >= maxLeases {
+				continue
+			}
+			if best < 0 || total[i] < total[best] || (total[i] == total[best] && count[i] < count[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		total[best] += load[s.id]
+		count[best]++
+		assigned[s.id] = workers[best]
+	}
+	return assigned
+}
+
+// parseReplayArgs reads the key=value arguments of the replay command
+func parseReplayArgs(args []string, now time.Time) (replayOptions, bool, error) {
+	opts := replayOptions{
+		from:       now.Add(-24 * time.Hour),
+		to:         now,
+		period:     5 * time.Minute,
+		assignment: replayAssignKCL,
+		metric:     "IncomingRecords",
+		stealing:   getEnv("KDS_LEASE_STEALING", "true") == "true",
+	}
+	asJSON := false
+	source := getEnv("KDS_MAX_LEASES_EXPR", DefaultLeaseExpression)
+	// from= and to= take an RFC 3339 time or a duration before now
+	parseTime := func(value string) (time.Time, error) {
+		if d, err := time.ParseDuration(value); err == nil {
+			return now.Add(-d), nil
+		}
+		return time.Parse(time.RFC3339, value)
+	}
+	var err error
+	for _, arg := range args {
+		if arg == "json" {
+			asJSON = true
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return opts, false, fmt.Errorf("invalid argument %q", arg)
+		}
+		switch key {
+		case "from":
+			opts.from, err = parseTime(value)
+		case "to":
+			opts.to, err = parseTime(value)
+		case "period":
+			opts.period, err = time.ParseDuration(value)
+			if err == nil && (opts.period < time.Minute || opts.period%time.Minute != 0) {
+				err = fmt.Errorf("period must be a whole number of minutes, got %s", value)
+			}
+		case "workers":
+			opts.workers, err = strconv.Atoi(value)
+			if err == nil && opts.workers < 1 {
+				err = fmt.Errorf("workers must be at least 1, got %d", opts.workers)
+			}
+		case "policy":
+			source = value
+		case "assign":
+			opts.assignment = value
+			if value != replayAssignKCL && value != replayAssignBalanced {
+				err = fmt.Errorf("assign must be %s or %s, got %q", replayAssignKCL, replayAssignBalanced, value)
+			}
+		case "metric":
+			opts.metric = value
+			if value != "IncomingRecords" && value != "IncomingBytes" {
+				err = fmt.Errorf("metric must be IncomingRecords or IncomingBytes, got %q", value)
+			}
+		case "capacity":
+			opts.capacity, err = strconv.ParseFloat(value, 64)
+			if err == nil && (opts.capacity <= 0 || math.IsInf(opts.capacity, 0)) {
+				err = fmt.Errorf("capacity must be a positive number, got %s", value)
+			}
+		default:
+			err = fmt.Errorf("unknown argument %q", key)
+		}
+		if err != nil {
+			return opts, false, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if opts.workers == 0 {
+		return opts, false, fmt.Errorf("workers= is required")
+	}
+	if !opts.from.Before(opts.to) {
+		return opts, false, fmt.Errorf("from %s is not before to %s", opts.from.Format(time.RFC3339), opts.to.Format(time.RFC3339))
+	}
+	if opts.env, err = LoadLeaseExpressionEnv(); err != nil {
+		return opts, false, err
+	}
+	if opts.expr, err = CompileLeaseExpression(source, opts.env.CustomNames()...); err != nil {
+		return opts, false, fmt.Errorf("policy: %w", err)
+	}
+	return opts, asJSON, nil
+}
+
+// runReplayCommand implements "replay workers=N [from=] [to=] [period=] [policy=]
+// [assign=kcl|balanced] [metric=] [capacity=] [json]": it replays the stream's
+// recorded traffic from CloudWatch through a lease policy and assignment and prints
+// the projected load of the workers in every period, for capacity planning before a
+// policy changes
+func runReplayCommand(ctx context.Context, cfg appConfig, args []string) int {
+	opts, asJSON, err := parseReplayArgs(args, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "usage: replay workers=<n> [from=<RFC3339|duration ago>] [to=...] [period=5m] [policy=<expression>] [assign=kcl|balanced] [metric=IncomingRecords|IncomingBytes] [capacity=<per second>] [json]")
+		return 2
+	}
+
+	awsCfg, err := loadAWSConfig(ctx, cfg.region, cfg.endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	h, err := loadReplayHistory(ctx, awsCfg, cfg.endpoint, kinesis.NewFromConfig(awsCfg), cfg.streamName, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	results := replay(h, opts)
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	unit := "records/s"
+	if opts.metric == "IncomingBytes" {
+		unit = "bytes/s"
+	}
+	fmt.Printf("Stream: %s, policy: %s, assignment: %s, %d workers, loads in %s\n", cfg.streamName, opts.expr, opts.assignment, opts.workers, unit)
+	if !h.shardLevel {
+		fmt.Println("WARN: no shard-level metrics (enable enhanced shard-level monitoring); the stream total is split evenly across open shards")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSHARDS\tLAG\tMAX LEASES\tTOTAL\tBUSIEST\tLOAD\tMEAN\tIMBALANCE\tUNASSIGNED\tMOVES")
+	peak := -1
+	for i, r := range results {
+		maxLeases := fmt.Sprint(r.MaxLeases)
+		if r.Error != "" {
+			maxLeases += " (!)"
+		}
+		unassigned := fmt.Sprint(r.Unassigned)
+		if r.Unassigned > 0 {
+			unassigned += fmt.Sprintf(" (%.1f)", r.UnassignedLoad)
+		}
+		busiest := r.Busiest
+		if len(r.OverCapacity) > 0 {
+			busiest += fmt.Sprintf(" (+%d over capacity)", len(r.OverCapacity))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%.1f\t%s\t%.1f\t%.1f\t%.2f\t%s\t%d\n", r.Time.Format("Mon 15:04"), r.Shards,
+			time.Duration(r.LagMillis)*time.Millisecond, maxLeases, r.Total, busiest, r.BusiestLoad, r.MeanLoad, r.Imbalance, unassigned, r.Moves)
+		if peak < 0 || r.BusiestLoad > results[peak].BusiestLoad {
+			peak = i
+		}
+	}
+	w.Flush()
+	if peak >= 0 {
+		fmt.Printf("Peak: %s on %s at %s\n", strconv.FormatFloat(results[peak].BusiestLoad, 'f', 1, 64), results[peak].Busiest, results[peak].Time.Format(time.RFC3339))
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Printf("WARN: at %s: %s\n", r.Time.Format(time.RFC3339), r.Error)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// rewindPollInterval keeps GetRecords below the per-shard limit of 5 calls a second
+const rewindPollInterval = 250 * time.Millisecond
+
+// rewindPlan is the new checkpoint of one shard. An empty checkpoint removes it, so
+// the shard restarts from the application's initial position.
+type rewindPlan struct {
+	shardID    string
+	owner      string
+	old        string
+	checkpoint string
+}
+
+// runRewind implements "checkpoints rewind <shard-id,...|all> at=<RFC3339>|after=<sequence>".
+// at= replays every record that arrived at or after the timestamp; after= replays the
+// records after the sequence number, as if it were the last one checkpointed. Without
+// KDS_CONFIRM_REWIND=true it only prints the plan. Shards with a live lease are refused,
+// since their owner overwrites the checkpoint: stop the consumers first.
+func runRewind(ctx context.Context, cfg appConfig, awsCfg aws.Config, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: checkpoints rewind <shard-id,...|all> at=<RFC3339 timestamp>|after=<sequence number>")
+		return 2
+	}
+
+	var at time.Time
+	var after string
+	switch kind, value, _ := strings.Cut(args[1], "="); kind {
+	case "at":
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid timestamp %q: %v\n", value, err)
+			return 2
+		}
+		at = t
+	case "after":
+		if value == "" {
+			fmt.Fprintln(os.Stderr, "after= needs a sequence number")
+			return 2
+		}
+		after = value
+	default:
+		fmt.Fprintf(os.Stderr, "invalid rewind target %q: use at=<RFC3339 timestamp> or after=<sequence number>\n", args[1])
+		return 2
+	}
+
+	table := getEnv("KDS_KCL_LEASE_TABLE", cfg.appName)
+	leases := dynamodb.NewFromConfig(awsCfg)
+	stream := kinesis.NewFromConfig(awsCfg)
+
+	shardIDs, err := rewindShards(ctx, leases, table, args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Records older than the retention period are gone, so searches stop there
+	var oldest time.Time
+	if after == "" {
+		summary, err := stream.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(cfg.streamName)})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to describe stream %s: %v\n", cfg.streamName, err)
+			return 1
+		}
+		retention := time.Duration(aws.ToInt32(summary.StreamDescriptionSummary.RetentionPeriodHours)) * time.Hour
+		oldest = time.Now().Add(-retention)
+	}
+
+	var plans []rewindPlan
+	var live []string
+	for _, shardID := range shardIDs {
+		lease, err := leases.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(table),
+			Key:            map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read lease of shard %s: %v\n", shardID, err)
+			return 1
+		}
+		if lease.Item == nil {
+			fmt.Fprintf(os.Stderr, "shard %s has no lease in %s\n", shardID, table)
+			return 1
+		}
+		plan := rewindPlan{
+			shardID: shardID,
+			owner:   attrString(lease.Item, kclLeaseOwnerKey),
+			old:     attrString(lease.Item, kclCheckpointKey),
+		}
+		timeout, _ := time.Parse(time.RFC3339, attrString(lease.Item, kclLeaseTimeoutKey))
+		if plan.owner != "" && timeout.After(time.Now()) {
+			live = append(live, fmt.Sprintf("%s (owned by %s until %s)", shardID, plan.owner, timeout.Format(time.RFC3339)))
+			continue
+		}
+
+		if after != "" {
+			// Fails for a sequence number that does not belong to the shard
+			if _, err := stream.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+				StreamName:             aws.String(cfg.streamName),
+				ShardId:                aws.String(shardID),
+				ShardIteratorType:      kinesistypes.ShardIteratorTypeAfterSequenceNumber,
+				StartingSequenceNumber: aws.String(after),
+			}); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid sequence number for shard %s: %v\n", shardID, err)
+				return 1
+			}
+			plan.checkpoint = after
+		} else {
+			plan.checkpoint, err = lastSequenceBefore(ctx, stream, cfg.streamName, shardID, at, oldest)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to find the position of %s in shard %s: %v\n", at.Format(time.RFC3339), shardID, err)
+				return 1
+			}
+		}
+		plans = append(plans, plan)
+	}
+	if len(live) > 0 {
+		fmt.Fprintf(os.Stderr, "refusing to rewind shards with a live lease, stop the consumers first: %s\n", strings.Join(live, ", "))
+		return 1
+	}
+
+	confirmed := getEnv("KDS_CONFIRM_REWIND", "false") == "true"
+	for _, plan := range plans {
+		target := plan.checkpoint
+		if target == "" {
+			target = "<initial position>"
+		}
+		fmt.Printf("%s: %s -> %s\n", plan.shardID, plan.old, target)
+		if !confirmed {
+			continue
+		}
+		if err := applyRewind(ctx, leases, table, plan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if !confirmed {
+		fmt.Println("Dry run; set KDS_CONFIRM_REWIND=true to rewind these checkpoints")
+		return 0
+	}
+	fmt.Printf("Rewound %d shards in %s\n", len(plans), table)
+	return 0
+}
+
+// rewindShards resolves the shard list argument; "all" is every shard with a lease
+func rewindShards(ctx context.Context, client *dynamodb.Client, table, spec string) ([]string, error) {
+	if spec != "all" {
+		var shardIDs []string
+		for _, shardID := range strings.Split(spec, ",") {
+			if shardID = strings.TrimSpace(shardID); shardID != "" {
+				shardIDs = append(shardIDs, shardID)
+			}
+		}
+		if len(shardIDs) == 0 {
+			return nil, fmt.Errorf("no shards in %q", spec)
+		}
+		return shardIDs, nil
+	}
+
+	var shardIDs []string
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		ProjectionExpression:     aws.String("#k"),
+		ExpressionAttributeNames: map[string]string{"#k": kclLeaseKeyKey},
+	}
+	for {
+		result, err := client.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lease table %s: %w", table, err)
+		}
+		for _, item := range result.Items {
+			shardIDs = append(shardIDs, attrString(item, kclLeaseKeyKey))
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return shardIDs, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// lastSequenceBefore returns the sequence number of the last record in the shard that
+// arrived before t, the checkpoint from which KCL replays every record at or after t.
+// It reads forward from a growing window before t, ending at the trim horizon (oldest),
+// and returns "" when no retained record is older than t.
+func lastSequenceBefore(ctx context.Context, client KinesisAPIForRecords, streamName, shardID string, t, oldest time.Time) (string, error) {
+	for lookback := time.Minute; ; lookback *= 4 {
+		input := &kinesis.GetShardIteratorInput{
+			StreamName:        aws.String(streamName),
+			ShardId:           aws.String(shardID),
+			ShardIteratorType: kinesistypes.ShardIteratorTypeAtTimestamp,
+			Timestamp:         aws.Time(t.Add(-lookback)),
+		}
+		atHorizon := !t.Add(-lookback).After(oldest)
+		if atHorizon {
+			input.ShardIteratorType = kinesistypes.ShardIteratorTypeTrimHorizon
+			input.Timestamp = nil
+		}
+		iterator, err := client.GetShardIterator(ctx, input)
+		if err != nil {
+			return "", err
+		}
+
+		last, err := scanBefore(ctx, client, iterator.ShardIterator, t)
+		if err != nil || last != "" || atHorizon {
+			return last, err
+		}
+	}
+}
+
+// scanBefore reads records from iterator until one arrived at or after t, or the shard
+// is caught up, and returns the sequence number of the last record before t
+func scanBefore(ctx context.Context, client KinesisAPIForRecords, iterator *string, t time.Time) (string, error) {
+	last := ""
+	for iterator != nil {
+		out, err := client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator, Limit: aws.Int32(1000)})
+		if err != nil {
+			return "", err
+		}
+		for _, record := range out.Records {
+			if !aws.ToTime(record.ApproximateArrivalTimestamp).Before(t) {
+				return last, nil
+			}
+			last = aws.ToString(record.SequenceNumber)
+		}
+		if len(out.Records) == 0 && aws.ToInt64(out.MillisBehindLatest) == 0 {
+			return last, nil
+		}
+		iterator = out.NextShardIterator
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(rewindPollInterval):
+		}
+	}
+	return last, nil
+}
+
+// applyRewind writes the new checkpoint unless the lease changed since it was read
+func applyRewind(ctx context.Context, client *dynamodb.Client, table string, plan rewindPlan) error {
+	names := map[string]string{"#c": kclCheckpointKey, "#o": kclLeaseOwnerKey}
+	values := map[string]types.AttributeValue{}
+
+	condition := "attribute_not_exists(#c)"
+	if plan.old != "" {
+		condition = "#c = :old"
+		values[":old"] = &types.AttributeValueMemberS{Value: plan.old}
+	}
+	if plan.owner != "" {
+		condition += " AND #o = :owner"
+		values[":owner"] = &types.AttributeValueMemberS{Value: plan.owner}
+	} else {
+		condition += " AND attribute_not_exists(#o)"
+	}
+
+	update := "REMOVE #c"
+	if plan.checkpoint != "" {
+		update = "SET #c = :new"
+		values[":new"] = &types.AttributeValueMemberS{Value: plan.checkpoint}
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: plan.shardID}},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condCheckErr) {
+		return fmt.Errorf("lease of shard %s changed while rewinding, nothing written for it; rerun once the consumers are stopped", plan.shardID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rewind shard %s: %w", plan.shardID, err)
+	}
+	return nil
+}
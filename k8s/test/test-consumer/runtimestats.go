@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"expr_mohan/leasemanager"
+)
+
+// Worker row attributes holding runtime stats
+const (
+	leasesHeldKey       = "leases_held"
+	recordsPerSecondKey = "records_per_second"
+	lagMillisKey        = "lag_ms"
+	startedAtKey        = "started_at"
+	shardRecordsKey     = "shard_records_per_second"
+	kinesisCallsKey     = "kinesis_calls_per_minute"
+)
+
+// processStart is reported as started_at, telling restarts apart from long-lived workers
+var processStart = time.Now()
+
+// RuntimeStats is what a worker is doing right now, written to its row by SaveMetadata
+// and every Heartbeat so ListAllWorkerMetadata is an operational snapshot of the fleet
+type RuntimeStats struct {
+	LeasesHeld       int
+	RecordsPerSecond float64
+	LagMillis        int64 // max MillisBehindLatest across the shards held
+	// ShardRecordsPerSecond is the record rate of every shard held
+	ShardRecordsPerSecond map[string]float64
+}
+
+// SetRuntimeStats registers the source of the stats reported on the worker row; the
+// row only carries the process start time without one
+func (lm *KDSLeaseManager) SetRuntimeStats(stats func() RuntimeStats) {
+	lm.runtimeStats = stats
+}
+
+// runtimeStatsItem adds the start time, the Kinesis calls of the last full minute and
+// the current runtime stats to a worker row
+func (lm *KDSLeaseManager) runtimeStatsItem(item map[string]types.AttributeValue) {
+	item[startedAtKey] = &types.AttributeValueMemberS{Value: lm.startedAt.UTC().Format(time.RFC3339)}
+	// Always written, even empty: a heartbeat only overwrites the attributes it sets
+	calls := kinesisCalls.lastMinute()
+	counts := make(map[string]types.AttributeValue, len(calls))
+	for op, n := range calls {
+		counts[op] = &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+	}
+	item[kinesisCallsKey] = &types.AttributeValueMemberM{Value: counts}
+	if lm.runtimeStats == nil {
+		return
+	}
+	stats := lm.runtimeStats()
+	item[leasesHeldKey] = &types.AttributeValueMemberN{Value: strconv.Itoa(stats.LeasesHeld)}
+	item[recordsPerSecondKey] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(stats.RecordsPerSecond, 'f', 2, 64)}
+	item[lagMillisKey] = &types.AttributeValueMemberN{Value: strconv.FormatInt(stats.LagMillis, 10)}
+	if len(stats.ShardRecordsPerSecond) > 0 {
+		rates := make(map[string]types.AttributeValue, len(stats.ShardRecordsPerSecond))
+		for shardID, rate := range stats.ShardRecordsPerSecond {
+			rates[shardID] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(rate, 'f', 2, 64)}
+		}
+		item[shardRecordsKey] = &types.AttributeValueMemberM{Value: rates}
+	}
+}
+
+// parseRuntimeStats reads the runtime stats of a worker row into metadata
+func parseRuntimeStats(item map[string]types.AttributeValue, metadata *leasemanager.Metadata) {
+	metadata.StartedAt, _ = time.Parse(time.RFC3339, attrString(item, startedAtKey))
+	if val, ok := item[leasesHeldKey].(*types.AttributeValueMemberN); ok {
+		metadata.LeasesHeld, _ = strconv.Atoi(val.Value)
+	}
+	if val, ok := item[recordsPerSecondKey].(*types.AttributeValueMemberN); ok {
+		metadata.RecordsPerSecond, _ = parseFiniteFloat(val.Value)
+	}
+	if val, ok := item[lagMillisKey].(*types.AttributeValueMemberN); ok {
+		metadata.LagMillis, _ = strconv.ParseInt(val.Value, 10, 64)
+	}
+	if val, ok := item[shardRecordsKey].(*types.AttributeValueMemberM); ok {
+		metadata.ShardRecordsPerSecond = make(map[string]float64, len(val.Value))
+		for shardID, v := range val.Value {
+			if n, ok := v.(*types.AttributeValueMemberN); ok {
+				if rate, err := parseFiniteFloat(n.Value); err == nil {
+					metadata.ShardRecordsPerSecond[shardID] = rate
+				}
+			}
+		}
+	}
+	if val, ok := item[kinesisCallsKey].(*types.AttributeValueMemberM); ok {
+		metadata.KinesisCallsPerMinute = make(map[string]int, len(val.Value))
+		for op, v := range val.Value {
+			if n, ok := v.(*types.AttributeValueMemberN); ok {
+				if calls, err := strconv.Atoi(n.Value); err == nil && calls >= 0 {
+					metadata.KinesisCallsPerMinute[op] = calls
+				}
+			}
+		}
+	}
+}
+
+// parseFiniteFloat parses a rate, rejecting the NaN and infinities strconv accepts,
+// which a hand-edited row may hold and JSON cannot encode
+func parseFiniteFloat(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%q is not finite", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// s3Object is an object addressed as s3://bucket/key. It is read and written with
+// SigV4-signed requests against the S3 REST API, which is all snapshots need.
+type s3Object struct {
+	bucket string
+	key    string
+}
+
+// parseS3URI returns the object of an s3://bucket/key URI, or false for anything else
+func parseS3URI(uri string) (s3Object, bool, error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return s3Object{}, false, nil
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return s3Object{}, true, fmt.Errorf("invalid S3 URI %q: use s3://bucket/key", uri)
+	}
+	return s3Object{bucket: bucket, key: key}, true, nil
+}
+
+func (o s3Object) String() string {
+	return "s3://" + o.bucket + "/" + o.key
+}
+
+// url uses path-style addressing against a custom endpoint (LocalStack) and
+// virtual-hosted style against AWS
+func (o s3Object) url(region, endpoint string) string {
+	key := (&url.URL{Path: o.key}).EscapedPath()
+	if endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/" + o.bucket + "/" + key
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", o.bucket, region, key)
+}
+
+func (o s3Object) put(ctx context.Context, awsCfg aws.Config, endpoint string, body []byte) error {
+	_, err := o.do(ctx, awsCfg, endpoint, http.MethodPut, body)
+	return err
+}
+
+func (o s3Object) get(ctx context.Context, awsCfg aws.Config, endpoint string) ([]byte, error) {
+	return o.do(ctx, awsCfg, endpoint, http.MethodGet, nil)
+}
+
+func (o s3Object) do(ctx context.Context, awsCfg aws.Config, endpoint, method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, o.url(awsCfg.Region, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	creds, err := awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve credentials for %s: %w", o, err)
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, "s3", awsCfg.Region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	client := awsCfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, o, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, o, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, o, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
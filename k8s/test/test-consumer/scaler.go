@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+// fleetScaler grows the workload that owns this pod when the shard count outgrows
+// what the current fleet can cover at the max leases cap. It only ever scales up.
+type fleetScaler struct {
+	client      KubernetesAPIForScaling
+	maxReplicas int32
+}
+
+// newFleetScalerFromEnv returns nil unless KDS_AUTOSCALE=true. KDS_AUTOSCALE_MAX_REPLICAS
+// bounds how far the scaler may grow the fleet (default 50).
+func newFleetScalerFromEnv() (*fleetScaler, error) {
+	if getEnv("KDS_AUTOSCALE", "false") != "true" {
+		return nil, nil
+	}
+	if !kubernetesLookupEnabled() {
+		return nil, errors.New("KDS_AUTOSCALE requires KDS_ENABLE_K8S_LOOKUP to find the owning workload")
+	}
+
+	maxReplicas := 50
+	if v := os.Getenv("KDS_AUTOSCALE_MAX_REPLICAS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("KDS_AUTOSCALE_MAX_REPLICAS %q is not a positive integer", v)
+		}
+		maxReplicas = n
+	}
+
+	clientset, err := newKubernetesClientset()
+	if err != nil {
+		return nil, err
+	}
+	return &fleetScaler{client: clientsetAPI{clientset: clientset}, maxReplicas: int32(maxReplicas)}, nil
+}
+
+// SetFleetScaler lets the coordinator patch the workload replica count instead of
+// only warning when shards outgrow the fleet
+func (lm *KDSLeaseManager) SetFleetScaler(scaler *fleetScaler) {
+	lm.scaler = scaler
+}
+
+// ensureFleetCoverage checks that workers * maxLeases covers every shard. When it does
+// not, it warns and, with a fleet scaler configured, scales the owning workload up to
+// ceil(shards / maxLeases) replicas.
+func (lm *KDSLeaseManager) ensureFleetCoverage(ctx context.Context, shards, workers, maxLeases int) {
+	if maxLeases <= 0 || shards <= workers*maxLeases {
+		return
+	}
+
+	needed := int(math.Ceil(float64(shards) / float64(maxLeases)))
+	log.Printf("WARN: %d shards exceed fleet coverage of %d (%d workers x %d leases), %d workers needed",
+		shards, workers*maxLeases, workers, maxLeases, needed)
+
+	if lm.scaler == nil {
+		log.Printf("WARN: Scale the workload to at least %d replicas, or set KDS_AUTOSCALE=true", needed)
+		return
+	}
+	if err := lm.scaleOwnerTo(ctx, int32(needed)); err != nil {
+		log.Printf("WARN: Failed to scale fleet: %v", err)
+	}
+}
+
+// scaleOwnerTo raises the replica count of the StatefulSet or Deployment owning this
+// pod to replicas, bounded by the scaler's maxReplicas
+func (lm *KDSLeaseManager) scaleOwnerTo(ctx context.Context, replicas int32) error {
+	if lm.k8sClient == nil {
+		return errors.New("kubernetes client not available")
+	}
+
+	kind, name, current, err := lm.ownerWorkload(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := min(replicas, lm.scaler.maxReplicas)
+	if current >= target {
+		if target < replicas {
+			log.Printf("WARN: %s %s already at KDS_AUTOSCALE_MAX_REPLICAS=%d, %d needed",
+				kind, name, lm.scaler.maxReplicas, replicas)
+		}
+		return nil
+	}
+
+	namespace := currentNamespace()
+	if err := lm.scaler.client.ScaleWorkload(ctx, namespace, kind, name, target); err != nil {
+		return fmt.Errorf("failed to scale %s %s to %d: %w", kind, name, target, err)
+	}
+	log.Printf("📈 Scaled %s %s from %d to %d replicas to cover all shards", kind, name, current, target)
+	return nil
+}
+
+// ownerWorkload returns the kind, name and desired replicas of the StatefulSet or
+// Deployment that owns this pod
+func (lm *KDSLeaseManager) ownerWorkload(ctx context.Context) (string, string, int32, error) {
+	namespace := currentNamespace()
+	pod, err := lm.k8sClient.GetPod(ctx, namespace, lm.workerID)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to get pod %s: %w", lm.workerID, err)
+	}
+
+	for _, owner := range pod.OwnerReferences {
+		switch owner.Kind {
+		case "StatefulSet":
+			statefulset, err := lm.k8sClient.GetStatefulSet(ctx, namespace, owner.Name)
+			if err != nil {
+				return "", "", 0, err
+			}
+			if statefulset.Spec.Replicas == nil {
+				return "", "", 0, fmt.Errorf("statefulset %s has no replica count", owner.Name)
+			}
+			return "StatefulSet", owner.Name, *statefulset.Spec.Replicas, nil
+
+		case "ReplicaSet":
+			replicaset, err := lm.k8sClient.GetReplicaSet(ctx, namespace, owner.Name)
+			if err != nil {
+				return "", "", 0, err
+			}
+			for _, rsOwner := range replicaset.OwnerReferences {
+				if rsOwner.Kind == "Deployment" && replicaset.Spec.Replicas != nil {
+					return "Deployment", rsOwner.Name, *replicaset.Spec.Replicas, nil
+				}
+			}
+		}
+	}
+	return "", "", 0, fmt.Errorf("pod %s is not owned by a StatefulSet or Deployment", lm.workerID)
+}
+
+// knownWorkerIDs returns the pod names of the fleet when this pod belongs to a
+// StatefulSet, whose pods are named <statefulset>-<ordinal>
+func (lm *KDSLeaseManager) knownWorkerIDs(ctx context.Context) ([]string, error) {
+	if lm.k8sClient == nil {
+		return nil, errors.New("kubernetes client not available")
+	}
+
+	kind, name, replicas, err := lm.ownerWorkload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "StatefulSet" {
+		return nil, fmt.Errorf("%s %s pod names are not predictable", kind, name)
+	}
+
+	ids := make([]string, replicas)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s-%d", name, i)
+	}
+	return ids, nil
+}
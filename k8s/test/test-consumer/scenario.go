@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+var scenarioStepGauge = metrics.gauge("kds_scenario_step", "Steps of the chaos scenario applied so far")
+
+// Scenario actions
+const (
+	scenarioLatency           = "latency"
+	scenarioRefuseCheckpoints = "refuse_checkpoints"
+	scenarioAcceptCheckpoints = "accept_checkpoints"
+	scenarioCrash             = "crash"
+	scenarioExit              = "exit"
+)
+
+// Scenario is a chaos script the test consumer runs from KDS_SCENARIO_FILE, so fault
+// injection in the k8s harness is the same on every run:
+//
+//	name: slow-then-crash
+//	workers: [kds-consumer-1]
+//	steps:
+//	  - after: 1m
+//	    action: latency
+//	    latency: 50ms
+//	  - records: 5000
+//	    action: crash
+//
+// Steps apply in order. A step fires once `after` passed since the previous step
+// (or since consumption started) and the worker has processed at least `records`
+// records in total.
+type Scenario struct {
+	Name string `json:"name"`
+	// Workers the scenario applies to; empty means every worker
+	Workers []string       `json:"workers,omitempty"`
+	Steps   []ScenarioStep `json:"steps"`
+}
+
+// ScenarioStep is one fault injection
+type ScenarioStep struct {
+	After   string `json:"after,omitempty"`
+	Records int64  `json:"records,omitempty"`
+	Action  string `json:"action"`
+	// Latency is added per record processed; "0s" removes it
+	Latency string `json:"latency,omitempty"`
+	// Shards limits latency and refused checkpoints to these shards; empty means all
+	Shards []string `json:"shards,omitempty"`
+	// ExitCode of crash and exit (default 1)
+	ExitCode int `json:"exitCode,omitempty"`
+
+	after   time.Duration
+	latency time.Duration
+}
+
+// loadScenario reads and validates a scenario file
+func loadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	var s Scenario
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func (s *Scenario) validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("no steps")
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		var err error
+		if step.After != "" {
+			if step.after, err = time.ParseDuration(step.After); err != nil || step.after < 0 {
+				return fmt.Errorf("step %d: after must be a non-negative duration, got %q", i+1, step.After)
+			}
+		}
+		if step.Records < 0 {
+			return fmt.Errorf("step %d: records must not be negative", i+1)
+		}
+		if step.ExitCode < 0 || step.ExitCode > 255 {
+			return fmt.Errorf("step %d: exitCode must be 0-255, got %d", i+1, step.ExitCode)
+		}
+		switch step.Action {
+		case scenarioLatency:
+			if step.latency, err = time.ParseDuration(step.Latency); err != nil || step.latency < 0 {
+				return fmt.Errorf("step %d: latency must be a non-negative duration, got %q", i+1, step.Latency)
+			}
+		case scenarioRefuseCheckpoints, scenarioAcceptCheckpoints, scenarioCrash, scenarioExit:
+		default:
+			return fmt.Errorf("step %d: unknown action %q (want %s)", i+1, step.Action, strings.Join([]string{
+				scenarioLatency, scenarioRefuseCheckpoints, scenarioAcceptCheckpoints, scenarioCrash, scenarioExit}, ", "))
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the scenario targets workerID
+func (s *Scenario) appliesTo(workerID string) bool {
+	if len(s.Workers) == 0 {
+		return true
+	}
+	for _, w := range s.Workers {
+		if w == workerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (step ScenarioStep) String() string {
+	var trigger []string
+	if step.After != "" {
+		trigger = append(trigger, "after "+step.After)
+	}
+	if step.Records > 0 {
+		trigger = append(trigger, fmt.Sprintf("at %d records", step.Records))
+	}
+	if len(trigger) == 0 {
+		trigger = append(trigger, "immediately")
+	}
+	action := step.Action
+	switch step.Action {
+	case scenarioLatency:
+		action += " " + step.Latency + " per record"
+	case scenarioCrash, scenarioExit:
+		action += fmt.Sprintf(" with code %d", step.exitCode())
+	}
+	if len(step.Shards) > 0 && (step.Action == scenarioLatency || step.Action == scenarioRefuseCheckpoints) {
+		action += " on " + strings.Join(step.Shards, ",")
+	}
+	return strings.Join(trigger, ", ") + ": " + action
+}
+
+func (step ScenarioStep) exitCode() int {
+	if step.ExitCode == 0 {
+		return 1
+	}
+	return step.ExitCode
+}
+
+// activeScenario is set while a scenario runs; the shard consumers ask it for latency
+// and whether to checkpoint
+var activeScenario atomic.Pointer[scenarioRunner]
+
+// scenarioRunner applies the steps of a scenario to this worker
+type scenarioRunner struct {
+	scenario *Scenario
+	records  atomic.Int64
+
+	mu      sync.Mutex
+	latency map[string]time.Duration // shard ID ("" for all) -> per-record latency
+	refused map[string]bool          // shard ID ("" for all) -> checkpoints refused
+}
+
+// newScenarioRunnerFromEnv returns nil unless KDS_SCENARIO_FILE names a scenario that
+// applies to this worker
+func newScenarioRunnerFromEnv(workerID string) (*scenarioRunner, error) {
+	path := os.Getenv("KDS_SCENARIO_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	s, err := loadScenario(path)
+	if err != nil {
+		return nil, err
+	}
+	if !s.appliesTo(workerID) {
+		log.Printf("Scenario %q does not target worker %s", s.Name, workerID)
+		return nil, nil
+	}
+	return &scenarioRunner{
+		scenario: s,
+		latency:  make(map[string]time.Duration),
+		refused:  make(map[string]bool),
+	}, nil
+}
+
+// run applies the steps in order until the last one or until ctx ends
+func (r *scenarioRunner) run(ctx context.Context) {
+	log.Printf("🎬 Running scenario %q with %d steps", r.scenario.Name, len(r.scenario.Steps))
+	for i, step := range r.scenario.Steps {
+		select {
+		case <-time.After(step.after):
+		case <-ctx.Done():
+			return
+		}
+		for r.records.Load() < step.Records {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+		}
+		log.Printf("🎬 Scenario %q step %d/%d: %s", r.scenario.Name, i+1, len(r.scenario.Steps), step)
+		scenarioStepGauge.set(float64(i + 1))
+		r.apply(ctx, step)
+	}
+	log.Printf("🎬 Scenario %q finished", r.scenario.Name)
+}
+
+func (r *scenarioRunner) apply(ctx context.Context, step ScenarioStep) {
+	shards := step.Shards
+	if len(shards) == 0 {
+		shards = []string{""}
+	}
+	switch step.Action {
+	case scenarioLatency:
+		r.mu.Lock()
+		for _, shardID := range shards {
+			r.latency[shardID] = step.latency
+		}
+		r.mu.Unlock()
+
+	case scenarioRefuseCheckpoints, scenarioAcceptCheckpoints:
+		r.mu.Lock()
+		if len(step.Shards) == 0 {
+			// All shards: earlier per-shard settings no longer apply
+			r.refused = make(map[string]bool)
+		}
+		for _, shardID := range shards {
+			r.refused[shardID] = step.Action == scenarioRefuseCheckpoints
+		}
+		r.mu.Unlock()
+
+	case scenarioCrash:
+		// No checkpoint and no release: peers wait for the leases to expire
+		log.Printf("💥 Scenario crash, exiting with code %d", step.exitCode())
+		os.Exit(step.exitCode())
+
+	case scenarioExit:
+		isReady.Store(false)
+		releaseCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		activeConsumer.Load().releaseAll(releaseCtx)
+		cancel()
+		log.Printf("Scenario exit, exiting with code %d", step.exitCode())
+		os.Exit(step.exitCode())
+	}
+}
+
+// processed counts n records of shardID and returns the latency to inject for them
+func (r *scenarioRunner) processed(shardID string, n int) time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.records.Add(int64(n))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	latency, ok := r.latency[shardID]
+	if !ok {
+		latency = r.latency[""]
+	}
+	return latency * time.Duration(n)
+}
+
+// refusesCheckpoint reports whether checkpoints of shardID are refused
+func (r *scenarioRunner) refusesCheckpoint(shardID string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if refused, ok := r.refused[shardID]; ok {
+		return refused
+	}
+	return r.refused[""]
+}
+
+// runScenarioCommand implements "scenario <file>": it validates the file and prints
+// the steps, exiting 2 when the file is invalid
+func runScenarioCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: scenario <file>")
+		return 2
+	}
+	s, err := loadScenario(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	workers := "all workers"
+	if len(s.Workers) > 0 {
+		workers = strings.Join(s.Workers, ", ")
+	}
+	fmt.Printf("Scenario %q for %s\n", s.Name, workers)
+	for i, step := range s.Steps {
+		fmt.Printf("%d. %s\n", i+1, step)
+	}
+	return 0
+}
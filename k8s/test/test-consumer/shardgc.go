@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var shardLeasesCollected = metrics.counter("kds_shard_leases_collected_total", "SHARD_END lease rows deleted by the coordinator")
+
+// shardGC is the coordinator duty deleting lease rows of finished shards, which KCL
+// never removes, so the lease table of a frequently resharded stream stays bounded.
+// A row is only deleted once its shard is checkpointed SHARD_END, no longer listed by
+// the stream (KCL would recreate the row of a listed shard and read it again) and no
+// listed child still waits for it, and only after it stayed that way for the retention.
+type shardGC struct {
+	lm           *KDSLeaseManager
+	leaseTable   string
+	archiveTable string
+	interval     time.Duration
+	retention    time.Duration
+	last         time.Time
+	unlisted     map[string]time.Time // shard ID -> first seen finished and unlisted
+}
+
+// newShardGCFromEnv returns nil unless KDS_SHARD_GC=true; it reads
+// KDS_SHARD_GC_INTERVAL, KDS_SHARD_GC_RETENTION and KDS_SHARD_GC_ARCHIVE_TABLE
+func newShardGCFromEnv(lm *KDSLeaseManager, leaseTable string) *shardGC {
+	if getEnv("KDS_SHARD_GC", "false") != "true" {
+		return nil
+	}
+	return &shardGC{
+		lm:           lm,
+		leaseTable:   leaseTable,
+		archiveTable: getEnv("KDS_SHARD_GC_ARCHIVE_TABLE", ""),
+		interval:     getEnvDuration("KDS_SHARD_GC_INTERVAL", time.Hour),
+		retention:    getEnvDuration("KDS_SHARD_GC_RETENTION", 24*time.Hour),
+		unlisted:     make(map[string]time.Time),
+	}
+}
+
+// maybeRun collects when this worker is the coordinator and the last run is an
+// interval old. The retention restarts when another worker becomes coordinator.
+func (g *shardGC) maybeRun(ctx context.Context) {
+	if g == nil || !g.lm.isCoordinator.Load() || time.Since(g.last) < g.interval {
+		return
+	}
+	g.last = time.Now()
+	collected, err := g.collect(ctx)
+	if err != nil {
+		log.Printf("WARN: Shard lease GC failed: %v", err)
+	}
+	if len(collected) > 0 {
+		log.Printf("🗑️  Deleted %d SHARD_END lease rows: %v", len(collected), collected)
+	}
+}
+
+func (g *shardGC) collect(ctx context.Context) ([]string, error) {
+	leases, err := g.lm.ListKCLLeases(ctx, g.leaseTable)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := g.lm.listShards(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byShard := make(map[string]KCLLease, len(leases))
+	for _, lease := range leases {
+		byShard[lease.ShardID] = lease
+	}
+	listed := make(map[string]bool, len(shards))
+	waitedFor := map[string]bool{}
+	for _, shard := range shards {
+		listed[aws.ToString(shard.ShardId)] = true
+		// A child that has not started yet reads its parent's row first
+		if lease, ok := byShard[aws.ToString(shard.ShardId)]; !ok || lease.Checkpoint == "" {
+			waitedFor[aws.ToString(shard.ParentShardId)] = true
+			waitedFor[aws.ToString(shard.AdjacentParentShardId)] = true
+		}
+	}
+	for _, lease := range leases {
+		if lease.Checkpoint == "" {
+			waitedFor[lease.ParentShardID] = true
+		}
+	}
+
+	now := time.Now()
+	unlisted := make(map[string]time.Time)
+	collected := []string{}
+	for _, lease := range leases {
+		if lease.State != kclLeaseFinished || listed[lease.ShardID] || waitedFor[lease.ShardID] {
+			continue
+		}
+		since, ok := g.unlisted[lease.ShardID]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < g.retention {
+			unlisted[lease.ShardID] = since
+			continue
+		}
+		deleted, err := g.lm.deleteFinishedLease(ctx, g.leaseTable, g.archiveTable, lease.ShardID)
+		if err != nil {
+			unlisted[lease.ShardID] = since
+			g.unlisted = unlisted
+			return collected, err
+		}
+		if deleted {
+			shardLeasesCollected.add(1)
+			collected = append(collected, lease.ShardID)
+		}
+	}
+	g.unlisted = unlisted
+	return collected, nil
+}
+
+// deleteFinishedLease deletes the lease row of a shard, conditional on it being
+// checkpointed SHARD_END, after copying it to archiveTable when one is set
+func (lm *KDSLeaseManager) deleteFinishedLease(ctx context.Context, leaseTable, archiveTable, shardID string) (bool, error) {
+	key := map[string]types.AttributeValue{kclLeaseKeyKey: &types.AttributeValueMemberS{Value: shardID}}
+	if archiveTable != "" {
+		result, err := lm.dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(leaseTable),
+			Key:            key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to read lease of shard %s: %w", shardID, err)
+		}
+		if result.Item == nil || attrString(result.Item, kclCheckpointKey) != kclShardEnd {
+			return false, nil
+		}
+		result.Item["archived_at"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+		if _, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(archiveTable),
+			Item:      result.Item,
+		}); err != nil {
+			return false, fmt.Errorf("failed to archive lease of shard %s: %w", shardID, err)
+		}
+	}
+
+	_, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(leaseTable),
+		Key:                       key,
+		ConditionExpression:       aws.String("#c = :end"),
+		ExpressionAttributeNames:  map[string]string{"#c": kclCheckpointKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":end": &types.AttributeValueMemberS{Value: kclShardEnd}},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &condCheckErr):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to delete lease of shard %s: %w", shardID, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"expr_mohan/leasemanager"
+)
+
+// Simulation is a hypothetical timeline the lease math is replayed over, so a policy
+// expression can be validated offline before it is rolled out:
+//
+//	expression: min(limit, ceil(if(backfill, 2, 1) * shards / workers))
+//	variables: {backfill: 0}
+//	start: 2024-06-03T00:00:00Z
+//	steps:
+//	  - {at: 0s, shards: 20, workers: 3}
+//	  - {at: 10m, shards: 30}
+//	  - {at: 15m, workers: 5}
+//	  - {at: 2h, variables: {backfill: 1}, lagMs: 900000}
+//
+// Every step changes the inputs it sets and keeps the others. `at` is the offset from
+// start, which sets the hour and weekday variables.
+type Simulation struct {
+	// Expression defaults to KDS_MAX_LEASES_EXPR, then to the built-in formula
+	Expression string `json:"expression,omitempty"`
+	// Variables declares the custom scalars and their initial values
+	Variables map[string]float64 `json:"variables,omitempty"`
+	// Start is an RFC 3339 time (default 2024-01-01T00:00:00Z); TimeZone an IANA name
+	Start    string           `json:"start,omitempty"`
+	TimeZone string           `json:"timeZone,omitempty"`
+	Steps    []SimulationStep `json:"steps"`
+
+	expr  *LeaseExpression
+	start time.Time
+}
+
+// SimulationStep changes some inputs at an offset from the start
+type SimulationStep struct {
+	At        string             `json:"at"`
+	Shards    *int               `json:"shards,omitempty"`
+	Workers   *int               `json:"workers,omitempty"`
+	LagMillis *int64             `json:"lagMs,omitempty"`
+	Variables map[string]float64 `json:"variables,omitempty"`
+
+	at time.Duration
+}
+
+// SimulationResult is the lease math at one step
+type SimulationResult struct {
+	At        string             `json:"at"`
+	Time      time.Time          `json:"time"`
+	Shards    int                `json:"shards"`
+	Workers   int                `json:"workers"`
+	LagMillis int64              `json:"lag_ms"`
+	Variables map[string]float64 `json:"variables,omitempty"`
+	MaxLeases int                `json:"max_leases"`
+	// Clamped is set when the expression result was out of [1, limit]; Error when it
+	// failed and the worker would use the built-in formula instead
+	Clamped bool   `json:"clamped,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Unassigned shards exceed workers * max leases and are consumed by nobody
+	Unassigned int `json:"unassigned"`
+	// Rebalance lists what changed since the previous step, empty when nothing did;
+	// Moves is how many leases workers give up for it, see expectedMoves
+	Rebalance []string `json:"rebalance,omitempty"`
+	Moves     int      `json:"moves"`
+}
+
+// loadSimulation reads and validates a simulation file
+func loadSimulation(path string) (*Simulation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read simulation: %w", err)
+	}
+	var s Simulation
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse simulation %s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid simulation %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func (s *Simulation) validate() error {
+	if s.Expression == "" {
+		s.Expression = getEnv("KDS_MAX_LEASES_EXPR", DefaultLeaseExpression)
+	}
+	custom := make([]string, 0, len(s.Variables))
+	for name := range s.Variables {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	var err error
+	if s.expr, err = CompileLeaseExpression(s.Expression, custom...); err != nil {
+		return err
+	}
+
+	loc := time.UTC
+	if s.TimeZone != "" {
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return fmt.Errorf("timeZone: %w", err)
+		}
+	}
+	s.start = time.Date(2024, 1, 1, 0, 0, 0, 0, loc)
+	if s.Start != "" {
+		if s.start, err = time.Parse(time.RFC3339, s.Start); err != nil {
+			return fmt.Errorf("start must be an RFC 3339 time, got %q", s.Start)
+		}
+		s.start = s.start.In(loc)
+	}
+
+	if len(s.Steps) == 0 {
+		return errors.New("no steps")
+	}
+	if s.Steps[0].Shards == nil || s.Steps[0].Workers == nil {
+		return errors.New("step 1 must set shards and workers")
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.at, err = time.ParseDuration(step.At); err != nil || step.at < 0 {
+			return fmt.Errorf("step %d: at must be a non-negative duration, got %q", i+1, step.At)
+		}
+		if i > 0 && step.at < s.Steps[i-1].at {
+			return fmt.Errorf("step %d: at %s is before the previous step", i+1, step.At)
+		}
+		if step.Shards != nil && *step.Shards < 0 {
+			return fmt.Errorf("step %d: shards must not be negative", i+1)
+		}
+		if step.Workers != nil && *step.Workers < 1 {
+			return fmt.Errorf("step %d: workers must be at least 1", i+1)
+		}
+		for name := range step.Variables {
+			if _, ok := s.Variables[name]; !ok {
+				return fmt.Errorf("step %d: variable %q is not declared in variables", i+1, name)
+			}
+		}
+	}
+	return nil
+}
+
+// run replays the steps through the expression the way CalculateMaxLeasesPerWorker
+// evaluates it on the coordinator
+func (s *Simulation) run() []SimulationResult {
+	vars := make(map[string]float64, len(s.Variables))
+	for name, v := range s.Variables {
+		vars[name] = v
+	}
+	var shards, workers int
+	var lag int64
+	results := make([]SimulationResult, 0, len(s.Steps))
+	for i, step := range s.Steps {
+		if step.Shards != nil {
+			shards = *step.Shards
+		}
+		if step.Workers != nil {
+			workers = *step.Workers
+		}
+		if step.LagMillis != nil {
+			lag = *step.LagMillis
+		}
+		for name, v := range step.Variables {
+			vars[name] = v
+		}
+
+		r := SimulationResult{At: step.At, Time: s.start.Add(step.at), Shards: shards, Workers: workers, LagMillis: lag}
+		if len(vars) > 0 {
+			r.Variables = make(map[string]float64, len(vars))
+			for name, v := range vars {
+				r.Variables[name] = v
+			}
+		}
+		in := LeaseExpressionInputs{Shards: shards, Workers: workers, LagMillis: lag, Time: r.Time, Custom: r.Variables}
+		var err error
+		if r.MaxLeases, r.Clamped, err = s.expr.EvaluateMaxLeases(in); err != nil {
+			r.Error = err.Error()
+			r.MaxLeases = leasemanager.BuiltinMaxLeases(shards, workers)
+		}
+		r.Unassigned = max(0, shards-workers*r.MaxLeases)
+
+		if i > 0 {
+			prev := results[i-1]
+			if prev.Shards != r.Shards {
+				r.Rebalance = append(r.Rebalance, fmt.Sprintf("shards %d→%d", prev.Shards, r.Shards))
+			}
+			if prev.Workers != r.Workers {
+				r.Rebalance = append(r.Rebalance, fmt.Sprintf("workers %d→%d", prev.Workers, r.Workers))
+			}
+			if prev.MaxLeases != r.MaxLeases {
+				r.Rebalance = append(r.Rebalance, fmt.Sprintf("max leases %d→%d", prev.MaxLeases, r.MaxLeases))
+			}
+			if len(r.Rebalance) > 0 {
+				r.Moves = expectedMoves(prev.Shards, prev.Workers, prev.MaxLeases, r.Shards, r.Workers, r.MaxLeases)
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// leaseSpread is how many leases each worker holds once the fleet settled: the shards
+// spread as evenly as possible, every worker capped at maxLeases
+func leaseSpread(shards, workers, maxLeases int) []int {
+	spread := make([]int, workers)
+	for i := range spread {
+		spread[i] = leaseShare(shards, workers, maxLeases, i)
+	}
+	return spread
+}
+
+// leaseShare is the settled lease count of the worker at position i of leaseSpread
+func leaseShare(shards, workers, maxLeases, i int) int {
+	if i >= workers {
+		return 0
+	}
+	share := shards / workers
+	if i < shards%workers {
+		share++
+	}
+	return min(share, maxLeases)
+}
+
+// expectedMoves estimates the leases workers give up between two settled states:
+// what workers above their new share shed plus everything held by workers scaled
+// away. StatefulSets remove the highest ordinals first, so the workers are compared
+// by position. Resharding is counted by lease count only; the leases of closed
+// parents finish rather than move.
+func expectedMoves(shards, workers, maxLeases, nextShards, nextWorkers, nextMaxLeases int) int {
+	// Both spreads are constant between these positions, so the sum goes by segment
+	// rather than by worker; a simulation file may ask for any number of workers
+	cuts := []int{0, shards % workers, nextShards % nextWorkers, nextWorkers, workers}
+	sort.Ints(cuts)
+	moves := 0
+	for i := 0; i+1 < len(cuts); i++ {
+		from, to := cuts[i], min(cuts[i+1], workers)
+		if from >= to {
+			continue
+		}
+		shed := leaseShare(shards, workers, maxLeases, from) - leaseShare(nextShards, nextWorkers, nextMaxLeases, from)
+		moves += (to - from) * max(0, shed)
+	}
+	return moves
+}
+
+// runSimulateCommand implements "simulate <file> [json]": it replays a timeline of
+// shard and worker counts through the lease expression and prints the max leases,
+// unassigned shards and expected rebalances of every step
+func runSimulateCommand(args []string) int {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "json") {
+		fmt.Fprintln(os.Stderr, "usage: simulate <file> [json]")
+		return 2
+	}
+	s, err := loadSimulation(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	results := s.run()
+
+	if len(args) == 2 {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("Expression: %s\n", s.expr)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tTIME\tSHARDS\tWORKERS\tLAG\tMAX LEASES\tUNASSIGNED\tREBALANCE\tMOVES")
+	for _, r := range results {
+		maxLeases := fmt.Sprint(r.MaxLeases)
+		switch {
+		case r.Error != "":
+			maxLeases += " (built-in)"
+		case r.Clamped:
+			maxLeases += " (clamped)"
+		}
+		rebalance := "-"
+		if len(r.Rebalance) > 0 {
+			rebalance = strings.Join(r.Rebalance, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%d\t%s\t%d\n", r.At, r.Time.Format("Mon 15:04"), r.Shards, r.Workers,
+			time.Duration(r.LagMillis)*time.Millisecond, maxLeases, r.Unassigned, rebalance, r.Moves)
+	}
+	w.Flush()
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Printf("WARN: at %s the expression failed, workers would use the built-in formula: %s\n", r.At, r.Error)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+
+	"expr_mohan/leasemanager"
+)
+
+// standaloneEnabled reports whether KDS_STANDALONE=true: max leases per worker come
+// from ListShards and KDS_WORKER_COUNT alone, without Kubernetes or the metadata
+// table, for local development and docker-compose runs. Nothing coordinates the
+// workers, so every worker must be given the same KDS_WORKER_COUNT.
+func standaloneEnabled() bool {
+	return getEnv("KDS_STANDALONE", "false") == "true"
+}
+
+// newStandaloneLeaseManager returns a lease manager with only a Kinesis client.
+// Without a DynamoDB or Kubernetes client it can count shards and workers and apply
+// the formula or lease expression, but must not be used for metadata or KCL leases.
+func newStandaloneLeaseManager(cfg appConfig, kc *kinesis.Client) *KDSLeaseManager {
+	return &KDSLeaseManager{
+		region:        cfg.region,
+		streamName:    cfg.streamName,
+		appName:       cfg.appName,
+		workerID:      cfg.workerID,
+		consumerGroup: getEnv("KDS_CONSUMER_GROUP", leasemanager.DefaultConsumerGroup),
+		kinesisClient: &timeoutKinesis{next: kc, timeouts: callTimeoutsFromEnv()},
+		startedAt:     processStart,
+	}
+}
+
+// computeStandaloneMaxLeases counts the active shards and takes the worker count from
+// KDS_WORKER_COUNT (1 when unset)
+func (lm *KDSLeaseManager) computeStandaloneMaxLeases(ctx context.Context) (maxLeases, shardCount, workerCount int, err error) {
+	if shardCount, err = lm.GetShardCount(ctx); err != nil {
+		return 0, 0, 0, err
+	}
+	if workerCount, err = lm.GetWorkerCount(ctx); err != nil {
+		return 0, 0, 0, err
+	}
+	shardCountGauge.set(float64(shardCount))
+	workerCountGauge.set(float64(workerCount))
+	lm.observedWorkers.Store(int64(workerCount))
+	return lm.CalculateMaxLeasesPerWorker(shardCount, workerCount), shardCount, workerCount, nil
+}
+
+// runStandalone computes max leases once as the coordinator_resolved phase, then
+// recomputes it every KDS_STANDALONE_INTERVAL to follow resharding, until ctx ends
+// or a health server fails. Records are not consumed: the KCL lease protocol needs
+// the lease table this mode goes without.
+func runStandalone(ctx context.Context, cfg appConfig, sc *startupConfig, kc *kinesis.Client, healthErrs <-chan error, failures failurePolicy) int {
+	log.Println("Running standalone: no Kubernetes lookups, no metadata table, no record consumption")
+	for _, name := range []string{subsystemMetadata, subsystemKubernetes, subsystemKCLWorker} {
+		subsystems.disable(name)
+	}
+
+	lm := newStandaloneLeaseManager(cfg, kc)
+	if sc.leaseExpr != nil {
+		log.Printf("Using lease expression: %s (custom variables: %v)", sc.leaseExpr, sc.leaseExprEnv.Custom)
+		lm.SetLeaseExpression(sc.leaseExpr, sc.leaseExprEnv)
+	}
+
+	startup.skip(phaseTableReady)
+	var maxLeases int
+	if err := startup.run(ctx, phaseCoordinatorResolved, func(ctx context.Context) error {
+		var err error
+		maxLeases, _, _, err = lm.computeStandaloneMaxLeases(ctx)
+		return err
+	}); err != nil {
+		log.Printf("Startup failed: %v", err)
+		return 1
+	}
+	startup.skip(phaseWorkerStarted)
+	log.Printf("✅ Standalone max leases per worker: %d", maxLeases)
+	isReady.Store(true)
+
+	ticker := time.NewTicker(getEnvDuration("KDS_STANDALONE_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			computed, shards, workers, err := lm.computeStandaloneMaxLeases(ctx)
+			subsystems.observe(subsystemAWS, start, err)
+			if err != nil {
+				log.Printf("WARN: Failed to recompute max leases per worker: %v", err)
+				continue
+			}
+			if computed != maxLeases {
+				log.Printf("⚠️  Max leases per worker changed: Old: %d, New: %d (shards=%d, workers=%d)",
+					maxLeases, computed, shards, workers)
+				maxLeases = computed
+			}
+		case err := <-healthErrs:
+			log.Printf("%v, exiting (KDS_FAILURE_POLICY=%s)", err, failures)
+			return 1
+		case <-ctx.Done():
+			return 0
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	startupPhaseSeconds  = metrics.gauge("kds_startup_phase_seconds", "Seconds from process start until the initialization phase completed")
+	startupPhaseAttempts = metrics.counter("kds_startup_phase_attempts_total", "Initialization phase attempts, by result")
+)
+
+// Initialization phases reported by the /startup probe, in order
+const (
+	phaseConfigLoaded        = "config_loaded"
+	phaseAWSConfigLoaded     = "aws_config_loaded"
+	phaseTableReady          = InitPhaseTableReady
+	phaseCoordinatorResolved = InitPhaseCoordinatorResolved
+	phaseWorkerStarted       = "worker_started"
+)
+
+// Phase states
+const (
+	phaseStatusPending  = "pending"
+	phaseStatusRunning  = "running"
+	phaseStatusDone     = "done"
+	phaseStatusSkipped  = "skipped"
+	phaseStatusFailed   = "failed"
+	phaseStatusDegraded = "degraded" // failed, and the worker continues without it
+)
+
+// phasePolicy bounds one initialization phase: each attempt gets timeout, and failed
+// attempts are retried after backoff, doubling up to maxPhaseBackoff
+type phasePolicy struct {
+	timeout  time.Duration
+	attempts int
+	backoff  time.Duration
+}
+
+const maxPhaseBackoff = 30 * time.Second
+
+// defaultPhasePolicies retry the phases talking to AWS; configuration is read once
+var defaultPhasePolicies = map[string]phasePolicy{
+	phaseConfigLoaded:        {timeout: 30 * time.Second, attempts: 1},
+	phaseAWSConfigLoaded:     {timeout: 30 * time.Second, attempts: 3, backoff: 2 * time.Second},
+	phaseTableReady:          {timeout: time.Minute, attempts: 5, backoff: 2 * time.Second},
+	phaseCoordinatorResolved: {timeout: time.Minute, attempts: 3, backoff: 2 * time.Second},
+	phaseWorkerStarted:       {timeout: time.Minute, attempts: 3, backoff: 2 * time.Second},
+}
+
+// phasePolicyFromEnv overrides the default policy of phase with
+// KDS_STARTUP_<PHASE>_TIMEOUT, _ATTEMPTS and _BACKOFF, e.g. KDS_STARTUP_TABLE_READY_ATTEMPTS
+func phasePolicyFromEnv(phase string) phasePolicy {
+	policy := defaultPhasePolicies[phase]
+	prefix := "KDS_STARTUP_" + strings.ToUpper(phase) + "_"
+	policy.timeout = getEnvDuration(prefix+"TIMEOUT", policy.timeout)
+	policy.backoff = getEnvDuration(prefix+"BACKOFF", policy.backoff)
+	if n, err := strconv.Atoi(getEnv(prefix+"ATTEMPTS", "")); err == nil && n > 0 {
+		policy.attempts = n
+	}
+	policy.attempts = max(policy.attempts, 1)
+	return policy
+}
+
+// permanentPhaseError marks a failure retrying cannot fix
+type permanentPhaseError struct{ err error }
+
+func (e permanentPhaseError) Error() string { return e.err.Error() }
+func (e permanentPhaseError) Unwrap() error { return e.err }
+
+// noRetry stops the phase at err instead of retrying it
+func noRetry(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentPhaseError{err}
+}
+
+// startupPhase is the JSON view of a single initialization phase
+type startupPhase struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ElapsedMs   int64      `json:"elapsed_ms,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// startupStatus is the JSON body served by /startup
+type startupStatus struct {
+	Started   bool           `json:"started"`
+	StartedAt time.Time      `json:"started_at"`
+	Phases    []startupPhase `json:"phases"`
+}
+
+// startupTracker records when each initialization phase completed so the startup
+// probe can distinguish "still initializing" from "hung"
+type startupTracker struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	phases    []startupPhase
+	// retryForever lifts the attempt limit of every phase but config_loaded
+	retryForever bool
+}
+
+func newStartupTracker(names ...string) *startupTracker {
+	phases := make([]startupPhase, len(names))
+	for i, name := range names {
+		phases[i] = startupPhase{Name: name, Status: phaseStatusPending}
+	}
+	return &startupTracker{startedAt: time.Now(), phases: phases}
+}
+
+// complete marks a phase as done; completing an already finished phase is a no-op
+func (t *startupTracker) complete(name string) {
+	t.set(name, phaseStatusDone)
+}
+
+// skip marks a phase as not applicable in the current mode
+func (t *startupTracker) skip(name string) {
+	t.set(name, phaseStatusSkipped)
+}
+
+// degrade marks a failed phase the worker continues without
+func (t *startupTracker) degrade(name string) {
+	t.set(name, phaseStatusDegraded)
+}
+
+// finished reports whether the status ends a phase without failing startup
+func finished(status string) bool {
+	return status == phaseStatusDone || status == phaseStatusSkipped || status == phaseStatusDegraded
+}
+
+func (t *startupTracker) set(name, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.phases {
+		p := &t.phases[i]
+		if p.Name != name || finished(p.Status) {
+			continue
+		}
+		now := time.Now()
+		p.Status = status
+		p.CompletedAt = &now
+		p.ElapsedMs = now.Sub(t.startedAt).Milliseconds()
+		if status == phaseStatusDone {
+			startupPhaseSeconds.set(now.Sub(t.startedAt).Seconds(), "phase", name)
+		}
+	}
+}
+
+// attempt records the start of an attempt, or with err its failure
+func (t *startupTracker) attempt(name string, err error, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.phases {
+		p := &t.phases[i]
+		if p.Name != name {
+			continue
+		}
+		p.Status = status
+		if err != nil {
+			p.LastError = err.Error()
+		} else {
+			p.Attempts++
+		}
+	}
+}
+
+// run executes the phase name under its policy and marks it done. It returns the
+// last error once the attempts are used up, fn returned a noRetry error, or ctx
+// ended; the phase is then reported as failed.
+func (t *startupTracker) run(ctx context.Context, name string, fn func(context.Context) error) error {
+	policy := phasePolicyFromEnv(name)
+	backoff := policy.backoff
+	for attempt := 1; ; attempt++ {
+		t.attempt(name, nil, phaseStatusRunning)
+		attemptCtx, cancel := context.WithTimeout(ctx, policy.timeout)
+		err := fn(attemptCtx)
+		cancel()
+		if err == nil {
+			startupPhaseAttempts.add(1, "phase", name, "result", "ok")
+			t.complete(name)
+			return nil
+		}
+		startupPhaseAttempts.add(1, "phase", name, "result", "error")
+
+		var permanent permanentPhaseError
+		limited := !t.retryForever || name == phaseConfigLoaded
+		if (limited && attempt >= policy.attempts) || errors.As(err, &permanent) || ctx.Err() != nil {
+			t.attempt(name, err, phaseStatusFailed)
+			return fmt.Errorf("%s failed after %d attempt(s): %w", name, attempt, err)
+		}
+		t.attempt(name, err, phaseStatusRunning)
+		log.Printf("WARN: Startup phase %s failed (attempt %d): %v; retrying in %s", name, attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			t.attempt(name, ctx.Err(), phaseStatusFailed)
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, maxPhaseBackoff)
+	}
+}
+
+// status returns a copy of the current phase state
+func (t *startupTracker) status() startupStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := startupStatus{
+		Started:   true,
+		StartedAt: t.startedAt,
+		Phases:    make([]startupPhase, len(t.phases)),
+	}
+	copy(status.Phases, t.phases)
+
+	for _, p := range t.phases {
+		if !finished(p.Status) {
+			status.Started = false
+		}
+	}
+	return status
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps a datagram under the 1500 byte Ethernet MTU
+const statsdMaxPacket = 1432
+
+// statsdEmitter pushes the registry over UDP to a StatsD server or the Datadog agent,
+// for clusters whose observability path is the agent daemonset rather than a
+// Prometheus scraper. Gauges are sent as gauges and counters as their increase since
+// the previous flush. With the dogstatsd format the labels, app, stream and worker
+// are tags; plain StatsD has no tags, so the label values are appended to the name.
+type statsdEmitter struct {
+	registry *metricsRegistry
+	addr     string
+	prefix   string
+	tagged   bool
+	interval time.Duration
+	base     []string // name/value pairs added as tags to every metric
+
+	last map[string]float64 // counter name + label set -> value at the last flush
+}
+
+// newStatsDEmitterFromEnv returns nil unless KDS_METRICS_STATSD_ADDR is set; it reads
+// KDS_METRICS_STATSD_FORMAT (dogstatsd or statsd), KDS_METRICS_STATSD_PREFIX and
+// KDS_METRICS_STATSD_INTERVAL
+func newStatsDEmitterFromEnv(cfg appConfig) (*statsdEmitter, error) {
+	addr := getEnv("KDS_METRICS_STATSD_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("KDS_METRICS_STATSD_ADDR must be host:port: %w", err)
+	}
+	format := getEnv("KDS_METRICS_STATSD_FORMAT", "dogstatsd")
+	if format != "dogstatsd" && format != "statsd" {
+		return nil, fmt.Errorf("KDS_METRICS_STATSD_FORMAT must be dogstatsd or statsd, got %q", format)
+	}
+	return &statsdEmitter{
+		registry: metrics,
+		addr:     addr,
+		prefix:   getEnv("KDS_METRICS_STATSD_PREFIX", ""),
+		tagged:   format == "dogstatsd",
+		interval: getEnvDuration("KDS_METRICS_STATSD_INTERVAL", 10*time.Second),
+		base:     []string{"app", cfg.appName, "stream", cfg.streamName, "worker", cfg.workerID},
+		last:     map[string]float64{},
+	}, nil
+}
+
+// run flushes every interval and once more when ctx ends. The address is resolved on
+// every flush, so an agent pod replaced on the node is picked up.
+func (s *statsdEmitter) run(ctx context.Context) {
+	format := "statsd"
+	if s.tagged {
+		format = "dogstatsd"
+	}
+	log.Printf("📈 Sending metrics to %s (%s) every %s", s.addr, format, s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.send()
+		case <-ctx.Done():
+			s.send()
+			return
+		}
+	}
+}
+
+func (s *statsdEmitter) send() {
+	lines := s.lines()
+	if len(lines) == 0 {
+		return
+	}
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		log.Printf("WARN: Failed to reach StatsD at %s: %v", s.addr, err)
+		return
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			conn.Write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		log.Printf("WARN: Failed to send metrics to StatsD at %s: %v", s.addr, err)
+	}
+}
+
+// lines renders the registry as StatsD lines and advances the counter baselines
+func (s *statsdEmitter) lines() []string {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+
+	var lines []string
+	for _, name := range s.registry.order {
+		f := s.registry.families[name]
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, kind := f.values[k], "g"
+			if f.kind == "counter" {
+				// Counters restart at zero with the process
+				prev, seen := s.last[name+k]
+				s.last[name+k] = v
+				if seen && v >= prev {
+					v -= prev
+				}
+				if seen && v == 0 {
+					continue
+				}
+				kind = "c"
+			}
+			lines = append(lines, s.line(name, f.labels[k], v, kind))
+		}
+	}
+	return lines
+}
+
+// line renders one metric as name:value|type, with |#tags for dogstatsd
+func (s *statsdEmitter) line(name string, labels []string, v float64, kind string) string {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	if !s.tagged {
+		for i := 1; i < len(labels); i += 2 {
+			b.WriteString("." + statsdSanitize(labels[i]))
+		}
+	}
+	b.WriteString(":" + strconv.FormatFloat(v, 'g', -1, 64) + "|" + kind)
+	if s.tagged {
+		sep := "|#"
+		for _, pairs := range [][]string{s.base, labels} {
+			for i := 0; i+1 < len(pairs); i += 2 {
+				b.WriteString(sep + statsdSanitize(pairs[i]) + ":" + statsdSanitize(pairs[i+1]))
+				sep = ","
+			}
+		}
+	}
+	return b.String()
+}
+
+// statsdSanitize replaces the characters the line protocol reserves
+func statsdSanitize(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "@", "_", "\n", "_", " ", "_").Replace(s)
+}
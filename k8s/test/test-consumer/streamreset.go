@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+
+	"expr_mohan/leasemanager"
+)
+
+// ErrStreamRecreated is returned when the coordinator metadata belongs to an earlier
+// stream with the same name and the reset has not been confirmed
+var ErrStreamRecreated = errors.New("stream was deleted and recreated")
+
+var streamRecreatedGauge = metrics.gauge("kds_stream_recreated", "1 while the stream was recreated and the metadata reset awaits confirmation")
+
+// loadStreamIdentity records the creation time of the stream. A recreated stream
+// keeps its name and ARN but gets a new creation time and new shard IDs.
+func (lm *KDSLeaseManager) loadStreamIdentity(ctx context.Context) error {
+	createdAt, err := lm.describeStreamCreation(ctx)
+	if err != nil {
+		return err
+	}
+	lm.streamCreatedAt = createdAt
+	return nil
+}
+
+func (lm *KDSLeaseManager) describeStreamCreation(ctx context.Context) (time.Time, error) {
+	start := time.Now()
+	out, err := lm.kinesisClient.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(lm.streamName),
+	})
+	subsystems.observe(subsystemAWS, start, err)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to describe stream %s: %w", lm.streamName, err)
+	}
+	return aws.ToTime(out.StreamDescriptionSummary.StreamCreationTimestamp).UTC().Truncate(time.Second), nil
+}
+
+// CheckStreamIdentity reports whether the stream was recreated since initialization.
+// Consumers must then restart so the new stream's metadata and shards are used.
+func (lm *KDSLeaseManager) CheckStreamIdentity(ctx context.Context) (bool, error) {
+	if lm.streamCreatedAt.IsZero() {
+		return false, nil
+	}
+	createdAt, err := lm.describeStreamCreation(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !createdAt.Equal(lm.streamCreatedAt), nil
+}
+
+// streamIdentityItem adds the stream creation time to a coordinator item
+func (lm *KDSLeaseManager) streamIdentityItem(item map[string]types.AttributeValue) {
+	if !lm.streamCreatedAt.IsZero() {
+		item[leasemanager.StreamCreatedAtKey] = &types.AttributeValueMemberS{Value: lm.streamCreatedAt.Format(time.RFC3339)}
+	}
+}
+
+// streamRecreated reports whether the coordinator row was written for an earlier
+// stream. Rows written before the creation time was recorded are assumed current.
+func (lm *KDSLeaseManager) streamRecreated(coordinator *leasemanager.Metadata) bool {
+	return !lm.streamCreatedAt.IsZero() && !coordinator.StreamCreatedAt.IsZero() &&
+		!coordinator.StreamCreatedAt.Equal(lm.streamCreatedAt)
+}
+
+// resetForRecreatedStream removes the coordinator row and the KCL checkpoints left by
+// the earlier stream. The reset only happens when KDS_CONFIRM_STREAM_RESET is set to
+// the new stream's creation time, so a misread never wipes checkpoints. The worker
+// whose conditional delete of the coordinator row succeeds clears the KCL lease table;
+// the others find the row already gone or recreated.
+func (lm *KDSLeaseManager) resetForRecreatedStream(ctx context.Context, coordinator *leasemanager.Metadata) error {
+	newCreatedAt := lm.streamCreatedAt.Format(time.RFC3339)
+	oldCreatedAt := coordinator.StreamCreatedAt.Format(time.RFC3339)
+	if getEnv("KDS_CONFIRM_STREAM_RESET", "") != newCreatedAt {
+		streamRecreatedGauge.set(1)
+		return fmt.Errorf("%w: stream %s was created at %s but the coordinator metadata belongs to the stream created at %s; set KDS_CONFIRM_STREAM_RESET=%s to reset the metadata and KCL checkpoints",
+			ErrStreamRecreated, lm.streamName, newCreatedAt, oldCreatedAt, newCreatedAt)
+	}
+
+	log.Printf("Stream %s was recreated (created %s, metadata from %s), resetting coordinator metadata as confirmed",
+		lm.streamName, newCreatedAt, oldCreatedAt)
+	_, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lm.metadataTable),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: lm.keys().Coordinator()},
+		},
+		ConditionExpression:       aws.String("#c = :old"),
+		ExpressionAttributeNames:  map[string]string{"#c": leasemanager.StreamCreatedAtKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":old": &types.AttributeValueMemberS{Value: oldCreatedAt}},
+	})
+	if err != nil {
+		var condCheckErr *types.ConditionalCheckFailedException
+		if errors.As(err, &condCheckErr) {
+			log.Printf("Another worker already reset the coordinator metadata")
+			streamRecreatedGauge.set(0)
+			lm.lastCoordinator.Store(nil)
+			return nil
+		}
+		return fmt.Errorf("failed to delete coordinator metadata of the recreated stream: %w", err)
+	}
+	lm.lastCoordinator.Store(nil)
+
+	leaseTable := getEnv("KDS_KCL_LEASE_TABLE", lm.appName)
+	deleted, err := lm.clearKCLLeases(ctx, leaseTable)
+	if err != nil {
+		return fmt.Errorf("deleted coordinator metadata but failed to clear KCL leases in %s after %d rows, delete them before restarting: %w",
+			leaseTable, deleted, err)
+	}
+	log.Printf("Cleared %d KCL leases from %s for the recreated stream", deleted, leaseTable)
+	streamRecreatedGauge.set(0)
+	return nil
+}
+
+// clearKCLLeases deletes every lease in the KCL lease table. A missing table has
+// nothing to clear.
+func (lm *KDSLeaseManager) clearKCLLeases(ctx context.Context, leaseTable string) (int, error) {
+	deleted := 0
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(leaseTable),
+		ProjectionExpression:     aws.String("#k"),
+		ExpressionAttributeNames: map[string]string{"#k": kclLeaseKeyKey},
+	}
+	for {
+		result, err := lm.dynamodbClient.Scan(ctx, input)
+		if err != nil {
+			var notFound *types.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				return deleted, nil
+			}
+			return deleted, err
+		}
+		for _, item := range result.Items {
+			if _, err := lm.dynamodbClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(leaseTable),
+				Key:       map[string]types.AttributeValue{kclLeaseKeyKey: item[kclLeaseKeyKey]},
+			}); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return deleted, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// recordStreamIdentity adds the stream creation time to a coordinator row written
+// before it was recorded, so a later recreation is detected
+func (lm *KDSLeaseManager) recordStreamIdentity(ctx context.Context, coordinator *leasemanager.Metadata) {
+	if lm.streamCreatedAt.IsZero() || !coordinator.StreamCreatedAt.IsZero() {
+		return
+	}
+	item := map[string]types.AttributeValue{
+		"worker_id":             &types.AttributeValueMemberS{Value: lm.keys().Coordinator()},
+		"max_leases_per_worker": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", coordinator.MaxLeasesPerWorker)},
+		"stream_name":           &types.AttributeValueMemberS{Value: lm.streamName},
+		"app_name":              &types.AttributeValueMemberS{Value: lm.appName},
+		"shard_count":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", coordinator.ShardCount)},
+		"worker_count":          &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", coordinator.WorkerCount)},
+	}
+	timestampItem(item, time.Now())
+	lm.streamIdentityItem(item)
+
+	// Only rewrite the row read, so a concurrent recalculation is never overwritten
+	_, err := lm.dynamodbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(lm.metadataTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#c) AND max_leases_per_worker = :max AND shard_count = :shards AND worker_count = :workers"),
+		ExpressionAttributeNames: map[string]string{"#c": leasemanager.StreamCreatedAtKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":max":     item["max_leases_per_worker"],
+			":shards":  item["shard_count"],
+			":workers": item["worker_count"],
+		},
+	})
+	var condCheckErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condCheckErr) {
+		log.Printf("WARN: Failed to record stream creation time on coordinator metadata: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Subsystems reported by the /health and /ready probes
+const (
+	subsystemAWS        = "aws"
+	subsystemMetadata   = "metadata_store"
+	subsystemKCLWorker  = "kcl_worker"
+	subsystemKubernetes = "kubernetes"
+)
+
+// Subsystem states
+const (
+	subsystemStatusUnknown  = "unknown" // not checked yet
+	subsystemStatusOK       = "ok"
+	subsystemStatusFailing  = "failing"
+	subsystemStatusDisabled = "disabled"
+)
+
+// subsystemStatus is the JSON view of the last check of one subsystem
+type subsystemStatus struct {
+	Name          string     `json:"name"`
+	Status        string     `json:"status"`
+	LastCheck     *time.Time `json:"last_check,omitempty"`
+	LatencyMs     int64      `json:"latency_ms,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	FailingChecks int        `json:"consecutive_failures,omitempty"`
+}
+
+// probeStatus is the JSON body served by /health and /ready. The status code alone
+// decides the probe; the subsystems are there for whoever looks at a failing pod.
+type probeStatus struct {
+	Status     string            `json:"status"`
+	Worker     string            `json:"worker"`
+	Uptime     string            `json:"uptime"`
+	Subsystems []subsystemStatus `json:"subsystems"`
+	// Degraded is set while any fallback is in use, see degradation.go; it does not
+	// fail the probe
+	Degraded     bool          `json:"degraded"`
+	Degradations []degradation `json:"degradations,omitempty"`
+}
+
+// subsystemTracker records the outcome of the calls the worker makes anyway, so the
+// probes report them without calling AWS or Kubernetes themselves
+type subsystemTracker struct {
+	mu         sync.Mutex
+	subsystems []subsystemStatus
+}
+
+var subsystems = newSubsystemTracker(subsystemAWS, subsystemMetadata, subsystemKCLWorker, subsystemKubernetes)
+
+func newSubsystemTracker(names ...string) *subsystemTracker {
+	subsystems := make([]subsystemStatus, len(names))
+	for i, name := range names {
+		subsystems[i] = subsystemStatus{Name: name, Status: subsystemStatusUnknown}
+	}
+	return &subsystemTracker{subsystems: subsystems}
+}
+
+// observe records a check of name that started at start and returned err. The last
+// error is kept after the subsystem recovers.
+func (t *subsystemTracker) observe(name string, start time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for i := range t.subsystems {
+		s := &t.subsystems[i]
+		if s.Name != name {
+			continue
+		}
+		s.LastCheck = &now
+		s.LatencyMs = now.Sub(start).Milliseconds()
+		if err != nil {
+			s.Status = subsystemStatusFailing
+			s.LastError = err.Error()
+			s.LastErrorAt = &now
+			s.FailingChecks++
+		} else {
+			s.Status = subsystemStatusOK
+			s.FailingChecks = 0
+		}
+	}
+}
+
+// disable marks a subsystem this worker does not use
+func (t *subsystemTracker) disable(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.subsystems {
+		if t.subsystems[i].Name == name {
+			t.subsystems[i].Status = subsystemStatusDisabled
+		}
+	}
+}
+
+// status returns a copy of the subsystems under the given overall status
+func (t *subsystemTracker) status(overall string) probeStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := probeStatus{
+		Status:     overall,
+		Worker:     getEnv("HOSTNAME", "worker-unknown"),
+		Uptime:     time.Since(processStart).Round(time.Second).String(),
+		Subsystems: make([]subsystemStatus, len(t.subsystems)),
+	}
+	copy(status.Subsystems, t.subsystems)
+	status.Degradations = degradations.list()
+	status.Degraded = len(status.Degradations) > 0
+	return status
+}
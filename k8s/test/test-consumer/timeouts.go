@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// callTimeouts bounds each AWS call, so a hung endpoint fails the call instead of
+// blocking for as long as the SDK's retryer and HTTP client allow. A zero timeout
+// leaves the call bounded only by its context.
+type callTimeouts struct {
+	// listShards also bounds DescribeStreamSummary
+	listShards time.Duration
+	getItem    time.Duration
+	// putItem also bounds DeleteItem and UpdateItem
+	putItem time.Duration
+	// other covers the remaining DynamoDB calls (Scan, BatchGetItem, table management)
+	other time.Duration
+}
+
+// callTimeoutsFromEnv reads KDS_LIST_SHARDS_TIMEOUT (default 10s), KDS_GET_ITEM_TIMEOUT
+// and KDS_PUT_ITEM_TIMEOUT (default 5s) and KDS_DYNAMODB_TIMEOUT (default 30s)
+func callTimeoutsFromEnv() callTimeouts {
+	return callTimeouts{
+		listShards: getEnvDuration("KDS_LIST_SHARDS_TIMEOUT", 10*time.Second),
+		getItem:    getEnvDuration("KDS_GET_ITEM_TIMEOUT", 5*time.Second),
+		putItem:    getEnvDuration("KDS_PUT_ITEM_TIMEOUT", 5*time.Second),
+		other:      getEnvDuration("KDS_DYNAMODB_TIMEOUT", 30*time.Second),
+	}
+}
+
+func withCallTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timeoutKinesis applies callTimeouts to Kinesis calls
+type timeoutKinesis struct {
+	next     KinesisAPIForLease
+	timeouts callTimeouts
+}
+
+func (t *timeoutKinesis) ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.listShards)
+	defer cancel()
+	return t.next.ListShards(ctx, params, optFns...)
+}
+
+func (t *timeoutKinesis) DescribeStreamSummary(ctx context.Context, params *kinesis.DescribeStreamSummaryInput, optFns ...func(*kinesis.Options)) (*kinesis.DescribeStreamSummaryOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.listShards)
+	defer cancel()
+	return t.next.DescribeStreamSummary(ctx, params, optFns...)
+}
+
+// timeoutDynamoDB applies callTimeouts to DynamoDB calls. It sits below the rate
+// limiter so time spent waiting for a token does not count against the call.
+type timeoutDynamoDB struct {
+	next     DynamoDBAPIForLease
+	timeouts callTimeouts
+}
+
+func (t *timeoutDynamoDB) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.other)
+	defer cancel()
+	return t.next.CreateTable(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.other)
+	defer cancel()
+	return t.next.DescribeTable(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.getItem)
+	defer cancel()
+	return t.next.GetItem(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.putItem)
+	defer cancel()
+	return t.next.PutItem(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.other)
+	defer cancel()
+	return t.next.Scan(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.other)
+	defer cancel()
+	return t.next.BatchGetItem(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.putItem)
+	defer cancel()
+	return t.next.DeleteItem(ctx, params, optFns...)
+}
+
+func (t *timeoutDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	ctx, cancel := withCallTimeout(ctx, t.timeouts.putItem)
+	defer cancel()
+	return t.next.UpdateItem(ctx, params, optFns...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// version is the build version, set with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+// userAgentOptions tag every AWS request with this build, the app and the worker,
+// e.g. "kds-consumer/1.4.0 app/orders worker/orders-3", so CloudTrail entries and
+// support cases can be attributed to a fleet and pod. KDS_USER_AGENT_EXTRA appends
+// a free-form token such as a team or cost center.
+func userAgentOptions() []func(*middleware.Stack) error {
+	cfg := loadAppConfig()
+	opts := []func(*middleware.Stack) error{
+		awsmiddleware.AddUserAgentKeyValue("kds-consumer", userAgentToken(version)),
+		awsmiddleware.AddUserAgentKeyValue("app", userAgentToken(cfg.appName)),
+		awsmiddleware.AddUserAgentKeyValue("worker", userAgentToken(cfg.workerID)),
+	}
+	if extra := getEnv("KDS_USER_AGENT_EXTRA", ""); extra != "" {
+		opts = append(opts, awsmiddleware.AddUserAgentKey(userAgentToken(extra)))
+	}
+	return opts
+}
+
+// userAgentToken replaces characters that are not allowed in a user agent token
+func userAgentToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+			return r
+		}
+		return '-'
+	}, s)
+}
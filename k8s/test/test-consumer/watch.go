@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+// maxLeasesSubscriber is called with the previous value and the coordinator row that
+// changed it
+type maxLeasesSubscriber func(old int, coordinator *leasemanager.Metadata)
+
+// Subscribe calls fn whenever the coordinator max leases value this manager reads or
+// writes differs from the last one it saw, whichever caller read it. fn runs on the
+// goroutine that saw the change, one call at a time and in order, so it must return
+// quickly and must not call the lease manager. The returned function unsubscribes;
+// once it returns fn is not called again.
+func (lm *KDSLeaseManager) Subscribe(fn func(old, new int)) (unsubscribe func()) {
+	return lm.subscribe(func(old int, coordinator *leasemanager.Metadata) {
+		fn(old, coordinator.MaxLeasesPerWorker)
+	})
+}
+
+func (lm *KDSLeaseManager) subscribe(fn maxLeasesSubscriber) func() {
+	lm.notifyMu.Lock()
+	defer lm.notifyMu.Unlock()
+	if lm.subscribers == nil {
+		lm.subscribers = make(map[int]maxLeasesSubscriber)
+	}
+	id := lm.nextSubscriber
+	lm.nextSubscriber++
+	lm.subscribers[id] = fn
+	return func() {
+		lm.notifyMu.Lock()
+		defer lm.notifyMu.Unlock()
+		delete(lm.subscribers, id)
+	}
+}
+
+// Watch polls the coordinator metadata at the adaptive poll interval (see polling.go)
+// and sends every change of its max leases value on the returned channel, including
+// changes other callers of the lease manager read first. A change the receiver has
+// not taken yet is merged with the next. The channel is closed when ctx ends.
+func (lm *KDSLeaseManager) Watch(ctx context.Context) <-chan MaxLeasesChange {
+	changes := make(chan MaxLeasesChange, 1)
+	unsubscribe := lm.subscribe(func(old int, coordinator *leasemanager.Metadata) {
+		sendMaxLeasesChange(changes, MaxLeasesChange{
+			OldMaxLeases: old,
+			NewMaxLeases: coordinator.MaxLeasesPerWorker,
+			ShardCount:   coordinator.ShardCount,
+			WorkerCount:  coordinator.WorkerCount,
+			At:           time.Now(),
+		})
+	})
+
+	polling := adaptivePollingFromEnv()
+	go func() {
+		defer close(changes)
+		// Unsubscribed first, so nothing sends on the closed channel
+		defer unsubscribe()
+		ticker := newAdaptiveJitterTicker(func() time.Duration { return lm.PollInterval(polling) }, pollJitter)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			coordinator, err := lm.GetCoordinatorMetadata(ctx)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					log.Printf("WARN: Failed to watch coordinator metadata: %v", err)
+				}
+			case coordinator != nil && !leasemanager.ValidMaxLeases(coordinator.MaxLeasesPerWorker):
+				log.Printf("WARN: Coordinator metadata has invalid max leases %d (allowed 1-%d), ignoring it",
+					coordinator.MaxLeasesPerWorker, leasemanager.MaxLeasePerWorkerLimit)
+			}
+		}
+	}()
+	return changes
+}
+
+// notifyMaxLeases tells the subscribers about coordinator when its value differs from
+// the last one seen. The first value seen only sets the baseline, unless startup
+// already settled on a value, from the cache or the fallback.
+func (lm *KDSLeaseManager) notifyMaxLeases(coordinator *leasemanager.Metadata) {
+	lm.notifyMu.Lock()
+	defer lm.notifyMu.Unlock()
+	old := lm.notifiedMaxLeases
+	if old == 0 {
+		old = lm.initialMaxLeases
+	}
+	lm.notifiedMaxLeases = coordinator.MaxLeasesPerWorker
+	if old == 0 || old == coordinator.MaxLeasesPerWorker {
+		return
+	}
+	for _, fn := range lm.subscribers {
+		fn(old, coordinator)
+	}
+}
+
+// setInitialMaxLeases records the value InitializeMaxLeasesPerWorker settled on
+func (lm *KDSLeaseManager) setInitialMaxLeases(maxLeases int) {
+	lm.notifyMu.Lock()
+	defer lm.notifyMu.Unlock()
+	lm.initialMaxLeases = maxLeases
+}
+
+// sendMaxLeasesChange sends change without blocking: when the receiver has not taken
+// the pending change yet, the two are merged into one. Callers never send on ch
+// concurrently.
+func sendMaxLeasesChange(ch chan MaxLeasesChange, change MaxLeasesChange) {
+	select {
+	case ch <- change:
+		return
+	default:
+	}
+	select {
+	case pending := <-ch:
+		change.OldMaxLeases = pending.OldMaxLeases
+		change.Recalculated = change.Recalculated || pending.Recalculated
+	default:
+	}
+	if change.OldMaxLeases != change.NewMaxLeases {
+		ch <- change
+	}
+}
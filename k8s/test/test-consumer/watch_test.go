@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"expr_mohan/leasemanager"
+)
+
+func TestSendMaxLeasesChange(t *testing.T) {
+	t.Run("merges a change the receiver has not taken", func(t *testing.T) {
+		ch := make(chan MaxLeasesChange, 1)
+		sendMaxLeasesChange(ch, MaxLeasesChange{OldMaxLeases: 5, NewMaxLeases: 7, Recalculated: true})
+		sendMaxLeasesChange(ch, MaxLeasesChange{OldMaxLeases: 7, NewMaxLeases: 9, ShardCount: 18, WorkerCount: 2})
+
+		got := <-ch
+		if got.OldMaxLeases != 5 || got.NewMaxLeases != 9 || !got.Recalculated || got.ShardCount != 18 || got.WorkerCount != 2 {
+			t.Fatalf("got %+v, want one change 5 -> 9 with the latest counts", got)
+		}
+		if len(ch) != 0 {
+			t.Fatalf("%d more changes pending", len(ch))
+		}
+	})
+
+	t.Run("drops a change that cancels back to the old value", func(t *testing.T) {
+		ch := make(chan MaxLeasesChange, 1)
+		sendMaxLeasesChange(ch, MaxLeasesChange{OldMaxLeases: 5, NewMaxLeases: 7})
+		sendMaxLeasesChange(ch, MaxLeasesChange{OldMaxLeases: 7, NewMaxLeases: 5})
+		if len(ch) != 0 {
+			t.Fatalf("got %+v, want no change", <-ch)
+		}
+
+		// A later change is sent again
+		sendMaxLeasesChange(ch, MaxLeasesChange{OldMaxLeases: 5, NewMaxLeases: 6})
+		if got := <-ch; got.OldMaxLeases != 5 || got.NewMaxLeases != 6 {
+			t.Fatalf("got %+v, want 5 -> 6", got)
+		}
+	})
+}
+
+func TestNotifyMaxLeases(t *testing.T) {
+	lm := &KDSLeaseManager{}
+	var calls [][2]int
+	unsubscribe := lm.Subscribe(func(old, new int) {
+		calls = append(calls, [2]int{old, new})
+	})
+
+	// The first value only sets the baseline, and an unchanged value is not a change
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 5})
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 5})
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 7})
+	if len(calls) != 1 || calls[0] != [2]int{5, 7} {
+		t.Fatalf("got calls %v, want [[5 7]]", calls)
+	}
+
+	unsubscribe()
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 9})
+	if len(calls) != 1 {
+		t.Fatalf("called after unsubscribing: %v", calls)
+	}
+}
+
+func TestNotifyMaxLeasesFromInitialValue(t *testing.T) {
+	lm := &KDSLeaseManager{}
+	lm.setInitialMaxLeases(4)
+	var calls [][2]int
+	lm.Subscribe(func(old, new int) {
+		calls = append(calls, [2]int{old, new})
+	})
+
+	// Startup settled on a fallback value, so the first row read is a change
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 6})
+	if len(calls) != 1 || calls[0] != [2]int{4, 6} {
+		t.Fatalf("got calls %v, want [[4 6]]", calls)
+	}
+}
+
+// TestWatchUnsubscribesBeforeClose notifies after the channel of an ended Watch was
+// closed: the subscription must be gone by then, or the send panics
+func TestWatchUnsubscribesBeforeClose(t *testing.T) {
+	lm := &KDSLeaseManager{}
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 5})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := lm.Watch(ctx)
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 7})
+	cancel()
+
+	select {
+	case got := <-changes:
+		if got.OldMaxLeases != 5 || got.NewMaxLeases != 7 {
+			t.Fatalf("got %+v, want 5 -> 7", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not delivered")
+	}
+	select {
+	case _, open := <-changes:
+		if open {
+			t.Fatal("got a second change")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after ctx ended")
+	}
+
+	lm.notifyMaxLeases(&leasemanager.Metadata{MaxLeasesPerWorker: 9})
+	if n := len(lm.subscribers); n != 0 {
+		t.Fatalf("%d subscribers left", n)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WorkerCountProvider supplies the authoritative number of workers sharing the
+// stream's leases, e.g. from a central scheduler instead of Kubernetes replicas
+type WorkerCountProvider interface {
+	WorkerCount(ctx context.Context) (int, error)
+}
+
+// httpWorkerCountProvider asks an operator-provided control-plane endpoint for the
+// worker count. The endpoint receives app, stream and worker query parameters and
+// answers either {"worker_count": N} or a bare integer.
+type httpWorkerCountProvider struct {
+	endpoint   string
+	token      string
+	tokenFile  string
+	appName    string
+	streamName string
+	workerID   string
+	client     *http.Client
+}
+
+// newWorkerCountProviderFromEnv returns the HTTP provider configured through
+// KDS_WORKER_COUNT_URL, or nil when no control-plane endpoint is set.
+// Authentication uses a bearer token from KDS_WORKER_COUNT_TOKEN or, re-read on
+// every call so rotated tokens are picked up, KDS_WORKER_COUNT_TOKEN_FILE.
+func newWorkerCountProviderFromEnv(appName, streamName, workerID string) (WorkerCountProvider, error) {
+	endpoint := os.Getenv("KDS_WORKER_COUNT_URL")
+	if endpoint == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid KDS_WORKER_COUNT_URL: %w", err)
+	}
+
+	return &httpWorkerCountProvider{
+		endpoint:   endpoint,
+		token:      os.Getenv("KDS_WORKER_COUNT_TOKEN"),
+		tokenFile:  os.Getenv("KDS_WORKER_COUNT_TOKEN_FILE"),
+		appName:    appName,
+		streamName: streamName,
+		workerID:   workerID,
+		client:     &http.Client{Timeout: getEnvDuration("KDS_WORKER_COUNT_TIMEOUT", 5*time.Second)},
+	}, nil
+}
+
+// WorkerCount queries the control plane; any transport, auth or decoding problem is
+// returned as an error rather than silently defaulting
+func (p *httpWorkerCountProvider) WorkerCount(ctx context.Context) (int, error) {
+	u, err := url.Parse(p.endpoint)
+	if err != nil {
+		return 0, err
+	}
+	q := u.Query()
+	q.Set("app", p.appName)
+	q.Set("stream", p.streamName)
+	q.Set("worker", p.workerID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token, err := p.bearerToken()
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("worker count request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read worker count response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("worker count endpoint returned %s", resp.Status)
+	}
+
+	count, err := parseWorkerCountResponse(body)
+	if err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		return 0, fmt.Errorf("worker count endpoint returned non-positive count %d", count)
+	}
+	return count, nil
+}
+
+func (p *httpWorkerCountProvider) bearerToken() (string, error) {
+	if p.tokenFile == "" {
+		return p.token, nil
+	}
+	data, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read worker count token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func parseWorkerCountResponse(body []byte) (int, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if n, err := strconv.Atoi(trimmed); err == nil {
+		return n, nil
+	}
+
+	var payload struct {
+		WorkerCount *int `json:"worker_count"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.WorkerCount == nil {
+		return 0, fmt.Errorf("unexpected worker count response %q", trimmed)
+	}
+	return *payload.WorkerCount, nil
+}
@@ -0,0 +1,114 @@
+package leasemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+)
+
+// ListShardsAPI defines the Kinesis operation OpenShardCount lists shards with
+type ListShardsAPI interface {
+	ListShards(ctx context.Context, params *kinesis.ListShardsInput, optFns ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+}
+
+// OpenShardCount lists every shard of stream, page by page, and counts the open ones
+func OpenShardCount(ctx context.Context, client ListShardsAPI, stream string) (int, error) {
+	input := &kinesis.ListShardsInput{StreamName: aws.String(stream)}
+	var open int
+	for {
+		out, err := client.ListShards(ctx, input)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list shards of stream %s: %w", stream, err)
+		}
+		open += CountOpenShards(out.Shards)
+		if out.NextToken == nil {
+			return open, nil
+		}
+		// A continued listing names only the token
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// Workers reads every worker row of the fleet
+func (t Table) Workers(ctx context.Context) ([]*Metadata, error) {
+	input := t.WorkerScan()
+	var workers []*Metadata
+	for {
+		out, err := t.DB.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan worker metadata: %w", err)
+		}
+		for _, item := range out.Items {
+			workers = append(workers, ParseWorker(item, t.Keys.Worker("")))
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return workers, nil
+		}
+		next := *input
+		next.ExclusiveStartKey = out.LastEvaluatedKey
+		input = &next
+	}
+}
+
+// LiveWorkers counts the workers whose row was updated within timeout of now. A
+// worker that stopped without deleting its row no longer counts once it goes stale.
+func LiveWorkers(workers []*Metadata, now time.Time, timeout time.Duration) int {
+	var live int
+	for _, w := range workers {
+		if !w.LastUpdateTime.IsZero() && now.Sub(w.LastUpdateTime) <= timeout {
+			live++
+		}
+	}
+	return live
+}
+
+// Reconcile makes the coordinator row hold the value for shardCount and workerCount
+// and returns the row as stored. With no row it creates one; when the row was computed
+// for other counts, or holds an invalid value, it replaces it only if the counts read
+// are still there. Either way, a write lost to another worker is not retried: that
+// worker saw counts at least as recent, so its row is read back and kept. maxLeases
+// computes the value, BuiltinMaxLeases unless the caller has its own.
+func (t Table) Reconcile(ctx context.Context, shardCount, workerCount int, maxLeases func(shardCount, workerCount int) int) (*Metadata, error) {
+	current, err := t.Coordinator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.ShardCount == shardCount && current.WorkerCount == workerCount &&
+		ValidMaxLeases(current.MaxLeasesPerWorker) {
+		return current, nil
+	}
+
+	next := &Metadata{
+		WorkerID:           t.Keys.Coordinator(),
+		MaxLeasesPerWorker: maxLeases(shardCount, workerCount),
+		StreamName:         t.Keys.Stream,
+		AppName:            t.Keys.App,
+		ShardCount:         shardCount,
+		WorkerCount:        workerCount,
+		LastUpdateTime:     time.Now(),
+	}
+	item := Item(next.WorkerID, next)
+	if current == nil {
+		err = t.CreateCoordinator(ctx, item)
+	} else {
+		err = t.UpdateCoordinator(ctx, item, current.ShardCount, current.WorkerCount)
+	}
+	if errors.Is(err, ErrCoordinatorChanged) {
+		return t.Coordinator(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// The SDK clients satisfy the interfaces the package reads with
+var (
+	_ DynamoDBAPI   = (*dynamodb.Client)(nil)
+	_ ListShardsAPI = (*kinesis.Client)(nil)
+)
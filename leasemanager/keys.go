@@ -0,0 +1,43 @@
+package leasemanager
+
+// Keys names the metadata rows of one fleet. Every row is namespaced by (app, stream,
+// region) and consumer group, so deployments sharing an app name but consuming
+// different streams, or independent fleets of the same stream, never see each
+// other's rows.
+type Keys struct {
+	App    string
+	Stream string
+	Region string
+	// Group is the consumer group; empty is DefaultConsumerGroup
+	Group string
+}
+
+// Table is the metadata table of the application
+func (k Keys) Table() string {
+	return k.App + "_meta"
+}
+
+// Prefix is the start of every row key of the fleet
+func (k Keys) Prefix() string {
+	prefix := k.App + "#" + k.Stream + "#" + k.Region
+	if k.Group != "" && k.Group != DefaultConsumerGroup {
+		prefix += "@" + k.Group
+	}
+	return prefix + "#"
+}
+
+// Coordinator is the key of the row holding the fleet's max leases per worker
+func (k Keys) Coordinator() string {
+	// All pods in the same deployment/statefulset share app, stream and region
+	return k.Prefix() + "coordinator"
+}
+
+// Worker is the metadata row key of a worker
+func (k Keys) Worker(workerID string) string {
+	return k.Prefix() + "worker#" + workerID
+}
+
+// LegacyCoordinator is the coordinator key used before rows were namespaced
+func (k Keys) LegacyCoordinator() string {
+	return k.App + "_coordinator"
+}
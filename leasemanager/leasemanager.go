@@ -0,0 +1,66 @@
+// Package leasemanager is what every worker of a KCL fleet shares through the lease
+// manager's metadata table: the row keys, the max leases per worker formula, the row
+// format, and the coordinator row, written with conditional puts so that workers
+// starting or refreshing at the same time settle on one value.
+//
+// The k8s test consumer (k8s/test/test-consumer) and the enhanced consumer
+// (consumer/) both use it, so a fleet mixing the two reads and writes the same rows.
+package leasemanager
+
+import (
+	"math"
+	"regexp"
+
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+const (
+	MaxLeasePerWorkerLimit = 80 // Maximum number of leases a single worker can handle
+)
+
+// ValidMaxLeases reports whether a stored max leases value is usable. Rows can be
+// edited by hand, so values read back are checked before a worker applies them.
+func ValidMaxLeases(maxLeases int) bool {
+	return maxLeases >= 1 && maxLeases <= MaxLeasePerWorkerLimit
+}
+
+// DefaultConsumerGroup is the group used when none is configured; its rows keep the
+// keys used before consumer groups existed
+const DefaultConsumerGroup = "default"
+
+// consumerGroupPattern restricts group IDs to characters that cannot collide with
+// the separators used in metadata keys
+var consumerGroupPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidConsumerGroup reports whether group can be used in metadata keys
+func ValidConsumerGroup(group string) bool {
+	return consumerGroupPattern.MatchString(group)
+}
+
+// BuiltinMaxLeases is the built-in formula, min(80, ceil(shardCount / workerCount)).
+// No workers count as one.
+func BuiltinMaxLeases(shardCount, workerCount int) int {
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+	// Calculate shards per worker
+	shardsPerWorker := int(math.Ceil(float64(shardCount) / float64(workerCount)))
+
+	// Apply the limit of 80
+	if shardsPerWorker > MaxLeasePerWorkerLimit {
+		return MaxLeasePerWorkerLimit
+	}
+	return shardsPerWorker
+}
+
+// CountOpenShards counts the shards still open, those without an ending sequence
+// number, in a ListShards result
+func CountOpenShards(shards []kinesistypes.Shard) int {
+	var open int
+	for _, shard := range shards {
+		if shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil {
+			open++
+		}
+	}
+	return open
+}
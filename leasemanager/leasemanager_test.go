@@ -0,0 +1,349 @@
+package leasemanager
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// fakeTable is a metadata table in memory. It evaluates the two coordinator write
+// conditions; a Scan returns every row whose key starts with the prefix.
+type fakeTable struct {
+	rows map[string]map[string]types.AttributeValue
+	puts int
+}
+
+func newFakeTable() *fakeTable {
+	return &fakeTable{rows: make(map[string]map[string]types.AttributeValue)}
+}
+
+func key(item map[string]types.AttributeValue) string {
+	return item["worker_id"].(*types.AttributeValueMemberS).Value
+}
+
+func (f *fakeTable) GetItem(_ context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.rows[key(in.Key)]}, nil
+}
+
+func (f *fakeTable) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.puts++
+	existing, exists := f.rows[key(in.Item)]
+	failed := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	switch aws.ToString(in.ConditionExpression) {
+	case "":
+	case "attribute_not_exists(worker_id)":
+		if exists {
+			return nil, failed
+		}
+	default:
+		values := in.ExpressionAttributeValues
+		if !exists || !equalN(existing["shard_count"], values[":expected_shard_count"]) ||
+			!equalN(existing["worker_count"], values[":expected_worker_count"]) {
+			return nil, failed
+		}
+		if expected, ok := values[":expected_max_leases"]; ok && !equalN(existing["max_leases_per_worker"], expected) {
+			return nil, failed
+		}
+	}
+	f.rows[key(in.Item)] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func equalN(a, b types.AttributeValue) bool {
+	an, ok := a.(*types.AttributeValueMemberN)
+	bn, ok2 := b.(*types.AttributeValueMemberN)
+	return ok && ok2 && an.Value == bn.Value
+}
+
+func (f *fakeTable) Scan(_ context.Context, in *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	prefix := in.ExpressionAttributeValues[":prefix"].(*types.AttributeValueMemberS).Value
+	out := &dynamodb.ScanOutput{}
+	for k, item := range f.rows {
+		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+			out.Items = append(out.Items, item)
+		}
+	}
+	return out, nil
+}
+
+func TestKeys(t *testing.T) {
+	k := Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	for got, want := range map[string]string{
+		k.Table():             "app_meta",
+		k.Coordinator():       "app#stream#us-east-1#coordinator",
+		k.Worker("pod-0"):     "app#stream#us-east-1#worker#pod-0",
+		k.LegacyCoordinator(): "app_coordinator",
+	} {
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// The default group keeps the keys used before consumer groups existed
+	k.Group = DefaultConsumerGroup
+	if got := k.Coordinator(); got != "app#stream#us-east-1#coordinator" {
+		t.Errorf("default group coordinator key %q", got)
+	}
+	k.Group = "blue"
+	if got := k.Worker("pod-0"); got != "app#stream#us-east-1@blue#worker#pod-0" {
+		t.Errorf("group worker key %q", got)
+	}
+}
+
+func TestBuiltinMaxLeases(t *testing.T) {
+	for _, tt := range []struct{ shards, workers, want int }{
+		{20, 3, 7},
+		{30, 5, 6},
+		{1, 10, 1},
+		{0, 4, 0},
+		{10000, 2, MaxLeasePerWorkerLimit},
+		{12, 0, 12},
+	} {
+		if got := BuiltinMaxLeases(tt.shards, tt.workers); got != tt.want {
+			t.Errorf("BuiltinMaxLeases(%d, %d) = %d, want %d", tt.shards, tt.workers, got, tt.want)
+		}
+	}
+}
+
+func TestCountOpenShards(t *testing.T) {
+	shards := []kinesistypes.Shard{
+		{ShardId: aws.String("shardId-000000000000"), SequenceNumberRange: &kinesistypes.SequenceNumberRange{EndingSequenceNumber: aws.String("9")}},
+		{ShardId: aws.String("shardId-000000000001"), SequenceNumberRange: &kinesistypes.SequenceNumberRange{}},
+		{ShardId: aws.String("shardId-000000000002"), SequenceNumberRange: &kinesistypes.SequenceNumberRange{}},
+	}
+	if got := CountOpenShards(shards); got != 2 {
+		t.Fatalf("counted %d open shards, want 2", got)
+	}
+}
+
+func TestCoordinatorConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	keys := Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	db := newFakeTable()
+	table := Table{DB: db, Name: keys.Table(), Keys: keys}
+	row := func(maxLeases, shards, workers int) map[string]types.AttributeValue {
+		return Item(keys.Coordinator(), &Metadata{MaxLeasesPerWorker: maxLeases, StreamName: "stream", AppName: "app",
+			ShardCount: shards, WorkerCount: workers, LastUpdateTime: time.Now()})
+	}
+
+	if m, err := table.Coordinator(ctx); m != nil || err != nil {
+		t.Fatalf("got %+v, %v before the row was created", m, err)
+	}
+	if err := table.CreateCoordinator(ctx, row(7, 20, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// A second worker starting at the same time keeps the first value
+	if err := table.CreateCoordinator(ctx, row(10, 20, 2)); !errors.Is(err, ErrCoordinatorChanged) {
+		t.Fatalf("second create: got %v, want ErrCoordinatorChanged", err)
+	}
+
+	// Of two workers that read 20/3, only the first update applies
+	if err := table.UpdateCoordinator(ctx, row(6, 30, 5), 20, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.UpdateCoordinator(ctx, row(5, 20, 4), 20, 3); !errors.Is(err, ErrCoordinatorChanged) {
+		t.Fatalf("stale update: got %v, want ErrCoordinatorChanged", err)
+	}
+
+	m, err := table.Coordinator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.WorkerID != keys.Coordinator() || m.MaxLeasesPerWorker != 6 || m.ShardCount != 30 || m.WorkerCount != 5 {
+		t.Fatalf("coordinator read back as %+v", m)
+	}
+
+	// A replace also requires the value read, which an update does not check
+	if err := table.ReplaceCoordinator(ctx, row(4, 30, 5), &Metadata{MaxLeasesPerWorker: 7, ShardCount: 30, WorkerCount: 5}); !errors.Is(err, ErrCoordinatorChanged) {
+		t.Fatalf("replace of another value: got %v, want ErrCoordinatorChanged", err)
+	}
+	if err := table.ReplaceCoordinator(ctx, row(4, 30, 5), m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerRows(t *testing.T) {
+	ctx := context.Background()
+	keys := Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	db := newFakeTable()
+	table := Table{DB: db, Name: keys.Table(), Keys: keys}
+	updated := time.UnixMilli(1717372800123)
+
+	if err := table.PutWorker(ctx, Item(keys.Worker("pod-0"), &Metadata{MaxLeasesPerWorker: 7, StreamName: "stream",
+		AppName: "app", ShardCount: 20, WorkerCount: 3, LastUpdateTime: updated})); err != nil {
+		t.Fatal(err)
+	}
+	// Rows of another group share the table but not the prefix
+	other := keys
+	other.Group = "blue"
+	if err := table.PutWorker(ctx, Item(other.Worker("pod-0"), &Metadata{})); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := db.Scan(ctx, table.WorkerScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 1 {
+		t.Fatalf("scanned %d worker rows, want 1", len(out.Items))
+	}
+	m := ParseWorker(out.Items[0], keys.Worker(""))
+	if m.WorkerID != "pod-0" || m.MaxLeasesPerWorker != 7 || m.ShardCount != 20 || m.WorkerCount != 3 ||
+		!m.LastUpdateTime.Equal(updated) {
+		t.Fatalf("worker row read back as %+v", m)
+	}
+}
+
+func TestLastUpdate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		item map[string]types.AttributeValue
+		want time.Time
+		ok   bool
+	}{
+		{"millis", map[string]types.AttributeValue{LastUpdateMillisKey: &types.AttributeValueMemberN{Value: "1717372800123"}}, time.UnixMilli(1717372800123), true},
+		{"millis preferred", map[string]types.AttributeValue{
+			LastUpdateMillisKey: &types.AttributeValueMemberN{Value: "1717372800123"},
+			LastUpdateKey:       &types.AttributeValueMemberS{Value: "2020-01-01T00:00:00Z"}}, time.UnixMilli(1717372800123), true},
+		{"rfc3339", map[string]types.AttributeValue{LastUpdateKey: &types.AttributeValueMemberS{Value: "2024-06-03T00:00:00Z"}}, time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC), true},
+		{"beyond year 9999", map[string]types.AttributeValue{LastUpdateMillisKey: &types.AttributeValueMemberN{Value: "999999999999999"}}, time.Time{}, false},
+		{"missing", map[string]types.AttributeValue{}, time.Time{}, false},
+	} {
+		got, ok := LastUpdate(tt.item)
+		if ok != tt.ok || (ok && !got.Equal(tt.want)) {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// fakeShards is a stream listed two shards per page
+type fakeShards struct {
+	shards []kinesistypes.Shard
+}
+
+func (f *fakeShards) ListShards(_ context.Context, in *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	start := 0
+	if in.NextToken != nil {
+		if in.StreamName != nil {
+			return nil, errors.New("StreamName and NextToken are exclusive")
+		}
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	end := start + 2
+	if end >= len(f.shards) {
+		return &kinesis.ListShardsOutput{Shards: f.shards[start:]}, nil
+	}
+	return &kinesis.ListShardsOutput{Shards: f.shards[start:end], NextToken: aws.String(strconv.Itoa(end))}, nil
+}
+
+func TestOpenShardCount(t *testing.T) {
+	stream := &fakeShards{}
+	for i := 0; i < 5; i++ {
+		shard := kinesistypes.Shard{SequenceNumberRange: &kinesistypes.SequenceNumberRange{}}
+		if i == 0 {
+			shard.SequenceNumberRange.EndingSequenceNumber = aws.String("9")
+		}
+		stream.shards = append(stream.shards, shard)
+	}
+	got, err := OpenShardCount(context.Background(), stream, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 4 {
+		t.Fatalf("counted %d open shards over three pages, want 4", got)
+	}
+}
+
+func TestLiveWorkers(t *testing.T) {
+	now := time.Now()
+	workers := []*Metadata{
+		{WorkerID: "fresh", LastUpdateTime: now.Add(-time.Minute)},
+		{WorkerID: "edge", LastUpdateTime: now.Add(-3 * time.Minute)},
+		{WorkerID: "stale", LastUpdateTime: now.Add(-time.Hour)},
+		{WorkerID: "never"},
+	}
+	if got := LiveWorkers(workers, now, 3*time.Minute); got != 2 {
+		t.Fatalf("counted %d live workers, want 2", got)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	keys := Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	db := newFakeTable()
+	table := Table{DB: db, Name: keys.Table(), Keys: keys}
+
+	m, err := table.Reconcile(ctx, 20, 3, BuiltinMaxLeases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxLeasesPerWorker != 7 {
+		t.Fatalf("created coordinator with %d, want 7", m.MaxLeasesPerWorker)
+	}
+
+	// Unchanged counts only read the row
+	puts := db.puts
+	if m, err = table.Reconcile(ctx, 20, 3, BuiltinMaxLeases); err != nil || m.MaxLeasesPerWorker != 7 || db.puts != puts {
+		t.Fatalf("unchanged counts: got %+v, %v after %d writes", m, err, db.puts-puts)
+	}
+
+	if m, err = table.Reconcile(ctx, 20, 4, BuiltinMaxLeases); err != nil || m.MaxLeasesPerWorker != 5 {
+		t.Fatalf("scaled up: got %+v, %v", m, err)
+	}
+
+	// A hand-edited row is replaced even though its counts match
+	if err := table.UpdateCoordinator(ctx, Item(keys.Coordinator(), &Metadata{MaxLeasesPerWorker: 500,
+		ShardCount: 20, WorkerCount: 4}), 20, 4); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = table.Reconcile(ctx, 20, 4, BuiltinMaxLeases); err != nil || m.MaxLeasesPerWorker != 5 {
+		t.Fatalf("invalid row: got %+v, %v", m, err)
+	}
+}
+
+// racingTable lets another worker update the coordinator between Reconcile's read
+// and its write
+type racingTable struct {
+	*fakeTable
+	race func()
+}
+
+func (r *racingTable) PutItem(ctx context.Context, in *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if r.race != nil {
+		race := r.race
+		r.race = nil
+		race()
+	}
+	return r.fakeTable.PutItem(ctx, in, optFns...)
+}
+
+func TestReconcileKeepsTheWinner(t *testing.T) {
+	ctx := context.Background()
+	keys := Keys{App: "app", Stream: "stream", Region: "us-east-1"}
+	db := &racingTable{fakeTable: newFakeTable()}
+	table := Table{DB: db, Name: keys.Table(), Keys: keys}
+	if _, err := table.Reconcile(ctx, 20, 3, BuiltinMaxLeases); err != nil {
+		t.Fatal(err)
+	}
+
+	db.race = func() {
+		if _, err := table.Reconcile(ctx, 30, 5, BuiltinMaxLeases); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := table.Reconcile(ctx, 20, 4, BuiltinMaxLeases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxLeasesPerWorker != 6 || m.ShardCount != 30 || m.WorkerCount != 5 {
+		t.Fatalf("got %+v, want the row of the worker that wrote first", m)
+	}
+}
@@ -0,0 +1,145 @@
+package leasemanager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Row attributes holding the last update, as RFC 3339 and as Unix milliseconds, and
+// the creation time of the stream a coordinator row was computed for
+const (
+	LastUpdateKey       = "last_update_time"
+	LastUpdateMillisKey = "last_update_ms"
+	StreamCreatedAtKey  = "stream_created_at"
+)
+
+// Metadata represents the metadata stored in DynamoDB for a worker or the coordinator
+type Metadata struct {
+	WorkerID           string    `dynamodbav:"worker_id"`
+	MaxLeasesPerWorker int       `dynamodbav:"max_leases_per_worker"`
+	StreamName         string    `dynamodbav:"stream_name"`
+	AppName            string    `dynamodbav:"app_name"`
+	LastUpdateTime     time.Time `dynamodbav:"last_update_time"`
+	ShardCount         int       `dynamodbav:"shard_count"`
+	WorkerCount        int       `dynamodbav:"worker_count"`
+	// StreamCreatedAt is set on coordinator rows, to tell a recreated stream apart
+	StreamCreatedAt time.Time `dynamodbav:"stream_created_at"`
+	// Runtime stats are set on the rows of workers that report them
+	LeasesHeld       int       `dynamodbav:"leases_held"`
+	RecordsPerSecond float64   `dynamodbav:"records_per_second"`
+	LagMillis        int64     `dynamodbav:"lag_ms"`
+	StartedAt        time.Time `dynamodbav:"started_at"`
+	// ProcessID names the process writing the worker row, to detect duplicate worker IDs
+	ProcessID string `dynamodbav:"process_id"`
+	// ShardRecordsPerSecond is the record rate of every shard the worker holds
+	ShardRecordsPerSecond map[string]float64 `dynamodbav:"shard_records_per_second"`
+	// KinesisCallsPerMinute is the worker's Kinesis requests in the last full minute,
+	// by operation
+	KinesisCallsPerMinute map[string]int `dynamodbav:"kinesis_calls_per_minute"`
+	// ClockOffset is how far the writer's clock ran ahead of AWS, when it knew
+	ClockOffset      time.Duration `dynamodbav:"clock_offset_ms"`
+	ClockOffsetKnown bool          `dynamodbav:"-"`
+}
+
+// Item renders the attributes of metadata shared by worker and coordinator rows under
+// key, stamped with metadata.LastUpdateTime. Writers add their own attributes before
+// putting it.
+func Item(key string, metadata *Metadata) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"worker_id":             &types.AttributeValueMemberS{Value: key},
+		"max_leases_per_worker": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.MaxLeasesPerWorker)},
+		"stream_name":           &types.AttributeValueMemberS{Value: metadata.StreamName},
+		"app_name":              &types.AttributeValueMemberS{Value: metadata.AppName},
+		"shard_count":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.ShardCount)},
+		"worker_count":          &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", metadata.WorkerCount)},
+	}
+	Timestamp(item, metadata.LastUpdateTime)
+	return item
+}
+
+// Timestamp sets the last update of a row to t, as Unix milliseconds and, for
+// workers that only read the string, RFC 3339
+func Timestamp(item map[string]types.AttributeValue, t time.Time) {
+	item[LastUpdateKey] = &types.AttributeValueMemberS{Value: t.UTC().Format(time.RFC3339)}
+	item[LastUpdateMillisKey] = &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+// LastUpdate reads the last update of a row, preferring the milliseconds
+func LastUpdate(item map[string]types.AttributeValue) (time.Time, bool) {
+	if t, ok := parseTime(item[LastUpdateMillisKey]); ok {
+		return t, true
+	}
+	return parseTime(item[LastUpdateKey])
+}
+
+// parseTime reads a time attribute written as Unix milliseconds, a number or a
+// string of digits, or as RFC 3339 with or without fractional seconds
+func parseTime(av types.AttributeValue) (time.Time, bool) {
+	var text string
+	switch v := av.(type) {
+	case *types.AttributeValueMemberN:
+		text = v.Value
+	case *types.AttributeValueMemberS:
+		text = v.Value
+	default:
+		return time.Time{}, false
+	}
+	if millis, err := strconv.ParseInt(text, 10, 64); err == nil {
+		// Years beyond 9999 have no RFC 3339 form, and the JSON views need one
+		t := time.UnixMilli(millis)
+		return t, t.Year() >= 1 && t.Year() <= 9999
+	}
+	t, err := time.Parse(time.RFC3339Nano, text)
+	return t, err == nil
+}
+
+// ParseWorker decodes the shared attributes of a worker row, stripping workerPrefix
+// from its key. Its values are not checked: callers must validate max leases, since
+// the row may have been edited by hand.
+func ParseWorker(item map[string]types.AttributeValue, workerPrefix string) *Metadata {
+	metadata := &Metadata{}
+	if val, ok := item["worker_id"].(*types.AttributeValueMemberS); ok {
+		metadata.WorkerID = strings.TrimPrefix(val.Value, workerPrefix)
+	}
+	if val, ok := item["stream_name"].(*types.AttributeValueMemberS); ok {
+		metadata.StreamName = val.Value
+	}
+	if val, ok := item["app_name"].(*types.AttributeValueMemberS); ok {
+		metadata.AppName = val.Value
+	}
+	parseCounts(item, metadata)
+	metadata.LastUpdateTime, _ = LastUpdate(item)
+	return metadata
+}
+
+// ParseCoordinator decodes the coordinator row of keys. Its values are not checked:
+// callers must validate max leases, since the row may have been edited by hand.
+func ParseCoordinator(keys Keys, item map[string]types.AttributeValue) *Metadata {
+	metadata := &Metadata{
+		WorkerID:   keys.Coordinator(),
+		StreamName: keys.Stream,
+		AppName:    keys.App,
+	}
+	parseCounts(item, metadata)
+	if val, ok := item[StreamCreatedAtKey].(*types.AttributeValueMemberS); ok {
+		metadata.StreamCreatedAt, _ = time.Parse(time.RFC3339, val.Value)
+	}
+	return metadata
+}
+
+// parseCounts reads max leases and the shard and worker counts it was computed from
+func parseCounts(item map[string]types.AttributeValue, metadata *Metadata) {
+	if val, ok := item["max_leases_per_worker"].(*types.AttributeValueMemberN); ok {
+		metadata.MaxLeasesPerWorker, _ = strconv.Atoi(val.Value)
+	}
+	if val, ok := item["shard_count"].(*types.AttributeValueMemberN); ok {
+		metadata.ShardCount, _ = strconv.Atoi(val.Value)
+	}
+	if val, ok := item["worker_count"].(*types.AttributeValueMemberN); ok {
+		metadata.WorkerCount, _ = strconv.Atoi(val.Value)
+	}
+}
@@ -0,0 +1,125 @@
+package leasemanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBAPI defines the DynamoDB operations Table reads and writes rows with
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// ErrCoordinatorChanged is returned when a conditional coordinator write lost to
+// another worker: the row was created, or its counts changed, since it was read
+var ErrCoordinatorChanged = errors.New("coordinator metadata was written by another worker")
+
+// Table reads and writes the rows of one fleet in its metadata table
+type Table struct {
+	DB   DynamoDBAPI
+	Name string
+	Keys Keys
+}
+
+// Coordinator reads the coordinator row, nil when there is none yet
+func (t Table) Coordinator(ctx context.Context) (*Metadata, error) {
+	result, err := t.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(t.Name),
+		Key: map[string]types.AttributeValue{
+			"worker_id": &types.AttributeValueMemberS{Value: t.Keys.Coordinator()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get coordinator metadata from DynamoDB: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	return ParseCoordinator(t.Keys, result.Item), nil
+}
+
+// CreateCoordinator writes item as the coordinator row if there is none yet, so of
+// the workers starting together only one computes the value. ErrCoordinatorChanged
+// means another worker created it first.
+func (t Table) CreateCoordinator(ctx context.Context, item map[string]types.AttributeValue) error {
+	return t.putCoordinator(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(t.Name),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(worker_id)"),
+	})
+}
+
+// UpdateCoordinator replaces the coordinator row with item if its shard and worker
+// counts are still the expected ones read before, so a row another worker updated in
+// the meantime is kept. ErrCoordinatorChanged means the counts no longer match.
+func (t Table) UpdateCoordinator(ctx context.Context, item map[string]types.AttributeValue, expectedShardCount, expectedWorkerCount int) error {
+	return t.putCoordinator(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(t.Name),
+		Item:                item,
+		ConditionExpression: aws.String("shard_count = :expected_shard_count AND worker_count = :expected_worker_count"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected_shard_count":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedShardCount)},
+			":expected_worker_count": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expectedWorkerCount)},
+		},
+	})
+}
+
+// ReplaceCoordinator replaces the coordinator row with item if it still holds the
+// counts and the value of expected, so a value set since it was read, by a refresh or
+// another worker, is kept. ErrCoordinatorChanged means the row no longer matches.
+func (t Table) ReplaceCoordinator(ctx context.Context, item map[string]types.AttributeValue, expected *Metadata) error {
+	return t.putCoordinator(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(t.Name),
+		Item:      item,
+		ConditionExpression: aws.String("shard_count = :expected_shard_count AND worker_count = :expected_worker_count" +
+			" AND max_leases_per_worker = :expected_max_leases"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected_shard_count":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expected.ShardCount)},
+			":expected_worker_count": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expected.WorkerCount)},
+			":expected_max_leases":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expected.MaxLeasesPerWorker)},
+		},
+	})
+}
+
+func (t Table) putCoordinator(ctx context.Context, input *dynamodb.PutItemInput) error {
+	_, err := t.DB.PutItem(ctx, input)
+	var condCheckErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condCheckErr) {
+		return ErrCoordinatorChanged
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write coordinator metadata: %w", err)
+	}
+	return nil
+}
+
+// PutWorker writes item as a worker row
+func (t Table) PutWorker(ctx context.Context, item map[string]types.AttributeValue) error {
+	_, err := t.DB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(t.Name),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save metadata to DynamoDB: %w", err)
+	}
+	return nil
+}
+
+// WorkerScan is the Scan input reading every worker row of the fleet, page by page
+func (t Table) WorkerScan() *dynamodb.ScanInput {
+	return &dynamodb.ScanInput{
+		TableName:        aws.String(t.Name),
+		FilterExpression: aws.String("begins_with(worker_id, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: t.Keys.Worker("")},
+		},
+	}
+}
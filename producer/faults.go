@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// FaultConfig injects adversarial input so the consumer's deduplication, ordering and
+// DLQ handling can be tested. Rates are fractions of records, 0 to 1.
+type FaultConfig struct {
+	// DuplicateRate sends a record a second time, same payload and partition key, at
+	// the end of its batch
+	DuplicateRate float64 `yaml:"duplicate_rate"`
+	// ReorderRate holds a record back until after the next record with the same
+	// partition key in its batch, so the two reach their shard in swapped order
+	ReorderRate float64 `yaml:"reorder_rate"`
+	// MalformedRate truncates a payload so it is no longer valid JSON
+	MalformedRate float64 `yaml:"malformed_rate"`
+}
+
+func (c FaultConfig) isSet() bool {
+	return c.DuplicateRate > 0 || c.ReorderRate > 0 || c.MalformedRate > 0
+}
+
+func (c FaultConfig) validate() error {
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{{"duplicate_rate", c.DuplicateRate}, {"reorder_rate", c.ReorderRate}, {"malformed_rate", c.MalformedRate}} {
+		if rate.value < 0 || rate.value > 1 {
+			return fmt.Errorf("faults: %s must be between 0 and 1, got %g", rate.name, rate.value)
+		}
+	}
+	return nil
+}
+
+// faultCounts are the faults injected into a stream
+type faultCounts struct {
+	duplicated int
+	reordered  int
+	malformed  int
+}
+
+// injectFaults applies the faults of cfg to a batch, drawing from the stream's
+// generator so a seeded run injects the same faults. Every record draws for every
+// fault whether or not it is injected, which keeps the draws of later records
+// independent of earlier outcomes.
+func injectFaults(cfg FaultConfig, g *generator, entries []types.PutRecordsRequestEntry) ([]types.PutRecordsRequestEntry, faultCounts) {
+	var counts faultCounts
+	var duplicates []types.PutRecordsRequestEntry
+	out := make([]types.PutRecordsRequestEntry, 0, len(entries))
+	held := map[string][]types.PutRecordsRequestEntry{} // by partition key
+
+	for _, entry := range entries {
+		malformed, reorder, duplicate := g.rand.Float64(), g.rand.Float64(), g.rand.Float64()
+		cut := 0
+		if len(entry.Data) > 1 {
+			cut = 1 + g.rand.Intn(len(entry.Data)-1)
+		}
+		if malformed < cfg.MalformedRate && cut > 0 {
+			// A prefix of a JSON document never parses
+			entry.Data = append([]byte(nil), entry.Data[:cut]...)
+			counts.malformed++
+		}
+		if duplicate < cfg.DuplicateRate && len(entries)+len(duplicates) < maxPutRecordsEntries {
+			duplicates = append(duplicates, entry)
+			counts.duplicated++
+		}
+
+		key := aws.ToString(entry.PartitionKey)
+		earlier := held[key]
+		delete(held, key)
+		if reorder < cfg.ReorderRate {
+			held[key] = append(earlier, entry)
+			continue
+		}
+		out = append(out, entry)
+		// Records held back for this key follow it, in their original order
+		out = append(out, earlier...)
+		counts.reordered += len(earlier)
+	}
+	// Held records without a later record of their key go out unswapped
+	for _, entry := range entries {
+		key := aws.ToString(entry.PartitionKey)
+		out = append(out, held[key]...)
+		delete(held, key)
+	}
+	return append(out, duplicates...), counts
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// generator is the randomness and clock behind one stream's records. Each stream has
+// its own, seeded from the run seed and the stream's position, so streams written
+// concurrently do not interleave their draws.
+type generator struct {
+	seed int64
+	rand *rand.Rand
+	// With a fixed seed, record times are logical: start plus tick per record, so a
+	// replay renders the same bytes; otherwise the wall clock
+	start time.Time
+	tick  time.Duration
+	seq   int64 // records generated so far
+}
+
+func newGenerator(seed int64, stream int, deterministic bool, start time.Time, cfg StreamConfig) *generator {
+	g := &generator{seed: seed + int64(stream)}
+	g.rewind()
+	if deterministic {
+		// One batch per batch delay, spread over the batch
+		g.start = start.UTC()
+		g.tick = max(time.Duration(cfg.BatchDelayMs)*time.Millisecond/time.Duration(cfg.BatchSize), time.Microsecond)
+	}
+	return g
+}
+
+// rewind starts the generator over, as after a sample record
+func (g *generator) rewind() {
+	g.rand = rand.New(rand.NewSource(g.seed))
+	g.seq = 0
+}
+
+// now is the time of the record being generated
+func (g *generator) now() time.Time {
+	if g.tick == 0 {
+		return time.Now()
+	}
+	return g.start.Add(time.Duration(max(g.seq-1, 0)) * g.tick)
+}
+
+// RunManifest records what a producer run needs to be replayed with -replay: the seed,
+// the configuration shaping the records and how many records each stream generated
+type RunManifest struct {
+	Seed          int64      `json:"seed"`
+	Deterministic bool       `json:"deterministic"` // false when the run used the wall clock
+	StartTime     time.Time  `json:"start_time"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	ConfigFile    string     `json:"config_file"`
+	// Config is the YAML configuration without the aws block, which a replay takes from
+	// its own config file so it can target another endpoint
+	Config    string           `json:"config"`
+	Streams   []ManifestStream `json:"streams"`
+	Generated int64            `json:"generated"`
+	Sent      int              `json:"sent"`
+	ReplayOf  string           `json:"replay_of,omitempty"`
+}
+
+// ManifestStream is one stream of a run
+type ManifestStream struct {
+	StreamName string `json:"stream_name"`
+	Generated  int64  `json:"generated"` // records rendered, including failed ones
+	Sent       int    `json:"sent"`
+	Failed     int    `json:"failed"`
+	// Faults injected, see faults.go
+	Duplicated int `json:"duplicated,omitempty"`
+	Reordered  int `json:"reordered,omitempty"`
+	Malformed  int `json:"malformed,omitempty"`
+}
+
+// manifestConfig renders cfg for the manifest, leaving out the credentials. Template
+// files are inlined, so a replay does not depend on them being unchanged.
+func manifestConfig(cfg *Config) (string, error) {
+	var zero Config
+	c := *cfg
+	c.AWS = zero.AWS
+	var err error
+	if c.Producer.Template, err = inlineTemplate(c.Producer.Template); err != nil {
+		return "", err
+	}
+	c.Kinesis.Streams = append([]StreamConfig(nil), cfg.Kinesis.Streams...)
+	for i, s := range c.Kinesis.Streams {
+		if s.Template != nil {
+			t, err := inlineTemplate(*s.Template)
+			if err != nil {
+				return "", err
+			}
+			c.Kinesis.Streams[i].Template = &t
+		}
+	}
+	data, err := yaml.Marshal(&c)
+	return string(data), err
+}
+
+// inlineTemplate replaces a template file with its text
+func inlineTemplate(t TemplateConfig) (TemplateConfig, error) {
+	if t.File == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(t.File)
+	if err != nil {
+		return t, fmt.Errorf("template: %w", err)
+	}
+	t.Text, t.File = string(data), ""
+	return t, nil
+}
+
+// loadManifest reads a manifest and rebuilds the configuration of its run, with the
+// aws block of cfg
+func loadManifest(path string, cfg *Config) (*RunManifest, *Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m RunManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	var replayed Config
+	if err := yaml.Unmarshal([]byte(m.Config), &replayed); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the config in manifest %s: %w", path, err)
+	}
+	replayed.AWS = cfg.AWS
+	return &m, &replayed, nil
+}
+
+// write stores the manifest as indented JSON
+func (m *RunManifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -26,12 +28,29 @@ type Config struct {
 	} `yaml:"aws"`
 	Kinesis struct {
 		StreamName string `yaml:"stream_name"`
+
+		// Streams written at the same time as stream_name, each with its own
+		// settings, see streams.go
+		Streams []StreamConfig `yaml:"streams"`
 	} `yaml:"kinesis"`
 	Producer struct {
 		BatchSize     int `yaml:"batch_size"`
 		BatchDelayMs  int `yaml:"batch_delay_ms"`
 		TotalMessages int `yaml:"total_messages"`
 		NumShards     int `yaml:"num_shards"`
+
+		// Consecutive batches of which no record was written before a stream stops,
+		// default 10
+		MaxFailedBatches int `yaml:"max_failed_batches"`
+
+		// Records per second across all streams, 0 for no limit
+		RatePerSecond float64 `yaml:"rate_per_second"`
+
+		// Template defines the payload instead of generateEvent, see template.go
+		Template TemplateConfig `yaml:"template"`
+
+		// Faults injects duplicates, reordering and malformed payloads, see faults.go
+		Faults FaultConfig `yaml:"faults"`
 	} `yaml:"producer"`
 }
 
@@ -46,10 +65,12 @@ type Event struct {
 	ShardKey  string                 `json:"shard_key"`
 }
 
+// statsInterval is how often the per-stream and combined statistics are logged
+const statsInterval = 5 * time.Second
+
 var actions = []string{"login", "purchase", "view", "click", "logout", "search", "add_to_cart", "checkout"}
 
-func loadConfig() (*Config, error) {
-	configFile := "../config/config-20-shards.yaml"
+func loadConfig(configFile string) (*Config, error) {
 	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -63,20 +84,21 @@ func loadConfig() (*Config, error) {
 	return &cfg, nil
 }
 
-func generateEvent(numShards int) *Event {
+func generateEvent(g *generator, numShards int) *Event {
 	// Generate a deterministic shard key to evenly distribute across shards
-	shardKey := fmt.Sprintf("shard-key-%d", rand.Intn(numShards))
+	shardKey := fmt.Sprintf("shard-key-%d", g.rand.Intn(numShards))
+	now := g.now()
 
 	return &Event{
-		EventID:   fmt.Sprintf("evt_%d", time.Now().UnixNano()),
-		UserID:    fmt.Sprintf("user_%d", rand.Intn(10000)),
-		Timestamp: time.Now(),
-		Action:    actions[rand.Intn(len(actions))],
-		Value:     rand.Float64() * 1000,
+		EventID:   fmt.Sprintf("evt_%d", now.UnixNano()),
+		UserID:    fmt.Sprintf("user_%d", g.rand.Intn(10000)),
+		Timestamp: now,
+		Action:    actions[g.rand.Intn(len(actions))],
+		Value:     g.rand.Float64() * 1000,
 		Metadata: map[string]interface{}{
 			"source":     "producer",
 			"version":    "2.0",
-			"session":    fmt.Sprintf("sess_%d", rand.Intn(1000)),
+			"session":    fmt.Sprintf("sess_%d", g.rand.Intn(1000)),
 			"experiment": "mohan-20-shards",
 		},
 		ShardKey: shardKey,
@@ -85,15 +107,48 @@ func generateEvent(numShards int) *Event {
 
 func main() {
 	log.Println("========================================")
-	log.Println("🚀 Starting Kinesis Producer (20 Shards)")
+	log.Println("🚀 Starting Kinesis Producer")
 	log.Println("========================================")
 
+	configFile := flag.String("config", "../config/config-20-shards.yaml", "configuration file")
+	seedFlag := flag.Int64("seed", 0, "seed of the random generators, making the records reproducible (default: a random seed and wall-clock times)")
+	manifestPath := flag.String("manifest", "", "file the run manifest is written to (default producer-run-<seed>.json with -seed, producer-replay-<seed>.json with -replay)")
+	replayPath := flag.String("replay", "", "manifest of a run to replay record for record")
+	flag.Parse()
+
 	// Load configuration
-	cfg, err := loadConfig()
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatalf("❌ Failed to load config: %v", err)
 	}
 
+	// A seeded run renders the same records every time: per-stream generators and
+	// logical record times; see manifest.go
+	seed, deterministic, start := time.Now().UnixNano(), false, time.Now()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seed, deterministic = *seedFlag, true
+		}
+	})
+	var replayed *RunManifest
+	if *replayPath != "" {
+		if replayed, cfg, err = loadManifest(*replayPath, cfg); err != nil {
+			log.Fatalf("❌ Failed to load manifest: %v", err)
+		}
+		seed, deterministic, start = replayed.Seed, replayed.Deterministic, replayed.StartTime
+		log.Printf("🔁 Replaying %s: seed %d, %d records", *replayPath, seed, replayed.Generated)
+		if !deterministic {
+			log.Printf("⚠️  Warning: %s was not seeded; record times and event IDs will differ", *replayPath)
+		}
+	}
+	if *manifestPath == "" && deterministic {
+		*manifestPath = fmt.Sprintf("producer-run-%d.json", seed)
+		if replayed != nil {
+			*manifestPath = fmt.Sprintf("producer-replay-%d.json", seed)
+		}
+	}
+	log.Printf("📝 Seed: %d (reproducible: %v)", seed, deterministic)
+
 	// Initialize AWS Config
 	ctx := context.Background()
 	awsCfg, err := config.LoadDefaultConfig(ctx,
@@ -118,102 +173,161 @@ func main() {
 	// Create Kinesis client
 	client := kinesis.NewFromConfig(awsCfg)
 
-	log.Printf("📝 Stream: %s", cfg.Kinesis.StreamName)
-	log.Printf("📝 Configuration: BatchSize=%d, BatchDelay=%dms, TotalMessages=%d, NumShards=%d",
-		cfg.Producer.BatchSize, cfg.Producer.BatchDelayMs, cfg.Producer.TotalMessages, cfg.Producer.NumShards)
-
-	// Verify stream exists and has correct shard count
-	describeOutput, err := client.DescribeStream(ctx, &kinesis.DescribeStreamInput{
-		StreamName: aws.String(cfg.Kinesis.StreamName),
-	})
+	streams, err := streamConfigs(cfg)
 	if err != nil {
-		log.Fatalf("❌ Failed to describe stream: %v", err)
+		log.Fatalf("❌ Invalid config: %v", err)
 	}
-
-	actualShardCount := len(describeOutput.StreamDescription.Shards)
-	log.Printf("✅ Stream has %d shards", actualShardCount)
-
-	if actualShardCount != cfg.Producer.NumShards {
-		log.Printf("⚠️  Warning: Expected %d shards but found %d", cfg.Producer.NumShards, actualShardCount)
+	shared := newRateLimiter(cfg.Producer.RatePerSecond)
+	if shared != nil {
+		log.Printf("📝 Shared rate limit: %.0f msgs/sec across %d streams", cfg.Producer.RatePerSecond, len(streams))
 	}
 
-	messageCount := 0
-	startTime := time.Now()
-	shardDistribution := make(map[string]int)
+	producers := make([]*streamProducer, 0, len(streams))
+	stats := make([]*streamStats, 0, len(streams))
+	for i, stream := range streams {
+		log.Printf("📝 Stream: %s", stream.StreamName)
+		log.Printf("📝 Configuration: BatchSize=%d, BatchDelay=%dms, TotalMessages=%d, NumShards=%d, RateLimit=%.0f msgs/sec",
+			stream.BatchSize, stream.BatchDelayMs, stream.TotalMessages, stream.NumShards, stream.RatePerSecond)
+
+		// Verify stream exists and has correct shard count
+		describeOutput, err := client.DescribeStream(ctx, &kinesis.DescribeStreamInput{
+			StreamName: aws.String(stream.StreamName),
+		})
+		if err != nil {
+			log.Fatalf("❌ Failed to describe stream %s: %v", stream.StreamName, err)
+		}
 
-	log.Println("========================================")
-	log.Println("✅ Producer is running. Press Ctrl+C to stop.")
-	log.Println("========================================")
+		actualShardCount := len(describeOutput.StreamDescription.Shards)
+		log.Printf("✅ Stream %s has %d shards", stream.StreamName, actualShardCount)
 
-	for {
-		// Check if we've reached the total message limit
-		if cfg.Producer.TotalMessages > 0 && messageCount >= cfg.Producer.TotalMessages {
-			log.Printf("✅ Reached total message limit: %d messages", cfg.Producer.TotalMessages)
-			break
+		if actualShardCount != stream.NumShards {
+			log.Printf("⚠️  Warning: Expected %d shards on %s but found %d", stream.NumShards, stream.StreamName, actualShardCount)
 		}
 
-		// Send batch of messages
-		for i := 0; i < cfg.Producer.BatchSize; i++ {
-			event := generateEvent(cfg.Producer.NumShards)
-			data, err := json.Marshal(event)
+		gen := newGenerator(seed, i, deterministic, start, stream)
+		tmpl, err := compileRecordTemplate(*stream.Template, gen)
+		if err != nil {
+			log.Fatalf("❌ Invalid template for %s: %v", stream.StreamName, err)
+		}
+		if tmpl != nil {
+			// Render one record up front, so a template that fails at every record
+			// fails here instead
+			gen.seq = 1
+			data, key, err := tmpl.render(templateData{Stream: stream.StreamName, Seq: 1, Shards: stream.NumShards, Time: gen.now()})
 			if err != nil {
-				log.Printf("❌ Failed to marshal event: %v", err)
-				continue
-			}
-
-			// Use the shard key for consistent distribution
-			input := &kinesis.PutRecordInput{
-				StreamName:   aws.String(cfg.Kinesis.StreamName),
-				Data:         data,
-				PartitionKey: aws.String(event.ShardKey),
+				log.Fatalf("❌ Template for %s does not render: %v", stream.StreamName, err)
 			}
-
-			output, err := client.PutRecord(ctx, input)
-			if err != nil {
-				log.Printf("❌ Failed to put record: %v", err)
-				continue
+			log.Printf("📝 Templated record for %s (key %s): %s", stream.StreamName, key, data)
+			gen.rewind()
+		}
+		limitGenerated := int64(-1)
+		if replayed != nil {
+			limitGenerated = 0
+			for _, m := range replayed.Streams {
+				if m.StreamName == stream.StreamName {
+					limitGenerated = m.Generated
+				}
 			}
+		}
 
-			messageCount++
-			shardDistribution[*output.ShardId]++
-
-			// Log every 100th message
-			if messageCount%100 == 0 {
-				log.Printf("[%d] 📤 EventID: %s | UserID: %s | Action: %s | ShardID: %s",
-					messageCount, event.EventID, event.UserID, event.Action, *output.ShardId)
-			}
+		s := &streamStats{name: stream.StreamName, shards: actualShardCount, shardDistribution: make(map[string]int)}
+		stats = append(stats, s)
+		producers = append(producers, &streamProducer{
+			cfg:      stream,
+			client:   client,
+			limit:    newRateLimiter(stream.RatePerSecond),
+			shared:   shared,
+			stats:    s,
+			gen:      gen,
+			template: tmpl,
+
+			limitGenerated: limitGenerated,
+		})
+	}
+	// The sample records used up sequence values
+	templateSequences.reset()
 
-			// Break if we've reached the limit mid-batch
-			if cfg.Producer.TotalMessages > 0 && messageCount >= cfg.Producer.TotalMessages {
-				break
-			}
+	manifest := &RunManifest{Seed: seed, Deterministic: deterministic, StartTime: start.UTC(), ConfigFile: *configFile, ReplayOf: *replayPath}
+	if manifest.Config, err = manifestConfig(cfg); err != nil {
+		log.Fatalf("❌ Failed to render config for the manifest: %v", err)
+	}
+	writeManifest := func() {
+		if *manifestPath == "" {
+			return
 		}
+		manifest.Streams, manifest.Generated, manifest.Sent = nil, 0, 0
+		for _, p := range producers {
+			sent, failed, _, _ := p.stats.snapshot()
+			faults := p.stats.injected()
+			manifest.Streams = append(manifest.Streams, ManifestStream{StreamName: p.cfg.StreamName, Generated: p.gen.seq, Sent: sent, Failed: failed,
+				Duplicated: faults.duplicated, Reordered: faults.reordered, Malformed: faults.malformed})
+			manifest.Generated += p.gen.seq
+			manifest.Sent += sent
+		}
+		if err := manifest.write(*manifestPath); err != nil {
+			log.Printf("❌ Failed to write manifest %s: %v", *manifestPath, err)
+		}
+	}
+	// Written before the first record too, so a crashed run leaves its seed behind
+	writeManifest()
 
-		// Calculate and display stats every batch
-		elapsed := time.Since(startTime).Seconds()
-		rate := float64(messageCount) / elapsed
-
-		// Count unique shards that have received messages
-		uniqueShards := len(shardDistribution)
+	// Ctrl+C stops every stream and still prints the summary
+	runCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	startTime := time.Now()
 
-		log.Printf("📊 Stats: Total=%d, Rate=%.2f msgs/sec, Elapsed=%.2fs, UniqueShards=%d/%d",
-			messageCount, rate, elapsed, uniqueShards, actualShardCount)
+	log.Println("========================================")
+	log.Println("✅ Producer is running. Press Ctrl+C to stop.")
+	log.Println("========================================")
 
-		// Wait before next batch
-		if cfg.Producer.TotalMessages == 0 || messageCount < cfg.Producer.TotalMessages {
-			time.Sleep(time.Duration(cfg.Producer.BatchDelayMs) * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, p := range producers {
+		wg.Add(1)
+		go func(p *streamProducer) {
+			defer wg.Done()
+			p.run(runCtx)
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			logStats(stats, time.Since(startTime).Seconds())
 		}
 	}
 
 	elapsed := time.Since(startTime).Seconds()
-	uniqueShards := len(shardDistribution)
+	finished := time.Now().UTC()
+	manifest.FinishedAt = &finished
+	writeManifest()
 
 	log.Println("========================================")
 	log.Printf("✅ Producer completed!")
+	var messageCount, uniqueShards, actualShardCount int
+	for _, s := range stats {
+		sent, failed, throttled, used := s.snapshot()
+		messageCount, uniqueShards, actualShardCount = messageCount+sent, uniqueShards+used, actualShardCount+s.shards
+		log.Printf("📊 %s: Messages=%d, Failed=%d, Throttled=%d, Rate=%.2f msgs/sec, Unique Shards Used=%d/%d%s",
+			s.name, sent, failed, throttled, float64(sent)/elapsed, used, s.shards, s.injected())
+	}
 	log.Printf("📊 Total Messages: %d", messageCount)
 	log.Printf("📊 Duration: %.2f seconds", elapsed)
 	log.Printf("📊 Rate: %.2f msgs/sec", float64(messageCount)/elapsed)
 	log.Printf("📊 Unique Shards Used: %d/%d", uniqueShards, actualShardCount)
-	log.Printf("📊 Average Messages per Shard: %.2f", float64(messageCount)/float64(uniqueShards))
+	if uniqueShards > 0 {
+		log.Printf("📊 Average Messages per Shard: %.2f", float64(messageCount)/float64(uniqueShards))
+	}
+	if *manifestPath != "" {
+		log.Printf("📝 Manifest: %s (replay with -replay %s)", *manifestPath, *manifestPath)
+	}
 	log.Println("========================================")
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of records per second, shared by every goroutine that
+// writes through it. A batch larger than the bucket goes into debt and the next batch
+// waits for it to be paid off, so the long-run rate holds for any batch size.
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	filled time.Time
+}
+
+// newRateLimiter returns a limiter of perSecond records, nil (no limit) when it is not positive
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	// Start full: a second's worth of records
+	return &rateLimiter{rate: perSecond, tokens: perSecond, filled: time.Now()}
+}
+
+// wait blocks until n records may be sent and takes their tokens; false when ctx ends first
+func (l *rateLimiter) wait(ctx context.Context, n int) bool {
+	if l == nil {
+		return ctx.Err() == nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.filled).Seconds()*l.rate, l.rate)
+	l.filled = now
+	var delay time.Duration
+	if l.tokens < float64(n) {
+		delay = time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second))
+	}
+	// Take the tokens now; the refill after the sleep covers them
+	l.tokens -= float64(n)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// maxPutRecordsEntries is how many records one PutRecords call may carry
+const maxPutRecordsEntries = 500
+
+// putAttempts is how often a PutRecords call that failed, or the records it rejected,
+// throttled ones mostly, are sent before they count as failed
+const putAttempts = 3
+
+// defaultMaxFailedBatches is max_failed_batches when it is not set
+const defaultMaxFailedBatches = 10
+
+// StreamConfig is one stream the producer writes. Settings left at zero are taken from
+// the producer block.
+type StreamConfig struct {
+	StreamName    string `yaml:"stream_name"`
+	BatchSize     int    `yaml:"batch_size"`
+	BatchDelayMs  int    `yaml:"batch_delay_ms"`
+	TotalMessages int    `yaml:"total_messages"`
+	NumShards     int    `yaml:"num_shards"`
+	// MaxFailedBatches is how many batches in a row may fail entirely before the stream
+	// stops
+	MaxFailedBatches int `yaml:"max_failed_batches"`
+	// RatePerSecond caps the records per second of this stream, 0 for no limit; the
+	// shared producer rate_per_second applies as well
+	RatePerSecond float64 `yaml:"rate_per_second"`
+	// Template replaces the producer template for this stream, see template.go
+	Template *TemplateConfig `yaml:"template"`
+	// Faults replaces the producer fault injection for this stream, see faults.go
+	Faults *FaultConfig `yaml:"faults"`
+}
+
+// streamConfigs returns stream_name, when set, followed by the streams blocks, each
+// completed with the producer settings
+func streamConfigs(cfg *Config) ([]StreamConfig, error) {
+	var streams []StreamConfig
+	if cfg.Kinesis.StreamName != "" {
+		streams = append(streams, StreamConfig{StreamName: cfg.Kinesis.StreamName})
+	}
+	streams = append(streams, cfg.Kinesis.Streams...)
+	if len(streams) == 0 {
+		return nil, errors.New("no stream configured: set kinesis.stream_name or kinesis.streams")
+	}
+
+	seen := make(map[string]bool, len(streams))
+	for i := range streams {
+		s := &streams[i]
+		if s.StreamName == "" {
+			return nil, fmt.Errorf("kinesis.streams[%d]: stream_name is required", i)
+		}
+		if seen[s.StreamName] {
+			return nil, fmt.Errorf("stream %s is configured twice", s.StreamName)
+		}
+		seen[s.StreamName] = true
+		if s.BatchSize == 0 {
+			s.BatchSize = cfg.Producer.BatchSize
+		}
+		if s.BatchDelayMs == 0 {
+			s.BatchDelayMs = cfg.Producer.BatchDelayMs
+		}
+		if s.TotalMessages == 0 {
+			s.TotalMessages = cfg.Producer.TotalMessages
+		}
+		if s.NumShards == 0 {
+			s.NumShards = cfg.Producer.NumShards
+		}
+		if s.MaxFailedBatches == 0 {
+			s.MaxFailedBatches = cfg.Producer.MaxFailedBatches
+		}
+		if s.MaxFailedBatches == 0 {
+			s.MaxFailedBatches = defaultMaxFailedBatches
+		}
+		if s.Template == nil {
+			s.Template = &cfg.Producer.Template
+		}
+		if s.Faults == nil {
+			s.Faults = &cfg.Producer.Faults
+		}
+		if err := s.Faults.validate(); err != nil {
+			return nil, fmt.Errorf("stream %s: %w", s.StreamName, err)
+		}
+		if s.BatchSize < 1 || s.BatchSize > maxPutRecordsEntries {
+			return nil, fmt.Errorf("stream %s: batch_size must be between 1 and %d, got %d", s.StreamName, maxPutRecordsEntries, s.BatchSize)
+		}
+		if s.NumShards < 1 {
+			return nil, fmt.Errorf("stream %s: num_shards must be at least 1, got %d", s.StreamName, s.NumShards)
+		}
+	}
+	return streams, nil
+}
+
+// streamStats counts what a stream producer sent, read by the stats reporter
+type streamStats struct {
+	name   string
+	shards int // as described at startup
+
+	mu                sync.Mutex
+	sent              int
+	failed            int
+	throttled         int
+	faults            faultCounts
+	shardDistribution map[string]int
+}
+
+// snapshot returns the counters and the number of shards that received records
+func (s *streamStats) snapshot() (sent, failed, throttled, uniqueShards int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent, s.failed, s.throttled, len(s.shardDistribution)
+}
+
+// injected returns the faults injected so far
+func (s *streamStats) injected() faultCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+// String renders the counts for the stats lines, empty when nothing was injected
+func (c faultCounts) String() string {
+	if c == (faultCounts{}) {
+		return ""
+	}
+	return fmt.Sprintf(", Duplicated=%d, Reordered=%d, Malformed=%d", c.duplicated, c.reordered, c.malformed)
+}
+
+// streamProducer writes batches of events to one stream
+type streamProducer struct {
+	cfg    StreamConfig
+	client *kinesis.Client
+	limit  *rateLimiter // this stream's, nil for none
+	shared *rateLimiter // across all streams, nil for none
+	stats  *streamStats
+
+	gen      *generator
+	template *recordTemplate // nil for generateEvent
+	// limitGenerated stops the stream after as many records as the run being replayed
+	// generated, -1 for no limit
+	limitGenerated int64
+}
+
+// run sends batches until total_messages records were sent, max_failed_batches batches
+// in a row failed entirely, or ctx ends
+func (p *streamProducer) run(ctx context.Context) {
+	failedBatches := 0
+	for {
+		sent, failed, _, _ := p.stats.snapshot()
+		if p.cfg.TotalMessages > 0 && sent >= p.cfg.TotalMessages {
+			log.Printf("✅ %s reached total message limit: %d messages, %d failed", p.cfg.StreamName, p.cfg.TotalMessages, failed)
+			return
+		}
+		if failedBatches >= p.cfg.MaxFailedBatches {
+			log.Printf("❌ %s stopped after %d batches in a row failed: %d messages, %d failed",
+				p.cfg.StreamName, failedBatches, sent, failed)
+			return
+		}
+		n := p.cfg.BatchSize
+		if p.cfg.TotalMessages > 0 {
+			n = min(n, p.cfg.TotalMessages-sent)
+		}
+		if p.limitGenerated >= 0 {
+			if p.gen.seq >= p.limitGenerated {
+				log.Printf("✅ %s replayed all %d records of the run", p.cfg.StreamName, p.limitGenerated)
+				return
+			}
+			n = min(n, int(p.limitGenerated-p.gen.seq))
+		}
+		if !p.limit.wait(ctx, n) || !p.shared.wait(ctx, n) {
+			return
+		}
+
+		entries := make([]types.PutRecordsRequestEntry, 0, n)
+		for i := 0; i < n; i++ {
+			data, key, err := p.record()
+			if err != nil {
+				log.Printf("❌ Failed to render record for %s: %v", p.cfg.StreamName, err)
+				p.stats.mu.Lock()
+				p.stats.failed++
+				p.stats.mu.Unlock()
+				continue
+			}
+			entries = append(entries, types.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(key)})
+		}
+		if p.cfg.Faults.isSet() {
+			var counts faultCounts
+			entries, counts = injectFaults(*p.cfg.Faults, p.gen, entries)
+			p.stats.mu.Lock()
+			p.stats.faults.duplicated += counts.duplicated
+			p.stats.faults.reordered += counts.reordered
+			p.stats.faults.malformed += counts.malformed
+			p.stats.mu.Unlock()
+		}
+		if p.put(ctx, entries) > 0 {
+			failedBatches = 0
+		} else {
+			failedBatches++
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.cfg.BatchDelayMs) * time.Millisecond):
+		}
+	}
+}
+
+// record returns the payload and partition key of the next record: the stream's
+// template when one is configured, a generateEvent event otherwise
+func (p *streamProducer) record() ([]byte, string, error) {
+	p.gen.seq++
+	if p.template != nil {
+		return p.template.render(templateData{Stream: p.cfg.StreamName, Seq: p.gen.seq, Shards: p.cfg.NumShards, Time: p.gen.now()})
+	}
+	event := generateEvent(p.gen, p.cfg.NumShards)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	// Use the shard key for consistent distribution
+	return data, event.ShardKey, nil
+}
+
+// put sends entries with PutRecords and returns how many were written. A call that
+// fails is sent again, and so are the records it rejects, up to putAttempts times with
+// growing pauses.
+func (p *streamProducer) put(ctx context.Context, entries []types.PutRecordsRequestEntry) int {
+	written := 0
+	for attempt := 1; len(entries) > 0; attempt++ {
+		output, err := p.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+			StreamName: aws.String(p.cfg.StreamName),
+			Records:    entries,
+		})
+		retry := entries
+		if err != nil {
+			log.Printf("❌ Failed to put %d records to %s (attempt %d): %v", len(entries), p.cfg.StreamName, attempt, err)
+		} else {
+			retry = nil
+			p.stats.mu.Lock()
+			for i, result := range output.Records {
+				switch {
+				case result.ErrorCode == nil:
+					p.stats.sent++
+					p.stats.shardDistribution[aws.ToString(result.ShardId)]++
+				default:
+					if aws.ToString(result.ErrorCode) == "ProvisionedThroughputExceededException" {
+						p.stats.throttled++
+					}
+					retry = append(retry, entries[i])
+				}
+			}
+			sent := p.stats.sent
+			p.stats.mu.Unlock()
+			written += len(entries) - len(retry)
+
+			// Log every 100th message
+			if before := sent - (len(entries) - len(retry)); sent/100 > before/100 {
+				log.Printf("[%d] 📤 %s: %d records in the last batch", sent, p.cfg.StreamName, len(entries)-len(retry))
+			}
+		}
+		if len(retry) == 0 {
+			return written
+		}
+		if attempt >= putAttempts {
+			p.stats.mu.Lock()
+			p.stats.failed += len(retry)
+			p.stats.mu.Unlock()
+			return written
+		}
+		select {
+		case <-ctx.Done():
+			return written
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		}
+		entries = retry
+	}
+	return written
+}
+
+// logStats prints one line per stream and, with several streams, the combined totals
+func logStats(stats []*streamStats, elapsed float64) {
+	var total, totalFailed, totalThrottled int
+	var totalFaults faultCounts
+	for _, s := range stats {
+		sent, failed, throttled, uniqueShards := s.snapshot()
+		faults := s.injected()
+		total, totalFailed, totalThrottled = total+sent, totalFailed+failed, totalThrottled+throttled
+		totalFaults.duplicated += faults.duplicated
+		totalFaults.reordered += faults.reordered
+		totalFaults.malformed += faults.malformed
+		log.Printf("📊 %s: Total=%d, Rate=%.2f msgs/sec, Failed=%d, Throttled=%d, UniqueShards=%d/%d%s",
+			s.name, sent, float64(sent)/elapsed, failed, throttled, uniqueShards, s.shards, faults)
+	}
+	if len(stats) > 1 {
+		log.Printf("📊 All %d streams: Total=%d, Rate=%.2f msgs/sec, Failed=%d, Throttled=%d, Elapsed=%.2fs%s",
+			len(stats), total, float64(total)/elapsed, totalFailed, totalThrottled, elapsed, totalFaults)
+	}
+}
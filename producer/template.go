@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// maxRecordBytes is the largest payload Kinesis accepts for one record
+const maxRecordBytes = 1 << 20
+
+// TemplateConfig defines record payloads without changing generateEvent. Exactly one
+// of Text, File and JSON is set; all of them are Go text/templates rendered per record
+// with templateData and the functions of generator.templateFuncs.
+type TemplateConfig struct {
+	// Text is a template of the whole payload; File reads it from a file
+	Text string `yaml:"text"`
+	File string `yaml:"file"`
+	// JSON is a document whose string values are templates. A value that is a single
+	// action, such as "{{randInt 1 100}}", and renders valid JSON keeps its type, so
+	// numbers stay numbers; other values are strings.
+	JSON map[string]interface{} `yaml:"json"`
+	// PartitionKey is a template of the partition key, default shard-key-<0..num_shards-1>
+	PartitionKey string `yaml:"partition_key"`
+}
+
+func (c TemplateConfig) isSet() bool {
+	return c.Text != "" || c.File != "" || c.JSON != nil || c.PartitionKey != ""
+}
+
+// templateData is what templates see as "."
+type templateData struct {
+	Stream string    // stream name
+	Seq    int64     // records rendered for the stream so far, from 1
+	Shards int       // num_shards of the stream
+	Time   time.Time // when the record was rendered
+}
+
+// sequences are the named counters of the seq function, shared by every stream
+type sequences struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func (s *sequences) next(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name]++
+	return s.values[name]
+}
+
+func (s *sequences) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string]int64{}
+}
+
+var templateSequences = &sequences{values: map[string]int64{}}
+
+const randStringAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// templateFuncs are the random and sequence functions templates may call, drawing
+// from the stream's generator
+func (g *generator) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// randInt returns an integer in [min, max]
+		"randInt": func(min, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + g.rand.Intn(max-min+1)
+		},
+		// randFloat returns a number in [min, max)
+		"randFloat": func(min, max float64) float64 {
+			return min + g.rand.Float64()*(max-min)
+		},
+		// randChoice returns one of its arguments
+		"randChoice": func(items ...interface{}) (interface{}, error) {
+			if len(items) == 0 {
+				return nil, errors.New("randChoice needs at least one argument")
+			}
+			return items[g.rand.Intn(len(items))], nil
+		},
+		// randString returns n random lowercase letters and digits
+		"randString": func(n int) string {
+			b := make([]byte, max(n, 0))
+			for i := range b {
+				b[i] = randStringAlphabet[g.rand.Intn(len(randStringAlphabet))]
+			}
+			return string(b)
+		},
+		// uuid returns a random version 4 UUID
+		"uuid": func() string {
+			var b [16]byte
+			_, _ = g.rand.Read(b[:])
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		},
+		// seq returns the next value of a named counter, from 1
+		"seq": templateSequences.next,
+		// now returns the record's time, e.g. {{now.UnixMilli}} or {{now.Format "2006-01-02"}}
+		"now": g.now,
+	}
+}
+
+// recordTemplate renders the payload and partition key of a record
+type recordTemplate struct {
+	gen  *generator
+	text *template.Template // the whole payload, nil with json or the built-in event
+	json interface{}        // the JSON document with templates compiled to *jsonLeaf
+	key  *template.Template // nil for the default partition key
+}
+
+// jsonLeaf is a templated string value of a JSON template
+type jsonLeaf struct {
+	tmpl  *template.Template
+	typed bool // a single action, whose valid-JSON result keeps its type
+}
+
+// compileRecordTemplate compiles cfg for the records of gen, nil when it sets nothing
+func compileRecordTemplate(cfg TemplateConfig, gen *generator) (*recordTemplate, error) {
+	if !cfg.isSet() {
+		return nil, nil
+	}
+	set := 0
+	for _, ok := range []bool{cfg.Text != "", cfg.File != "", cfg.JSON != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("template: set only one of text, file and json")
+	}
+
+	t := &recordTemplate{gen: gen}
+	funcs := gen.templateFuncs()
+	var err error
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("template: %w", err)
+		}
+		cfg.Text = string(data)
+	}
+	if cfg.Text != "" {
+		if t.text, err = template.New("payload").Funcs(funcs).Option("missingkey=error").Parse(cfg.Text); err != nil {
+			return nil, fmt.Errorf("template: %w", err)
+		}
+	}
+	if cfg.JSON != nil {
+		if t.json, err = compileJSONTemplate(cfg.JSON, "json", funcs); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PartitionKey != "" {
+		if t.key, err = template.New("partition_key").Funcs(funcs).Parse(cfg.PartitionKey); err != nil {
+			return nil, fmt.Errorf("template: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// compileJSONTemplate replaces every string of the document with its compiled template
+func compileJSONTemplate(v interface{}, path string, funcs template.FuncMap) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			compiled, err := compileJSONTemplate(value, path+"."+key, funcs)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = compiled
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			compiled, err := compileJSONTemplate(value, fmt.Sprintf("%s[%d]", path, i), funcs)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = compiled
+		}
+		return out, nil
+	case string:
+		tmpl, err := template.New(path).Funcs(funcs).Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", path, err)
+		}
+		nodes := tmpl.Tree.Root.Nodes
+		typed := len(nodes) == 1 && nodes[0].Type() == parse.NodeAction
+		return &jsonLeaf{tmpl: tmpl, typed: typed}, nil
+	default:
+		// Numbers, booleans and nulls are copied as they are
+		return v, nil
+	}
+}
+
+// render returns the payload and partition key of one record
+func (t *recordTemplate) render(data templateData) ([]byte, string, error) {
+	var payload []byte
+	switch {
+	case t.text != nil:
+		var buf bytes.Buffer
+		if err := t.text.Execute(&buf, data); err != nil {
+			return nil, "", err
+		}
+		payload = buf.Bytes()
+	case t.json != nil:
+		doc, err := renderJSONTemplate(t.json, data)
+		if err != nil {
+			return nil, "", err
+		}
+		if payload, err = json.Marshal(doc); err != nil {
+			return nil, "", err
+		}
+	default:
+		var err error
+		if payload, err = json.Marshal(generateEvent(t.gen, data.Shards)); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(payload) == 0 {
+		return nil, "", errors.New("template rendered an empty payload")
+	}
+	if len(payload) > maxRecordBytes {
+		return nil, "", fmt.Errorf("template rendered %d bytes, over the %d bytes of a record", len(payload), maxRecordBytes)
+	}
+
+	key := fmt.Sprintf("shard-key-%d", t.gen.rand.Intn(data.Shards))
+	if t.key != nil {
+		var buf strings.Builder
+		if err := t.key.Execute(&buf, data); err != nil {
+			return nil, "", err
+		}
+		if key = buf.String(); key == "" || len(key) > 256 {
+			return nil, "", fmt.Errorf("partition key template rendered %d characters, need 1 to 256", len(key))
+		}
+	}
+	return payload, key, nil
+}
+
+// renderJSONTemplate renders every template of a compiled JSON document
+func renderJSONTemplate(v interface{}, data templateData) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		// In key order, so fields calling the same seq get their values in a fixed order
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out := make(map[string]interface{}, len(v))
+		for _, key := range keys {
+			value := v[key]
+			rendered, err := renderJSONTemplate(value, data)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			rendered, err := renderJSONTemplate(value, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	case *jsonLeaf:
+		var buf bytes.Buffer
+		if err := v.tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		if v.typed && json.Valid(buf.Bytes()) {
+			return json.RawMessage(buf.Bytes()), nil
+		}
+		return buf.String(), nil
+	default:
+		return v, nil
+	}
+}